@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/internal/ignore"
+	"github.com/lc/pfzf/internal/processor"
+	"github.com/lc/pfzf/internal/scanner"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// runBatch writes every file the scan finds to w without the UI, as if all
+// of them were selected, and returns how many were written. A file that
+// fails to process or write doesn't stop the run; the failures are returned
+// together once the scan is done.
+func runBatch(ctx context.Context, s *scanner.Scanner, proc *processor.Processor, w types.Writer, includes []string, logger *slog.Logger) (int, error) {
+	var written int
+	err := eachCandidate(ctx, s, proc, includes, logger, func(processed types.ProcessedContent) error {
+		if err := w.Write(processed); err != nil {
+			return fmt.Errorf("writing %s: %w", processed.Entry.Path, err)
+		}
+		written++
+		return nil
+	})
+	return written, err
+}
+
+// runList prints the files runBatch would write to out, one per line as
+// the path, the size in bytes and the estimated tokens separated by tabs,
+// so the list can be piped to other tools. The totals go to summary, with
+// the tokens processing saved, if any.
+func runList(ctx context.Context, s *scanner.Scanner, proc *processor.Processor, out, summary io.Writer, includes []string, logger *slog.Logger) error {
+	var files, tokens, saved int
+	var size int64
+	err := eachCandidate(ctx, s, proc, includes, logger, func(processed types.ProcessedContent) error {
+		files++
+		size += processed.Entry.Size
+		tokens += processed.TokenCount
+		saved += processed.SavedTokens
+		_, err := fmt.Fprintf(out, "%s\t%d\t%d\n", processed.Entry.Path, processed.Entry.Size, processed.TokenCount)
+		return err
+	})
+	if saved > 0 {
+		fmt.Fprintf(summary, "%d files, %s, %d tokens (%d saved)\n", files, fs.FormatSize(size), tokens, saved)
+	} else {
+		fmt.Fprintf(summary, "%d files, %s, %d tokens\n", files, fs.FormatSize(size), tokens)
+	}
+	return err
+}
+
+// runStats prints a summary of the files runBatch would write to out: a
+// table, or JSON when asJSON is set.
+func runStats(ctx context.Context, s *scanner.Scanner, proc *processor.Processor, out io.Writer, asJSON bool, includes []string, logger *slog.Logger) error {
+	var entries []types.FileEntry
+	scanErr := eachEntry(ctx, s, includes, logger, func(entry types.FileEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	stats, err := proc.StatsContext(ctx, entries)
+
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		if encErr := encoder.Encode(stats); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+
+	fmt.Fprintf(out, "%d files, %s, %d tokens", stats.Files, fs.FormatSize(stats.Bytes), stats.Tokens)
+	if stats.Skipped > 0 {
+		fmt.Fprintf(out, " (%d skipped)", stats.Skipped)
+	}
+	fmt.Fprint(out, "\n\n")
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LANGUAGE\tFILES\tSIZE\tTOKENS")
+	for _, lang := range stats.Languages {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\n", lang.Language, lang.Files, fs.FormatSize(lang.Bytes), lang.Tokens)
+	}
+	fmt.Fprintln(tw, "\nLARGEST\tLANGUAGE\tSIZE\tTOKENS")
+	for _, file := range stats.Largest {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", file.Path, file.Language, fs.FormatSize(file.Bytes), file.Tokens)
+	}
+	if flushErr := tw.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// eachCandidate scans and passes each file the UI would let be added to
+// the context, processed, to fn. With includes, only files matching one of
+// the globs are passed. Files the processor rules out, such as binary and
+// empty files, are skipped. Scan errors are reported as warnings, while
+// processing errors and fn's errors are returned together once the scan is
+// done.
+func eachCandidate(ctx context.Context, s *scanner.Scanner, proc *processor.Processor, includes []string, logger *slog.Logger, fn func(types.ProcessedContent) error) error {
+	return eachEntry(ctx, s, includes, logger, func(entry types.FileEntry) error {
+		if proc.Sensitive(entry) {
+			logger.Warn("skipping a file that may hold secrets", "path", entry.Path)
+			return nil
+		}
+		if !proc.ShouldProcess(entry) {
+			return nil
+		}
+		processed, err := proc.ProcessContext(ctx, entry)
+		if err != nil {
+			return fmt.Errorf("processing %s: %w", entry.Path, err)
+		}
+		return fn(processed)
+	})
+}
+
+// eachEntry scans and passes each file matching one of includes, or every
+// file without includes, to fn. Scan errors are reported as warnings, while
+// fn's errors are returned together once the scan is done.
+func eachEntry(ctx context.Context, s *scanner.Scanner, includes []string, logger *slog.Logger, fn func(types.FileEntry) error) error {
+	files, scanErrs := s.ScanContext(ctx, types.ScanOptions{})
+
+	var errs []error
+	for files != nil || scanErrs != nil {
+		select {
+		case entry, ok := <-files:
+			if !ok {
+				files = nil
+				continue
+			}
+			if !included(entry.Path, includes) {
+				continue
+			}
+			if err := fn(entry); err != nil {
+				errs = append(errs, err)
+			}
+
+		case err, ok := <-scanErrs:
+			if !ok {
+				scanErrs = nil
+				continue
+			}
+			// Like the UI, carry on past files the scan can't read and
+			// use the files found before a timeout
+			logger.Warn("scan error", "error", err)
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// included reports whether path matches one of the include globs, or
+// whether there are none.
+func included(path string, includes []string) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	for _, glob := range includes {
+		if ignore.MatchGlob(glob, path) {
+			return true
+		}
+	}
+	return false
+}
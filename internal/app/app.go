@@ -3,9 +3,17 @@ package app
 import (
 	"context"
 	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/lc/pfzf/internal/clipboard"
 	"github.com/lc/pfzf/internal/config"
+	"github.com/lc/pfzf/internal/opener"
+	"github.com/lc/pfzf/internal/termimg"
 	"github.com/lc/pfzf/pkg/types"
 	"github.com/rivo/tview"
 )
@@ -18,39 +26,154 @@ type App struct {
 	processor    types.Processor
 	writer       types.Writer
 	themeManager *ThemeManager
+	// languages detects preview languages for the enclosing symbol
+	languages languageDetector
 
 	// UI components
+	pages    *tview.Pages
 	fileList *tview.List
 	preview  *tview.TextView
 	status   *tview.TextView
 	search   *tview.InputField
+	overlay  *tview.TextView
+	// overlayReturn is focused again when the open overlay closes
+	overlayOpen   bool
+	overlayReturn tview.Primitive
+	// body holds the file list and side, the preview and status column
+	body          *tview.Flex
+	side          *tview.Flex
+	previewHidden bool
+
+	// keys dispatches key presses to actions
+	keys *keyMap
 
 	// State
-	entries      []types.FileEntry
-	filteredIdx  []int
-	ctx          context.Context
-	cancel       context.CancelFunc
-	mu           sync.Mutex
-	searchString string
+	// list holds the entries and search filter, totals counts the files
+	// written to the output, restorePending holds restored files the scan
+	// hasn't listed yet, scanDone is set once it listed everything and
+	// ignored holds the patterns added with :ignore; mu guards all five
+	list           *ListViewModel
+	totals         *selectionTotals
+	restorePending map[string]bool
+	scanDone       bool
+	ignored        []string
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+
+	// previewSem bounds the files held open by previews
+	previewSem    chan struct{}
+	previewCancel context.CancelFunc
+	// previewState is the file in the preview, scrolled by the preview keys
+	// when it is text; it is only used on the event loop
+	previewState *PreviewState
+	// previewColumn is the column the preview is scrolled to when long
+	// lines aren't wrapped; it is only used on the event loop
+	previewColumn int
+
+	// sessionPath is where the selection is saved on quit, or "" to not
+	// save it; savedSelection is the last run's selection until restored,
+	// and is only used on the event loop
+	sessionPath    string
+	savedSelection []string
+	// configPath is the config file :ignore! saves patterns to, or "" for
+	// the default one
+	configPath string
+	// discard is set when quitting without writing the output
+	discard bool
+	// searchTimer filters the list once typing pauses, and searchGen
+	// counts the keystrokes so a stale filter is dropped; both are only
+	// used on the event loop
+	searchTimer *time.Timer
+	searchGen   uint64
+	// header renders the preview's header line
+	header headerBuilder
+
+	// imageProtocol draws image previews, or is ProtocolNone to show them
+	// as binary files
+	imageProtocol termimg.Protocol
+	// previewImg is the previewed image, drawn over the preview once tview
+	// has drawn it; imageDrawn holds the cells it covers on screen. Both
+	// are only used on the event loop.
+	previewImg image.Image
+	imageDirty bool
+	imageDrawn image.Rectangle
+
+	// queueUpdateDraw runs f on the event loop; tests replace it since no
+	// loop is running there. It never blocks, so it can be called from any
+	// goroutine, the event loop included. Changes are applied in the order
+	// they were queued.
+	queueUpdateDraw func(f func())
+	// updates holds the changes queued until pumpUpdates hands them to the
+	// event loop; updatesMu guards it and updatesReady is signalled when
+	// changes are added
+	updates      []func()
+	updatesMu    sync.Mutex
+	updatesReady chan struct{}
+	// openFile opens files for preview; tests replace it to observe them
+	openFile func(name string) (io.ReadCloser, error)
+	// copyToClipboard copies text to the system clipboard; tests replace it
+	copyToClipboard func(text string) error
+	// openPath opens a file with the default application; tests replace it
+	openPath func(path string) error
 }
 
+// defaultMaxOpenPreviews is used when the config does not bound preview files.
+const defaultMaxOpenPreviews = 4
+
 // New creates a new App instance.
 func New(cfg *config.Config, scanner types.Scanner, processor types.Processor, writer types.Writer) *App {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	app := &App{
-		Application: tview.NewApplication(),
-		config:      cfg,
-		scanner:     scanner,
-		processor:   processor,
-		writer:      writer,
-		fileList:    tview.NewList(),
-		preview:     tview.NewTextView(),
-		status:      tview.NewTextView(),
-		search:      tview.NewInputField(),
-		ctx:         ctx,
-		cancel:      cancel,
-		filteredIdx: make([]int, 0),
+		Application:    tview.NewApplication(),
+		config:         cfg,
+		scanner:        scanner,
+		processor:      processor,
+		writer:         writer,
+		pages:          tview.NewPages(),
+		fileList:       tview.NewList(),
+		preview:        tview.NewTextView(),
+		status:         tview.NewTextView(),
+		search:         tview.NewInputField(),
+		overlay:        tview.NewTextView(),
+		list:           newListViewModel(cfg.UI.PriorityGlobs),
+		totals:         newSelectionTotals(),
+		restorePending: make(map[string]bool),
+		updatesReady:   make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	app.queueUpdateDraw = app.queueUpdate
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+	app.copyToClipboard = clipboard.Copy
+	app.openPath = opener.Open
+
+	maxOpen := cfg.UI.MaxOpenPreviews
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenPreviews
+	}
+	app.previewSem = make(chan struct{}, maxOpen)
+	app.languages = newLanguageDetector()
+	if app.languages != nil {
+		app.list.detectLanguage = func(path string) string {
+			// Only the name is used; the content isn't read
+			lang, _ := app.languages.DetectLanguage(path, strings.NewReader(""))
+			return lang
+		}
+	}
+	app.imageProtocol = termimg.Resolve(cfg.UI.ImagePreview, os.Getenv)
+	app.header = newHeaderBuilder(cfg.UI.PreviewHeader)
+	if order, ok := ParseSortOrder(cfg.UI.SortBy); ok {
+		app.list.SetSortOrder(order)
+	}
+	app.list.SetShowSizes(cfg.UI.ShowSizes)
+	if ranking, ok := ParseSearchRanking(cfg.UI.SearchRanking); ok {
+		app.list.SetSearchRanking(ranking)
 	}
 
 	// initialize theme manager
@@ -62,7 +185,16 @@ func New(cfg *config.Config, scanner types.Scanner, processor types.Processor, w
 		app.themeManager.applyTheme(config.DefaultTheme())
 	}
 
+	var warnings []string
+	app.keys, warnings = newKeyMap(cfg.UI.KeyBindings)
+
 	app.setupUI()
+	if app.imageProtocol != termimg.ProtocolNone {
+		app.SetAfterDrawFunc(app.drawPreviewImage)
+	}
+	if len(warnings) > 0 {
+		app.status.SetText("Key bindings: " + strings.Join(warnings, "; "))
+	}
 	return app
 }
 
@@ -72,15 +204,74 @@ func (a *App) Run() error {
 	if err := a.startScanning(); err != nil {
 		return fmt.Errorf("scanning files: %w", err)
 	}
+	a.offerRestore()
+	go a.pumpUpdates()
 
 	// Run the application
 	if err := a.Application.Run(); err != nil {
 		return fmt.Errorf("running application: %w", err)
 	}
 
-	// Cleanup
+	return a.shutdown()
+}
+
+// queueUpdate queues f to run on the event loop without waiting for it.
+func (a *App) queueUpdate(f func()) {
+	a.updatesMu.Lock()
+	a.updates = append(a.updates, f)
+	a.updatesMu.Unlock()
+
+	select {
+	case a.updatesReady <- struct{}{}:
+	default:
+	}
+}
+
+// pumpUpdates hands the queued changes to the event loop until the app
+// stops. Only this goroutine waits on the event loop, so nothing else is
+// held up by a busy or stopped loop.
+func (a *App) pumpUpdates() {
+	for {
+		select {
+		case <-a.updatesReady:
+		case <-a.ctx.Done():
+			return
+		}
+
+		a.updatesMu.Lock()
+		updates := a.updates
+		a.updates = nil
+		a.updatesMu.Unlock()
+
+		a.Application.QueueUpdateDraw(func() {
+			for _, f := range updates {
+				f()
+			}
+		})
+	}
+}
+
+// shutdown cancels in-flight processing, waits for it to observe the
+// cancellation and flushes whatever has already been buffered, or discards
+// it when the user chose to quit without writing.
+func (a *App) shutdown() error {
 	a.cancel()
+	if a.searchTimer != nil {
+		a.searchTimer.Stop()
+	}
+	// Stopping the scanner saves its checkpoint when resuming is enabled
+	a.scanner.Stop()
+	a.wg.Wait()
 
+	if err := a.saveSelection(); err != nil {
+		return err
+	}
+	if a.discard {
+		if err := a.writer.Discard(); err != nil {
+			return fmt.Errorf("discarding output: %w", err)
+		}
+		return nil
+	}
 	if err := a.writer.Flush(); err != nil {
 		return fmt.Errorf("flushing writer: %w", err)
 	}
@@ -88,7 +279,8 @@ func (a *App) Run() error {
 	return a.writer.Close()
 }
 
-// Stop stops the application.
+// Stop stops the application. The context is cancelled before the event loop
+// exits so in-flight processing stops queueing UI updates first.
 func (a *App) Stop() {
 	a.cancel()
 	a.Application.Stop()
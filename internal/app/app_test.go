@@ -2,11 +2,26 @@
 package app
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gdamore/tcell/v2"
 	"github.com/lc/pfzf/internal/config"
+	"github.com/lc/pfzf/internal/termimg"
+	"github.com/lc/pfzf/internal/writer"
 	"github.com/lc/pfzf/pkg/types"
+	"github.com/rivo/tview"
 )
 
 type mockScanner struct {
@@ -40,23 +55,108 @@ func (m *mockProcessor) Process(entry types.FileEntry) (types.ProcessedContent,
 	}, nil
 }
 
+func (m *mockProcessor) ProcessContext(ctx context.Context, entry types.FileEntry) (types.ProcessedContent, error) {
+	return m.Process(entry)
+}
+
 func (m *mockProcessor) ShouldProcess(entry types.FileEntry) bool {
 	return !entry.IsBinary
 }
 
+// tokenProcessor counts every file as tokens tokens.
+type tokenProcessor struct {
+	mockProcessor
+	tokens int
+}
+
+func (p *tokenProcessor) ProcessContext(ctx context.Context, entry types.FileEntry) (types.ProcessedContent, error) {
+	content, err := p.Process(entry)
+	content.TokenCount = p.tokens
+	return content, err
+}
+
 type mockWriter struct {
+	// mu guards written and removed, which files processed together
+	// change at once
+	mu      sync.Mutex
 	written []types.ProcessedContent
+	removed []string
+	err     error
+	// preview is what Preview renders
+	preview string
+	// flushed and discarded record calls to Flush and Discard
+	flushed   bool
+	discarded bool
 }
 
 func (m *mockWriter) Write(content types.ProcessedContent) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.written = append(m.written, content)
 	return nil
 }
 
+func (m *mockWriter) WriteDirectoryContext(cwd string, tree *types.TreeNode) error {
+	return nil
+}
+
+func (m *mockWriter) Flush() error {
+	m.flushed = true
+	return nil
+}
+
+func (m *mockWriter) Preview(dst io.Writer) error {
+	_, err := io.WriteString(dst, m.preview)
+	return err
+}
+
+func (m *mockWriter) Remove(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removed = append(m.removed, path)
+}
+
 func (m *mockWriter) Close() error {
 	return nil
 }
 
+func (m *mockWriter) Discard() error {
+	m.discarded = true
+	return nil
+}
+
+// serializeUpdates makes app run each update where it is queued, one at a
+// time as the event loop would. Tests hold the returned lock to read the
+// widgets while goroutines of the app may still be queueing updates.
+func serializeUpdates(app *App) *sync.Mutex {
+	var mu sync.Mutex
+	app.queueUpdateDraw = func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+	return &mu
+}
+
+type slowProcessor struct {
+	mockProcessor
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func (m *slowProcessor) ProcessContext(ctx context.Context, entry types.FileEntry) (types.ProcessedContent, error) {
+	select {
+	case <-m.release:
+		return m.mockProcessor.Process(entry)
+	case <-ctx.Done():
+		close(m.cancelled)
+		return types.ProcessedContent{}, ctx.Err()
+	}
+}
+
 func TestApp(t *testing.T) {
 	// Create test files
 	testFiles := []types.FileEntry{
@@ -79,6 +179,7 @@ func TestApp(t *testing.T) {
 	writer := &mockWriter{}
 
 	app := New(config.DefaultConfig(), scanner, processor, writer)
+	serializeUpdates(app)
 
 	// Test file scanning
 	if err := app.startScanning(); err != nil {
@@ -86,19 +187,1795 @@ func TestApp(t *testing.T) {
 	}
 
 	// Wait for scanning to complete
-	time.Sleep(100 * time.Millisecond)
+	app.wg.Wait()
 
 	// Verify files were added
-	if len(app.entries) != len(testFiles) {
-		t.Errorf("Expected %d entries, got %d", len(testFiles), len(app.entries))
+	if len(app.list.Entries()) != len(testFiles) {
+		t.Errorf("Expected %d entries, got %d", len(testFiles), len(app.list.Entries()))
 	}
 
 	// Test file selection
 	app.toggleSelection(0)
 
 	// Verify file was processed and written
-	time.Sleep(100 * time.Millisecond)
+	app.wg.Wait()
 	if len(writer.written) != 1 {
 		t.Errorf("Expected 1 written file, got %d", len(writer.written))
 	}
 }
+
+func TestShutdownDoesNotWaitOnProcessing(t *testing.T) {
+	testFiles := []types.FileEntry{
+		{
+			Path:    "large.txt",
+			Size:    100 << 20,
+			ModTime: time.Now(),
+		},
+	}
+
+	scanner := &mockScanner{files: testFiles}
+	processor := &slowProcessor{
+		release:   make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	defer close(processor.release)
+	writer := &mockWriter{}
+
+	app := New(config.DefaultConfig(), scanner, processor, writer)
+	app.list.Add(testFiles...)
+	app.toggleSelection(0)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.shutdown()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown blocked on in-flight processing")
+	}
+
+	select {
+	case <-processor.cancelled:
+	case <-time.After(time.Second):
+		t.Error("processor did not observe cancellation")
+	}
+
+	if len(writer.written) != 0 {
+		t.Errorf("Expected cancelled entry not to be written, got %d", len(writer.written))
+	}
+}
+
+func TestOutputPreviewOverlay(t *testing.T) {
+	w, err := writer.New(types.WriterOptions{
+		OutputPath: filepath.Join(t.TempDir(), "output.xml"),
+		Format:     types.OutputFormatXML,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.WriteDirectoryContext("/project", &types.TreeNode{
+		Name:     ".",
+		IsDir:    true,
+		Children: []*types.TreeNode{{Name: "a.go"}, {Name: "b.go"}},
+	}); err != nil {
+		t.Fatalf("Failed to write directory context: %v", err)
+	}
+	for _, path := range []string{"b.go", "a.go"} {
+		if err := w.Write(types.ProcessedContent{
+			Entry:   types.FileEntry{Path: path},
+			Content: []byte("package main"),
+		}); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, w)
+	app.showOutputPreview()
+
+	var want bytes.Buffer
+	if err := w.Preview(&want); err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+
+	if got := app.overlay.GetText(false); got != want.String() {
+		t.Errorf("Overlay content = %q, want %q", got, want.String())
+	}
+}
+
+func TestRejectedWriteClearsSelection(t *testing.T) {
+	testFiles := []types.FileEntry{
+		{
+			Path:    "config.yaml",
+			Size:    100,
+			ModTime: time.Now(),
+		},
+	}
+
+	writer := &mockWriter{err: fmt.Errorf("yaml token budget exceeded")}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, writer)
+	app.queueUpdateDraw = func(f func()) {}
+	app.list.Add(testFiles...)
+
+	app.toggleSelection(0)
+	app.wg.Wait()
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.list.Entries()[0].IsSelected {
+		t.Error("Expected entry rejected by the writer to be deselected")
+	}
+}
+
+func TestDeselectedWhileProcessingIsNotWritten(t *testing.T) {
+	processor := &slowProcessor{
+		release:   make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	writer := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, processor, writer)
+	app.queueUpdateDraw = func(f func()) {}
+	app.list.Add(types.FileEntry{Path: "main.go", Size: 100, ModTime: time.Now()})
+
+	app.toggleSelection(0)
+	app.toggleSelection(0)
+	close(processor.release)
+	app.wg.Wait()
+
+	if len(writer.written) != 0 {
+		t.Errorf("wrote %d files, want the deselected file left out", len(writer.written))
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if len(app.totals.files) != 0 {
+		t.Errorf("totals count %d files, want none", len(app.totals.files))
+	}
+}
+
+func TestDeselectDir(t *testing.T) {
+	writer := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, writer)
+	app.queueUpdateDraw = func(f func()) {}
+	app.list.Add([]types.FileEntry{
+		{Path: "cmd/main.go", IsSelected: true},
+		{Path: "internal/app/app.go", IsSelected: true},
+		{Path: "internal/app/ui.go", IsSelected: true},
+		{Path: "internal/application.go", IsSelected: true},
+		{Path: "internal/writer/writer.go"},
+		{Path: "internal/writer/writer_test.go", IsSelected: true},
+	}...)
+
+	if n := app.deselectDir("internal/app/"); n != 2 {
+		t.Errorf("deselectDir() = %d, want 2", n)
+	}
+
+	want := map[string]bool{
+		"cmd/main.go":                    true,
+		"internal/app/app.go":            false,
+		"internal/app/ui.go":             false,
+		"internal/application.go":        true,
+		"internal/writer/writer.go":      false,
+		"internal/writer/writer_test.go": true,
+	}
+	for _, entry := range app.list.Entries() {
+		if entry.IsSelected != want[entry.Path] {
+			t.Errorf("%s selected = %v, want %v", entry.Path, entry.IsSelected, want[entry.Path])
+		}
+	}
+
+	wantRemoved := []string{"internal/app/app.go", "internal/app/ui.go"}
+	if fmt.Sprint(writer.removed) != fmt.Sprint(wantRemoved) {
+		t.Errorf("removed = %v, want %v", writer.removed, wantRemoved)
+	}
+}
+
+// blockingFile is a preview file whose reads wait for release.
+type blockingFile struct {
+	release <-chan struct{}
+	onClose func()
+}
+
+func (f *blockingFile) Read(p []byte) (int, error) {
+	<-f.release
+	return 0, io.EOF
+}
+
+func (f *blockingFile) Close() error {
+	f.onClose()
+	return nil
+}
+
+func TestPreviewBoundsOpenFiles(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.MaxOpenPreviews = 3
+
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	app.queueUpdateDraw = func(f func()) {}
+
+	var (
+		mu               sync.Mutex
+		open, maxOpen    int
+		opened, released int
+	)
+	release := make(chan struct{})
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		open++
+		opened++
+		maxOpen = max(maxOpen, open)
+		return &blockingFile{
+			release: release,
+			onClose: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				open--
+				released++
+			},
+		}, nil
+	}
+
+	// A scroll burst previews many files in quick succession
+	for i := 0; i < 100; i++ {
+		app.showPreview(types.FileEntry{Path: fmt.Sprintf("file%d.txt", i)})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	if maxOpen > cfg.UI.MaxOpenPreviews {
+		t.Errorf("max open preview files = %d, want at most %d", maxOpen, cfg.UI.MaxOpenPreviews)
+	}
+	mu.Unlock()
+
+	close(release)
+	app.wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if open != 0 {
+		t.Errorf("%d preview files left open", open)
+	}
+	if released != opened {
+		t.Errorf("closed %d of %d opened preview files", released, opened)
+	}
+	// Previews superseded while waiting for a slot never open their file
+	if opened >= 100 {
+		t.Errorf("opened %d files, want superseded previews skipped", opened)
+	}
+}
+
+// failingFile is a preview file whose reads wait for release and then fail.
+type failingFile struct {
+	release <-chan struct{}
+}
+
+func (f *failingFile) Read(p []byte) (int, error) {
+	<-f.release
+	return 0, fmt.Errorf("disk error")
+}
+
+func (f *failingFile) Close() error {
+	return nil
+}
+
+func TestOnlyLatestPreviewUpdates(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+
+	// Queue updates like the event loop would, to run them after the loads
+	var (
+		mu     sync.Mutex
+		queued []func()
+	)
+	app.queueUpdateDraw = func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		queued = append(queued, f)
+	}
+	runQueued := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range queued {
+			f()
+		}
+		queued = nil
+	}
+
+	var release chan struct{}
+	opened := make(chan struct{})
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		if name == "slow.txt" {
+			opened <- struct{}{}
+			return &failingFile{release: release}, nil
+		}
+		return io.NopCloser(strings.NewReader("package fast\n")), nil
+	}
+
+	// A slow file's failure, reported after a newer preview, is dropped
+	release = make(chan struct{})
+	app.showPreview(types.FileEntry{Path: "slow.txt"})
+	<-opened
+	app.showPreview(types.FileEntry{Path: "fast.go"})
+	close(release)
+	app.wg.Wait()
+	runQueued()
+	if got := app.preview.GetText(true); !strings.Contains(got, "package fast") {
+		t.Errorf("preview = %q, want fast.go", got)
+	}
+
+	// So are its updates after a binary file, shown as a hex dump
+	release = make(chan struct{})
+	app.showPreview(types.FileEntry{Path: "slow.txt"})
+	<-opened
+	app.showPreview(types.FileEntry{Path: "blob.bin", IsBinary: true})
+	close(release)
+	app.wg.Wait()
+	runQueued()
+	if got := app.preview.GetText(true); !strings.Contains(got, "00000000  70 61 63 6b 61 67 65 20  66 61 73 74 0a           |package fast.|") {
+		t.Errorf("preview = %q, want the hex dump of blob.bin", got)
+	}
+
+	// The latest preview still reports its own errors
+	release = make(chan struct{})
+	app.showPreview(types.FileEntry{Path: "slow.txt"})
+	<-opened
+	close(release)
+	app.wg.Wait()
+	runQueued()
+	if got := app.preview.GetText(true); got != "Error reading file: disk error" {
+		t.Errorf("preview = %q, want the read error", got)
+	}
+}
+
+func TestPriorityGlobsSortFirst(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.PriorityGlobs = []string{"**/handler*.go", "README.md"}
+	// Within each priority the scan order is kept
+	cfg.UI.SortBy = "scan"
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	app.list.Add([]types.FileEntry{
+		{Path: "README.md"},
+		{Path: "cmd/main.go"},
+		{Path: "internal/api/handler_test.go"},
+		{Path: "internal/api/server.go"},
+		{Path: "handler.go"},
+		{Path: "docs/README.md"},
+	}...)
+
+	listed := func() []string {
+		var paths []string
+		for row := 0; row < app.list.Len(); row++ {
+			entry, _ := app.list.Entry(row)
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	app.updateFileList()
+	want := []string{
+		"internal/api/handler_test.go", "handler.go",
+		"README.md", "docs/README.md",
+		"cmd/main.go", "internal/api/server.go",
+	}
+	if got := listed(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", got, want)
+	}
+	if n := app.fileList.GetItemCount(); n != len(want) {
+		t.Errorf("list has %d items, want %d", n, len(want))
+	}
+
+	// Priority matches stay on top of the fuzzy ranking, which orders them
+	// among themselves
+	app.list.SetQuery("go")
+	app.updateFileList()
+	want = []string{"handler.go", "internal/api/handler_test.go", "cmd/main.go", "internal/api/server.go"}
+	if got := listed(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", got, want)
+	}
+}
+
+func TestScanBatchesListUpdates(t *testing.T) {
+	files := make([]types.FileEntry, 5000)
+	for i := range files {
+		files[i] = types.FileEntry{Path: fmt.Sprintf("dir/file%04d.go", i)}
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.UI.ScanRefreshMs = 20
+	app := New(cfg, &mockScanner{files: files}, &mockProcessor{}, &mockWriter{})
+	var draws int
+	var mu sync.Mutex
+	app.queueUpdateDraw = func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		draws++
+		f()
+	}
+
+	start := time.Now()
+	if err := app.startScanning(); err != nil {
+		t.Fatalf("Failed to start scanning: %v", err)
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		mu.Lock()
+		n := app.fileList.GetItemCount()
+		mu.Unlock()
+		if n == len(files) {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("list has %d items, want %d", n, len(files))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// One draw per interval at most, plus the final one when the scan ends
+	if limit := int(elapsed/(20*time.Millisecond)) + 2; draws > limit {
+		t.Errorf("%d draws for %d files in %s, want at most %d", draws, len(files), elapsed, limit)
+	}
+	if len(app.list.Entries()) != len(files) {
+		t.Errorf("got %d entries, want %d", len(app.list.Entries()), len(files))
+	}
+}
+
+func TestListViewModel(t *testing.T) {
+	vm := newListViewModel([]string{"*.md"})
+	vm.Add(
+		types.FileEntry{Path: "internal/app/app.go"},
+		types.FileEntry{Path: "internal/app/ui.go"},
+		types.FileEntry{Path: "README.md"},
+	)
+	vm.Add(types.FileEntry{Path: "main.go"})
+
+	rows := func() []string {
+		var paths []string
+		for row := 0; row < vm.Len(); row++ {
+			entry, _ := vm.Entry(row)
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	want := []string{"README.md", "internal/app/app.go", "internal/app/ui.go", "main.go"}
+	if got := rows(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows = %v, want %v", got, want)
+	}
+
+	// Rows index the filtered list, so toggling a row selects what is shown
+	vm.SetQuery("ui")
+	if got := rows(); fmt.Sprint(got) != "[internal/app/ui.go]" {
+		t.Fatalf("rows = %v, want only ui.go", got)
+	}
+	entry, ok := vm.Toggle(0)
+	if !ok || entry.Path != "internal/app/ui.go" || !entry.IsSelected {
+		t.Errorf("Toggle(0) = %+v, %v; want ui.go selected", entry, ok)
+	}
+	if _, ok := vm.Toggle(1); ok {
+		t.Error("Toggle() past the last row should fail")
+	}
+
+	vm.SetQuery("nothing matches this")
+	if vm.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", vm.Len())
+	}
+
+	// Selection survives filtering
+	vm.SetQuery("")
+	want = []string{"[ ] README.md", "[ ] internal/app/app.go", "[x] internal/app/ui.go", "[ ] main.go"}
+	if got := vm.Labels(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Labels() = %v, want %v", got, want)
+	}
+
+	vm.Toggle(3)
+	if removed := vm.DeselectUnder("internal"); fmt.Sprint(removed) != "[internal/app/ui.go]" {
+		t.Errorf("DeselectUnder() = %v, want ui.go", removed)
+	}
+	if !vm.Deselect("main.go") || vm.Deselect("main.go") {
+		t.Error("Deselect() should report main.go selected only the first time")
+	}
+	for _, entry := range vm.Entries() {
+		if entry.IsSelected {
+			t.Errorf("%s still selected", entry.Path)
+		}
+	}
+}
+
+func TestListSizes(t *testing.T) {
+	vm := newListViewModel(nil)
+	vm.Add(
+		types.FileEntry{Path: "main.go", Size: 120},
+		types.FileEntry{Path: "internal/app/app.go", Size: 3174, IsSelected: true},
+		types.FileEntry{Path: "testdata/" + strings.Repeat("x", 60) + "/big.json", Size: 5 << 20},
+	)
+
+	// Without sizes, the labels are unchanged
+	if got, want := vm.Labels()[0], "[ ] main.go"; got != want {
+		t.Errorf("label = %q, want %q", got, want)
+	}
+
+	vm.SetShowSizes(true)
+	want := []string{
+		"[ ] main.go" + strings.Repeat(" ", 53) + "     120 B",
+		"[x] internal/app/app.go" + strings.Repeat(" ", 41) + "    3.1 KB",
+		"[ ] …" + strings.Repeat("x", 50) + "/big.json    5.0 MB",
+	}
+	if got := vm.Labels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels() = %q, want %q", got, want)
+	}
+
+	// The path column is only as wide as the longest displayed path
+	vm.SetQuery("main")
+	if got, want := vm.Labels(), []string{"[ ] main.go     120 B"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels() = %q, want %q", got, want)
+	}
+}
+
+func TestInvertSelection(t *testing.T) {
+	w := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, w)
+	mu := serializeUpdates(app)
+	var entries []types.FileEntry
+	for i := range 20 {
+		entries = append(entries, types.FileEntry{Path: fmt.Sprintf("src/file%02d.go", i)})
+	}
+	entries = append(entries, types.FileEntry{Path: "README.md"})
+	app.addEntries(entries)
+
+	app.toggleSelection(app.list.Row("src/file03.go"))
+	app.toggleSelection(app.list.Row("README.md"))
+	app.wg.Wait()
+	w.written = nil
+
+	// Only the listed files are inverted; README.md is hidden by the search
+	app.list.SetQuery("src/")
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'I', tcell.ModNone))
+	app.wg.Wait()
+
+	selected := make(map[string]bool)
+	for _, entry := range app.list.Entries() {
+		selected[entry.Path] = entry.IsSelected
+	}
+	for _, entry := range entries {
+		want := entry.Path != "src/file03.go"
+		if selected[entry.Path] != want {
+			t.Errorf("%s selected = %v, want %v", entry.Path, selected[entry.Path], want)
+		}
+	}
+	if len(w.written) != 19 {
+		t.Errorf("wrote %d files, want the 19 newly selected", len(w.written))
+	}
+	if fmt.Sprint(w.removed) != "[src/file03.go]" {
+		t.Errorf("removed %v, want the deselected file", w.removed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if title := app.status.GetTitle(); !strings.HasPrefix(title, "Status: 20 files selected") {
+		t.Errorf("status title = %q, want the 20 selected files", title)
+	}
+}
+
+func TestQuitConfirmation(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         tcell.Key
+		r           rune
+		wantStopped bool
+		wantDiscard bool
+	}{
+		{"write", tcell.KeyRune, 'y', true, false},
+		{"discard", tcell.KeyRune, 'n', true, true},
+		{"cancel", tcell.KeyEscape, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &mockWriter{}
+			app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, w)
+			serializeUpdates(app)
+			app.addEntries([]types.FileEntry{{Path: "main.go"}})
+			app.toggleSelection(app.list.Row("main.go"))
+			app.wg.Wait()
+
+			app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone))
+			if app.ctx.Err() != nil {
+				t.Fatal("quit stopped the app without asking")
+			}
+			name, front := app.pages.GetFrontPage()
+			if name != confirmPage {
+				t.Fatalf("front page = %q, want %q", name, confirmPage)
+			}
+			modal := front.(*tview.Modal)
+			if event := modal.GetInputCapture()(tcell.NewEventKey(tt.key, tt.r, tcell.ModNone)); event != nil {
+				modal.InputHandler()(event, func(tview.Primitive) {})
+			}
+
+			if stopped := app.ctx.Err() != nil; stopped != tt.wantStopped {
+				t.Errorf("stopped = %v, want %v", stopped, tt.wantStopped)
+			}
+			if app.pages.HasPage(confirmPage) {
+				t.Error("confirmation still open after answering it")
+			}
+			if err := app.shutdown(); err != nil {
+				t.Fatalf("shutdown() error = %v", err)
+			}
+			if w.discarded != tt.wantDiscard || w.flushed == tt.wantDiscard {
+				t.Errorf("discarded = %v, flushed = %v, want discarded %v", w.discarded, w.flushed, tt.wantDiscard)
+			}
+		})
+	}
+
+	// Without a selection, or with the prompt disabled, quit stops at once
+	cfg := config.DefaultConfig()
+	cfg.UI.ConfirmQuit = false
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries([]types.FileEntry{{Path: "main.go"}})
+	app.toggleSelection(app.list.Row("main.go"))
+	app.wg.Wait()
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone))
+	if app.ctx.Err() == nil || app.pages.HasPage(confirmPage) {
+		t.Error("quit asked for a confirmation with confirmQuit off")
+	}
+}
+
+func TestTokenBudget(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.TokenBudget = 100
+	w := &mockWriter{}
+	app := New(cfg, &mockScanner{}, &tokenProcessor{tokens: 40}, w)
+	mu := serializeUpdates(app)
+	app.addEntries([]types.FileEntry{{Path: "a.go"}, {Path: "b.go"}, {Path: "c.go"}})
+
+	// Key presses run on the event loop, like the updates they queue
+	for _, path := range []string{"a.go", "b.go", "c.go"} {
+		app.queueUpdateDraw(func() { app.toggleSelection(app.list.Row(path)) })
+		if path != "c.go" {
+			app.wg.Wait()
+		}
+	}
+	app.wg.Wait()
+
+	if len(w.written) != 2 {
+		t.Errorf("wrote %d files, want the 2 that fit the budget", len(w.written))
+	}
+	app.mu.Lock()
+	tokens := app.totals.tokens
+	selected, _ := app.list.Entry(app.list.Row("c.go"))
+	app.mu.Unlock()
+	if tokens != 80 {
+		t.Errorf("totals.tokens = %d, want 80", tokens)
+	}
+	if selected.IsSelected {
+		t.Error("c.go is selected although it exceeds the budget")
+	}
+	mu.Lock()
+	text := app.status.GetText(true)
+	mu.Unlock()
+	if !strings.Contains(text, "Not selecting c.go") {
+		t.Errorf("status = %q, want the refused file", text)
+	}
+}
+
+func TestSearchSelectsDisplayedRow(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries([]types.FileEntry{
+		{Path: "cmd/pfzf/main.go"},
+		{Path: "internal/app/files.go"},
+		{Path: "internal/fs/filter.go"},
+		{Path: "README.md"},
+	})
+
+	// Searching filters through the view-model only, so the list shows its
+	// rows and toggling a row selects the entry displayed there
+	app.handleSearch("fil")
+	var shown []string
+	for row := 0; row < app.fileList.GetItemCount(); row++ {
+		label, _ := app.fileList.GetItemText(row)
+		shown = append(shown, label)
+	}
+	if fmt.Sprint(shown) != fmt.Sprint(app.list.Labels()) {
+		t.Fatalf("list shows %v, view-model rows are %v", shown, app.list.Labels())
+	}
+
+	for row, label := range shown {
+		app.toggleSelection(row)
+		app.wg.Wait()
+		entry, _ := app.list.Entry(row)
+		if !entry.IsSelected || !strings.HasPrefix(label, "[ ] "+entry.Path+" ") {
+			t.Errorf("toggling row %d (%q) selected %+v", row, label, entry)
+		}
+	}
+}
+
+func TestSearchDebounce(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.SearchDebounceMs = 20
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	// The debounce timer runs the filter on its own goroutine
+	var loop sync.Mutex
+	// filtered records each query the list was filtered for; previews
+	// queue updates as well, which leave the query as it was
+	var filtered []string
+	last := ""
+	app.queueUpdateDraw = func(f func()) {
+		loop.Lock()
+		defer loop.Unlock()
+		f()
+		if q := app.query(); q != last {
+			filtered = append(filtered, q)
+			last = q
+		}
+	}
+	app.list.Add(
+		types.FileEntry{Path: "internal/app/files.go"},
+		types.FileEntry{Path: "internal/fs/filter.go"},
+		types.FileEntry{Path: "README.md"},
+	)
+
+	// Typing quickly filters once, for the last keystroke
+	loop.Lock()
+	for _, text := range []string{"f", "fi", "fil", "filt"} {
+		app.search.SetText(text)
+	}
+	if got := app.query(); got != "" {
+		t.Errorf("query = %q while typing, want it debounced", got)
+	}
+	loop.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	loop.Lock()
+	if fmt.Sprint(filtered) != "[filt]" {
+		t.Errorf("filtered %v, want only the last keystroke", filtered)
+	}
+	if got := app.fileList.GetItemCount(); got != 1 {
+		t.Errorf("list shows %d files, want the one matching filt", got)
+	}
+
+	// Enter applies a pending search at once
+	app.search.SetText("READ")
+	app.handleSearchInput(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	if got := app.query(); got != "READ" {
+		t.Errorf("query = %q after enter, want READ", got)
+	}
+	if app.searchTimer != nil {
+		t.Error("enter left the debounced search pending")
+	}
+	loop.Unlock()
+}
+
+func TestSelectionFilter(t *testing.T) {
+	w := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, w)
+	app.queueUpdateDraw = func(f func()) {}
+	app.list.Add(
+		types.FileEntry{Path: "a.go"},
+		types.FileEntry{Path: "b.go"},
+		types.FileEntry{Path: "c_test.go"},
+		types.FileEntry{Path: "d_test.go"},
+	)
+	for _, row := range []int{0, 2, 3} {
+		app.toggleSelection(row)
+		app.wg.Wait()
+	}
+	app.toggleSelection(3)
+	app.wg.Wait()
+
+	// The buffered set is what the writer was given and not removed since
+	buffered := make(map[string]bool)
+	for _, content := range w.written {
+		buffered[content.Entry.Path] = true
+	}
+	for _, path := range w.removed {
+		delete(buffered, path)
+	}
+
+	shown := func() []string {
+		var paths []string
+		for row := 0; row < app.fileList.GetItemCount(); row++ {
+			entry, _ := app.list.Entry(row)
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	app.runAction(actionFilterSelection)
+	got := shown()
+	if len(got) != len(buffered) {
+		t.Errorf("selected only shows %v, want the buffered %v", got, buffered)
+	}
+	for _, path := range got {
+		if !buffered[path] {
+			t.Errorf("selected only shows %s, which isn't buffered", path)
+		}
+	}
+	if title := app.fileList.GetTitle(); !strings.HasPrefix(title, "Files, selected only") {
+		t.Errorf("title = %q, want the filter named", title)
+	}
+
+	// The filter composes with the search
+	app.handleSearch("test")
+	if got := shown(); fmt.Sprint(got) != "[c_test.go]" {
+		t.Errorf("selected matching test = %v, want c_test.go", got)
+	}
+	app.handleSearch("")
+
+	app.runAction(actionFilterSelection)
+	if got := shown(); fmt.Sprint(got) != "[b.go d_test.go]" {
+		t.Errorf("unselected only = %v, want b.go and d_test.go", got)
+	}
+	// Selecting an entry moves it out of the unselected rows
+	app.toggleSelection(0)
+	app.wg.Wait()
+	if got := shown(); fmt.Sprint(got) != "[d_test.go]" {
+		t.Errorf("unselected only = %v after selecting b.go, want d_test.go", got)
+	}
+
+	app.runAction(actionFilterSelection)
+	if got := shown(); len(got) != 4 {
+		t.Errorf("all = %v, want every file", got)
+	}
+}
+
+func TestPreviewScrolling(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	mu := serializeUpdates(app)
+
+	var content strings.Builder
+	for i := 1; i <= 300; i++ {
+		if i == 40 || i == 250 {
+			fmt.Fprintf(&content, "needle on line %d\n", i)
+		} else {
+			fmt.Fprintf(&content, "line %d\n", i)
+		}
+	}
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content.String())), nil
+	}
+	app.list.SetQuery("needle")
+	// A page is the 20 lines inside the border, less the header
+	app.preview.SetRect(0, 0, 80, 22)
+
+	app.showPreview(types.FileEntry{Path: "haystack.txt"})
+	app.wg.Wait()
+
+	current := func() int {
+		t.Helper()
+		if app.previewState == nil {
+			t.Fatal("no preview state")
+		}
+		return app.previewState.currentLine + 1
+	}
+	// The preview opens at the first match
+	if got := current(); got != 40 {
+		t.Fatalf("current line = %d, want 40", got)
+	}
+
+	app.runAction(actionFocusPreview)
+	if app.GetFocus() != app.preview {
+		t.Fatal("focus_preview did not focus the preview")
+	}
+
+	steps := []struct {
+		name  string
+		event *tcell.EventKey
+		want  int
+	}{
+		{"next match", tcell.NewEventKey(tcell.KeyRune, 'n', tcell.ModNone), 250},
+		{"next match wraps", tcell.NewEventKey(tcell.KeyRune, 'n', tcell.ModNone), 40},
+		{"previous match wraps", tcell.NewEventKey(tcell.KeyRune, 'N', tcell.ModNone), 250},
+		{"bottom", tcell.NewEventKey(tcell.KeyRune, 'G', tcell.ModNone), 300},
+		{"page up", tcell.NewEventKey(tcell.KeyPgUp, 0, tcell.ModNone), 281},
+		{"line up", tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone), 280},
+		{"top", tcell.NewEventKey(tcell.KeyRune, 'g', tcell.ModNone), 1},
+		{"line up at the top", tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone), 1},
+		{"page down", tcell.NewEventKey(tcell.KeyCtrlD, 0, tcell.ModCtrl), 20},
+	}
+	for _, step := range steps {
+		if app.handlePreviewInput(step.event) != nil {
+			t.Errorf("%s: key not consumed", step.name)
+		}
+		if got := current(); got != step.want {
+			t.Errorf("%s: current line = %d, want %d", step.name, got, step.want)
+		}
+	}
+	if text := app.preview.GetText(true); !strings.Contains(text, ">   20 line 20") {
+		t.Errorf("preview = %q, want line 20 marked current", text)
+	}
+
+	app.handlePreviewInput(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if app.GetFocus() != app.fileList {
+		t.Error("Esc did not return to the file list")
+	}
+
+	// Scrolling a replaced preview does nothing. Keys run on the event loop,
+	// so the preview loading meanwhile waits for them.
+	mu.Lock()
+	app.showPreview(types.FileEntry{Path: "logo.bin", IsBinary: true})
+	app.runAction(actionPreviewBottom)
+	mu.Unlock()
+	app.wg.Wait()
+	if state := app.previewState; state == nil || state.filename != "logo.bin" || !state.hex {
+		t.Error("binary preview kept the text preview's state")
+	}
+}
+
+// seekCloser is a seekable file for previews.
+type seekCloser struct{ *strings.Reader }
+
+func (seekCloser) Close() error { return nil }
+
+func TestPreviewWrap(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.preview.SetText(strings.Repeat("wide,", 100))
+	right := tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModNone)
+	left := tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone)
+	column := func() int {
+		_, column := app.preview.GetScrollOffset()
+		return column
+	}
+
+	// Wrapped lines don't scroll sideways
+	app.handlePreviewInput(right)
+	if got := column(); got != 0 {
+		t.Errorf("column = %d with wrapping, want 0", got)
+	}
+
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'w', tcell.ModNone))
+	if app.config.UI.PreviewWrap {
+		t.Fatal("toggle_wrap left wrapping on")
+	}
+	app.handlePreviewInput(right)
+	app.handlePreviewInput(right)
+	if got := column(); got != 2*previewColumns {
+		t.Errorf("column = %d after →→, want %d", got, 2*previewColumns)
+	}
+	app.handlePreviewInput(left)
+	app.handlePreviewInput(left)
+	app.handlePreviewInput(left)
+	if got := column(); got != 0 {
+		t.Errorf("column = %d after ←←←, want 0", got)
+	}
+
+	// Wrapping again starts at the first column
+	app.handlePreviewInput(right)
+	app.runAction(actionToggleWrap)
+	if !app.config.UI.PreviewWrap || column() != 0 {
+		t.Errorf("after toggling back, wrap = %v and column = %d", app.config.UI.PreviewWrap, column())
+	}
+}
+
+func TestPreviewSeeking(t *testing.T) {
+	var b strings.Builder
+	for i := 1; i <= 5000; i++ {
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	content := b.String()
+	long := strings.Repeat("x", 100_000)
+
+	for _, seekable := range []bool{true, false} {
+		t.Run(fmt.Sprintf("seekable=%v", seekable), func(t *testing.T) {
+			app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+			serializeUpdates(app)
+			app.openFile = func(name string) (io.ReadCloser, error) {
+				data := content
+				if name == "long.txt" {
+					data = long
+				}
+				if seekable {
+					return seekCloser{strings.NewReader(data)}, nil
+				}
+				return io.NopCloser(strings.NewReader(data)), nil
+			}
+			press := func(r rune) *PreviewState {
+				t.Helper()
+				app.handlePreviewInput(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+				app.wg.Wait()
+				return app.previewState
+			}
+
+			app.showPreview(types.FileEntry{Path: "big.log", Size: int64(len(content))})
+			app.wg.Wait()
+			state := app.previewState
+			if len(state.lines) != previewMaxLines || state.lines[0] != "line 1" || !state.truncated {
+				t.Fatalf("start: %d lines from %q, truncated = %v; want %d from line 1, truncated",
+					len(state.lines), state.lines[0], state.truncated, previewMaxLines)
+			}
+
+			state = press('G')
+			if last := state.lines[len(state.lines)-1]; last != "line 5000" || state.currentLine != len(state.lines)-1 || state.truncated {
+				t.Errorf("end: current line %d of %d ending %q, truncated = %v; want the last line", state.currentLine, len(state.lines), last, state.truncated)
+			}
+			if status := app.status.GetText(true); !strings.Contains(status, "end of the file") {
+				t.Errorf("end: status = %q, want it to say so", status)
+			}
+			if text := app.preview.GetText(true); !strings.Contains(text, "> line 5000") || strings.Contains(text, "5000 line 5000") {
+				t.Errorf("end: preview = %q, want the last line current and unnumbered", text)
+			}
+
+			state = press('5')
+			offset := int64(len(content)) / 2
+			want := content[offset:]
+			if i := strings.Index(content[offset-1:], "\n"); i > 0 {
+				want = content[offset+int64(i):]
+			}
+			want, _, _ = strings.Cut(want, "\n")
+			if state.offset != offset || state.lines[0] != want || !state.truncated {
+				t.Errorf("50%%: window at %d from %q, want %d from %q", state.offset, state.lines[0], offset, want)
+			}
+
+			state = press('g')
+			if state.offset != 0 || state.lines[0] != "line 1" || state.currentLine != 0 {
+				t.Errorf("top: window at %d from %q, want the start of the file", state.offset, state.lines[0])
+			}
+
+			// A huge single-line file is read in pieces
+			app.showPreview(types.FileEntry{Path: "long.txt", Size: int64(len(long))})
+			app.wg.Wait()
+			state = app.previewState
+			if got := strings.Join(state.lines, ""); got != long || len(state.lines) != 7 {
+				t.Errorf("long line: %d pieces of %d bytes, want 7 of %d", len(state.lines), len(got), len(long))
+			}
+		})
+	}
+}
+
+func TestCopyPath(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries([]types.FileEntry{{Path: "cmd/main.go"}, {Path: "internal/app/ui.go"}})
+	app.fileList.SetCurrentItem(1)
+
+	var copied []string
+	app.copyToClipboard = func(text string) error {
+		copied = append(copied, text)
+		return nil
+	}
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'y', tcell.ModNone))
+	app.wg.Wait()
+
+	if fmt.Sprint(copied) != "[internal/app/ui.go]" {
+		t.Errorf("copied %q, want the highlighted path", copied)
+	}
+	if got := app.status.GetText(true); got != "Copied internal/app/ui.go" {
+		t.Errorf("status = %q, want a confirmation", got)
+	}
+
+	app.copyToClipboard = func(text string) error {
+		return fmt.Errorf("no clipboard")
+	}
+	app.runAction(actionCopyPath)
+	app.wg.Wait()
+	if got := app.status.GetText(true); got != "Copying path: no clipboard" {
+		t.Errorf("status = %q, want the error", got)
+	}
+}
+
+func TestOutputPathActions(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Writer.OutputPath = filepath.Join(t.TempDir(), "context.xml")
+	w := &mockWriter{}
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, w)
+	serializeUpdates(app)
+	var copied, opened []string
+	app.copyToClipboard = func(text string) error {
+		copied = append(copied, text)
+		return nil
+	}
+	app.openPath = func(path string) error {
+		opened = append(opened, path)
+		return nil
+	}
+
+	// Nothing is written before files are selected
+	app.runAction(actionCopyOutputPath)
+	app.wg.Wait()
+	if len(copied) != 0 || app.status.GetText(true) != "No output written yet: select files first" {
+		t.Errorf("copied %q with no output, status %q", copied, app.status.GetText(true))
+	}
+	if !w.flushed {
+		t.Error("copy_output_path didn't flush the writer")
+	}
+
+	if err := os.WriteFile(cfg.Writer.OutputPath, []byte("<files/>"), 0o644); err != nil {
+		t.Fatalf("Failed to create output: %v", err)
+	}
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'P', tcell.ModNone))
+	app.wg.Wait()
+	if fmt.Sprint(copied) != "["+cfg.Writer.OutputPath+"]" {
+		t.Errorf("copied %q, want the output path", copied)
+	}
+	if got := app.status.GetText(true); got != "Copied "+cfg.Writer.OutputPath {
+		t.Errorf("status = %q, want a confirmation", got)
+	}
+
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'O', tcell.ModNone))
+	app.wg.Wait()
+	if fmt.Sprint(opened) != "["+cfg.Writer.OutputPath+"]" {
+		t.Errorf("opened %q, want the output path", opened)
+	}
+
+	app.openPath = func(path string) error {
+		return fmt.Errorf("no open command")
+	}
+	app.runAction(actionOpenOutput)
+	app.wg.Wait()
+	if got := app.status.GetText(true); got != "Opening the output: no open command" {
+		t.Errorf("status = %q, want the error", got)
+	}
+}
+
+func TestCopyOutput(t *testing.T) {
+	w := &mockWriter{preview: "<files>...</files>"}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, w)
+	serializeUpdates(app)
+	var copied []string
+	app.copyToClipboard = func(text string) error {
+		copied = append(copied, text)
+		return nil
+	}
+
+	app.runAction(actionCopyOutput)
+	if len(copied) != 0 || app.status.GetText(true) != "No files selected to copy" {
+		t.Errorf("copied %q with nothing selected, status %q", copied, app.status.GetText(true))
+	}
+
+	app.mu.Lock()
+	app.totals.add(types.ProcessedContent{Entry: types.FileEntry{Path: "a.go"}, Content: []byte("package a"), TokenCount: 1500})
+	app.mu.Unlock()
+	app.handleInput(tcell.NewEventKey(tcell.KeyRune, 'Y', tcell.ModNone))
+	app.wg.Wait()
+
+	if fmt.Sprint(copied) != "[<files>...</files>]" {
+		t.Errorf("copied %q, want the rendered output", copied)
+	}
+	if got, want := app.status.GetText(true), "Copied the output to the clipboard: 1 file · 1.5k tokens · 18 B"; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+
+	app.copyToClipboard = func(text string) error {
+		return fmt.Errorf("no clipboard")
+	}
+	app.runAction(actionCopyOutput)
+	app.wg.Wait()
+	if got := app.status.GetText(true); got != "Copying output: no clipboard" {
+		t.Errorf("status = %q, want the error", got)
+	}
+}
+
+func TestSelectionTotals(t *testing.T) {
+	totals := newSelectionTotals()
+	totals.add(types.ProcessedContent{Entry: types.FileEntry{Path: "a.go"}, Content: make([]byte, 40<<10), TokenCount: 10_000})
+	// Chunked files count their chunks' tokens, as the writer does
+	totals.add(types.ProcessedContent{
+		Entry:   types.FileEntry{Path: "b.go"},
+		Content: make([]byte, 32<<10),
+		Chunks:  []types.Chunk{{TokenCount: 5000}, {TokenCount: 3400}},
+	})
+	totals.add(types.ProcessedContent{Entry: types.FileEntry{Path: "c.go"}, Content: []byte("package c\n"), TokenCount: 3})
+
+	if got, want := totals.String(), "3 files selected · 18.4k tokens · 72 KB"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	// Writing a file again replaces its count, and removing it drops it
+	totals.add(types.ProcessedContent{Entry: types.FileEntry{Path: "c.go"}, Content: []byte("package c\n"), TokenCount: 3, SavedTokens: 1200})
+	totals.remove("a.go")
+	totals.remove("missing.go")
+	if got, want := totals.String(), "2 files selected · 8.4k tokens · 32 KB · 1.2k saved"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestStatusShowsSelectionTotals(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	mu := serializeUpdates(app)
+	app.list.Add(types.FileEntry{Path: "a.go"}, types.FileEntry{Path: "b.go"})
+
+	title := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return app.status.GetTitle()
+	}
+
+	app.toggleSelection(0)
+	app.wg.Wait()
+	app.toggleSelection(1)
+	app.wg.Wait()
+	if got := title(); !strings.HasPrefix(got, "Status: 2 files selected · ") {
+		t.Errorf("title = %q, want two files counted", got)
+	}
+
+	app.toggleSelection(0)
+	app.toggleSelection(1)
+	app.wg.Wait()
+	if got := title(); got != "Status" {
+		t.Errorf("title = %q, want no totals once nothing is selected", got)
+	}
+}
+
+func TestKeyBindings(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.KeyBindings["select"] = "x"
+	cfg.UI.KeyBindings["quit"] = "ctrl-q"
+	cfg.UI.KeyBindings["move_down"] = "j"
+	cfg.UI.KeyBindings["focus_search"] = "f10"
+	cfg.UI.KeyBindings["toggle_preview"] = ""
+	cfg.UI.KeyBindings["jump"] = "g"
+
+	keys, warnings := newKeyMap(cfg.UI.KeyBindings)
+	wantWarnings := []string{`focus_search: unknown key "f10", using /`, `unknown action "jump"`}
+	if fmt.Sprint(warnings) != fmt.Sprint(wantWarnings) {
+		t.Errorf("warnings = %q, want %q", warnings, wantWarnings)
+	}
+
+	tests := []struct {
+		event *tcell.EventKey
+		want  string
+	}{
+		{tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone), actionSelect},
+		{tcell.NewEventKey(tcell.KeyRune, ' ', tcell.ModNone), ""},
+		{tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone), ""},
+		{tcell.NewEventKey(tcell.KeyCtrlA+16, 0, tcell.ModCtrl), actionQuit},
+		{tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModNone), actionMoveDown},
+		{tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModAlt), ""},
+		{tcell.NewEventKey(tcell.KeyRune, '/', tcell.ModNone), actionFocusSearch},
+		{tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone), ""},
+		{tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone), actionClearSearch},
+	}
+	for _, tt := range tests {
+		if got := keys.action(tt.event); got != tt.want {
+			t.Errorf("action(%v %q) = %q, want %q", tt.event.Key(), tt.event.Rune(), got, tt.want)
+		}
+	}
+
+	// A remapped action takes its key from the default it collides with
+	cfg = config.DefaultConfig()
+	cfg.UI.KeyBindings["select"] = "p"
+	keys, warnings = newKeyMap(cfg.UI.KeyBindings)
+	if keys.keyFor(actionSelect) != "p" || keys.keyFor(actionTogglePreview) != "" {
+		t.Errorf("select = %q, toggle_preview = %q; want p and unbound", keys.keyFor(actionSelect), keys.keyFor(actionTogglePreview))
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "p is already bound to select") {
+		t.Errorf("warnings = %q, want the collision reported", warnings)
+	}
+}
+
+func TestRemappedKeysDispatch(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.KeyBindings["select"] = "x"
+	cfg.UI.KeyBindings["move_down"] = "j"
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	app.queueUpdateDraw = func(f func()) {}
+	app.addEntries([]types.FileEntry{{Path: "a.go"}, {Path: "b.go"}})
+	app.updateFileList()
+
+	press := func(r rune) *tcell.EventKey {
+		return app.handleInput(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	if press(' ') == nil {
+		t.Error("space should no longer be handled once select is remapped")
+	}
+	if press('j') != nil || press('x') != nil {
+		t.Fatal("remapped keys should be handled")
+	}
+	app.wg.Wait()
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	for _, entry := range app.list.Entries() {
+		if want := entry.Path == "b.go"; entry.IsSelected != want {
+			t.Errorf("%s selected = %v, want %v", entry.Path, entry.IsSelected, want)
+		}
+	}
+	if title := app.fileList.GetTitle(); !strings.Contains(title, "x to select") {
+		t.Errorf("file list title = %q, want the remapped select key", title)
+	}
+}
+
+func TestHelpOverlay(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.KeyBindings["select"] = "x"
+	cfg.UI.KeyBindings["toggle_preview"] = ""
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+
+	help := tcell.NewEventKey(tcell.KeyRune, '?', tcell.ModNone)
+	if app.handleInput(help) != nil || !app.overlayOpen {
+		t.Fatal("help key should open the overlay")
+	}
+	text := app.overlay.GetText(false)
+	if !strings.Contains(text, "x          Select or deselect the file") {
+		t.Errorf("help = %q, want the remapped select key", text)
+	}
+	if strings.Contains(text, "Show or hide the preview") {
+		t.Errorf("help = %q, want unbound actions left out", text)
+	}
+
+	// The help key closes it again, as does escape
+	if app.handleOverlayInput(help) != nil || app.overlayOpen {
+		t.Error("help key should close the overlay")
+	}
+	app.showHelp()
+	if app.handleOverlayInput(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone)) != nil || app.overlayOpen {
+		t.Error("escape should close the overlay")
+	}
+}
+
+func TestImagePreview(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.UI.ImagePreview = "kitty"
+
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 16, 8))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(encoded.Bytes())), nil
+	}
+
+	app.showPreview(types.FileEntry{Path: "logo.png", IsBinary: true})
+	app.wg.Wait()
+
+	if app.previewImg == nil {
+		t.Fatalf("preview = %q, want the image", app.preview.GetText(true))
+	}
+	if got := app.preview.GetText(true); !strings.Contains(got, "logo.png (16x8 image)") {
+		t.Errorf("preview header = %q, want the image size", got)
+	}
+
+	var out bytes.Buffer
+	if err := app.writePreviewImage(&out, image.Rect(2, 3, 42, 13)); err != nil {
+		t.Fatalf("writePreviewImage() error = %v", err)
+	}
+	// The image is placed at row 4, column 3 in the terminal's 1-based
+	// coordinates
+	if want := "\x1b7\x1b[4;3H\x1b_Ga=T,f=100,q=2,c=2,r=1,"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("writePreviewImage() = %q, want prefix %q", out.String(), want)
+	}
+	if !strings.HasSuffix(out.String(), "\x1b\\\x1b8") {
+		t.Errorf("writePreviewImage() = %q, want the cursor restored", out.String())
+	}
+
+	// Other binary files, and images once previews are off, are shown as
+	// hex dumps
+	const pngMagic = "00000000  89 50 4e 47 0d 0a 1a 0a"
+	app.showPreview(types.FileEntry{Path: "app.bin", IsBinary: true})
+	app.wg.Wait()
+	if app.previewImg != nil || !strings.Contains(app.preview.GetText(true), pngMagic) {
+		t.Errorf("preview = %q, image %v; want the hex dump", app.preview.GetText(true), app.previewImg != nil)
+	}
+	app.imageProtocol = termimg.ProtocolNone
+	app.showPreview(types.FileEntry{Path: "logo.png", IsBinary: true})
+	app.wg.Wait()
+	if !strings.Contains(app.preview.GetText(true), pngMagic) {
+		t.Errorf("preview = %q, want the hex dump", app.preview.GetText(true))
+	}
+}
+
+func TestHexDumpLines(t *testing.T) {
+	data := []byte("\x00\x01[red]abcdefghijklmnopqrstuvwxyz")
+	lines := hexDumpLines(data, 100)
+	want := []string{
+		"00000000  00 01 5b 72 65 64 5d 61  62 63 64 65 66 67 68 69  |..[red[]abcdefghi|",
+		"00000010  6a 6b 6c 6d 6e 6f 70 71  72 73 74 75 76 77 78 79  |jklmnopqrstuvwxy|",
+		"00000020  7a                                                |z|",
+		"... first 33 of 100 bytes shown",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("hexDumpLines() =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	if lines := hexDumpLines(nil, 0); len(lines) != 0 {
+		t.Errorf("hexDumpLines() of an empty file = %q, want none", lines)
+	}
+}
+
+func TestPreviewHeader(t *testing.T) {
+	modTime := time.Date(2024, 3, 9, 14, 5, 0, 0, time.UTC)
+	info := headerInfo{
+		path:         "main.go",
+		shownLines:   40,
+		totalLines:   120,
+		size:         3 << 10,
+		modTime:      modTime,
+		symbols:      7,
+		symbolsKnown: true,
+		gitStatus:    "modified",
+	}
+
+	tests := []struct {
+		name     string
+		segments []string
+		info     headerInfo
+		want     string
+	}{
+		{"default", nil, info, "[yellow]main.go (40/120 lines)[white]"},
+		{"disabled", []string{}, info, ""},
+		{"custom order", []string{"git", "symbols", "path", "modified", "size"}, info,
+			"[yellow]main.go (modified · 7 symbols · 2024-03-09 14:05 · 3 KB)[white]"},
+		{"path only", []string{"path"}, info, "[yellow]main.go[white]"},
+		{"without path", []string{"size", "lines"}, info, "[yellow]3 KB · 40/120 lines[white]"},
+		{"image", []string{"path", "lines"}, headerInfo{path: "logo.png", imageWidth: 16, imageHeight: 8},
+			"[yellow]logo.png (16x8 image)[white]"},
+		{"unknown values left out", []string{"path", "symbols", "git", "modified"}, headerInfo{path: "main.go"},
+			"[yellow]main.go[white]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newHeaderBuilder(tt.segments).render(tt.info); got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The preview renders the configured header, and drops its line when
+	// the header is disabled
+	cfg := config.DefaultConfig()
+	cfg.UI.PreviewHeader = []string{"size", "path", "lines"}
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("one\ntwo\n")), nil
+	}
+	app.showPreview(types.FileEntry{Path: "notes.txt", Size: 8})
+	app.wg.Wait()
+	if got, want := app.preview.GetText(true), "notes.txt (8 B · 2/2 lines)\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("preview = %q, want prefix %q", got, want)
+	}
+
+	cfg.UI.PreviewHeader = []string{}
+	app = New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.openFile = func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("one\ntwo\n")), nil
+	}
+	app.showPreview(types.FileEntry{Path: "notes.txt", Size: 8})
+	app.wg.Wait()
+	if got := app.preview.GetText(true); !strings.HasPrefix(got, "> ") {
+		t.Errorf("preview = %q, want the first line without a header", got)
+	}
+}
+
+func TestRestoreSelection(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "later.txt", "new.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get the working directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	sessionPath := filepath.Join(t.TempDir(), "state", "session.json")
+	if err := saveSession(sessionPath, dir, []string{"a.txt", "gone.txt", "later.txt"}); err != nil {
+		t.Fatalf("saveSession() error = %v", err)
+	}
+
+	writer := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, writer)
+	// Updates from the background wait until drained, so they don't
+	// overwrite the status being checked
+	var queueMu sync.Mutex
+	var queued []func()
+	app.queueUpdateDraw = func(f func()) {
+		queueMu.Lock()
+		defer queueMu.Unlock()
+		queued = append(queued, f)
+	}
+	drain := func() {
+		app.wg.Wait()
+		queueMu.Lock()
+		fs := queued
+		queued = nil
+		queueMu.Unlock()
+		for _, f := range fs {
+			f()
+		}
+	}
+	app.EnableSession(sessionPath)
+	app.list.Add(types.FileEntry{Path: "a.txt"}, types.FileEntry{Path: "new.txt"})
+
+	app.offerRestore()
+	if got := app.status.GetText(true); !strings.Contains(got, "3 files were selected") || !strings.Contains(got, "press R") {
+		t.Errorf("status = %q, want the restore offer", got)
+	}
+
+	// Listed files are selected right away, deleted ones are skipped and
+	// the rest wait for the scan
+	app.runAction(actionRestoreSelection)
+	if got, want := app.status.GetText(true), "Restored 1 of 3 previously selected files; 1 no longer exist"; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	drain()
+	app.addEntries([]types.FileEntry{{Path: "later.txt"}})
+	drain()
+
+	var selected []string
+	for _, entry := range app.list.Entries() {
+		if entry.IsSelected {
+			selected = append(selected, entry.Path)
+		}
+	}
+	if want := []string{"a.txt", "later.txt"}; fmt.Sprint(selected) != fmt.Sprint(want) {
+		t.Errorf("selected = %v, want %v", selected, want)
+	}
+	if len(writer.written) != 2 {
+		t.Errorf("written = %d files, want 2", len(writer.written))
+	}
+
+	// Quitting saves the current selection for the next run
+	app.toggleSelection(app.list.Row("new.txt"))
+	drain()
+	if err := app.saveSelection(); err != nil {
+		t.Fatalf("saveSelection() error = %v", err)
+	}
+	saved, err := loadSession(sessionPath)
+	if err != nil {
+		t.Fatalf("loadSession() error = %v", err)
+	}
+	if want := []string{"a.txt", "later.txt", "new.txt"}; fmt.Sprint(saved) != fmt.Sprint(want) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	now := time.Now()
+	entries := []types.FileEntry{
+		{Path: "b.go", Size: 300, ModTime: now.Add(-time.Hour)},
+		{Path: "c.go", Size: 100, ModTime: now},
+		{Path: "a.go", Size: 200, ModTime: now.Add(-2 * time.Hour)},
+		{Path: "d.go", Size: 200, ModTime: now.Add(-2 * time.Hour)},
+	}
+
+	cfg := config.DefaultConfig()
+	app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries(entries[:2])
+	app.addEntries(entries[2:])
+
+	listed := func() []string {
+		var paths []string
+		for row := 0; row < app.list.Len(); row++ {
+			entry, _ := app.list.Entry(row)
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	// The configured order applies as entries stream in, and each key press
+	// moves on to the next; equal entries are ordered by path
+	tests := []struct {
+		order SortOrder
+		want  []string
+	}{
+		{SortPath, []string{"a.go", "b.go", "c.go", "d.go"}},
+		{SortSize, []string{"b.go", "a.go", "d.go", "c.go"}},
+		{SortModified, []string{"c.go", "b.go", "a.go", "d.go"}},
+		{SortScan, []string{"b.go", "c.go", "a.go", "d.go"}},
+		{SortPath, []string{"a.go", "b.go", "c.go", "d.go"}},
+	}
+	for i, tt := range tests {
+		if i > 0 {
+			app.runAction(actionSort)
+		}
+		if got := app.list.SortOrder(); got != tt.order {
+			t.Fatalf("SortOrder() = %v, want %v", got, tt.order)
+		}
+		if got := listed(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v: listed = %v, want %v", tt.order, got, tt.want)
+		}
+	}
+
+	// Sorting keeps the highlighted file highlighted, and selecting a row
+	// targets the file displayed there
+	app.fileList.SetCurrentItem(app.list.Row("c.go"))
+	app.runAction(actionSort)
+	if got, _ := app.list.Entry(app.fileList.GetCurrentItem()); got.Path != "c.go" {
+		t.Errorf("highlighted %s after sorting, want c.go", got.Path)
+	}
+	if title := app.fileList.GetTitle(); !strings.HasPrefix(title, "Files, by size") {
+		t.Errorf("title = %q, want the sort order", title)
+	}
+	app.toggleSelection(app.fileList.GetCurrentItem())
+	app.wg.Wait()
+	for _, entry := range app.list.Entries() {
+		if entry.IsSelected != (entry.Path == "c.go") {
+			t.Errorf("%s selected = %v", entry.Path, entry.IsSelected)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	now := time.Now()
+	entries := []types.FileEntry{
+		{Path: "main.go", ModTime: now.Add(-2 * time.Hour)},
+		{Path: "cmd/zz/main.go", ModTime: now.Add(-time.Hour)},
+		{Path: "internal/domain.go", ModTime: now},
+		{Path: "readme.md", ModTime: now},
+	}
+
+	tests := []struct {
+		ranking string
+		want    []string
+	}{
+		{"name", []string{"cmd/zz/main.go", "internal/domain.go", "main.go"}},
+		{"mtime", []string{"internal/domain.go", "cmd/zz/main.go", "main.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ranking, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.UI.SearchRanking = tt.ranking
+			app := New(cfg, &mockScanner{}, &mockProcessor{}, &mockWriter{})
+			serializeUpdates(app)
+			app.addEntries(entries)
+			app.list.SetQuery("main")
+
+			var got []string
+			for row := 0; row < app.list.Len(); row++ {
+				entry, _ := app.list.Entry(row)
+				got = append(got, entry.Path)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("listed = %v, want %v", got, tt.want)
+			}
+
+			// Selecting the first row selects the file displayed there
+			app.toggleSelection(0)
+			app.wg.Wait()
+			for _, entry := range app.list.Entries() {
+				if entry.IsSelected != (entry.Path == tt.want[0]) {
+					t.Errorf("%s selected = %v", entry.Path, entry.IsSelected)
+				}
+			}
+		})
+	}
+
+	// By score, the best match comes first
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries(entries)
+	app.list.SetQuery("main")
+	if entry, _ := app.list.Entry(0); entry.Path != "main.go" {
+		t.Errorf("best match = %s, want main.go", entry.Path)
+	}
+}
+
+func TestLanguageFilter(t *testing.T) {
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, &mockWriter{})
+	serializeUpdates(app)
+	app.addEntries([]types.FileEntry{
+		{Path: "main.go"},
+		{Path: "app.py"},
+		{Path: "lib/util.go"},
+		{Path: "lib/util.py"},
+		{Path: "build", Language: "go"},
+		{Path: "Makefile"},
+	})
+
+	listed := func() []string {
+		var paths []string
+		for row := 0; row < app.list.Len(); row++ {
+			entry, _ := app.list.Entry(row)
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	if !app.runCommand(":lang Go") {
+		t.Fatal("runCommand(:lang) = false, want true")
+	}
+	// Entries scanned without a language are detected from their names
+	if got, want := listed(), []string{"build", "lib/util.go", "main.go"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", got, want)
+	}
+	if title := app.fileList.GetTitle(); !strings.HasPrefix(title, "Files, in go") {
+		t.Errorf("title = %q, want the language", title)
+	}
+
+	// The language filter combines with the search
+	app.list.SetQuery("util")
+	if got, want := listed(), []string{"lib/util.go"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", got, want)
+	}
+	app.list.SetQuery("")
+
+	app.runCommand(":lang make")
+	if got, want := listed(), []string{"Makefile"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", got, want)
+	}
+
+	app.runCommand(":lang")
+	if got := listed(); len(got) != 6 {
+		t.Errorf("listed = %v after :lang, want every file", got)
+	}
+	if app.runCommand(":language go") {
+		t.Error("runCommand(:language) = true, want false")
+	}
+}
+
+func TestIgnorePattern(t *testing.T) {
+	writer := &mockWriter{}
+	app := New(config.DefaultConfig(), &mockScanner{}, &mockProcessor{}, writer)
+	serializeUpdates(app)
+	app.addEntries([]types.FileEntry{
+		{Path: "main.go"},
+		{Path: "vendor/lib/x.go"},
+		{Path: "vendor/y.go"},
+		{Path: "docs/guide.md"},
+	})
+	app.toggleSelection(app.list.Row("vendor/y.go"))
+	app.wg.Wait()
+
+	listed := func() []string {
+		var paths []string
+		for _, entry := range app.list.Entries() {
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	// A pattern matching a directory drops every file under it, and the
+	// selected ones leave the output
+	if !app.runCommand(":ignore vendor") {
+		t.Fatal("runCommand(:ignore) = false, want true")
+	}
+	if want := []string{"main.go", "docs/guide.md"}; fmt.Sprint(listed()) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", listed(), want)
+	}
+	if fmt.Sprint(writer.removed) != "[vendor/y.go]" {
+		t.Errorf("removed from output = %v, want [vendor/y.go]", writer.removed)
+	}
+	if got := app.status.GetText(true); got != "Ignoring vendor: removed 2 files, 1 of them selected" {
+		t.Errorf("status = %q", got)
+	}
+
+	// Files the scan delivers later are dropped too
+	app.addEntries([]types.FileEntry{{Path: "vendor/z.go"}, {Path: "cmd/main.go"}})
+	if want := []string{"main.go", "docs/guide.md", "cmd/main.go"}; fmt.Sprint(listed()) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", listed(), want)
+	}
+
+	// :ignore! also adds the pattern to the config file, keeping its other
+	// settings
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"ui": {"theme": "dark"}}`), 0o644); err != nil {
+		t.Fatalf("Failed to create config: %v", err)
+	}
+	app.SetConfigPath(configPath)
+	app.runCommand(":ignore! docs")
+	if want := []string{"main.go", "cmd/main.go"}; fmt.Sprint(listed()) != fmt.Sprint(want) {
+		t.Errorf("listed = %v, want %v", listed(), want)
+	}
+	saved, err := config.LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	patterns := saved.Scanner.IgnorePatterns
+	if len(patterns) != len(config.DefaultConfig().Scanner.IgnorePatterns)+1 || patterns[len(patterns)-1] != "docs" {
+		t.Errorf("saved ignorePatterns = %v, want the defaults and docs", patterns)
+	}
+	if saved.UI.Theme != "dark" {
+		t.Errorf("saved theme = %q, want dark", saved.UI.Theme)
+	}
+
+	if !app.runCommand(":ignore [") || !strings.HasPrefix(app.status.GetText(true), "Invalid pattern [") {
+		t.Errorf("status = %q, want the invalid pattern reported", app.status.GetText(true))
+	}
+}
@@ -2,42 +2,83 @@ package app
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/lc/pfzf/internal/processor"
+	"github.com/lc/pfzf/internal/writer"
 	"github.com/lc/pfzf/pkg/types"
-	"github.com/sahilm/fuzzy"
 )
 
 const (
-	previewChunkSize = 16 * 1024 // 16KB chunks
-	previewMaxLines  = 1000      // Maximum lines to show
-	previewContext   = 5         // Context lines around search
+	previewChunkSize = 16 * 1024  // 16KB chunks; longer lines are split
+	previewMaxLines  = 1000       // Maximum lines to show
+	previewContext   = 5          // Context lines around search
+	previewTailBytes = 256 * 1024 // How much of a file's end is read to show it
+	previewColumns   = 8          // Columns scrolled by ←/→ without wrapping
 )
 
 func (a *App) startScanning() error {
 	scanOpts := types.ScanOptions{
-		RootDir:       ".",
-		IgnorePattern: a.config.Scanner.IgnorePatterns,
-		MaxFileSize:   a.config.Scanner.MaxFileSize,
-		MaxFiles:      a.config.Scanner.MaxFiles,
+		RootDir:             ".",
+		IgnorePattern:       a.config.Scanner.IgnorePatterns,
+		MaxFileSize:         a.config.Scanner.MaxFileSize,
+		MinFileSize:         a.config.Scanner.MinFileSize,
+		MaxFiles:            a.config.Scanner.MaxFiles,
+		ResultBuffer:        a.config.Scanner.ResultBuffer,
+		MaxInvalidUTF8:      a.config.Scanner.MaxInvalidUTF8,
+		BinarySampleSize:    a.config.Scanner.BinarySampleSize,
+		BinaryThreshold:     a.config.Scanner.BinaryThreshold,
+		ExcludeContentTypes: a.config.Scanner.ExcludeContentTypes,
+		Timeout:             a.config.Scanner.ScanTimeout(),
 	}
 
 	filesChan, errChan := a.scanner.Scan(scanOpts)
+	interval := time.Duration(a.config.UI.ScanRefreshMs) * time.Millisecond
 
-	// Handle incoming files
+	// Handle incoming files. Entries are added in batches at most every
+	// interval, since rebuilding the list for each of thousands of files
+	// floods the event loop.
+	a.wg.Add(1)
 	go func() {
+		defer a.wg.Done()
+		var pending []types.FileEntry
+		var tick <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
 		for {
 			select {
 			case entry, ok := <-filesChan:
 				if !ok {
+					a.addEntries(pending)
+					a.mu.Lock()
+					a.scanDone = true
+					a.mu.Unlock()
+					a.finishRestore()
 					return
 				}
-				a.addEntry(entry)
-			case err := <-errChan:
+				pending = append(pending, entry)
+				if interval <= 0 {
+					a.addEntries(pending)
+					pending = nil
+				}
+			case <-tick:
+				a.addEntries(pending)
+				pending = nil
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
 				if err != nil {
 					a.updateStatus(fmt.Sprintf("Error scanning: %v", err))
 				}
@@ -50,62 +91,66 @@ func (a *App) startScanning() error {
 	return nil
 }
 
-func (a *App) addEntry(entry types.FileEntry) {
+// addEntries appends entries to the list and redraws it once.
+func (a *App) addEntries(entries []types.FileEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
 	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.list.Add(a.withoutIgnored(entries)...)
+	a.mu.Unlock()
+	a.applyRestore()
 
-	a.entries = append(a.entries, entry)
-	a.QueueUpdateDraw(func() {
+	// Never hold a.mu while waiting on the event loop; its handlers take it too
+	a.queueUpdateDraw(func() {
 		a.updateFileList()
 	})
 }
 
-func (a *App) toggleSelection(idx int) {
-	if idx < 0 || idx >= len(a.entries) {
-		return
-	}
-
-	a.mu.Lock()
+// toggleSelection toggles the entry displayed at row of the file list.
+func (a *App) toggleSelection(row int) {
 	currentItem := a.fileList.GetCurrentItem()
-	entry := a.entries[idx]
-	entry.IsSelected = !entry.IsSelected
-	a.entries[idx] = entry
+	a.mu.Lock()
+	entry, ok := a.list.Toggle(row)
 	a.mu.Unlock()
+	if !ok {
+		return
+	}
 
 	if entry.IsSelected {
-		go a.processAndWriteEntry(entry)
+		a.startProcessing(entry)
 	} else {
 		// Remove from writer when deselected
 		a.writer.Remove(entry.Path)
+		a.forget(entry.Path)
 	}
 
 	a.updateFileListPreserveSelection(currentItem)
 }
 
-// updateFileListPreserveSelection updates the list while preserving selection
-func (a *App) updateFileListPreserveSelection(currentItem int) {
-	a.fileList.Clear()
-	a.filteredIdx = make([]int, 0)
-
-	if a.searchString == "" {
-		// Show all entries
-		for i, entry := range a.entries {
-			a.filteredIdx = append(a.filteredIdx, i)
-			a.fileList.AddItem(a.formatListItem(entry), "", 0, nil)
-		}
-	} else {
-		// Perform fuzzy search
-		patterns := make([]string, len(a.entries))
-		for i, entry := range a.entries {
-			patterns[i] = entry.Path
-		}
+// invertSelection selects the listed files that aren't selected and
+// deselects the rest, so "everything but these" is a selection and a key
+// press away. Files hidden by the search or a filter are left alone.
+func (a *App) invertSelection() {
+	currentItem := a.fileList.GetCurrentItem()
+	a.mu.Lock()
+	selected, deselected := a.list.Invert()
+	a.mu.Unlock()
 
-		matches := fuzzy.Find(a.searchString, patterns)
-		for _, match := range matches {
-			a.filteredIdx = append(a.filteredIdx, match.Index)
-			a.fileList.AddItem(a.formatListItem(a.entries[match.Index]), "", 0, nil)
-		}
+	for _, entry := range deselected {
+		a.writer.Remove(entry.Path)
+		a.forget(entry.Path)
 	}
+	a.startProcessingAll(selected)
+
+	a.updateFileListPreserveSelection(currentItem)
+	a.status.SetText(fmt.Sprintf("Inverted the selection: %d selected, %d deselected", len(selected), len(deselected)))
+}
+
+// updateFileListPreserveSelection updates the list while preserving selection
+func (a *App) updateFileListPreserveSelection(currentItem int) {
+	a.updateFileList()
 
 	// Restore the selection
 	if currentItem >= 0 && currentItem < a.fileList.GetItemCount() {
@@ -113,114 +158,257 @@ func (a *App) updateFileListPreserveSelection(currentItem int) {
 	}
 }
 
-func (a *App) processAndWriteEntry(entry types.FileEntry) {
-	processed, err := a.processor.Process(entry)
-	if err != nil {
-		a.updateStatus(fmt.Sprintf("Error processing %s: %v", entry.Path, err))
+// processResult carries the outcome of processing a single entry.
+type processResult struct {
+	content types.ProcessedContent
+	err     error
+}
+
+// processAndWriteEntry processes entry and buffers it in the writer. The
+// processor observes ctx, and this returns as soon as ctx is cancelled
+// rather than waiting for the processor to notice.
+func (a *App) processAndWriteEntry(ctx context.Context, entry types.FileEntry) {
+	done := make(chan processResult, 1)
+	go func() {
+		processed, err := a.processor.ProcessContext(ctx, entry)
+		done <- processResult{content: processed, err: err}
+	}()
+
+	var result processResult
+	select {
+	case result = <-done:
+	case <-ctx.Done():
 		return
 	}
 
-	if err := a.writer.Write(processed); err != nil {
-		a.updateStatus(fmt.Sprintf("Error writing %s: %v", entry.Path, err))
+	if result.err != nil {
+		a.deselect(entry.Path)
+		if errors.Is(result.err, processor.ErrSensitive) {
+			a.updateStatus(fmt.Sprintf("Not selecting %s: %v", entry.Path, result.err))
+			return
+		}
+		a.updateStatus(fmt.Sprintf("Error processing %s: %v", entry.Path, result.err))
 		return
 	}
 
+	// Don't add content once shutdown has started
+	if ctx.Err() != nil {
+		return
+	}
+
+	// The file is written under the lock, so it can't be deselected between
+	// the check and the write; a deselection removes it from the writer
+	// once it takes the lock. It is counted before it is written, so files
+	// processed at once can't overrun the token budget together.
+	budget := a.config.UI.TokenBudget
+	a.mu.Lock()
+	if !a.list.Selected(entry.Path) {
+		a.mu.Unlock()
+		return
+	}
+	if !a.totals.fits(result.content, budget) {
+		used := a.totals.tokens
+		a.mu.Unlock()
+		a.deselect(entry.Path)
+		a.updateStatus(fmt.Sprintf("Not selecting %s: its %s tokens would exceed the %s token budget (%s used)",
+			entry.Path, formatCount(writer.FileTokens(result.content)), formatCount(budget), formatCount(used)))
+		return
+	}
+	a.totals.add(result.content)
+	err := a.writer.Write(result.content)
+	a.mu.Unlock()
+
+	if err != nil {
+		a.forget(entry.Path)
+		a.deselect(entry.Path)
+		a.updateStatus(fmt.Sprintf("Error writing %s: %v", entry.Path, err))
+		return
+	}
+	a.updateTotals()
 	a.updateStatus(fmt.Sprintf("Added %s to context", entry.Path))
 }
 
-func (a *App) updateStatus(msg string) {
-	a.QueueUpdateDraw(func() {
-		a.status.SetText(msg)
+// forget stops counting the file at path in the selection totals.
+func (a *App) forget(path string) {
+	a.mu.Lock()
+	a.totals.remove(path)
+	a.mu.Unlock()
+	a.updateTotals()
+}
+
+// deselect clears the selection of the entry at path after it failed to make
+// it into the output, so the list never shows a file that isn't written.
+func (a *App) deselect(path string) {
+	a.mu.Lock()
+	a.list.Deselect(path)
+	a.mu.Unlock()
+
+	a.queueUpdateDraw(func() {
+		a.updateFileListPreserveSelection(a.fileList.GetCurrentItem())
 	})
 }
 
-// handleSearch processes search input and updates the UI accordingly
-func (a *App) handleSearch(text string) {
+// deselectDir clears the selection of every entry under dir and removes them
+// from the writer, returning how many were deselected. Entries outside dir
+// keep their selection.
+func (a *App) deselectDir(dir string) int {
 	a.mu.Lock()
-	a.searchString = text
+	removed := a.list.DeselectUnder(dir)
 	a.mu.Unlock()
 
-	// Clear filtered indices
-	a.filteredIdx = a.filteredIdx[:0]
+	for _, path := range removed {
+		a.writer.Remove(path)
+		a.forget(path)
+	}
+	return len(removed)
+}
+
+// updateStatus sets the status bar text from any goroutine.
+func (a *App) updateStatus(msg string) {
+	if a.ctx.Err() != nil {
+		return
+	}
 
-	if text == "" {
-		// If search is empty, show all files
-		a.filteredIdx = make([]int, len(a.entries))
-		for i := range a.entries {
-			a.filteredIdx[i] = i
+	a.queueUpdateDraw(func() {
+		a.status.SetText(msg)
+	})
+}
+
+// searchChanged filters the list for text once typing pauses for the
+// configured debounce. Each keystroke supersedes the filter the previous one
+// scheduled, so only the last one is applied.
+func (a *App) searchChanged(text string) {
+	a.searchGen++
+	if a.searchTimer != nil {
+		a.searchTimer.Stop()
+		a.searchTimer = nil
+	}
+
+	delay := time.Duration(a.config.UI.SearchDebounceMs) * time.Millisecond
+	if delay <= 0 {
+		a.handleSearch(text)
+		return
+	}
+	gen := a.searchGen
+	a.searchTimer = time.AfterFunc(delay, func() {
+		if a.ctx.Err() != nil {
+			return
 		}
-	} else {
-		// Filter files based on search
-		for i, entry := range a.entries {
-			if strings.Contains(strings.ToLower(entry.Path), strings.ToLower(text)) {
-				a.filteredIdx = append(a.filteredIdx, i)
+		a.queueUpdateDraw(func() {
+			// A newer keystroke or enter has already taken over
+			if gen != a.searchGen || a.searchTimer == nil {
+				return
 			}
-		}
+			a.searchTimer = nil
+			a.handleSearch(text)
+		})
+	})
+}
+
+// flushSearch applies a pending debounced search at once, so acting on the
+// list right after typing sees the final query.
+func (a *App) flushSearch() {
+	if a.searchTimer == nil {
+		return
 	}
+	a.searchTimer.Stop()
+	a.searchTimer = nil
+	a.searchGen++
+	a.handleSearch(a.search.GetText())
+}
+
+// handleSearch processes search input and updates the UI accordingly
+func (a *App) handleSearch(text string) {
+	a.mu.Lock()
+	a.list.SetQuery(text)
+	matches := a.list.Len()
+	a.mu.Unlock()
 
-	// Update UI
 	a.updateFileList()
 
 	// Clear preview if no matches
-	if len(a.filteredIdx) == 0 {
+	if matches == 0 {
 		a.preview.Clear()
 		a.status.SetText("No matches found")
 		return
 	}
 
-	// Update preview for first match if any exist
-	if len(a.filteredIdx) > 0 {
-		a.handleSelection(0)
-	}
+	// Update preview for first match
+	a.handleSelection(0)
 }
 
+// updateFileList renders the view-model's rows into the file list.
 func (a *App) updateFileList() {
-	a.fileList.Clear()
-	a.filteredIdx = make([]int, 0)
-
-	if a.searchString == "" {
-		// Show all entries
-		for i, entry := range a.entries {
-			a.filteredIdx = append(a.filteredIdx, i)
-			a.fileList.AddItem(a.formatListItem(entry), "", 0, nil)
-		}
-		return
-	}
-
-	// Perform fuzzy search
-	patterns := make([]string, len(a.entries))
-	for i, entry := range a.entries {
-		patterns[i] = entry.Path
-	}
+	a.mu.Lock()
+	labels := a.list.Labels()
+	a.mu.Unlock()
 
-	matches := fuzzy.Find(a.searchString, patterns)
-	for _, match := range matches {
-		a.filteredIdx = append(a.filteredIdx, match.Index)
-		a.fileList.AddItem(a.formatListItem(a.entries[match.Index]), "", 0, nil)
+	a.fileList.Clear()
+	for _, label := range labels {
+		a.fileList.AddItem(label, "", 0, nil)
 	}
 }
 
-func (a *App) formatListItem(entry types.FileEntry) string {
-	prefix := map[bool]string{true: "[x]", false: "[ ]"}[entry.IsSelected]
-	return fmt.Sprintf("%s %s", prefix, entry.Path)
-}
-
 func (a *App) handleSelection(index int) {
-	if index >= 0 && index < len(a.filteredIdx) {
-		entry := a.entries[a.filteredIdx[index]]
+	a.mu.Lock()
+	entry, ok := a.list.Entry(index)
+	a.mu.Unlock()
+	if ok {
 		a.showPreview(entry)
 	}
 }
 
+// query returns the current search query from any goroutine.
+func (a *App) query() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.list.Query()
+}
+
 // PreviewState tracks preview pane state
 type PreviewState struct {
-	filename    string
-	offset      int64
+	filename string
+	entry    types.FileEntry
+	// offset is the byte the preview's window of lines starts at, just
+	// past the line break at or after it; line numbers are only known at 0
+	offset int64
+	// tail marks a window showing the end of the file
+	tail bool
+	// truncated marks a window that ends before the end of the file
+	truncated   bool
 	lines       []string
 	currentLine int
 	totalLines  int
 	searchMatch []int
 	isDirty     bool
+	// symbols are the file's top-level declarations, once fully loaded
+	symbols []types.Symbol
+	// gitStatus is the file's status in its repository, for the header;
+	// it is set before the preview is first shown
+	gitStatus string
+	// hex marks a binary file's hex dump, whose lines carry their offsets
+	// instead of line numbers
+	hex bool
+}
+
+// numbered reports whether the preview's lines are numbered: a text
+// preview reading the file from the start. Hex dumps carry offsets instead,
+// and the line numbers of a window further into the file aren't known.
+func (s *PreviewState) numbered() bool {
+	return !s.hex && s.offset == 0 && !s.tail
+}
+
+// enclosingSymbol describes the declaration containing the current line, or
+// returns "" outside of any.
+func (s *PreviewState) enclosingSymbol() string {
+	symbol, ok := processor.EnclosingSymbol(s.symbols, s.currentLine+1)
+	if !ok {
+		return ""
+	}
+	if symbol.Type == symbol.Name {
+		return symbol.Name
+	}
+	return symbol.Type + " " + symbol.Name
 }
 
 // previewBuffer manages the preview content
@@ -263,75 +451,242 @@ func (pb *previewBuffer) clear() {
 	pb.size = 0
 }
 
+// showPreview shows entry in the preview, loading it in the background. Only
+// the latest preview matters: one still loading is cancelled, and updates it
+// already queued are dropped since its state is no longer a.previewState.
 func (a *App) showPreview(entry types.FileEntry) {
-	if entry.IsBinary {
-		a.preview.SetText("Binary file - preview not available")
-		return
+	a.mu.Lock()
+	if a.previewCancel != nil {
+		a.previewCancel()
+		a.previewCancel = nil
 	}
+	a.mu.Unlock()
+
+	a.clearPreviewImage()
+	a.previewState = nil
+	isImage := a.previewImageFile(entry)
 
 	// Create new preview state
-	state := &PreviewState{
+	a.startPreview(&PreviewState{
 		filename: entry.Path,
+		entry:    entry,
 		isDirty:  true,
+		hex:      entry.IsBinary && !isImage,
+	}, isImage)
+}
+
+// startPreview makes state the preview's state and loads it in the
+// background, cancelling the preview it replaces.
+func (a *App) startPreview(state *PreviewState, isImage bool) {
+	a.mu.Lock()
+	if a.previewCancel != nil {
+		a.previewCancel()
+		a.previewCancel = nil
 	}
+	a.mu.Unlock()
+	// Another file starts at its first column
+	if a.previewState == nil || a.previewState.filename != state.filename {
+		a.previewColumn = 0
+	}
+	a.previewState = state
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	a.mu.Lock()
+	a.previewCancel = cancel
+	a.mu.Unlock()
 
 	// Start preview in background
-	go a.loadPreview(state)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer cancel()
+		switch {
+		case isImage:
+			a.loadPreviewImage(ctx, state)
+		case state.hex:
+			a.loadHexPreview(ctx, state)
+		default:
+			a.loadPreview(ctx, state)
+		}
+	}()
 }
 
-func (a *App) loadPreview(state *PreviewState) {
-	f, err := os.Open(state.filename)
+// loadPreview reads the file for state into the preview. At most
+// previewSem's capacity of files are open at once; previews cancelled while
+// waiting never open their file.
+func (a *App) loadPreview(ctx context.Context, state *PreviewState) {
+	select {
+	case a.previewSem <- struct{}{}:
+		defer func() { <-a.previewSem }()
+	case <-ctx.Done():
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	a.loadGitStatus(state)
+
+	f, err := a.openFile(state.filename)
 	if err != nil {
-		a.QueueUpdateDraw(func() {
-			a.preview.SetText(fmt.Sprintf("Error opening file: %v", err))
+		a.queueUpdateDraw(func() {
+			if a.previewState == state {
+				a.preview.SetText(fmt.Sprintf("Error opening file: %v", err))
+			}
 		})
 		return
 	}
 	defer f.Close()
 
 	buffer := newPreviewBuffer()
-	reader := bufio.NewReader(f)
+	reader := bufio.NewReaderSize(f, previewChunkSize)
+	if state.offset > 0 {
+		if err := skipTo(f, reader, state.offset); err != nil {
+			a.queueUpdateDraw(func() {
+				if a.previewState == state {
+					a.preview.SetText(fmt.Sprintf("Error reading file: %v", err))
+				}
+			})
+			return
+		}
+	}
 	lineCount := 0
 
-	// Read file in chunks
-	for lineCount < previewMaxLines {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			a.QueueUpdateDraw(func() {
-				a.preview.SetText(fmt.Sprintf("Error reading file: %v", err))
-			})
+	// Read file in chunks. The end of a file is read to the end, keeping
+	// the last lines.
+	eof := false
+	for state.tail || lineCount < previewMaxLines {
+		if ctx.Err() != nil {
 			return
 		}
 
-		buffer.append([]string{strings.TrimRight(line, "\n")})
-		lineCount++
+		line, err := readPreviewLine(reader)
+		if err != nil && err != io.EOF {
+			a.queueUpdateDraw(func() {
+				if a.previewState == state {
+					a.preview.SetText(fmt.Sprintf("Error reading file: %v", err))
+				}
+			})
+			return
+		}
+		if line != "" || err == nil {
+			buffer.append([]string{line})
+			lineCount++
+		}
+		if err == io.EOF {
+			eof = true
+			break
+		}
 
 		// Update preview periodically
-		if lineCount%100 == 0 {
-			a.updatePreviewContent(buffer.get(), state)
+		if lineCount%100 == 0 && !state.tail {
+			a.updatePreviewContent(buffer.get(), nil, state)
+		}
+	}
+	if !eof {
+		// Peek so a window ending with the file isn't taken as truncated
+		if _, err := reader.Peek(1); err == nil {
+			a.queueUpdateDraw(func() { state.truncated = true })
 		}
 	}
 
 	// Final update
-	a.updatePreviewContent(buffer.get(), state)
+	if ctx.Err() == nil {
+		lines := buffer.get()
+		var symbols []types.Symbol
+		if state.numbered() {
+			symbols = a.previewSymbols(state.filename, lines)
+		}
+		if symbols == nil {
+			// Non-nil marks the file as fully loaded
+			symbols = []types.Symbol{}
+		}
+		a.updatePreviewContent(lines, symbols, state)
+	}
 }
 
-func (a *App) updatePreviewContent(lines []string, state *PreviewState) {
-	state.lines = lines
-	state.totalLines = len(lines)
+// readPreviewLine reads the next line from reader without its line break.
+// Lines longer than the reader's buffer are returned in pieces, so a huge
+// single-line file isn't buffered whole.
+func readPreviewLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return strings.TrimRight(string(line), "\r\n"), err
+}
 
-	// Find search matches if search is active
-	if a.searchString != "" {
-		state.searchMatch = a.findSearchMatches(lines, a.searchString)
-		if len(state.searchMatch) > 0 && state.currentLine == 0 {
-			state.currentLine = state.searchMatch[0]
+// skipTo moves reader, which reads f, to the start of the first line at or
+// after offset. f is seeked when it can be and read up to offset otherwise.
+func skipTo(f io.Reader, reader *bufio.Reader, offset int64) error {
+	if seeker, ok := f.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset-1, io.SeekStart); err != nil {
+			return err
 		}
+		reader.Reset(f)
+	} else if _, err := reader.Discard(int(offset - 1)); err != nil && err != io.EOF {
+		return err
+	}
+	// The byte before offset tells whether offset starts a line
+	if _, err := reader.ReadSlice('\n'); err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// languageDetector detects the language of a previewed file.
+type languageDetector interface {
+	DetectLanguage(filename string, reader io.Reader) (string, error)
+}
+
+// newLanguageDetector returns the processor's language detector, or nil if
+// it cannot be created, in which case previews omit the enclosing symbol.
+func newLanguageDetector() languageDetector {
+	detector, err := processor.NewLanguageDetector()
+	if err != nil {
+		return nil
+	}
+	return detector
+}
+
+// previewSymbols extracts the top-level declarations of a previewed file.
+func (a *App) previewSymbols(filename string, lines []string) []types.Symbol {
+	if a.languages == nil || len(lines) == 0 {
+		return nil
+	}
+	content := strings.Join(lines, "\n")
+	language, err := a.languages.DetectLanguage(filename, strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	return processor.ExtractSymbols([]byte(content), language)
+}
+
+// updatePreviewContent shows the lines read so far for state, and the
+// file's symbols once it is fully read. The state is only changed on the
+// event loop, where scrolling changes it too, and a preview replaced in the
+// meantime is left alone.
+func (a *App) updatePreviewContent(lines []string, symbols []types.Symbol, state *PreviewState) {
+	// Find search matches if search is active
+	var matches []int
+	if query := a.query(); query != "" {
+		matches = a.findSearchMatches(lines, query)
 	}
 
-	a.QueueUpdateDraw(func() {
+	a.queueUpdateDraw(func() {
+		if a.previewState != state {
+			return
+		}
+		state.lines = lines
+		state.totalLines = len(lines)
+		state.searchMatch = matches
+		if symbols != nil {
+			state.symbols = symbols
+		}
+		if state.tail {
+			state.currentLine = len(lines) - 1
+		} else if len(matches) > 0 && state.currentLine == 0 {
+			state.currentLine = matches[0]
+		}
 		a.renderPreview(state)
 		a.updatePreviewStatus(state)
 	})
@@ -345,11 +700,14 @@ func (a *App) renderPreview(state *PreviewState) {
 	start := max(0, state.currentLine-previewContext)
 	end := min(visibleLines, start+previewMaxLines)
 
-	// Add file info header
-	fmt.Fprintf(&preview, "[yellow]%s (%d/%d lines)[white]\n",
-		state.filename, visibleLines, state.totalLines)
+	if a.header.enabled() {
+		info := a.headerInfo(state)
+		info.shownLines = visibleLines
+		preview.WriteString(a.header.render(info) + "\n")
+	}
 
 	// Render visible lines
+	query := strings.ToLower(a.query())
 	for i := start; i < end; i++ {
 		line := state.lines[i]
 
@@ -360,12 +718,14 @@ func (a *App) renderPreview(state *PreviewState) {
 		}
 
 		// Highlight search matches
-		if a.searchString != "" && strings.Contains(
-			strings.ToLower(line),
-			strings.ToLower(a.searchString)) {
+		if query != "" && strings.Contains(strings.ToLower(line), query) {
 			line = fmt.Sprintf("[red]%s[white]", line)
 		}
 
+		if !state.numbered() {
+			fmt.Fprintf(&preview, "%s%s\n", prefix, line)
+			continue
+		}
 		fmt.Fprintf(&preview, "%s[dimgray]%4d[white] %s\n",
 			prefix, i+1, line)
 	}
@@ -385,6 +745,18 @@ func (a *App) updatePreviewStatus(state *PreviewState) {
 		state.totalLines,
 		len(state.searchMatch),
 	)
+	if symbol := state.enclosingSymbol(); symbol != "" {
+		status += " | in " + symbol
+	}
+	switch {
+	case state.tail:
+		status += " | end of the file"
+	case state.offset > 0 && state.entry.Size > 0:
+		status += fmt.Sprintf(" | from %d%% of the file", state.offset*100/state.entry.Size)
+	}
+	if state.truncated {
+		status += " | more below"
+	}
 	a.status.SetText(status)
 }
 
@@ -400,8 +772,152 @@ func (a *App) findSearchMatches(lines []string, search string) []int {
 	return matches
 }
 
+// scrollToTop scrolls the preview to its first line, keeping the column
+// long lines are scrolled to when they aren't wrapped.
 func (a *App) scrollToTop() {
-	a.preview.ScrollTo(0, 0)
+	a.preview.ScrollTo(0, a.previewColumn)
+}
+
+// toggleWrap switches between wrapping long lines in the preview and
+// scrolling them horizontally.
+func (a *App) toggleWrap() {
+	a.config.UI.PreviewWrap = !a.config.UI.PreviewWrap
+	a.preview.SetWrap(a.config.UI.PreviewWrap)
+	a.previewColumn = 0
+	a.scrollToTop()
+	if a.config.UI.PreviewWrap {
+		a.status.SetText("Wrapping long lines in the preview")
+		return
+	}
+	a.status.SetText("Not wrapping long lines in the preview: scroll them with ←/→ in the preview")
+}
+
+// scrollPreviewColumn scrolls the unwrapped preview by delta columns.
+func (a *App) scrollPreviewColumn(delta int) {
+	if a.config.UI.PreviewWrap {
+		return
+	}
+	// The view stops scrolling at the end of the longest line, so the
+	// column it shows is where scrolling continues from
+	_, column := a.preview.GetScrollOffset()
+	a.previewColumn = max(0, column+delta)
+	a.scrollToTop()
+}
+
+// scrollPreview moves the preview's current line by delta lines.
+func (a *App) scrollPreview(delta int) {
+	if state := a.previewState; state != nil {
+		a.setPreviewLine(state.currentLine + delta)
+	}
+}
+
+// previewPage returns how many lines of the file the preview shows at once.
+func (a *App) previewPage() int {
+	_, _, _, height := a.preview.GetInnerRect()
+	return max(1, height-a.header.lines())
+}
+
+// jumpToMatch moves the preview to the next line matching the search, or
+// the previous one, wrapping around the file.
+func (a *App) jumpToMatch(forward bool) {
+	state := a.previewState
+	if state == nil {
+		return
+	}
+	if len(state.searchMatch) == 0 {
+		a.status.SetText("No matches in the preview")
+		return
+	}
+
+	matches := state.searchMatch
+	target := matches[0]
+	if !forward {
+		target = matches[len(matches)-1]
+	}
+	for i := range matches {
+		if forward && matches[i] > state.currentLine {
+			target = matches[i]
+			break
+		}
+		if j := len(matches) - 1 - i; !forward && matches[j] < state.currentLine {
+			target = matches[j]
+			break
+		}
+	}
+	a.setPreviewLine(target)
+}
+
+// previewTop moves the preview to the first line of the file, loading the
+// start of the file if the preview shows a window further in.
+func (a *App) previewTop() {
+	if state := a.previewState; state != nil && !state.hex && !state.numbered() {
+		a.seekPreview(0, false)
+		return
+	}
+	a.setPreviewLine(0)
+}
+
+// previewBottom moves the preview to the last line of the file, loading the
+// end of the file if the preview stops short of it.
+func (a *App) previewBottom() {
+	state := a.previewState
+	if state == nil {
+		return
+	}
+	if state.truncated {
+		offset := state.entry.Size - previewTailBytes
+		if offset < 0 {
+			offset = 0
+		}
+		a.seekPreview(offset, true)
+		return
+	}
+	a.setPreviewLine(len(state.lines) - 1)
+}
+
+// seekPercent loads the preview's window of lines from percent of the way
+// through the file.
+func (a *App) seekPercent(percent int) {
+	state := a.previewState
+	if state == nil {
+		return
+	}
+	if state.entry.Size == 0 {
+		a.setPreviewLine(len(state.lines) * percent / 100)
+		return
+	}
+	a.seekPreview(state.entry.Size*int64(percent)/100, false)
+}
+
+// seekPreview replaces the text preview with the window of lines starting
+// at offset, or with the end of the file when tail is set. Only that window
+// is read, so large files can be previewed anywhere with bounded memory.
+func (a *App) seekPreview(offset int64, tail bool) {
+	state := a.previewState
+	if state == nil || state.hex || a.previewImageFile(state.entry) {
+		return
+	}
+	a.startPreview(&PreviewState{
+		filename:  state.filename,
+		entry:     state.entry,
+		offset:    offset,
+		tail:      tail,
+		isDirty:   true,
+		gitStatus: state.gitStatus,
+	}, false)
+}
+
+// setPreviewLine makes line, clamped to the file, the preview's current
+// line and re-renders the preview around it.
+func (a *App) setPreviewLine(line int) {
+	state := a.previewState
+	if state == nil || len(state.lines) == 0 {
+		return
+	}
+	state.currentLine = max(0, min(line, len(state.lines)-1))
+	a.renderPreview(state)
+	a.updatePreviewStatus(state)
+	a.scrollToTop()
 }
 
 // Helper functions
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lc/pfzf/internal/git"
+)
+
+// Preview header segments, named as in UIConfig.PreviewHeader.
+const (
+	headerPath     = "path"
+	headerLines    = "lines"
+	headerSize     = "size"
+	headerModified = "modified"
+	headerSymbols  = "symbols"
+	headerGit      = "git"
+)
+
+// defaultPreviewHeader is the header shown when the config does not set one.
+var defaultPreviewHeader = []string{headerPath, headerLines}
+
+// headerInfo is what the preview header can describe about a file.
+type headerInfo struct {
+	path string
+	// shownLines and totalLines count a text file's lines; for an image,
+	// imageWidth and imageHeight are set instead
+	shownLines, totalLines  int
+	imageWidth, imageHeight int
+	size                    int64
+	modTime                 time.Time
+	// symbols counts the file's declarations once it is fully loaded;
+	// symbolsKnown is false until then
+	symbols      int
+	symbolsKnown bool
+	// gitStatus is empty outside a repository
+	gitStatus string
+}
+
+// headerBuilder renders the preview header from the configured segments.
+// The path leads and the other segments follow in parentheses, such as
+// "main.go (120/120 lines · 3.2 KB)". Segments with nothing to show, such
+// as git outside a repository, are left out.
+type headerBuilder struct {
+	segments []string
+}
+
+// newHeaderBuilder returns a builder for segments, or for the default
+// segments when segments is nil. An empty, non-nil list disables the header.
+func newHeaderBuilder(segments []string) headerBuilder {
+	if segments == nil {
+		segments = defaultPreviewHeader
+	}
+	return headerBuilder{segments: segments}
+}
+
+// enabled reports whether the preview shows a header line.
+func (b headerBuilder) enabled() bool {
+	return len(b.segments) > 0
+}
+
+// has reports whether segment is configured.
+func (b headerBuilder) has(segment string) bool {
+	for _, s := range b.segments {
+		if s == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// lines returns how many lines the header takes in the preview.
+func (b headerBuilder) lines() int {
+	if b.enabled() {
+		return 1
+	}
+	return 0
+}
+
+// render returns the header line for info, in tview color tags and without
+// a trailing newline, or "" when the header is disabled.
+func (b headerBuilder) render(info headerInfo) string {
+	var path string
+	var details []string
+	for _, segment := range b.segments {
+		switch segment {
+		case headerPath:
+			path = info.path
+		case headerLines:
+			if info.imageWidth > 0 {
+				details = append(details, fmt.Sprintf("%dx%d image", info.imageWidth, info.imageHeight))
+			} else {
+				details = append(details, fmt.Sprintf("%d/%d lines", info.shownLines, info.totalLines))
+			}
+		case headerSize:
+			details = append(details, formatBytes(info.size))
+		case headerModified:
+			if !info.modTime.IsZero() {
+				details = append(details, info.modTime.Format("2006-01-02 15:04"))
+			}
+		case headerSymbols:
+			if info.symbolsKnown {
+				noun := "symbols"
+				if info.symbols == 1 {
+					noun = "symbol"
+				}
+				details = append(details, fmt.Sprintf("%d %s", info.symbols, noun))
+			}
+		case headerGit:
+			if info.gitStatus != "" {
+				details = append(details, info.gitStatus)
+			}
+		}
+	}
+
+	header := path
+	if len(details) > 0 {
+		joined := strings.Join(details, " · ")
+		if header == "" {
+			header = joined
+		} else {
+			header += " (" + joined + ")"
+		}
+	}
+	if header == "" {
+		return ""
+	}
+	return "[yellow]" + header + "[white]"
+}
+
+// headerInfo describes state's file for the header. The caller fills in the
+// line count or image size.
+func (a *App) headerInfo(state *PreviewState) headerInfo {
+	return headerInfo{
+		path:         state.filename,
+		totalLines:   state.totalLines,
+		size:         state.entry.Size,
+		modTime:      state.entry.ModTime,
+		symbols:      len(state.symbols),
+		symbolsKnown: state.symbols != nil,
+		gitStatus:    state.gitStatus,
+	}
+}
+
+// loadGitStatus looks up the git status of state's file when the header
+// shows it. It runs on the preview's goroutine before any update is queued.
+func (a *App) loadGitStatus(state *PreviewState) {
+	if !a.header.has(headerGit) {
+		return
+	}
+	if status, ok := git.Status(state.filename); ok {
+		state.gitStatus = string(status)
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+	"github.com/rivo/tview"
+)
+
+// hexPreviewBytes caps how much of a binary file the hex preview reads, so
+// previewing a huge file stays cheap.
+const hexPreviewBytes = 4096
+
+// loadHexPreview shows the start of the binary file for state as a hex and
+// ASCII dump, like hexdump -C. Like text previews, it waits for a slot in
+// previewSem.
+func (a *App) loadHexPreview(ctx context.Context, state *PreviewState) {
+	select {
+	case a.previewSem <- struct{}{}:
+		defer func() { <-a.previewSem }()
+	case <-ctx.Done():
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	a.loadGitStatus(state)
+
+	f, err := a.openFile(state.filename)
+	if err != nil {
+		a.queueUpdateDraw(func() {
+			if a.previewState == state {
+				a.preview.SetText(fmt.Sprintf("Error opening file: %v", err))
+			}
+		})
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, hexPreviewBytes))
+	if err != nil {
+		a.queueUpdateDraw(func() {
+			if a.previewState == state {
+				a.preview.SetText(fmt.Sprintf("Error reading file: %v", err))
+			}
+		})
+		return
+	}
+	if ctx.Err() == nil {
+		// Non-nil symbols mark the file as fully loaded
+		a.updatePreviewContent(hexDumpLines(data, state.entry.Size), []types.Symbol{}, state)
+	}
+}
+
+// hexDumpLines formats data, the start of a file of size bytes, as the lines
+// of a hex dump with offset, hex and ASCII columns. A last line notes how
+// much of a larger file is shown. The lines are escaped for the preview's
+// color tags.
+func hexDumpLines(data []byte, size int64) []string {
+	lines := strings.Split(strings.TrimSuffix(hex.Dump(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	for i, line := range lines {
+		lines[i] = tview.Escape(line)
+	}
+	if size > int64(len(data)) {
+		lines = append(lines, fmt.Sprintf("... first %d of %d bytes shown", len(data), size))
+	}
+	return lines
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/lc/pfzf/internal/config"
+	"github.com/lc/pfzf/internal/ignore"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// SetConfigPath sets the config file ignore patterns are saved to with
+// :ignore!. It must be called before Run.
+func (a *App) SetConfigPath(path string) {
+	a.configPath = path
+}
+
+// ignorePattern adds pattern to the ignore patterns and drops the listed files it matches; selected
+// ones leave the output too. Files the scan finds later are dropped as
+// they arrive. With save, the pattern is added to the config file as well.
+func (a *App) ignorePattern(pattern string, save bool) {
+	if err := ignore.Validate(pattern); err != nil {
+		a.status.SetText(fmt.Sprintf("Invalid pattern %s: %v", pattern, err))
+		return
+	}
+
+	a.mu.Lock()
+	a.ignored = append(a.ignored, pattern)
+	removed := a.list.Remove(func(entry types.FileEntry) bool {
+		return ignore.New([]string{pattern}).Ignored(entry.Path) != ""
+	})
+	a.mu.Unlock()
+	a.config.Scanner.IgnorePatterns = append(a.config.Scanner.IgnorePatterns, pattern)
+
+	deselected := 0
+	for _, entry := range removed {
+		if entry.IsSelected {
+			a.writer.Remove(entry.Path)
+			a.forget(entry.Path)
+			deselected++
+		}
+	}
+	a.updateFileListPreserveSelection(a.fileList.GetCurrentItem())
+
+	msg := fmt.Sprintf("Ignoring %s: removed %d files", pattern, len(removed))
+	if deselected > 0 {
+		msg += fmt.Sprintf(", %d of them selected", deselected)
+	}
+	if save {
+		path := a.configPath
+		if path == "" {
+			path = config.GetConfigPath()
+		}
+		if err := config.AddIgnorePattern(path, pattern); err != nil {
+			msg += fmt.Sprintf("; saving it: %v", err)
+		} else {
+			msg += "; saved to " + path
+		}
+	}
+	a.status.SetText(msg)
+}
+
+// withoutIgnored returns entries without those matching a pattern added
+// with :ignore. a.mu must be held.
+func (a *App) withoutIgnored(entries []types.FileEntry) []types.FileEntry {
+	if len(a.ignored) == 0 {
+		return entries
+	}
+	ignored := ignore.New(a.ignored)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if ignored.Ignored(entry.Path) == "" {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
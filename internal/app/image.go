@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/lc/pfzf/internal/termimg"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// previewImageFile reports whether entry is shown as an image rather than
+// as text.
+func (a *App) previewImageFile(entry types.FileEntry) bool {
+	return a.imageProtocol != termimg.ProtocolNone && termimg.IsImage(entry.Path)
+}
+
+// loadPreviewImage decodes the image at state's file and shows it in the
+// preview. Like text previews, it waits for a slot in previewSem.
+func (a *App) loadPreviewImage(ctx context.Context, state *PreviewState) {
+	select {
+	case a.previewSem <- struct{}{}:
+		defer func() { <-a.previewSem }()
+	case <-ctx.Done():
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	a.loadGitStatus(state)
+
+	f, err := a.openFile(state.filename)
+	if err != nil {
+		a.queueUpdateDraw(func() {
+			if a.previewState == state {
+				a.preview.SetText(fmt.Sprintf("Error opening file: %v", err))
+			}
+		})
+		return
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	a.queueUpdateDraw(func() {
+		// A newer preview may have replaced this one meanwhile
+		if a.previewState != state {
+			return
+		}
+		if err != nil {
+			a.preview.SetText(fmt.Sprintf("Binary file - cannot decode image: %v", err))
+			return
+		}
+		info := a.headerInfo(state)
+		size := img.Bounds().Size()
+		info.imageWidth, info.imageHeight = size.X, size.Y
+		a.preview.SetText(a.header.render(info))
+		a.previewImg = img
+		a.imageDirty = true
+	})
+}
+
+// clearPreviewImage removes the image from the preview; it is erased from
+// the terminal on the next draw. It must run on the event loop.
+func (a *App) clearPreviewImage() {
+	if a.previewImg != nil {
+		a.previewImg = nil
+		a.imageDirty = true
+	}
+}
+
+// imageArea returns the cells the preview image is drawn in, below the
+// preview's header, or an empty rectangle when no image is visible.
+func (a *App) imageArea() image.Rectangle {
+	if a.previewImg == nil || a.previewHidden || a.overlayOpen {
+		return image.Rectangle{}
+	}
+	x, y, width, height := a.preview.GetInnerRect()
+	y, height = y+a.header.lines(), height-a.header.lines()
+	if width <= 0 || height <= 0 {
+		return image.Rectangle{}
+	}
+	return image.Rect(x, y, x+width, y+height)
+}
+
+// drawPreviewImage draws the preview image straight to the terminal after
+// tview has drawn the screen. The image's cells are locked so tcell doesn't
+// paint over it, and unlocked again once it is erased.
+func (a *App) drawPreviewImage(screen tcell.Screen) {
+	area := a.imageArea()
+	if !a.imageDirty && area == a.imageDrawn {
+		return
+	}
+	a.imageDirty = false
+
+	tty, ok := screen.Tty()
+	if !ok {
+		return
+	}
+	if !a.imageDrawn.Empty() {
+		old := a.imageDrawn
+		screen.LockRegion(old.Min.X, old.Min.Y, old.Dx(), old.Dy(), false)
+		if a.imageProtocol == termimg.ProtocolKitty {
+			io.WriteString(tty, termimg.KittyDelete)
+		}
+		a.imageDrawn = image.Rectangle{}
+	}
+	if area.Empty() {
+		return
+	}
+	if err := a.writePreviewImage(tty, area); err != nil {
+		a.status.SetText(fmt.Sprintf("Image preview: %v", err))
+		return
+	}
+	screen.LockRegion(area.Min.X, area.Min.Y, area.Dx(), area.Dy(), true)
+	a.imageDrawn = area
+}
+
+// writePreviewImage writes the preview image, encoded for the terminal, to
+// fit area. The cursor is moved to the area's corner and restored after.
+func (a *App) writePreviewImage(w io.Writer, area image.Rectangle) error {
+	data, err := termimg.Encode(a.imageProtocol, a.previewImg, area.Dx(), area.Dy())
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "\x1b7\x1b[%d;%dH%s\x1b8", area.Min.Y+1, area.Min.X+1, data); err != nil {
+		return fmt.Errorf("writing image: %w", err)
+	}
+	return nil
+}
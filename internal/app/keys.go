@@ -0,0 +1,259 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/lc/pfzf/internal/config"
+)
+
+// Actions that keys can be bound to in the keyBindings config.
+const (
+	actionQuit             = "quit"
+	actionSelect           = "select"
+	actionTogglePreview    = "toggle_preview"
+	actionHelp             = "help"
+	actionFocusSearch      = "focus_search"
+	actionClearSearch      = "clear_search"
+	actionOutputPreview    = "output_preview"
+	actionMoveUp           = "move_up"
+	actionMoveDown         = "move_down"
+	actionFilterSelection  = "filter_selection"
+	actionFocusPreview     = "focus_preview"
+	actionPreviewPageUp    = "preview_page_up"
+	actionPreviewPageDown  = "preview_page_down"
+	actionPreviewTop       = "preview_top"
+	actionPreviewBottom    = "preview_bottom"
+	actionNextMatch        = "next_match"
+	actionPrevMatch        = "prev_match"
+	actionCopyPath         = "copy_path"
+	actionCopyOutput       = "copy_output"
+	actionRestoreSelection = "restore_selection"
+	actionSort             = "sort"
+	actionIgnorePattern    = "ignore_pattern"
+	actionInvertSelection  = "invert_selection"
+	actionCopyOutputPath   = "copy_output_path"
+	actionOpenOutput       = "open_output"
+	actionToggleWrap       = "toggle_wrap"
+)
+
+// actionDescriptions describes each action in the help overlay, in the
+// order shown.
+var actionDescriptions = []struct {
+	action, description string
+}{
+	{actionSelect, "Select or deselect the file"},
+	{actionInvertSelection, "Select the listed files that aren't selected and deselect the rest"},
+	{actionMoveDown, "Move down"},
+	{actionMoveUp, "Move up"},
+	{actionFocusSearch, "Focus the search"},
+	{actionClearSearch, "Clear the search"},
+	{actionCopyPath, "Copy the file's path to the clipboard"},
+	{actionCopyOutput, "Copy the output to the clipboard"},
+	{actionCopyOutputPath, "Write the output and copy its path to the clipboard"},
+	{actionOpenOutput, "Write the output and open it"},
+	{actionIgnorePattern, "Ignore the files matching a pattern"},
+	{actionFilterSelection, "Show all, only selected or only unselected files"},
+	{actionSort, "Sort files by path, size, modification time or scan order"},
+	{actionRestoreSelection, "Restore the selection from the last run"},
+	{actionTogglePreview, "Show or hide the preview"},
+	{actionFocusPreview, "Move between the file list and the preview"},
+	{actionToggleWrap, "Wrap long lines in the preview, or scroll them with ←/→"},
+	{actionPreviewPageDown, "Scroll the preview down a page"},
+	{actionPreviewPageUp, "Scroll the preview up a page"},
+	{actionPreviewTop, "Go to the top of the preview"},
+	{actionPreviewBottom, "Go to the bottom of the preview"},
+	{actionNextMatch, "Go to the next search match in the preview"},
+	{actionPrevMatch, "Go to the previous search match in the preview"},
+	{actionOutputPreview, "Show the output as it would be written"},
+	{actionHelp, "Show or hide this help"},
+	{actionQuit, "Write the output and quit"},
+}
+
+// key is a key press: a special key, or a character when code is KeyRune.
+type key struct {
+	code tcell.Key
+	r    rune
+}
+
+// namedKeys maps the names used in keyBindings to special keys. The first
+// name of each key is used to display it.
+var namedKeys = []struct {
+	name string
+	code tcell.Key
+}{
+	{"esc", tcell.KeyEscape},
+	{"escape", tcell.KeyEscape},
+	{"enter", tcell.KeyEnter},
+	{"return", tcell.KeyEnter},
+	{"tab", tcell.KeyTab},
+	{"backspace", tcell.KeyBackspace2},
+	{"delete", tcell.KeyDelete},
+	{"up", tcell.KeyUp},
+	{"down", tcell.KeyDown},
+	{"left", tcell.KeyLeft},
+	{"right", tcell.KeyRight},
+	{"pgup", tcell.KeyPgUp},
+	{"pgdn", tcell.KeyPgDn},
+	{"home", tcell.KeyHome},
+	{"end", tcell.KeyEnd},
+}
+
+// parseKey parses a key name from the keyBindings config: a single
+// character such as "q" or "/", "space", "ctrl-x", or a special key name
+// such as "esc" or "down".
+func parseKey(name string) (key, error) {
+	if utf8.RuneCountInString(name) == 1 {
+		r, _ := utf8.DecodeRuneInString(name)
+		return key{code: tcell.KeyRune, r: r}, nil
+	}
+
+	lower := strings.ToLower(name)
+	if lower == "space" {
+		return key{code: tcell.KeyRune, r: ' '}, nil
+	}
+	for _, named := range namedKeys {
+		if lower == named.name {
+			return key{code: named.code}, nil
+		}
+	}
+	if letter, ok := strings.CutPrefix(lower, "ctrl-"); ok && len(letter) == 1 && letter[0] >= 'a' && letter[0] <= 'z' {
+		return key{code: tcell.KeyCtrlA + tcell.Key(letter[0]-'a')}, nil
+	}
+	return key{}, fmt.Errorf("unknown key %q", name)
+}
+
+// String returns the key's name as it would be written in keyBindings.
+func (k key) String() string {
+	if k.code == tcell.KeyRune {
+		if k.r == ' ' {
+			return "space"
+		}
+		return string(k.r)
+	}
+	for _, named := range namedKeys {
+		if k.code == named.code {
+			return named.name
+		}
+	}
+	if k.code >= tcell.KeyCtrlA && k.code <= tcell.KeyCtrlA+25 {
+		return fmt.Sprintf("ctrl-%c", 'a'+rune(k.code-tcell.KeyCtrlA))
+	}
+	return fmt.Sprintf("key %d", k.code)
+}
+
+// keyMap dispatches key presses to the actions they are bound to.
+type keyMap struct {
+	actions map[key]string
+	keys    map[string]key
+}
+
+// newKeyMap binds keys to actions as configured in bindings. Actions missing
+// from bindings keep their default key, and an empty key leaves an action
+// unbound. Unknown keys fall back to the default and unknown actions are
+// ignored; both are returned as warnings rather than failing, so a typo
+// never leaves pfzf without a way to quit.
+func newKeyMap(bindings map[string]string) (*keyMap, []string) {
+	defaults := config.DefaultConfig().UI.KeyBindings
+	m := &keyMap{
+		actions: make(map[key]string),
+		keys:    make(map[string]key),
+	}
+	var warnings []string
+
+	// Bind remapped actions first so they take their key from any default
+	// they collide with
+	actions := make([]string, 0, len(defaults))
+	for action := range defaults {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		ri, rj := remapped(bindings, defaults, actions[i]), remapped(bindings, defaults, actions[j])
+		if ri != rj {
+			return ri
+		}
+		return actions[i] < actions[j]
+	})
+
+	for _, action := range actions {
+		name, ok := bindings[action]
+		if !ok {
+			name = defaults[action]
+		}
+		if name == "" {
+			continue
+		}
+
+		k, err := parseKey(name)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v, using %s", action, err, defaults[action]))
+			if k, err = parseKey(defaults[action]); err != nil {
+				continue
+			}
+		}
+		if other, ok := m.actions[k]; ok {
+			warnings = append(warnings, fmt.Sprintf("%s: %s is already bound to %s", action, k, other))
+			continue
+		}
+		m.actions[k] = action
+		m.keys[action] = k
+	}
+
+	var unknown []string
+	for action := range bindings {
+		if _, ok := defaults[action]; !ok {
+			unknown = append(unknown, action)
+		}
+	}
+	sort.Strings(unknown)
+	for _, action := range unknown {
+		warnings = append(warnings, fmt.Sprintf("unknown action %q", action))
+	}
+	return m, warnings
+}
+
+// remapped reports whether bindings sets action to something other than its
+// default.
+func remapped(bindings, defaults map[string]string, action string) bool {
+	name, ok := bindings[action]
+	return ok && name != defaults[action]
+}
+
+// action returns the action bound to event's key, or "" if none is.
+// Characters typed with ctrl or alt held never match a character binding.
+func (m *keyMap) action(event *tcell.EventKey) string {
+	k := key{code: event.Key()}
+	if k.code == tcell.KeyRune {
+		if event.Modifiers()&(tcell.ModCtrl|tcell.ModAlt) != 0 {
+			return ""
+		}
+		k.r = event.Rune()
+	}
+	return m.actions[k]
+}
+
+// keyFor returns the name of the key bound to action, or "" if it is unbound.
+func (m *keyMap) keyFor(action string) string {
+	k, ok := m.keys[action]
+	if !ok {
+		return ""
+	}
+	return k.String()
+}
+
+// helpText lists the bound keys and their actions, followed by the keys
+// that can't be remapped.
+func (m *keyMap) helpText() string {
+	var b strings.Builder
+	for _, d := range actionDescriptions {
+		if k := m.keyFor(d.action); k != "" {
+			fmt.Fprintf(&b, "  %-10s %s\n", k, d.description)
+		}
+	}
+	fmt.Fprintf(&b, "\n  %-10s %s\n", "↑/↓", "Move through the files, or from the search to the files")
+	fmt.Fprintf(&b, "  %-10s %s\n", "enter", "In the search, go to the files or run :deselect-dir <path>")
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const (
+	mainPage    = "main"
+	overlayPage = "overlay"
+)
+
+// showOverlay displays text in a scrollable overlay above the main layout.
+func (a *App) showOverlay(title, text string) {
+	if !a.overlayOpen {
+		a.overlayReturn = a.GetFocus()
+	}
+	a.overlayOpen = true
+	a.overlay.SetTitle(title)
+	a.overlay.SetText(text)
+	a.overlay.ScrollToBeginning()
+	a.pages.ShowPage(overlayPage)
+	a.SetFocus(a.overlay)
+}
+
+// hideOverlay closes the overlay and returns focus to the widget that had it
+// before the overlay opened.
+func (a *App) hideOverlay() {
+	a.overlayOpen = false
+	a.pages.HidePage(overlayPage)
+
+	focus := a.overlayReturn
+	if focus == nil {
+		focus = a.fileList
+	}
+	a.overlayReturn = nil
+	a.SetFocus(focus)
+}
+
+func (a *App) handleOverlayInput(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyEscape:
+		a.hideOverlay()
+		return nil
+	case tcell.KeyRune:
+		if event.Rune() == 'q' {
+			a.hideOverlay()
+			return nil
+		}
+	}
+	// The help key toggles the help overlay closed
+	if a.keys.action(event) == actionHelp {
+		a.hideOverlay()
+		return nil
+	}
+	return event
+}
+
+// showHelp lists the active key bindings in the overlay.
+func (a *App) showHelp() {
+	a.showOverlay("Keys (Esc to close)", a.keys.helpText())
+}
+
+// showOutputPreview renders the writer's current buffer in memory and shows
+// the exact output in the overlay.
+func (a *App) showOutputPreview() {
+	var buf bytes.Buffer
+	if err := a.writer.Preview(&buf); err != nil {
+		a.status.SetText(fmt.Sprintf("Error rendering output: %v", err))
+		return
+	}
+	a.showOverlay("Output (↑/↓ to scroll, Esc to close)", buf.String())
+}
@@ -0,0 +1,84 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const confirmPage = "confirm"
+
+// Buttons of the quit confirmation, in order
+const (
+	quitWrite   = "Write"
+	quitDiscard = "Discard"
+	quitCancel  = "Cancel"
+)
+
+// selectedCount counts the selected files, including restored ones the scan
+// hasn't listed yet.
+func (a *App) selectedCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := len(a.restorePending)
+	for _, entry := range a.list.Entries() {
+		if entry.IsSelected {
+			n++
+		}
+	}
+	return n
+}
+
+// Discarded reports whether the output was discarded on quit, in which case
+// nothing was written.
+func (a *App) Discarded() bool {
+	return a.discard
+}
+
+// quit stops the application, first asking whether to write the output when
+// files are selected and the config asks for a confirmation.
+func (a *App) quit() {
+	selected := a.selectedCount()
+	if selected == 0 || !a.config.UI.ConfirmQuit {
+		// Stop cancels in-flight processing before stopping the event loop
+		a.Stop()
+		return
+	}
+	if a.pages.HasPage(confirmPage) {
+		return
+	}
+
+	returnTo := a.GetFocus()
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("Write %d files to %s?\n\n[y] write  [n] discard  [esc] cancel", selected, a.config.Writer.OutputPath)).
+		AddButtons([]string{quitWrite, quitDiscard, quitCancel})
+	answer := func(label string) {
+		a.pages.RemovePage(confirmPage)
+		switch label {
+		case quitWrite:
+			a.Stop()
+		case quitDiscard:
+			a.discard = true
+			a.Stop()
+		default:
+			// Esc, or the cancel button
+			a.SetFocus(returnTo)
+		}
+	}
+	modal.SetDoneFunc(func(_ int, label string) { answer(label) })
+	modal.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() != tcell.KeyRune {
+			return event
+		}
+		switch event.Rune() {
+		case 'y', 'Y':
+			answer(quitWrite)
+		case 'n', 'N':
+			answer(quitDiscard)
+		}
+		return nil
+	})
+	a.pages.AddPage(confirmPage, modal, false, true)
+	a.SetFocus(modal)
+}
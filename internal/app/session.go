@@ -0,0 +1,256 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// session is the selection saved when pfzf quits, restored on request the
+// next time it runs in the same directory.
+type session struct {
+	// Root is the directory the selection was made in
+	Root string `json:"root"`
+	// Selected lists the selected files relative to Root
+	Selected []string `json:"selected"`
+}
+
+// SessionFile returns the file the selection made in dir is saved to:
+// $XDG_STATE_HOME/pfzf/sessions, or ~/.local/state/pfzf/sessions, holds one
+// file per directory, named by a hash of its path.
+func SessionFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("finding the state directory: %w", err)
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(state, "pfzf", "sessions", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadSession reads the selection saved at path, or returns nil if there is
+// none.
+func loadSession(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading session: %w", err)
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing session %s: %w", path, err)
+	}
+	return s.Selected, nil
+}
+
+// saveSession writes the selection made in root to path.
+func saveSession(path, root string, selected []string) error {
+	data, err := json.MarshalIndent(session{Root: root, Selected: selected}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding session: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("writing session: %w", err)
+	}
+	// Replace the session atomically so an interruption never leaves a
+	// truncated one behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing session: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("writing session: %w", err)
+	}
+	return nil
+}
+
+// EnableSession saves the selection to path when pfzf quits, and offers to
+// restore the selection saved there by the last run. It must be called
+// before Run.
+func (a *App) EnableSession(path string) {
+	a.sessionPath = path
+}
+
+// offerRestore loads the saved selection and tells the user how to restore
+// it.
+func (a *App) offerRestore() {
+	if a.sessionPath == "" {
+		return
+	}
+	saved, err := loadSession(a.sessionPath)
+	if err != nil {
+		a.status.SetText(fmt.Sprintf("Previous selection: %v", err))
+		return
+	}
+	if len(saved) == 0 {
+		return
+	}
+	a.savedSelection = saved
+	if key := a.keys.keyFor(actionRestoreSelection); key != "" {
+		a.status.SetText(fmt.Sprintf("%d files were selected when pfzf last quit here; press %s to restore them", len(saved), key))
+	}
+}
+
+// restoreSelection selects the files saved by the last run again and
+// processes them. Files the scan hasn't listed yet are selected as they
+// arrive; saved files that no longer exist are skipped and reported.
+func (a *App) restoreSelection() {
+	saved := a.savedSelection
+	if len(saved) == 0 {
+		a.status.SetText("No previous selection to restore")
+		return
+	}
+	a.savedSelection = nil
+
+	missing := 0
+	a.mu.Lock()
+	for _, path := range saved {
+		if _, err := os.Stat(path); err != nil {
+			missing++
+			continue
+		}
+		a.restorePending[path] = true
+	}
+	a.mu.Unlock()
+
+	restored := a.applyRestore()
+	a.updateFileListPreserveSelection(a.fileList.GetCurrentItem())
+
+	msg := fmt.Sprintf("Restored %d of %d previously selected files", restored, len(saved))
+	if missing > 0 {
+		msg += fmt.Sprintf("; %d no longer exist", missing)
+	}
+	a.status.SetText(msg)
+	if a.scanFinished() {
+		a.finishRestore()
+	}
+}
+
+// applyRestore selects the listed entries that are waiting to be restored
+// and starts processing them, returning how many it selected.
+func (a *App) applyRestore() int {
+	a.mu.Lock()
+	if len(a.restorePending) == 0 {
+		a.mu.Unlock()
+		return 0
+	}
+	entries := a.list.Select(a.restorePending)
+	a.mu.Unlock()
+
+	for _, entry := range entries {
+		a.startProcessing(entry)
+	}
+	return len(entries)
+}
+
+// finishRestore reports the restored files the scan never listed, such as
+// files now ignored, once the scan is done.
+func (a *App) finishRestore() {
+	a.mu.Lock()
+	unlisted := len(a.restorePending)
+	clear(a.restorePending)
+	a.mu.Unlock()
+
+	if unlisted > 0 {
+		a.updateStatus(fmt.Sprintf("%d previously selected files are no longer listed", unlisted))
+	}
+}
+
+// scanFinished reports whether every scanned entry has been listed.
+func (a *App) scanFinished() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.scanDone
+}
+
+// saveSelection saves the selected files for the next run, along with the
+// restored ones still waiting for the scan. Nothing is saved when nothing
+// is selected, keeping the previous selection restorable.
+func (a *App) saveSelection() error {
+	if a.sessionPath == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	var selected []string
+	for _, entry := range a.list.Entries() {
+		if entry.IsSelected {
+			selected = append(selected, entry.Path)
+		}
+	}
+	for path := range a.restorePending {
+		selected = append(selected, path)
+	}
+	a.mu.Unlock()
+
+	if len(selected) == 0 {
+		return nil
+	}
+	sort.Strings(selected)
+	root, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("saving selection: %w", err)
+	}
+	return saveSession(a.sessionPath, root, selected)
+}
+
+// startProcessing processes a newly selected entry in the background.
+func (a *App) startProcessing(entry types.FileEntry) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.processAndWriteEntry(a.ctx, entry)
+	}()
+}
+
+// batchWorkers bounds how many files startProcessingAll processes at once.
+const batchWorkers = 4
+
+// startProcessingAll is like startProcessing for many entries selected at
+// once. A few workers share them, so selecting thousands of files doesn't
+// start a goroutine for each.
+func (a *App) startProcessingAll(entries []types.FileEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	next := make(chan types.FileEntry)
+	for range min(batchWorkers, len(entries)) {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for entry := range next {
+				a.processAndWriteEntry(a.ctx, entry)
+			}
+		}()
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(next)
+		for _, entry := range entries {
+			select {
+			case next <- entry:
+			case <-a.ctx.Done():
+				return
+			}
+		}
+	}()
+}
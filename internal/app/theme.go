@@ -48,6 +48,8 @@ func (tm *ThemeManager) applyListColors() {
 func (tm *ThemeManager) applyPreviewColors() {
 	tm.app.preview.SetBackgroundColor(tm.getColor("background", tcell.ColorDefault))
 	tm.app.preview.SetTextColor(tm.getColor("foreground", tcell.ColorWhite))
+	tm.app.overlay.SetBackgroundColor(tm.getColor("background", tcell.ColorDefault))
+	tm.app.overlay.SetTextColor(tm.getColor("foreground", tcell.ColorWhite))
 }
 
 // applyStatusColors applies theme colors to the status bar
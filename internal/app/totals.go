@@ -0,0 +1,121 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/lc/pfzf/internal/writer"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// selectionTotals adds up the tokens and bytes of the files written to the
+// output, so the status bar can show how much of a context window the
+// selection uses.
+type selectionTotals struct {
+	files map[string]fileTotal
+	// tokens, bytes and saved are the sums over files
+	tokens int
+	bytes  int64
+	saved  int
+}
+
+type fileTotal struct {
+	tokens int
+	bytes  int64
+	// saved is how many tokens processing removed
+	saved int
+}
+
+func newSelectionTotals() *selectionTotals {
+	return &selectionTotals{files: make(map[string]fileTotal)}
+}
+
+// add counts content, replacing an earlier count for the same path. Tokens
+// are counted like the writer counts them.
+func (t *selectionTotals) add(content types.ProcessedContent) {
+	t.remove(content.Entry.Path)
+	total := fileTotal{
+		tokens: writer.FileTokens(content),
+		bytes:  int64(len(content.Content)),
+		saved:  content.SavedTokens,
+	}
+	t.files[content.Entry.Path] = total
+	t.tokens += total.tokens
+	t.bytes += total.bytes
+	t.saved += total.saved
+}
+
+// fits reports whether the total stays within budget with content counted,
+// replacing an earlier count for the same path. A budget of 0 is unlimited.
+func (t *selectionTotals) fits(content types.ProcessedContent, budget int) bool {
+	if budget <= 0 {
+		return true
+	}
+	used := t.tokens - t.files[content.Entry.Path].tokens
+	return used+writer.FileTokens(content) <= budget
+}
+
+// remove stops counting the file at path.
+func (t *selectionTotals) remove(path string) {
+	total, ok := t.files[path]
+	if !ok {
+		return
+	}
+	delete(t.files, path)
+	t.tokens -= total.tokens
+	t.bytes -= total.bytes
+	t.saved -= total.saved
+}
+
+// String summarizes the totals, such as "3 files selected · 18.4k tokens ·
+// 72 KB", followed by the tokens processing saved, if any.
+func (t *selectionTotals) String() string {
+	files := "files"
+	if len(t.files) == 1 {
+		files = "file"
+	}
+	s := fmt.Sprintf("%d %s selected · %s tokens · %s", len(t.files), files, formatCount(t.tokens), formatBytes(t.bytes))
+	if t.saved > 0 {
+		s += fmt.Sprintf(" · %s saved", formatCount(t.saved))
+	}
+	return s
+}
+
+// formatCount abbreviates thousands and millions, such as 18.4k.
+func formatCount(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1_000_000)
+	case n >= 1000:
+		return fmt.Sprintf("%.1fk", float64(n)/1000)
+	}
+	return fmt.Sprint(n)
+}
+
+// formatBytes formats a size in binary units, such as 72 KB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// updateTotals shows the selection totals in the status bar's title. Like
+// updateStatus, it can be called from any goroutine. The totals are read
+// when the update runs, so it always shows the latest.
+func (a *App) updateTotals() {
+	if a.ctx.Err() != nil {
+		return
+	}
+	a.queueUpdateDraw(func() {
+		a.mu.Lock()
+		title := "Status"
+		if len(a.totals.files) > 0 {
+			title = "Status: " + a.totals.String()
+		}
+		a.mu.Unlock()
+		a.status.SetTitle(title)
+	})
+}
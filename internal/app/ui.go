@@ -1,71 +1,156 @@
 package app
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/gdamore/tcell/v2"
+	"github.com/lc/pfzf/internal/writer"
 	"github.com/rivo/tview"
 )
 
 func (a *App) setupUI() {
 	// Configure search field
 	a.search.SetLabel("Search: ").
-		SetChangedFunc(a.handleSearch)
+		SetChangedFunc(a.searchChanged)
 
 	// Configure file list
 	a.fileList.ShowSecondaryText(false).
 		SetBorder(true).
-		SetTitle("Files (↑/↓ to move, Space to select, q to quit)")
+		SetTitle(a.fileListTitle())
 
 		// Configure preview pane
 	a.preview.SetBorder(true)
 	a.preview.SetTitle("Preview")
 	a.preview.SetDynamicColors(true) // This method exists on TextView directly
-	a.preview.SetWrap(true)
+	a.preview.SetWrap(a.config.UI.PreviewWrap)
 
 	// Configure status bar
 	a.status.SetBorder(true).
 		SetTitle("Status")
 
+	// Configure overlay
+	a.overlay.SetScrollable(true).
+		SetWrap(false).
+		SetBorder(true)
+
 	// Create layout
+	a.side = tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(a.preview, 0, 3, false).
+		AddItem(a.status, 3, 1, false)
+	a.body = tview.NewFlex().
+		AddItem(a.fileList, 0, 2, false).
+		AddItem(a.side, 0, sideProportion, false)
 	mainFlex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
 		AddItem(a.search, 1, 0, true).
-		AddItem(tview.NewFlex().
-			AddItem(a.fileList, 0, 2, false).
-			AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-				AddItem(a.preview, 0, 3, false).
-				AddItem(a.status, 3, 1, false), 0, 3, false),
-			0, 1, false)
+		AddItem(a.body, 0, 1, false)
 
 	// Set up key handlers
 	a.fileList.SetInputCapture(a.handleInput)
 	a.search.SetInputCapture(a.handleSearchInput)
+	a.preview.SetInputCapture(a.handlePreviewInput)
+	a.overlay.SetInputCapture(a.handleOverlayInput)
 
 	// Set up selection handler
 	a.fileList.SetChangedFunc(func(index int, mainText, secondaryText string, shortcut rune) {
 		a.handleSelection(index)
 	})
 
-	a.SetRoot(mainFlex, true)
+	a.pages.AddPage(mainPage, mainFlex, true, true).
+		AddPage(overlayPage, a.overlay, true, false)
+
+	a.SetRoot(a.pages, true)
+}
+
+// sideProportion is the width of the preview and status column relative to
+// the file list's 2.
+const sideProportion = 3
+
+// fileListTitle describes the keys for the file list, as they are bound.
+func (a *App) fileListTitle() string {
+	hints := []string{"↑/↓ to move"}
+	if k := a.keys.keyFor(actionSelect); k != "" {
+		hints = append(hints, k+" to select")
+	}
+	if k := a.keys.keyFor(actionQuit); k != "" {
+		hints = append(hints, k+" to quit")
+	}
+	a.mu.Lock()
+	filter := a.list.SelectionFilter()
+	order := a.list.SortOrder()
+	lang := a.list.LanguageFilter()
+	a.mu.Unlock()
+
+	title := "Files"
+	if filter != FilterAll {
+		title += fmt.Sprintf(", %s only", filter)
+	}
+	if lang != "" {
+		title += ", in " + lang
+	}
+	if order != SortScan {
+		title += ", by " + order.String()
+	}
+	return fmt.Sprintf("%s (%s)", title, strings.Join(hints, ", "))
 }
 
 func (a *App) handleInput(event *tcell.EventKey) *tcell.EventKey {
+	action := a.keys.action(event)
+	if action == "" {
+		return event
+	}
+	a.runAction(action)
+	return nil
+}
+
+// handlePreviewInput scrolls the focused preview. The arrow, page, Home and
+// End keys scroll it, the digits 0 to 9 jump 0% to 90% through the file and
+// Esc returns to the file list; other keys run their actions.
+func (a *App) handlePreviewInput(event *tcell.EventKey) *tcell.EventKey {
 	switch event.Key() {
+	case tcell.KeyUp:
+		a.scrollPreview(-1)
+		return nil
+	case tcell.KeyDown:
+		a.scrollPreview(1)
+		return nil
+	case tcell.KeyLeft:
+		a.scrollPreviewColumn(-previewColumns)
+		return nil
+	case tcell.KeyRight:
+		a.scrollPreviewColumn(previewColumns)
+		return nil
+	case tcell.KeyPgUp:
+		a.runAction(actionPreviewPageUp)
+		return nil
+	case tcell.KeyPgDn:
+		a.runAction(actionPreviewPageDown)
+		return nil
+	case tcell.KeyHome:
+		a.runAction(actionPreviewTop)
+		return nil
+	case tcell.KeyEnd:
+		a.runAction(actionPreviewBottom)
+		return nil
+	case tcell.KeyEscape:
+		a.SetFocus(a.fileList)
+		return nil
 	case tcell.KeyRune:
-		switch event.Rune() {
-		case 'q':
-			a.Stop()
-			return nil
-		case ' ':
-			if idx := a.fileList.GetCurrentItem(); idx >= 0 && idx < len(a.filteredIdx) {
-				a.toggleSelection(a.filteredIdx[idx])
-			}
+		if r := event.Rune(); r >= '0' && r <= '9' {
+			a.seekPercent(int(r-'0') * 10)
 			return nil
 		}
-	case tcell.KeyEscape:
-		a.SetFocus(a.search)
-		return nil
 	}
-	return event
+	if action := a.keys.action(event); action != "" {
+		a.runAction(action)
+	}
+	// The preview is re-rendered around the current line rather than
+	// scrolled by the text view itself
+	return nil
 }
 
 func (a *App) handleSearchInput(event *tcell.EventKey) *tcell.EventKey {
@@ -74,10 +159,351 @@ func (a *App) handleSearchInput(event *tcell.EventKey) *tcell.EventKey {
 		a.SetFocus(a.fileList)
 		return nil
 	case tcell.KeyEnter:
-		if len(a.filteredIdx) > 0 {
+		a.flushSearch()
+		if a.runCommand(a.search.GetText()) {
+			a.search.SetText("")
+			return nil
+		}
+		a.mu.Lock()
+		matches := a.list.Len()
+		a.mu.Unlock()
+		if matches > 0 {
 			a.SetFocus(a.fileList)
 			return nil
 		}
+	case tcell.KeyRune:
+		// Characters are typed into the search
+		return event
+	}
+
+	// Only actions that make sense while typing a search apply here
+	switch action := a.keys.action(event); action {
+	case actionQuit, actionTogglePreview, actionHelp, actionClearSearch, actionOutputPreview, actionFilterSelection, actionSort:
+		a.runAction(action)
+		return nil
 	}
 	return event
 }
+
+// runAction performs a key-bound action.
+func (a *App) runAction(action string) {
+	switch action {
+	case actionQuit:
+		a.quit()
+	case actionSelect:
+		a.toggleSelection(a.fileList.GetCurrentItem())
+	case actionTogglePreview:
+		a.togglePreview()
+	case actionToggleWrap:
+		a.toggleWrap()
+	case actionHelp:
+		a.showHelp()
+	case actionFocusSearch:
+		a.SetFocus(a.search)
+	case actionClearSearch:
+		a.search.SetText("")
+		a.SetFocus(a.search)
+	case actionOutputPreview:
+		a.showOutputPreview()
+	case actionMoveUp:
+		a.moveCurrentItem(-1)
+	case actionMoveDown:
+		a.moveCurrentItem(1)
+	case actionFilterSelection:
+		a.cycleSelectionFilter()
+	case actionFocusPreview:
+		if a.GetFocus() == a.preview {
+			a.SetFocus(a.fileList)
+		} else if !a.previewHidden {
+			a.SetFocus(a.preview)
+		}
+	case actionPreviewPageUp:
+		a.scrollPreview(-a.previewPage())
+	case actionPreviewPageDown:
+		a.scrollPreview(a.previewPage())
+	case actionPreviewTop:
+		a.previewTop()
+	case actionPreviewBottom:
+		a.previewBottom()
+	case actionNextMatch:
+		a.jumpToMatch(true)
+	case actionPrevMatch:
+		a.jumpToMatch(false)
+	case actionCopyPath:
+		a.copyPath()
+	case actionCopyOutput:
+		a.copyOutput()
+	case actionRestoreSelection:
+		a.restoreSelection()
+	case actionSort:
+		a.cycleSortOrder()
+	case actionIgnorePattern:
+		a.search.SetText(ignoreCommand)
+		a.SetFocus(a.search)
+	case actionInvertSelection:
+		a.invertSelection()
+	case actionCopyOutputPath:
+		a.copyOutputPath()
+	case actionOpenOutput:
+		a.openOutput()
+	}
+}
+
+// copyPath copies the path of the highlighted file to the clipboard. The
+// clipboard command runs in the background and reports in the status bar.
+func (a *App) copyPath() {
+	a.mu.Lock()
+	entry, ok := a.list.Entry(a.fileList.GetCurrentItem())
+	a.mu.Unlock()
+	if !ok {
+		a.status.SetText("No file to copy the path of")
+		return
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := a.copyToClipboard(entry.Path)
+		a.queueUpdateDraw(func() {
+			if err != nil {
+				a.status.SetText(fmt.Sprintf("Copying path: %v", err))
+				return
+			}
+			a.status.SetText("Copied " + entry.Path)
+		})
+	}()
+}
+
+// copyOutput copies the output for the current selection, rendered in the
+// configured format, to the clipboard. The output file is still written
+// when pfzf quits.
+func (a *App) copyOutput() {
+	a.mu.Lock()
+	files, tokens := len(a.totals.files), a.totals.tokens
+	a.mu.Unlock()
+	if files == 0 {
+		a.status.SetText("No files selected to copy")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := a.writer.Preview(&buf); err != nil {
+		a.status.SetText(fmt.Sprintf("Error rendering output: %v", err))
+		return
+	}
+	text := buf.String()
+	noun := "files"
+	if files == 1 {
+		noun = "file"
+	}
+	summary := fmt.Sprintf("%d %s · %s tokens · %s", files, noun, formatCount(tokens), formatBytes(int64(len(text))))
+
+	a.status.SetText("Copying the output...")
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := a.copyToClipboard(text)
+		a.queueUpdateDraw(func() {
+			if err != nil {
+				a.status.SetText(fmt.Sprintf("Copying output: %v", err))
+				return
+			}
+			a.status.SetText("Copied the output to the clipboard: " + summary)
+		})
+	}()
+}
+
+// copyOutputPath writes the output now, rather than on quit, and copies its
+// path to the clipboard.
+func (a *App) copyOutputPath() {
+	a.withOutput("Copying the output path", func(paths []string) (string, error) {
+		if err := a.copyToClipboard(strings.Join(paths, "\n")); err != nil {
+			return "", err
+		}
+		return "Copied " + strings.Join(paths, ", "), nil
+	})
+}
+
+// openOutput writes the output now, rather than on quit, and opens it with
+// the default application. Of split outputs, the first is opened.
+func (a *App) openOutput() {
+	a.withOutput("Opening the output", func(paths []string) (string, error) {
+		if err := a.openPath(paths[0]); err != nil {
+			return "", err
+		}
+		return "Opened " + paths[0], nil
+	})
+}
+
+// withOutput flushes the writer so the output file is up to date, then
+// calls f with the absolute paths of the outputs written and shows the
+// status it returns. The output is only finalized when pfzf quits, so
+// streamed output may still be missing its closing lines.
+func (a *App) withOutput(doing string, f func(paths []string) (string, error)) {
+	a.status.SetText(doing + "...")
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		var msg string
+		paths, err := a.flushOutput()
+		switch {
+		case err != nil:
+		case len(paths) == 0:
+			msg = "No output written yet: select files first"
+		default:
+			msg, err = f(paths)
+		}
+		a.queueUpdateDraw(func() {
+			if err != nil {
+				a.status.SetText(fmt.Sprintf("%s: %v", doing, err))
+				return
+			}
+			a.status.SetText(msg)
+		})
+	}()
+}
+
+// flushOutput writes the buffered output and returns the absolute paths of
+// the output files that exist.
+func (a *App) flushOutput() ([]string, error) {
+	if err := a.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("writing output: %w", err)
+	}
+
+	outputs := []string{a.config.Writer.OutputPath}
+	if split, ok := a.writer.(*writer.SplitWriter); ok {
+		outputs = split.Outputs()
+	}
+	var paths []string
+	for _, output := range outputs {
+		if _, err := os.Stat(output); err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(output); err == nil {
+			output = abs
+		}
+		paths = append(paths, output)
+	}
+	return paths, nil
+}
+
+// cycleSelectionFilter switches the file list between all, selected and
+// unselected files.
+func (a *App) cycleSelectionFilter() {
+	a.mu.Lock()
+	filter := a.list.SelectionFilter().Next()
+	a.list.SetSelectionFilter(filter)
+	a.mu.Unlock()
+
+	a.updateFileList()
+	a.fileList.SetTitle(a.fileListTitle())
+	a.handleSelection(a.fileList.GetCurrentItem())
+}
+
+// filterLanguage shows only the files in lang, or every file if lang is
+// empty, on top of the search.
+func (a *App) filterLanguage(lang string) {
+	a.mu.Lock()
+	a.list.SetLanguageFilter(lang)
+	a.mu.Unlock()
+
+	a.updateFileList()
+	a.fileList.SetTitle(a.fileListTitle())
+	a.handleSelection(a.fileList.GetCurrentItem())
+	if lang == "" {
+		a.status.SetText("Showing files in every language")
+	} else {
+		a.status.SetText(fmt.Sprintf("Showing only %s files; :lang shows every language", lang))
+	}
+}
+
+// cycleSortOrder switches the file list between the sort orders, keeping
+// the highlighted file highlighted.
+func (a *App) cycleSortOrder() {
+	a.mu.Lock()
+	current, ok := a.list.Entry(a.fileList.GetCurrentItem())
+	order := a.list.SortOrder().Next()
+	a.list.SetSortOrder(order)
+	row := -1
+	if ok {
+		row = a.list.Row(current.Path)
+	}
+	a.mu.Unlock()
+
+	a.updateFileList()
+	if row >= 0 {
+		a.fileList.SetCurrentItem(row)
+	}
+	a.fileList.SetTitle(a.fileListTitle())
+	a.status.SetText("Sorted by " + order.String())
+}
+
+// togglePreview hides or shows the preview and status column, giving the
+// file list the full width while hidden.
+func (a *App) togglePreview() {
+	a.previewHidden = !a.previewHidden
+	if a.previewHidden && a.GetFocus() == a.preview {
+		a.SetFocus(a.fileList)
+	}
+	if a.previewHidden {
+		a.body.ResizeItem(a.side, 0, 0)
+	} else {
+		a.body.ResizeItem(a.side, 0, sideProportion)
+	}
+}
+
+// moveCurrentItem moves the file list's cursor by delta rows, wrapping
+// around like the arrow keys.
+func (a *App) moveCurrentItem(delta int) {
+	n := a.fileList.GetItemCount()
+	if n == 0 {
+		return
+	}
+	a.fileList.SetCurrentItem(((a.fileList.GetCurrentItem()+delta)%n + n) % n)
+}
+
+// Commands typed into the search field: deselectDirCommand deselects a
+// subtree, ignoreCommand hides the files matching an ignore pattern,
+// saveIgnoreCommand also adds the pattern to the config file and
+// languageCommand shows only the files in a language.
+const (
+	deselectDirCommand = ":deselect-dir "
+	ignoreCommand      = ":ignore "
+	saveIgnoreCommand  = ":ignore! "
+	languageCommand    = ":lang"
+)
+
+// runCommand runs text as a command if it is one, reporting whether it was.
+func (a *App) runCommand(text string) bool {
+	if lang, ok := strings.CutPrefix(text, languageCommand); ok && (lang == "" || lang[0] == ' ') {
+		a.filterLanguage(strings.ToLower(strings.TrimSpace(lang)))
+		return true
+	}
+
+	if dir, ok := strings.CutPrefix(text, deselectDirCommand); ok {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			a.status.SetText("Usage: :deselect-dir <path>")
+			return true
+		}
+		n := a.deselectDir(dir)
+		a.updateFileListPreserveSelection(a.fileList.GetCurrentItem())
+		a.status.SetText(fmt.Sprintf("Deselected %d files under %s", n, dir))
+		return true
+	}
+
+	pattern, save := strings.CutPrefix(text, saveIgnoreCommand)
+	if !save {
+		var ok bool
+		if pattern, ok = strings.CutPrefix(text, ignoreCommand); !ok {
+			return false
+		}
+	}
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		a.status.SetText("Usage: :ignore <pattern>, or :ignore! <pattern> to save it")
+		return true
+	}
+	a.ignorePattern(pattern, save)
+	return true
+}
@@ -0,0 +1,521 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/internal/ignore"
+	"github.com/lc/pfzf/pkg/types"
+	"github.com/sahilm/fuzzy"
+)
+
+// SelectionFilter limits the rows of a ListViewModel by selection state.
+type SelectionFilter int
+
+const (
+	// FilterAll shows entries whether or not they are selected.
+	FilterAll SelectionFilter = iota
+	// FilterSelected shows only selected entries.
+	FilterSelected
+	// FilterUnselected shows only entries that aren't selected.
+	FilterUnselected
+)
+
+// Next returns the filter that follows f when cycling through them.
+func (f SelectionFilter) Next() SelectionFilter {
+	return (f + 1) % 3
+}
+
+func (f SelectionFilter) String() string {
+	switch f {
+	case FilterSelected:
+		return "selected"
+	case FilterUnselected:
+		return "unselected"
+	}
+	return "all"
+}
+
+// SortOrder orders the rows of a ListViewModel.
+type SortOrder int
+
+const (
+	// SortScan keeps the order the scanner delivered entries in.
+	SortScan SortOrder = iota
+	// SortPath orders entries by path.
+	SortPath
+	// SortSize orders entries largest first.
+	SortSize
+	// SortModified orders entries most recently modified first.
+	SortModified
+)
+
+// sortOrders are the sort orders by name, as in UIConfig.SortBy.
+var sortOrders = map[string]SortOrder{
+	"scan":     SortScan,
+	"path":     SortPath,
+	"size":     SortSize,
+	"modified": SortModified,
+}
+
+// ParseSortOrder returns the sort order named s.
+func ParseSortOrder(s string) (SortOrder, bool) {
+	o, ok := sortOrders[s]
+	return o, ok
+}
+
+// Next returns the order that follows o when cycling through them.
+func (o SortOrder) Next() SortOrder {
+	return (o + 1) % 4
+}
+
+func (o SortOrder) String() string {
+	switch o {
+	case SortPath:
+		return "path"
+	case SortSize:
+		return "size"
+	case SortModified:
+		return "modified"
+	}
+	return "scan"
+}
+
+// SearchRanking orders the rows of a ListViewModel matching a search.
+type SearchRanking int
+
+const (
+	// RankScore orders matches best match first.
+	RankScore SearchRanking = iota
+	// RankName orders matches by path.
+	RankName
+	// RankMTime orders matches most recently modified first.
+	RankMTime
+)
+
+// searchRankings are the search rankings by name, as in
+// UIConfig.SearchRanking.
+var searchRankings = map[string]SearchRanking{
+	"score": RankScore,
+	"name":  RankName,
+	"mtime": RankMTime,
+}
+
+// ParseSearchRanking returns the search ranking named s.
+func ParseSearchRanking(s string) (SearchRanking, bool) {
+	r, ok := searchRankings[s]
+	return r, ok
+}
+
+func (r SearchRanking) String() string {
+	switch r {
+	case RankName:
+		return "name"
+	case RankMTime:
+		return "mtime"
+	}
+	return "score"
+}
+
+// ListViewModel owns the scanned entries and the search filter, and produces
+// the rows shown in the file list. It knows nothing about tview, so filtering
+// and selection can be tested on their own; the App renders its rows.
+//
+// A ListViewModel is not safe for concurrent use. The App guards it with mu.
+type ListViewModel struct {
+	entries []types.FileEntry
+	query   string
+	// selection composes with the query, narrowing its matches further
+	selection SelectionFilter
+	// order sorts the rows; with a query it breaks ties between equally
+	// good matches
+	order SortOrder
+	// ranking orders the rows matching a query
+	ranking SearchRanking
+	// language, if set, limits the rows to entries in that language,
+	// composing with the query like selection
+	language string
+	// detectLanguage names the language of entries scanned without one;
+	// nil leaves them unknown
+	detectLanguage func(path string) string
+	// showSizes adds a column with each entry's size to the labels
+	showSizes bool
+	// priorityGlobs sort matching entries to the top, earlier globs first
+	priorityGlobs []string
+	// rows are the indices into entries of the displayed rows, in order
+	rows []int
+}
+
+func newListViewModel(priorityGlobs []string) *ListViewModel {
+	return &ListViewModel{priorityGlobs: priorityGlobs}
+}
+
+// Add appends scanned entries and refilters the rows.
+func (m *ListViewModel) Add(entries ...types.FileEntry) {
+	m.entries = append(m.entries, entries...)
+	m.refilter()
+}
+
+// SetQuery filters the rows to the entries whose path fuzzy matches query,
+// best matches first. An empty query shows every entry.
+func (m *ListViewModel) SetQuery(query string) {
+	m.query = query
+	m.refilter()
+}
+
+// SetSelectionFilter limits the rows to entries in the selection state f,
+// on top of the query.
+func (m *ListViewModel) SetSelectionFilter(f SelectionFilter) {
+	m.selection = f
+	m.refilter()
+}
+
+// SetSortOrder sorts the rows by o.
+func (m *ListViewModel) SetSortOrder(o SortOrder) {
+	m.order = o
+	m.refilter()
+}
+
+// SetSearchRanking orders the rows matching a query by r.
+func (m *ListViewModel) SetSearchRanking(r SearchRanking) {
+	m.ranking = r
+	m.refilter()
+}
+
+// SetLanguageFilter limits the rows to entries whose language is lang, on
+// top of the query. An empty lang shows every language.
+func (m *ListViewModel) SetLanguageFilter(lang string) {
+	m.language = lang
+	m.refilter()
+}
+
+// LanguageFilter returns the language the rows are limited to, or "".
+func (m *ListViewModel) LanguageFilter() string {
+	return m.language
+}
+
+// languageOf returns the language of entry, detecting it from the path if
+// the scan didn't.
+func (m *ListViewModel) languageOf(entry types.FileEntry) string {
+	if entry.Language != "" {
+		return entry.Language
+	}
+	if m.detectLanguage != nil {
+		return m.detectLanguage(entry.Path)
+	}
+	return "unknown"
+}
+
+// SortOrder returns the current sort order.
+func (m *ListViewModel) SortOrder() SortOrder {
+	return m.order
+}
+
+// SelectionFilter returns the current selection filter.
+func (m *ListViewModel) SelectionFilter() SelectionFilter {
+	return m.selection
+}
+
+// Query returns the current search query.
+func (m *ListViewModel) Query() string {
+	return m.query
+}
+
+// Len returns the number of displayed rows.
+func (m *ListViewModel) Len() int {
+	return len(m.rows)
+}
+
+// Entry returns the entry displayed at row.
+func (m *ListViewModel) Entry(row int) (types.FileEntry, bool) {
+	if row < 0 || row >= len(m.rows) {
+		return types.FileEntry{}, false
+	}
+	return m.entries[m.rows[row]], true
+}
+
+// Row returns the row displaying the entry at path, or -1 if it isn't
+// displayed.
+func (m *ListViewModel) Row(path string) int {
+	for row, i := range m.rows {
+		if m.entries[i].Path == path {
+			return row
+		}
+	}
+	return -1
+}
+
+// Selected reports whether the entry at path is selected.
+func (m *ListViewModel) Selected(path string) bool {
+	for _, entry := range m.entries {
+		if entry.Path == path {
+			return entry.IsSelected
+		}
+	}
+	return false
+}
+
+// Entries returns every entry regardless of the filter. The slice must not
+// be modified.
+func (m *ListViewModel) Entries() []types.FileEntry {
+	return m.entries
+}
+
+// SetShowSizes adds a column with each entry's size to the labels.
+func (m *ListViewModel) SetShowSizes(show bool) {
+	m.showSizes = show
+}
+
+// Labels returns the text of each displayed row. With sizes shown, the
+// paths are padded to the longest displayed one, up to listPathWidth, so
+// the sizes line up.
+func (m *ListViewModel) Labels() []string {
+	width := 0
+	if m.showSizes {
+		for _, i := range m.rows {
+			width = max(width, utf8.RuneCountInString(m.entries[i].Path))
+		}
+		width = min(width, listPathWidth)
+	}
+
+	labels := make([]string, len(m.rows))
+	for row, i := range m.rows {
+		labels[row] = formatListItem(m.entries[i], width)
+	}
+	return labels
+}
+
+// Toggle flips the selection of the entry displayed at row and returns the
+// updated entry. Under a selection filter the entry leaves the rows.
+func (m *ListViewModel) Toggle(row int) (types.FileEntry, bool) {
+	if row < 0 || row >= len(m.rows) {
+		return types.FileEntry{}, false
+	}
+	entry := &m.entries[m.rows[row]]
+	entry.IsSelected = !entry.IsSelected
+	toggled := *entry
+	m.selectionChanged()
+	return toggled, true
+}
+
+// Invert flips the selection of every displayed entry and returns those it
+// selected and those it deselected. Entries hidden by the query or a filter
+// keep their selection.
+func (m *ListViewModel) Invert() (selected, deselected []types.FileEntry) {
+	for _, i := range m.rows {
+		entry := &m.entries[i]
+		entry.IsSelected = !entry.IsSelected
+		if entry.IsSelected {
+			selected = append(selected, *entry)
+		} else {
+			deselected = append(deselected, *entry)
+		}
+	}
+	m.selectionChanged()
+	return selected, deselected
+}
+
+// Select selects the entries whose path is in paths and returns those that
+// weren't selected already. Matched paths are deleted from paths, leaving
+// the ones not listed.
+func (m *ListViewModel) Select(paths map[string]bool) []types.FileEntry {
+	var selected []types.FileEntry
+	for i := range m.entries {
+		entry := &m.entries[i]
+		if !paths[entry.Path] {
+			continue
+		}
+		delete(paths, entry.Path)
+		if !entry.IsSelected {
+			entry.IsSelected = true
+			selected = append(selected, *entry)
+		}
+	}
+	if len(selected) > 0 {
+		m.selectionChanged()
+	}
+	return selected
+}
+
+// Remove drops the entries for which match returns true and returns them.
+func (m *ListViewModel) Remove(match func(types.FileEntry) bool) []types.FileEntry {
+	var removed []types.FileEntry
+	kept := m.entries[:0]
+	for _, entry := range m.entries {
+		if match(entry) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	m.entries = kept
+	if len(removed) > 0 {
+		m.refilter()
+	}
+	return removed
+}
+
+// Deselect clears the selection of the entry at path, reporting whether it
+// was selected.
+func (m *ListViewModel) Deselect(path string) bool {
+	for i := range m.entries {
+		if m.entries[i].Path == path {
+			selected := m.entries[i].IsSelected
+			m.entries[i].IsSelected = false
+			m.selectionChanged()
+			return selected
+		}
+	}
+	return false
+}
+
+// DeselectUnder clears the selection of every entry under dir and returns
+// their paths. Entries outside dir keep their selection.
+func (m *ListViewModel) DeselectUnder(dir string) []string {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+
+	var removed []string
+	for i, entry := range m.entries {
+		if entry.IsSelected && isUnder(filepath.ToSlash(entry.Path), dir) {
+			m.entries[i].IsSelected = false
+			removed = append(removed, entry.Path)
+		}
+	}
+	m.selectionChanged()
+	return removed
+}
+
+// selectionChanged refilters the rows if they depend on selection.
+func (m *ListViewModel) selectionChanged() {
+	if m.selection != FilterAll {
+		m.refilter()
+	}
+}
+
+// refilter recomputes the displayed rows from the entries and the query.
+func (m *ListViewModel) refilter() {
+	m.rows = m.rows[:0]
+	var candidates []int
+	for i, entry := range m.entries {
+		switch {
+		case m.selection == FilterSelected && !entry.IsSelected:
+		case m.selection == FilterUnselected && entry.IsSelected:
+		case m.language != "" && m.languageOf(entry) != m.language:
+		default:
+			candidates = append(candidates, i)
+		}
+	}
+	m.sort(candidates)
+
+	if m.query == "" {
+		m.rows = append(m.rows, candidates...)
+	} else {
+		paths := make([]string, len(candidates))
+		for i, c := range candidates {
+			paths[i] = m.entries[c].Path
+		}
+		for _, match := range fuzzy.Find(m.query, paths) {
+			m.rows = append(m.rows, candidates[match.Index])
+		}
+		m.rank()
+	}
+	m.prioritize()
+}
+
+// rank reorders the rows matching a query by m.ranking. Matches are
+// already ordered by score, which also breaks ties between equally recent
+// files.
+func (m *ListViewModel) rank() {
+	switch m.ranking {
+	case RankName:
+		sort.SliceStable(m.rows, func(x, y int) bool {
+			return m.entries[m.rows[x]].Path < m.entries[m.rows[y]].Path
+		})
+	case RankMTime:
+		sort.SliceStable(m.rows, func(x, y int) bool {
+			return m.entries[m.rows[x]].ModTime.After(m.entries[m.rows[y]].ModTime)
+		})
+	}
+}
+
+// sort orders the indices into entries by m.order. Entries that compare
+// equal are ordered by path, so the order doesn't depend on the scan.
+func (m *ListViewModel) sort(indices []int) {
+	if m.order == SortScan {
+		return
+	}
+	sort.SliceStable(indices, func(x, y int) bool {
+		a, b := m.entries[indices[x]], m.entries[indices[y]]
+		switch m.order {
+		case SortSize:
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+		case SortModified:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.After(b.ModTime)
+			}
+		}
+		return a.Path < b.Path
+	})
+}
+
+// prioritize moves the rows whose entry matches a priority glob to the
+// front, those matching earlier globs first. Otherwise the order, such as
+// the fuzzy match ranking, is kept.
+func (m *ListViewModel) prioritize() {
+	globs := m.priorityGlobs
+	if len(globs) == 0 {
+		return
+	}
+
+	rank := make(map[int]int, len(m.rows))
+	for _, i := range m.rows {
+		rank[i] = len(globs)
+		for g, glob := range globs {
+			if ignore.MatchGlob(glob, m.entries[i].Path) {
+				rank[i] = g
+				break
+			}
+		}
+	}
+	sort.SliceStable(m.rows, func(x, y int) bool {
+		return rank[m.rows[x]] < rank[m.rows[y]]
+	})
+}
+
+// isUnder reports whether the slash-separated path is dir or inside it.
+func isUnder(path, dir string) bool {
+	if dir == "." {
+		return true
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// listPathWidth caps the width of the path column when sizes are shown.
+const listPathWidth = 60
+
+// formatListItem returns the label of entry's row: a checkbox and the path,
+// followed by the size when pathWidth is set. The path is then padded or
+// shortened to pathWidth, and the size right-aligned after it.
+func formatListItem(entry types.FileEntry, pathWidth int) string {
+	prefix := map[bool]string{true: "[x]", false: "[ ]"}[entry.IsSelected]
+	if pathWidth == 0 {
+		return fmt.Sprintf("%s %s", prefix, entry.Path)
+	}
+	return fmt.Sprintf("%s %s  %8s", prefix, fitPath(entry.Path, pathWidth), fs.FormatSize(entry.Size))
+}
+
+// fitPath pads path with spaces to width runes, or shortens it to width by
+// dropping the start of it, which keeps the file name visible.
+func fitPath(path string, width int) string {
+	runes := []rune(path)
+	if len(runes) > width {
+		return "…" + string(runes[len(runes)-width+1:])
+	}
+	return path + strings.Repeat(" ", width-len(runes))
+}
@@ -0,0 +1,81 @@
+// Package clipboard copies text to the system clipboard through the
+// platform's clipboard command: pbcopy on macOS, clip on Windows, and
+// wl-copy, xclip or xsel elsewhere.
+package clipboard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable is returned when no clipboard command is installed.
+var ErrUnavailable = errors.New("no clipboard command found (install wl-copy, xclip or xsel)")
+
+// timeout bounds a clipboard command, which may hang without a display.
+const timeout = 5 * time.Second
+
+// Copy replaces the clipboard's contents with text.
+func Copy(text string) error {
+	args, err := command(runtime.GOOS, os.Getenv, exec.LookPath)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("running %s: %w", args[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("running %s: %w: %s", args[0], err, msg)
+		}
+		return fmt.Errorf("running %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// command returns the first clipboard command found with lookPath for the
+// operating system goos, preferring Wayland's when a Wayland display is set.
+func command(goos string, getenv func(string) string, lookPath func(string) (string, error)) ([]string, error) {
+	var candidates [][]string
+	switch goos {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		if getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		candidates = append(candidates,
+			[]string{"xclip", "-selection", "clipboard"},
+			[]string{"xsel", "--clipboard", "--input"},
+		)
+	}
+
+	for _, args := range candidates {
+		if _, err := lookPath(args[0]); err == nil {
+			return args, nil
+		}
+	}
+	return nil, ErrUnavailable
+}
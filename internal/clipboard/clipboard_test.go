@@ -0,0 +1,54 @@
+package clipboard
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		goos      string
+		env       map[string]string
+		installed []string
+		want      string
+		wantErr   error
+	}{
+		{name: "macOS", goos: "darwin", installed: []string{"pbcopy"}, want: "[pbcopy]"},
+		{name: "Windows", goos: "windows", installed: []string{"clip"}, want: "[clip]"},
+		{
+			name:      "Wayland",
+			goos:      "linux",
+			env:       map[string]string{"WAYLAND_DISPLAY": "wayland-0"},
+			installed: []string{"xclip", "wl-copy"},
+			want:      "[wl-copy]",
+		},
+		{name: "X11", goos: "linux", installed: []string{"xclip", "wl-copy"}, want: "[xclip -selection clipboard]"},
+		{name: "xsel", goos: "freebsd", installed: []string{"xsel"}, want: "[xsel --clipboard --input]"},
+		{name: "none", goos: "linux", wantErr: ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(name string) string { return tt.env[name] }
+			lookPath := func(file string) (string, error) {
+				for _, name := range tt.installed {
+					if name == file {
+						return "/usr/bin/" + file, nil
+					}
+				}
+				return "", exec.ErrNotFound
+			}
+
+			got, err := command(tt.goos, getenv, lookPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("command() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && fmt.Sprint(got) != tt.want {
+				t.Errorf("command() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
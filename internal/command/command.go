@@ -0,0 +1,62 @@
+// Package command captures the output of shell commands, such as
+// "go doc ./..." or "git log --oneline -20", to include in the context as
+// virtual files.
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// DefaultTimeout bounds commands that don't set their own timeout.
+const DefaultTimeout = 10 * time.Second
+
+// Spec describes a virtual file holding the output of a command.
+type Spec struct {
+	// Path is the file's synthetic path in the output
+	Path string
+	// Command is run with sh -c in the working directory
+	Command string
+	// Timeout stops the command; zero means DefaultTimeout
+	Timeout time.Duration
+}
+
+// Run runs spec's command and returns the content of its virtual file: the
+// command's stdout, followed by the error and stderr if it fails or times
+// out, so the failure is visible in the context. The error is also returned
+// for the caller to report.
+func Run(ctx context.Context, spec Spec) ([]byte, error) {
+	timeout := spec.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", spec.Command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Don't wait forever on pipes held open by the command's children
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err == nil {
+		return stdout.Bytes(), nil
+	}
+
+	err = fmt.Errorf("running %q: %w", spec.Command, err)
+	content := stdout.Bytes()
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	content = fmt.Appendf(content, "[%v]\n", err)
+	content = append(content, stderr.Bytes()...)
+	return content, err
+}
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    Spec
+		want    string
+		wantErr string
+	}{
+		{
+			name: "stdout",
+			spec: Spec{Command: "printf 'one\\ntwo\\n'"},
+			want: "one\ntwo\n",
+		},
+		{
+			name:    "failure",
+			spec:    Spec{Command: "echo partial; echo broken >&2; exit 3"},
+			want:    "partial\n[running \"echo partial; echo broken >&2; exit 3\": exit status 3]\nbroken\n",
+			wantErr: "exit status 3",
+		},
+		{
+			name:    "timeout",
+			spec:    Spec{Command: "printf started; sleep 5", Timeout: 50 * time.Millisecond},
+			want:    "started\n[running \"printf started; sleep 5\": timed out after 50ms]\n",
+			wantErr: "timed out after 50ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got, err := Run(context.Background(), tt.spec)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Run() = %q, want %q", got, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("Run() took %s", elapsed)
+			}
+		})
+	}
+}
@@ -6,57 +6,148 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/internal/ignore"
 	"github.com/lc/pfzf/pkg/types"
+	"gopkg.in/yaml.v3"
 )
 
 // Config represents the complete configuration for pfzf.
 type Config struct {
 	// Scanner configuration
-	Scanner ScannerConfig `json:"scanner"`
+	Scanner ScannerConfig `json:"scanner" yaml:"scanner"`
 
 	// Processor configuration
-	Processor ProcessorConfig `json:"processor"`
+	Processor ProcessorConfig `json:"processor" yaml:"processor"`
 
 	// Writer configuration
-	Writer WriterConfig `json:"writer"`
+	Writer WriterConfig `json:"writer" yaml:"writer"`
 
 	// UI configuration
-	UI UIConfig `json:"ui"`
+	UI UIConfig `json:"ui" yaml:"ui"`
+
+	// Commands whose output is included as virtual files
+	Commands []CommandConfig `json:"commands,omitempty" yaml:"commands,omitempty"`
 }
 
 // ScannerConfig configures the file scanner behavior.
 type ScannerConfig struct {
-	IgnorePatterns []string `json:"ignorePatterns"`
-	MaxFileSize    int64    `json:"maxFileSize"`
-	MaxFiles       int      `json:"maxFiles"`
+	IgnorePatterns   []string `json:"ignorePatterns" yaml:"ignorePatterns"`
+	MaxFileSize      int64    `json:"maxFileSize" yaml:"maxFileSize"`
+	MinFileSize      int64    `json:"minFileSize" yaml:"minFileSize"`
+	MaxFiles         int      `json:"maxFiles" yaml:"maxFiles"`
+	IncludeHidden    bool     `json:"includeHidden" yaml:"includeHidden"`
+	IncludeGenerated bool     `json:"includeGenerated" yaml:"includeGenerated"`
+	LanguageIgnores  bool     `json:"languageIgnores" yaml:"languageIgnores"`
+	ResultBuffer     int      `json:"resultBuffer" yaml:"resultBuffer"`
+	MaxInvalidUTF8   int      `json:"maxInvalidUTF8" yaml:"maxInvalidUTF8"`
+	BinarySampleSize int      `json:"binarySampleSize" yaml:"binarySampleSize"`
+	BinaryThreshold  float64  `json:"binaryThreshold" yaml:"binaryThreshold"`
+	// ExcludeContentTypes skips files by the media type of their content
+	ExcludeContentTypes []string `json:"excludeContentTypes,omitempty" yaml:"excludeContentTypes,omitempty"`
+	// Timeout is a duration such as "30s" after which the scan stops,
+	// keeping the files found so far; empty means no limit
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// ScanTimeout returns the parsed Timeout, or zero for no limit. Validate
+// rejects timeouts that don't parse.
+func (c ScannerConfig) ScanTimeout() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
 }
 
 // ProcessorConfig configures content processing behavior.
 type ProcessorConfig struct {
-	MaxChunkSize   int64 `json:"maxChunkSize"`
-	ChunkOverlap   int   `json:"chunkOverlap"`
-	MaxTokens      int   `json:"maxTokens"`
-	StripComments  bool  `json:"stripComments"`
-	DetectLanguage bool  `json:"detectLanguage"`
+	MaxChunkSize        int64               `json:"maxChunkSize" yaml:"maxChunkSize"`
+	ChunkOverlap        int                 `json:"chunkOverlap" yaml:"chunkOverlap"`
+	MaxTokens           int                 `json:"maxTokens" yaml:"maxTokens"`
+	StripComments       bool                `json:"stripComments" yaml:"stripComments"`
+	StripDocstrings     bool                `json:"stripDocstrings" yaml:"stripDocstrings"`
+	DetectLanguage      bool                `json:"detectLanguage" yaml:"detectLanguage"`
+	Tokenizer           types.TokenizerType `json:"tokenizer" yaml:"tokenizer"`
+	TokenizerVocab      string              `json:"tokenizerVocab,omitempty" yaml:"tokenizerVocab,omitempty"`
+	SemanticChunks      bool                `json:"semanticChunks" yaml:"semanticChunks"`
+	StripBlankLines     bool                `json:"stripBlankLines" yaml:"stripBlankLines"`
+	CollapseWhitespace  bool                `json:"collapseWhitespace" yaml:"collapseWhitespace"`
+	Dedent              bool                `json:"dedent" yaml:"dedent"`
+	RedactSecrets       bool                `json:"redactSecrets" yaml:"redactSecrets"`
+	RedactRules         []types.RedactRule  `json:"redactRules,omitempty" yaml:"redactRules,omitempty"`
+	PreserveLineEndings bool                `json:"preserveLineEndings" yaml:"preserveLineEndings"`
+	CacheSize           int64               `json:"cacheSize" yaml:"cacheSize"`
+	AllowSensitive      bool                `json:"allowSensitive" yaml:"allowSensitive"`
 }
 
 // WriterConfig configures output writing behavior.
 type WriterConfig struct {
-	OutputPath  string             `json:"outputPath"`
-	Format      types.OutputFormat `json:"format"`
-	PrettyPrint bool               `json:"prettyPrint"`
+	OutputPath           string                `json:"outputPath" yaml:"outputPath"`
+	OutputPattern        string                `json:"outputPattern,omitempty" yaml:"outputPattern,omitempty"`
+	Format               types.OutputFormat    `json:"format" yaml:"format"`
+	PrettyPrint          bool                  `json:"prettyPrint" yaml:"prettyPrint"`
+	LanguageTokenBudgets map[string]int        `json:"languageTokenBudgets,omitempty" yaml:"languageTokenBudgets,omitempty"`
+	ScopedTrees          bool                  `json:"scopedTrees" yaml:"scopedTrees"`
+	IncludeRepoInfo      bool                  `json:"includeRepoInfo" yaml:"includeRepoInfo"`
+	TemplatePath         string                `json:"templatePath,omitempty" yaml:"templatePath,omitempty"`
+	EmitChunks           bool                  `json:"emitChunks" yaml:"emitChunks"`
+	IncludeMetadata      bool                  `json:"includeMetadata" yaml:"includeMetadata"`
+	IncludeTokenCounts   bool                  `json:"includeTokenCounts" yaml:"includeTokenCounts"`
+	Stream               bool                  `json:"stream" yaml:"stream"`
+	FlushConcurrency     int                   `json:"flushConcurrency" yaml:"flushConcurrency"`
+	EncodeContent        types.ContentEncoding `json:"encodeContent,omitempty" yaml:"encodeContent,omitempty"`
+	SplitByTopDir        bool                  `json:"splitByTopDir" yaml:"splitByTopDir"`
+	TreeMaxDepth         int                   `json:"treeMaxDepth" yaml:"treeMaxDepth"`
+	TreeShowSizes        bool                  `json:"treeShowSizes" yaml:"treeShowSizes"`
+	AutoFlushChanges     int                   `json:"autoFlushChanges" yaml:"autoFlushChanges"`
+	// AutoFlushInterval is a duration such as "30s" after which changes to
+	// the selection are written to the output; empty only writes on quit
+	AutoFlushInterval string `json:"autoFlushInterval,omitempty" yaml:"autoFlushInterval,omitempty"`
+}
+
+// AutoFlushEvery returns the parsed AutoFlushInterval, or zero when it is
+// disabled. Validate rejects intervals that don't parse.
+func (c WriterConfig) AutoFlushEvery() time.Duration {
+	d, _ := time.ParseDuration(c.AutoFlushInterval)
+	return d
 }
 
 // UIConfig configures the user interface behavior.
 type UIConfig struct {
-	PreviewWidth int               `json:"previewWidth"`
-	Theme        string            `json:"theme"`
-	KeyBindings  map[string]string `json:"keyBindings"`
-	CustomTheme  map[string]string `json:"customTheme,omitempty"`
+	PreviewWidth     int               `json:"previewWidth" yaml:"previewWidth"`
+	MaxOpenPreviews  int               `json:"maxOpenPreviews" yaml:"maxOpenPreviews"`
+	Theme            string            `json:"theme" yaml:"theme"`
+	KeyBindings      map[string]string `json:"keyBindings" yaml:"keyBindings"`
+	CustomTheme      map[string]string `json:"customTheme,omitempty" yaml:"customTheme,omitempty"`
+	PriorityGlobs    []string          `json:"priorityGlobs,omitempty" yaml:"priorityGlobs,omitempty"`
+	ScanRefreshMs    int               `json:"scanRefreshMs" yaml:"scanRefreshMs"`
+	SearchDebounceMs int               `json:"searchDebounceMs" yaml:"searchDebounceMs"`
+	ImagePreview     string            `json:"imagePreview" yaml:"imagePreview"`
+	PreviewHeader    []string          `json:"previewHeader" yaml:"previewHeader"`
+	RestoreSelection bool              `json:"restoreSelection" yaml:"restoreSelection"`
+	SortBy           string            `json:"sortBy" yaml:"sortBy"`
+	SearchRanking    string            `json:"searchRanking" yaml:"searchRanking"`
+	ShowSizes        bool              `json:"showSizes" yaml:"showSizes"`
+	ConfirmQuit      bool              `json:"confirmQuit" yaml:"confirmQuit"`
+	PreviewWrap      bool              `json:"previewWrap" yaml:"previewWrap"`
+	TokenBudget      int               `json:"tokenBudget" yaml:"tokenBudget"`
+}
+
+// CommandConfig defines a virtual file holding the output of a shell command.
+type CommandConfig struct {
+	// Path is the file's path in the output; it defaults to "$ " followed
+	// by the command
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+	Command string `json:"command" yaml:"command"`
+	// Timeout is a duration such as "30s"; it defaults to ten seconds
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
 }
 
-// LoadConfig loads configuration from the specified path.
+// LoadConfig loads configuration from the specified path, which is parsed as
+// YAML if it ends in .yaml or .yml and as JSON otherwise. Settings the file
+// leaves out keep their defaults, so a file only needs what it changes.
 func LoadConfig(path string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -66,32 +157,41 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	config := *DefaultConfig()
+	if isYAML(path) {
+		err = yaml.Unmarshal(data, &config)
+	} else {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("parsing config file: %w", err)
 	}
-
-	var extension string
-	switch config.Writer.Format {
-	case types.OutputFormatJSON:
-		extension = ".json"
-	case types.OutputFormatYAML:
-		extension = ".yaml"
-	default:
-		extension = ".xml"
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := config.UI.ValidateTheme(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
 	}
-	config.Writer.OutputPath = generateRandomFilename(extension)
+
+	config.Writer.OutputPath = config.Writer.defaultOutputPath()
 	return &config, nil
 }
 
-// SaveConfig saves the configuration to the specified path.
+// SaveConfig saves the configuration to the specified path, as YAML or JSON
+// depending on its extension like LoadConfig.
 func SaveConfig(config *Config, path string) error {
 	// Ensure directory exists
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return fmt.Errorf("creating config directory: %w", err)
 	}
 
-	data, err := json.MarshalIndent(config, "", "  ")
+	var data []byte
+	var err error
+	if isYAML(path) {
+		data, err = yaml.Marshal(config)
+	} else {
+		data, err = json.MarshalIndent(config, "", "  ")
+	}
 	if err != nil {
 		return fmt.Errorf("encoding config: %w", err)
 	}
@@ -103,6 +203,78 @@ func SaveConfig(config *Config, path string) error {
 	return nil
 }
 
+// AddIgnorePattern appends pattern to the scanner's ignore patterns in the
+// config file at path, creating the file if needed. Only that setting is
+// changed; the file's other settings are written back as they were, though
+// their keys end up sorted. A file that doesn't set ignore patterns gets the
+// defaults plus pattern, so the defaults keep applying.
+func AddIgnorePattern(path, pattern string) error {
+	settings := make(map[string]any)
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("reading config file: %w", err)
+	case isYAML(path):
+		err = yaml.Unmarshal(data, &settings)
+	default:
+		err = json.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+	if settings == nil {
+		// An empty YAML file
+		settings = make(map[string]any)
+	}
+
+	scanner, ok := settings["scanner"].(map[string]any)
+	if !ok {
+		scanner = make(map[string]any)
+		settings["scanner"] = scanner
+	}
+	var patterns []any
+	if existing, ok := scanner["ignorePatterns"].([]any); ok {
+		patterns = existing
+	} else {
+		for _, p := range DefaultConfig().Scanner.IgnorePatterns {
+			patterns = append(patterns, p)
+		}
+	}
+	for _, p := range patterns {
+		if p == pattern {
+			return nil
+		}
+	}
+	scanner["ignorePatterns"] = append(patterns, pattern)
+
+	if isYAML(path) {
+		data, err = yaml.Marshal(settings)
+	} else {
+		data, err = json.MarshalIndent(settings, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("encoding config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating config directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("writing config file: %w", err)
+	}
+	return nil
+}
+
+// isYAML reports whether the config file at path is YAML, judged by its
+// extension. Anything else is JSON.
+func isYAML(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
 // GetConfigPath returns the default configuration file path.
 func GetConfigPath() string {
 	home, err := os.UserHomeDir()
@@ -117,21 +289,173 @@ func (c *Config) Validate() error {
 	if c.Scanner.MaxFileSize < 0 {
 		return fmt.Errorf("maxFileSize must be non-negative")
 	}
+	if c.Scanner.MinFileSize < 0 {
+		return fmt.Errorf("minFileSize must be non-negative")
+	}
 	if c.Scanner.MaxFiles < 0 {
 		return fmt.Errorf("maxFiles must be non-negative")
 	}
+	if c.UI.ScanRefreshMs < 0 {
+		return fmt.Errorf("scanRefreshMs must be non-negative")
+	}
+	if c.UI.SearchDebounceMs < 0 {
+		return fmt.Errorf("searchDebounceMs must be non-negative")
+	}
+	switch c.UI.ImagePreview {
+	case "", "auto", "kitty", "sixel", "off":
+	default:
+		return fmt.Errorf("unsupported imagePreview %q (must be auto, kitty, sixel or off)", c.UI.ImagePreview)
+	}
+	switch c.UI.SortBy {
+	case "", "scan", "path", "size", "modified":
+	default:
+		return fmt.Errorf("unsupported sortBy %q (must be scan, path, size or modified)", c.UI.SortBy)
+	}
+	switch c.UI.SearchRanking {
+	case "", "score", "name", "mtime":
+	default:
+		return fmt.Errorf("unsupported searchRanking %q (must be score, name or mtime)", c.UI.SearchRanking)
+	}
+	for _, segment := range c.UI.PreviewHeader {
+		switch segment {
+		case "path", "lines", "size", "modified", "symbols", "git":
+		default:
+			return fmt.Errorf("unsupported previewHeader segment %q (must be path, lines, size, modified, symbols or git)", segment)
+		}
+	}
+	if c.Scanner.ResultBuffer < 0 {
+		return fmt.Errorf("resultBuffer must be non-negative")
+	}
+	if c.Writer.TreeMaxDepth < 0 {
+		return fmt.Errorf("treeMaxDepth must be non-negative")
+	}
+	if c.Scanner.MaxInvalidUTF8 < 0 {
+		return fmt.Errorf("maxInvalidUTF8 must be non-negative")
+	}
+	if c.Scanner.BinarySampleSize <= 0 {
+		return fmt.Errorf("binarySampleSize must be positive")
+	}
+	if c.Scanner.BinaryThreshold <= 0 || c.Scanner.BinaryThreshold > 1 {
+		return fmt.Errorf("binaryThreshold must be greater than 0 and at most 1")
+	}
+	if c.Scanner.Timeout != "" {
+		if d, err := time.ParseDuration(c.Scanner.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid scanner timeout: %s", c.Scanner.Timeout)
+		}
+	}
+	for _, contentType := range c.Scanner.ExcludeContentTypes {
+		if err := fs.ValidateContentType(contentType); err != nil {
+			return fmt.Errorf("invalid excluded content type %q: %w", contentType, err)
+		}
+	}
 	if c.Processor.MaxChunkSize < 0 {
 		return fmt.Errorf("maxChunkSize must be non-negative")
 	}
 	if c.Processor.ChunkOverlap < 0 {
 		return fmt.Errorf("chunkOverlap must be non-negative")
 	}
+	// A zero maxChunkSize uses the processor's default
+	if c.Processor.MaxChunkSize > 0 && int64(c.Processor.ChunkOverlap) >= c.Processor.MaxChunkSize {
+		return fmt.Errorf("chunkOverlap (%d) must be less than maxChunkSize (%d)", c.Processor.ChunkOverlap, c.Processor.MaxChunkSize)
+	}
 	if c.Processor.MaxTokens < 0 {
 		return fmt.Errorf("maxTokens must be non-negative")
 	}
+	if c.Processor.CacheSize < 0 {
+		return fmt.Errorf("cacheSize must be non-negative")
+	}
+	switch c.Processor.Tokenizer {
+	case "", types.TokenizerHeuristic:
+	case types.TokenizerCL100K:
+		if c.Processor.TokenizerVocab == "" {
+			return fmt.Errorf("tokenizer %s requires tokenizerVocab", c.Processor.Tokenizer)
+		}
+	default:
+		return fmt.Errorf("unsupported tokenizer: %s", c.Processor.Tokenizer)
+	}
+	if !knownFormat(c.Writer.Format) {
+		return fmt.Errorf("unsupported format %q (must be xml, json, jsonl, yaml, text, markdown, csv, or template)", c.Writer.Format)
+	}
+	if c.Writer.Format == types.OutputFormatTemplate && c.Writer.TemplatePath == "" {
+		return fmt.Errorf("format template requires templatePath")
+	}
+	if c.Writer.Stream && c.Writer.ScopedTrees {
+		return fmt.Errorf("stream cannot be combined with scopedTrees")
+	}
+	if c.Writer.FlushConcurrency < 0 {
+		return fmt.Errorf("flushConcurrency must be non-negative")
+	}
+	switch c.Writer.EncodeContent {
+	case "", types.ContentEncodingNone:
+	case types.ContentEncodingBase64, types.ContentEncodingGzipBase64:
+		switch c.Writer.Format {
+		case types.OutputFormatXML, types.OutputFormatJSON, types.OutputFormatJSONL, types.OutputFormatYAML:
+		default:
+			return fmt.Errorf("encodeContent requires the xml, json, jsonl or yaml format")
+		}
+	default:
+		return fmt.Errorf("unsupported encodeContent %q (must be none, base64 or gzip-base64)", c.Writer.EncodeContent)
+	}
+	for i, rule := range c.Processor.RedactRules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("redactRules[%d] requires a pattern", i)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("redactRules[%d] has an invalid pattern: %w", i, err)
+		}
+	}
+	if c.UI.TokenBudget < 0 {
+		return fmt.Errorf("tokenBudget must be non-negative")
+	}
+	if err := validateOutputPattern(c.Writer.OutputPattern); err != nil {
+		return err
+	}
+	if c.Writer.AutoFlushInterval != "" {
+		if d, err := time.ParseDuration(c.Writer.AutoFlushInterval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid autoFlushInterval: %s", c.Writer.AutoFlushInterval)
+		}
+	}
+	if c.Writer.AutoFlushChanges < 0 {
+		return fmt.Errorf("autoFlushChanges must be non-negative")
+	}
+	for lang, budget := range c.Writer.LanguageTokenBudgets {
+		if budget < 0 {
+			return fmt.Errorf("languageTokenBudgets[%s] must be non-negative", lang)
+		}
+	}
+	for i, cmd := range c.Commands {
+		if strings.TrimSpace(cmd.Command) == "" {
+			return fmt.Errorf("commands[%d] requires a command", i)
+		}
+		if cmd.Timeout != "" {
+			if d, err := time.ParseDuration(cmd.Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("commands[%d] has an invalid timeout: %s", i, cmd.Timeout)
+			}
+		}
+	}
+	for _, pattern := range c.Scanner.IgnorePatterns {
+		if err := ignore.Validate(pattern); err != nil {
+			return fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+	}
+	for _, glob := range c.UI.PriorityGlobs {
+		if err := ignore.Validate(glob); err != nil {
+			return fmt.Errorf("invalid priority glob %q: %w", glob, err)
+		}
+	}
 	return nil
 }
 
+// knownFormat reports whether format is one of the supported output formats.
+func knownFormat(format types.OutputFormat) bool {
+	switch format {
+	case types.OutputFormatXML, types.OutputFormatJSON, types.OutputFormatJSONL, types.OutputFormatYAML,
+		types.OutputFormatText, types.OutputFormatMarkdown, types.OutputFormatTemplate, types.OutputFormatCSV:
+		return true
+	}
+	return false
+}
+
 // ValidateTheme checks if the theme configuration is valid.
 func (c *UIConfig) ValidateTheme() error {
 	if c.Theme == "" {
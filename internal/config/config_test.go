@@ -0,0 +1,350 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const jsonConfig = `{
+  "scanner": {
+    "ignorePatterns": ["node_modules", "*.log"],
+    "maxFileSize": 2048,
+    "minFileSize": 1,
+    "maxFiles": 50,
+    "includeHidden": true
+  },
+  "processor": {
+    "maxChunkSize": 1024,
+    "chunkOverlap": 10,
+    "maxTokens": 500,
+    "stripComments": true,
+    "tokenizer": "heuristic"
+  },
+  "writer": {
+    "format": "yaml",
+    "prettyPrint": true,
+    "languageTokenBudgets": {"go": 1000},
+    "flushConcurrency": 4
+  },
+  "ui": {
+    "previewWidth": 40,
+    "theme": "default",
+    "keyBindings": {"quit": "q"},
+    "priorityGlobs": ["**/main.go"]
+  }
+}`
+
+const yamlConfig = `scanner:
+  ignorePatterns: [node_modules, "*.log"]
+  maxFileSize: 2048
+  minFileSize: 1
+  maxFiles: 50
+  includeHidden: true
+processor:
+  maxChunkSize: 1024
+  chunkOverlap: 10
+  maxTokens: 500
+  stripComments: true
+  tokenizer: heuristic
+writer:
+  format: yaml
+  prettyPrint: true
+  languageTokenBudgets:
+    go: 1000
+  flushConcurrency: 4
+ui:
+  previewWidth: 40
+  theme: default
+  keyBindings:
+    quit: q
+  priorityGlobs:
+    - "**/main.go"
+`
+
+// loadTestConfig writes data to name in a temporary directory and loads it.
+// The output path is random, so it is checked and then cleared.
+func loadTestConfig(t *testing.T, name, data string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig(%s) error = %v", name, err)
+	}
+	if filepath.Ext(cfg.Writer.OutputPath) != ".yaml" {
+		t.Errorf("LoadConfig(%s) output path = %s, want a .yaml file", name, cfg.Writer.OutputPath)
+	}
+	cfg.Writer.OutputPath = ""
+	return cfg
+}
+
+func TestLoadConfigYAMLMatchesJSON(t *testing.T) {
+	want := loadTestConfig(t, "config.json", jsonConfig)
+	if want.Scanner.MaxFiles != 50 || want.UI.PriorityGlobs[0] != "**/main.go" {
+		t.Fatalf("JSON config not parsed: %+v", want)
+	}
+
+	for _, name := range []string{"config.yaml", "config.yml", "config.YAML"} {
+		if got := loadTestConfig(t, name, yamlConfig); !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadConfig(%s) = %+v, want %+v", name, got, want)
+		}
+	}
+
+	// Anything but a YAML extension is still JSON
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("LoadConfig() of YAML without a YAML extension should fail")
+	}
+}
+
+func TestSaveConfigRoundTrip(t *testing.T) {
+	want := DefaultConfig()
+	for _, name := range []string{"config.json", "config.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := SaveConfig(want, path); err != nil {
+				t.Fatalf("SaveConfig() error = %v", err)
+			}
+			got, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			// LoadConfig picks a fresh output path
+			got.Writer.OutputPath = want.Writer.OutputPath
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadConfig() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"PFZF_FORMAT":         "JSON",
+		"PFZF_OUTPUT":         "ctx.json",
+		"PFZF_MAX_FILE_SIZE":  "2097152",
+		"PFZF_INCLUDE_HIDDEN": "false",
+		"PFZF_MAX_TOKENS":     " 300 ",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg := DefaultConfig()
+	if err := cfg.ApplyEnv(lookup); err != nil {
+		t.Fatalf("ApplyEnv() error = %v", err)
+	}
+	if cfg.Writer.Format != "json" || cfg.Writer.OutputPath != "ctx.json" {
+		t.Errorf("writer = %s to %s, want json to ctx.json", cfg.Writer.Format, cfg.Writer.OutputPath)
+	}
+	if cfg.Scanner.MaxFileSize != 2097152 || cfg.Scanner.IncludeHidden || cfg.Processor.MaxTokens != 300 {
+		t.Errorf("scanner = %+v, maxTokens = %d", cfg.Scanner, cfg.Processor.MaxTokens)
+	}
+	// Unset variables keep the file's settings
+	if want := DefaultConfig().Scanner.MaxFiles; cfg.Scanner.MaxFiles != want {
+		t.Errorf("MaxFiles = %d, want %d", cfg.Scanner.MaxFiles, want)
+	}
+
+	env = map[string]string{
+		"PFZF_MAX_FILE_SIZE":  "2MB",
+		"PFZF_FORMAT":         "docx",
+		"PFZF_STRIP_COMMENTS": "sometimes",
+		"PFZF_MAX_FILES":      "12",
+	}
+	cfg = DefaultConfig()
+	err := cfg.ApplyEnv(lookup)
+	if err == nil {
+		t.Fatal("ApplyEnv() with malformed values should fail")
+	}
+	for _, want := range []string{`PFZF_MAX_FILE_SIZE: "2MB"`, `PFZF_FORMAT: unsupported format "docx"`, `PFZF_STRIP_COMMENTS: "sometimes"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ApplyEnv() error = %v, want it to mention %s", err, want)
+		}
+	}
+	if cfg.Scanner.MaxFiles != 12 {
+		t.Errorf("MaxFiles = %d, want valid variables applied despite errors", cfg.Scanner.MaxFiles)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	root := t.TempDir()
+	mkdir := func(parts ...string) string {
+		dir := filepath.Join(append([]string{root}, parts...)...)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		return dir
+	}
+	write := func(path string) {
+		if err := os.WriteFile(path, []byte(`{"writer": {"format": "json"}}`), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	// outer/.pfzf.json sits above the repository and must not be found
+	write(filepath.Join(mkdir("outer"), ".pfzf.json"))
+	repo := mkdir("outer", "repo")
+	mkdir("outer", "repo", ".git")
+	deep := mkdir("outer", "repo", "pkg", "deep")
+
+	if _, err := Discover(deep); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Discover() error = %v, want fs.ErrNotExist", err)
+	}
+
+	write(filepath.Join(repo, ".pfzf.yaml"))
+	if got, err := Discover(deep); err != nil || got != filepath.Join(repo, ".pfzf.yaml") {
+		t.Errorf("Discover() = %q, %v; want the repository config", got, err)
+	}
+
+	// The nearest config wins, and JSON over YAML in the same directory
+	pkg := filepath.Join(repo, "pkg")
+	write(filepath.Join(pkg, ".pfzf.yml"))
+	write(filepath.Join(pkg, ".pfzf.json"))
+	if got, err := Discover(deep); err != nil || got != filepath.Join(pkg, ".pfzf.json") {
+		t.Errorf("Discover() = %q, %v; want the nearest config", got, err)
+	}
+}
+
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".pfzf.json")
+	if err := os.WriteFile(path, []byte(`{"writer": {"format": "json"}, "scanner": {"ignorePatterns": ["dist"]}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	defaults := DefaultConfig()
+	if cfg.Writer.Format != "json" || !reflect.DeepEqual(cfg.Scanner.IgnorePatterns, []string{"dist"}) {
+		t.Errorf("LoadConfig() format = %s, ignorePatterns = %v", cfg.Writer.Format, cfg.Scanner.IgnorePatterns)
+	}
+	if cfg.Scanner.MaxFileSize != defaults.Scanner.MaxFileSize || !cfg.Scanner.IncludeHidden {
+		t.Errorf("LoadConfig() scanner = %+v, want unset keys to keep their defaults", cfg.Scanner)
+	}
+}
+
+func TestOutputPattern(t *testing.T) {
+	now := time.Date(2026, 3, 4, 15, 6, 7, 0, time.UTC)
+	got := expandOutputPattern("out/context_{dir}_{date}.{ext}", "/home/me/pfzf", ".json", now)
+	if want := "out/context_pfzf_20260304-150607.json"; got != want {
+		t.Errorf("expandOutputPattern() = %q, want %q", got, want)
+	}
+	if got := expandOutputPattern("ctx_{rand}{unknown}", ".", ".xml", now); !regexp.MustCompile(`^ctx_[0-9a-f]{16}\{unknown\}$`).MatchString(got) {
+		t.Errorf("expandOutputPattern() = %q, want 16 random hex digits", got)
+	}
+
+	// LoadConfig names the output after the pattern, with the format's
+	// extension
+	path := filepath.Join(t.TempDir(), ".pfzf.json")
+	if err := os.WriteFile(path, []byte(`{"writer": {"format": "markdown", "outputPattern": "context_{date}.{ext}"}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if !regexp.MustCompile(`^context_\d{8}-\d{6}\.md$`).MatchString(cfg.Writer.OutputPath) {
+		t.Errorf("OutputPath = %q, want the expanded pattern", cfg.Writer.OutputPath)
+	}
+}
+
+func TestLoadConfigValidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{
+			name:    "negative maxFileSize",
+			data:    `{"scanner": {"maxFileSize": -1}}`,
+			wantErr: "maxFileSize must be non-negative",
+		},
+		{
+			name:    "unknown format",
+			data:    `{"writer": {"format": "docx"}}`,
+			wantErr: `unsupported format "docx"`,
+		},
+		{
+			name:    "overlap as large as chunk",
+			data:    `{"processor": {"maxChunkSize": 100, "chunkOverlap": 100}}`,
+			wantErr: "chunkOverlap (100) must be less than maxChunkSize (100)",
+		},
+		{
+			name:    "invalid redaction rule",
+			data:    `{"processor": {"redactRules": [{"name": "bad", "pattern": "("}]}}`,
+			wantErr: "redactRules[0] has an invalid pattern",
+		},
+		{
+			name:    "unknown output pattern token",
+			data:    `{"writer": {"outputPattern": "context_{time}.xml"}}`,
+			wantErr: "unknown outputPattern token {time}",
+		},
+		{
+			name:    "invalid auto flush interval",
+			data:    `{"writer": {"autoFlushInterval": "soon"}}`,
+			wantErr: "invalid autoFlushInterval: soon",
+		},
+		{
+			name:    "binary threshold above one",
+			data:    `{"scanner": {"binaryThreshold": 1.5}}`,
+			wantErr: "binaryThreshold must be greater than 0 and at most 1",
+		},
+		{
+			name:    "negative cache size",
+			data:    `{"processor": {"cacheSize": -1}}`,
+			wantErr: "cacheSize must be non-negative",
+		},
+		{
+			name:    "negative search debounce",
+			data:    `{"ui": {"searchDebounceMs": -1}}`,
+			wantErr: "searchDebounceMs must be non-negative",
+		},
+		{
+			name:    "negative token budget",
+			data:    `{"ui": {"tokenBudget": -1}}`,
+			wantErr: "tokenBudget must be non-negative",
+		},
+		{
+			name:    "incomplete custom theme",
+			data:    `{"ui": {"theme": "mine", "customTheme": {"background": "black"}}}`,
+			wantErr: "custom theme missing required color",
+		},
+		{
+			name: "overlap with default chunk size",
+			data: `{"processor": {"maxChunkSize": 0, "chunkOverlap": 100}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+			_, err := LoadConfig(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), path) {
+				t.Errorf("LoadConfig() error = %v, want %q naming the file", err, tt.wantErr)
+			}
+		})
+	}
+}
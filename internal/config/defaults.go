@@ -29,31 +29,72 @@ func DefaultConfig() *Config {
 				"_build",
 				"deps",
 			},
-			MaxFileSize: 4 << 20, // 4MB
-			MaxFiles:    1000,
+			MaxFileSize:      4 << 20, // 4MB
+			MaxFiles:         1000,
+			IncludeHidden:    true,
+			LanguageIgnores:  true,
+			ResultBuffer:     256,
+			MaxInvalidUTF8:   8,
+			BinarySampleSize: 512,
+			BinaryThreshold:  0.3,
 		},
 		Processor: ProcessorConfig{
-			MaxChunkSize:   4096,
-			ChunkOverlap:   200,
-			MaxTokens:      2000,
-			StripComments:  false,
-			DetectLanguage: true,
+			MaxChunkSize:    4096,
+			ChunkOverlap:    200,
+			MaxTokens:       2000,
+			StripComments:   false,
+			StripDocstrings: false,
+			DetectLanguage:  true,
+			Tokenizer:       types.TokenizerHeuristic,
+			CacheSize:       64 << 20, // 64MB
 		},
 		Writer: WriterConfig{
-			OutputPath:  generateRandomFilename(".xml"),
-			Format:      types.OutputFormatXML,
-			PrettyPrint: true,
+			OutputPath:      generateRandomFilename(".xml"),
+			Format:          types.OutputFormatXML,
+			PrettyPrint:     true,
+			IncludeRepoInfo: true,
 		},
 		UI: UIConfig{
-			PreviewWidth: 50,
-			Theme:        "default",
+			PreviewWidth:     50,
+			MaxOpenPreviews:  4,
+			ScanRefreshMs:    50,
+			SearchDebounceMs: 100,
+			ImagePreview:     "auto",
+			PreviewHeader:    []string{"path", "lines"},
+			RestoreSelection: true,
+			SortBy:           "path",
+			SearchRanking:    "score",
+			ShowSizes:        true,
+			ConfirmQuit:      true,
+			PreviewWrap:      true,
+			Theme:            "default",
 			KeyBindings: map[string]string{
-				"quit":           "q",
-				"select":         "space",
-				"toggle_preview": "p",
-				"help":           "?",
-				"focus_search":   "/",
-				"clear_search":   "esc",
+				"quit":              "q",
+				"select":            "space",
+				"toggle_preview":    "p",
+				"help":              "?",
+				"focus_search":      "/",
+				"clear_search":      "esc",
+				"output_preview":    "o",
+				"move_up":           "",
+				"move_down":         "",
+				"filter_selection":  "f",
+				"focus_preview":     "tab",
+				"preview_page_up":   "ctrl-u",
+				"preview_page_down": "ctrl-d",
+				"preview_top":       "g",
+				"preview_bottom":    "G",
+				"next_match":        "n",
+				"prev_match":        "N",
+				"copy_path":         "y",
+				"copy_output":       "Y",
+				"restore_selection": "R",
+				"sort":              "s",
+				"ignore_pattern":    "i",
+				"invert_selection":  "I",
+				"copy_output_path":  "P",
+				"open_output":       "O",
+				"toggle_wrap":       "w",
 			},
 		},
 	}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// projectConfigNames are the project-local config files Discover looks for
+// in each directory, in order of preference.
+var projectConfigNames = []string{".pfzf.json", ".pfzf.yaml", ".pfzf.yml"}
+
+// Discover returns the path of the project-local config file nearest to
+// startDir, looking in startDir and then each parent up to the root of the
+// git repository or the home directory, whichever comes first. It returns an
+// error wrapping fs.ErrNotExist if there is none.
+func Discover(startDir string) (string, error) {
+	dir, err := filepath.Abs(startDir)
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", startDir, err)
+	}
+	home, _ := os.UserHomeDir()
+
+	for {
+		for _, name := range projectConfigNames {
+			path := filepath.Join(dir, name)
+			info, err := os.Stat(path)
+			if err == nil && !info.IsDir() {
+				return path, nil
+			}
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("checking %s: %w", path, err)
+			}
+		}
+
+		if dir == home || isRepoRoot(dir) {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return "", fmt.Errorf("no %s found from %s: %w", projectConfigNames[0], startDir, fs.ErrNotExist)
+}
+
+// isRepoRoot reports whether dir is the top of a git repository. Worktrees
+// and submodules have a .git file instead of a directory.
+func isRepoRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// envOverrides lists the environment variables ApplyEnv reads and the
+// setting each one overrides.
+var envOverrides = []struct {
+	name string
+	set  func(c *Config, value string) error
+}{
+	{"PFZF_OUTPUT", func(c *Config, v string) error { c.Writer.OutputPath = v; return nil }},
+	{"PFZF_FORMAT", func(c *Config, v string) error {
+		format := types.OutputFormat(strings.ToLower(v))
+		if !knownFormat(format) {
+			return fmt.Errorf("unsupported format %q", v)
+		}
+		c.Writer.Format = format
+		return nil
+	}},
+	{"PFZF_TEMPLATE", func(c *Config, v string) error { c.Writer.TemplatePath = v; return nil }},
+	{"PFZF_PRETTY_PRINT", func(c *Config, v string) error { return parseBool(v, &c.Writer.PrettyPrint) }},
+	{"PFZF_MAX_FILE_SIZE", func(c *Config, v string) error { return parseInt64(v, &c.Scanner.MaxFileSize) }},
+	{"PFZF_MIN_FILE_SIZE", func(c *Config, v string) error { return parseInt64(v, &c.Scanner.MinFileSize) }},
+	{"PFZF_MAX_FILES", func(c *Config, v string) error { return parseInt(v, &c.Scanner.MaxFiles) }},
+	{"PFZF_INCLUDE_HIDDEN", func(c *Config, v string) error { return parseBool(v, &c.Scanner.IncludeHidden) }},
+	{"PFZF_INCLUDE_GENERATED", func(c *Config, v string) error { return parseBool(v, &c.Scanner.IncludeGenerated) }},
+	{"PFZF_LANGUAGE_IGNORES", func(c *Config, v string) error { return parseBool(v, &c.Scanner.LanguageIgnores) }},
+	{"PFZF_MAX_TOKENS", func(c *Config, v string) error { return parseInt(v, &c.Processor.MaxTokens) }},
+	{"PFZF_STRIP_COMMENTS", func(c *Config, v string) error { return parseBool(v, &c.Processor.StripComments) }},
+	{"PFZF_THEME", func(c *Config, v string) error { c.UI.Theme = v; return nil }},
+}
+
+// ApplyEnv overrides settings with the PFZF_* environment variables found by
+// lookup, normally os.LookupEnv. Every variable is applied even if others are
+// malformed, and all errors are returned together.
+func (c *Config) ApplyEnv(lookup func(name string) (string, bool)) error {
+	var errs []error
+	for _, o := range envOverrides {
+		value, ok := lookup(o.name)
+		if !ok {
+			continue
+		}
+		if err := o.set(c, strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseInt64(value string, dst *int64) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a non-negative number of bytes", value)
+	}
+	*dst = n
+	return nil
+}
+
+func parseInt(value string, dst *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a non-negative number", value)
+	}
+	*dst = n
+	return nil
+}
+
+func parseBool(value string, dst *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	*dst = b
+	return nil
+}
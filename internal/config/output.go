@@ -0,0 +1,95 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// outputPatternToken matches the tokens of an outputPattern.
+var outputPatternToken = regexp.MustCompile(`\{[^{}]*\}`)
+
+// outputPatternTokens are the tokens an outputPattern may contain.
+var outputPatternTokens = map[string]bool{
+	"{dir}":  true,
+	"{date}": true,
+	"{rand}": true,
+	"{ext}":  true,
+}
+
+// outputExtension returns the file extension, with its dot, of outputs in
+// format.
+func outputExtension(format types.OutputFormat) string {
+	switch format {
+	case types.OutputFormatJSON:
+		return ".json"
+	case types.OutputFormatJSONL:
+		return ".jsonl"
+	case types.OutputFormatYAML:
+		return ".yaml"
+	case types.OutputFormatText, types.OutputFormatTemplate:
+		return ".txt"
+	case types.OutputFormatMarkdown:
+		return ".md"
+	case types.OutputFormatCSV:
+		return ".csv"
+	default:
+		return ".xml"
+	}
+}
+
+// defaultOutputPath returns the output path used when none is given: the
+// expanded OutputPattern, or a random name when there is no pattern.
+func (c WriterConfig) defaultOutputPath() string {
+	extension := outputExtension(c.Format)
+	if c.OutputPattern == "" {
+		return generateRandomFilename(extension)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "."
+	}
+	return expandOutputPattern(c.OutputPattern, dir, extension, time.Now())
+}
+
+// expandOutputPattern replaces the tokens of pattern: {dir} with the name
+// of the directory dir, {date} with now as YYYYMMDD-HHMMSS, {rand} with 16
+// random hex digits and {ext} with extension, without its dot.
+func expandOutputPattern(pattern, dir, extension string, now time.Time) string {
+	name := filepath.Base(filepath.Clean(dir))
+	if name == string(filepath.Separator) || name == "." {
+		name = "root"
+	}
+	return outputPatternToken.ReplaceAllStringFunc(pattern, func(token string) string {
+		switch token {
+		case "{dir}":
+			return name
+		case "{date}":
+			return now.Format("20060102-150405")
+		case "{rand}":
+			b := make([]byte, 8)
+			rand.Read(b)
+			return hex.EncodeToString(b)
+		case "{ext}":
+			return strings.TrimPrefix(extension, ".")
+		}
+		return token
+	})
+}
+
+// validateOutputPattern rejects patterns with unknown tokens.
+func validateOutputPattern(pattern string) error {
+	for _, token := range outputPatternToken.FindAllString(pattern, -1) {
+		if !outputPatternTokens[token] {
+			return fmt.Errorf("unknown outputPattern token %s (must be {dir}, {date}, {rand} or {ext})", token)
+		}
+	}
+	return nil
+}
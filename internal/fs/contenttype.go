@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DetectContentType returns the media type of a file from its first bytes,
+// such as "image/png" or "text/plain", without parameters like the charset.
+// It only looks at magic bytes, so a file's extension doesn't fool it.
+func DetectContentType(head []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// MatchContentType reports whether contentType matches pattern, a media
+// type such as "application/zip" or a whole top-level type such as
+// "image/*". Matching ignores case and parameters.
+func MatchContentType(pattern, contentType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	contentType = strings.ToLower(contentType)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(contentType, prefix+"/")
+	}
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = strings.TrimSpace(contentType[:i])
+	}
+	return pattern == contentType
+}
+
+// ValidateContentType reports whether pattern is a media type or a wildcard
+// MatchContentType understands.
+func ValidateContentType(pattern string) error {
+	typ, subtype, ok := strings.Cut(strings.TrimSpace(pattern), "/")
+	if !ok || typ == "" || typ == "*" || subtype == "" || strings.ContainsAny(subtype, "/;") {
+		return fmt.Errorf("want a media type such as image/png or image/*")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// DecodeUTF16 converts text starting with a UTF-16 byte order mark to
+// UTF-8 without the mark. It reports false, returning b unchanged, when b
+// has no such mark. A trailing odd byte, such as one cut off by reading
+// only the start of a file, is dropped.
+func DecodeUTF16(b []byte) ([]byte, bool) {
+	var order binary.ByteOrder
+	switch {
+	case len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe:
+		order = binary.LittleEndian
+	case len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff:
+		order = binary.BigEndian
+	default:
+		return b, false
+	}
+
+	units := make([]uint16, 0, (len(b)-2)/2)
+	for i := 2; i+1 < len(b); i += 2 {
+		units = append(units, order.Uint16(b[i:]))
+	}
+	out := make([]byte, 0, len(units))
+	for _, r := range utf16.Decode(units) {
+		out = utf8.AppendRune(out, r)
+	}
+	return out, true
+}
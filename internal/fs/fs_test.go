@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+func TestGetDirectoryTree(t *testing.T) {
+	root := t.TempDir()
+	sizes := map[string]int{"internal/app/app.go": 4300, "internal/app/ui.go": 700, "README.md": 12}
+	for _, name := range []string{"cmd/pfzf/main.go", "internal/app/app.go", "internal/app/ui.go", "internal/fs/tree.go", "node_modules/x.js", ".env", "README.md"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, make([]byte, sizes[name]), 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts TreeOptions
+		want string
+	}{
+		{
+			name: "connectors",
+			opts: TreeOptions{IgnorePatterns: []string{"node_modules"}},
+			want: `.
+├── README.md
+├── cmd
+│   └── pfzf
+│       └── main.go
+└── internal
+    ├── app
+    │   ├── app.go
+    │   └── ui.go
+    └── fs
+        └── tree.go
+`,
+		},
+		{
+			name: "hidden",
+			opts: TreeOptions{IgnorePatterns: []string{"node_modules", "internal"}, IncludeHidden: true},
+			want: `.
+├── .env
+├── README.md
+└── cmd
+    └── pfzf
+        └── main.go
+`,
+		},
+		{
+			name: "max depth",
+			opts: TreeOptions{IgnorePatterns: []string{"node_modules"}, MaxDepth: 2},
+			want: `.
+├── README.md
+├── cmd
+│   └── pfzf
+└── internal
+    ├── app
+    └── fs
+`,
+		},
+		{
+			name: "sizes",
+			opts: TreeOptions{IgnorePatterns: []string{"node_modules", "cmd"}, MaxDepth: 2, ShowSizes: true},
+			want: `.
+├── README.md (12 B)
+└── internal (4.9 KB)
+    ├── app (4.9 KB)
+    └── fs (0 B)
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetDirectoryTree(root, tt.opts)
+			if err != nil {
+				t.Fatalf("GetDirectoryTree() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetDirectoryTree() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDirectoryTreeNodes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for name, size := range map[string]int{"go.mod": 20, "src/main.go": 100} {
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	got, err := GetDirectoryTreeNodes(root, TreeOptions{ShowSizes: true})
+	if err != nil {
+		t.Fatalf("GetDirectoryTreeNodes() error = %v", err)
+	}
+	want := &types.TreeNode{Name: ".", IsDir: true, Size: 120, Children: []*types.TreeNode{
+		{Name: "go.mod", Size: 20},
+		{Name: "src", IsDir: true, Size: 100, Children: []*types.TreeNode{
+			{Name: "main.go", Size: 100},
+		}},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("GetDirectoryTreeNodes() = %s, want %s", gotJSON, wantJSON)
+	}
+	if got, want := RenderTree(got, true), ".\n├── go.mod (20 B)\n└── src (100 B)\n    └── main.go (100 B)\n"; got != want {
+		t.Errorf("RenderTree() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{4300, "4.2 KB"},
+		{5 << 20, "5.0 MB"},
+		{3 << 30, "3.0 GB"},
+		{2 << 40, "2.0 TB"},
+		{2048 << 40, "2048.0 TB"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.n); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+)
+
+// buildFileNames lists the build definitions of Bazel and Buck, which
+// describe targets rather than code and crowd out real sources in monorepos.
+var buildFileNames = map[string]bool{
+	"BUILD":       true,
+	"BUILD.bazel": true,
+	"BUCK":        true,
+	"TARGETS":     true,
+}
+
+// IsBuildFile reports whether path names a Bazel or Buck build file.
+func IsBuildFile(path string) bool {
+	return buildFileNames[filepath.Base(path)]
+}
+
+var (
+	// goGeneratedMarker is the line Go tools put in generated files; see
+	// https://go.dev/s/generatedcode
+	goGeneratedMarker = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.\r?$`)
+
+	// generatedTag is the annotation used by Meta's and other tools. It is
+	// split so this file isn't taken for generated code itself.
+	generatedTag = []byte("@" + "generated")
+)
+
+// IsGenerated reports whether head, the start of a file, marks the file as
+// generated by a tool, either with Go's "Code generated ... DO NOT EDIT."
+// line or with generatedTag.
+func IsGenerated(head []byte) bool {
+	return bytes.Contains(head, generatedTag) || goGeneratedMarker.Match(head)
+}
@@ -1,5 +1,5 @@
 // Package fs provides a utility responsible for generating a string representation of the directory tree.
-// It ignores common patterns such as .git, .DS_Store, node_modules, and .idea.
+// It leaves out the paths matched by ignore patterns, such as .git, .DS_Store, node_modules, and .idea.
 package fs
 
 import (
@@ -7,68 +7,169 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/lc/pfzf/internal/ignore"
+	"github.com/lc/pfzf/pkg/types"
 )
 
 // TreeOptions configures the directory tree generation
 type TreeOptions struct {
 	IgnorePatterns []string
+	// IncludeHidden lists dotfiles and dot-directories; it should match the
+	// scanner's setting so the tree shows what can be selected
+	IncludeHidden bool
+	// MaxDepth limits how many levels of directories are listed; the
+	// entries of deeper directories are left out. Zero means no limit.
+	MaxDepth int
+	// ShowSizes follows each file with its size and each directory with
+	// the total size of the files shown below it, at any depth
+	ShowSizes bool
 }
 
-// shouldIgnore checks if a path should be ignored based on patterns
-func shouldIgnore(path string, patterns []string) bool {
-	for _, pattern := range patterns {
-		if pattern == "" {
-			continue
+// IsHidden reports whether any component of the relative path rel is a
+// dotfile or dot-directory.
+func IsHidden(rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") && part != "." && part != ".." {
+			return true
 		}
+	}
+	return false
+}
 
-		// Handle glob patterns
-		if strings.Contains(pattern, "*") {
-			matched, err := filepath.Match(pattern, filepath.Base(path))
-			if err == nil && matched {
-				return true
-			}
+// GetDirectoryTree returns a string representation of the directory tree,
+// drawn by RenderTree.
+func GetDirectoryTree(root string, opts TreeOptions) (string, error) {
+	node, err := GetDirectoryTreeNodes(root, opts)
+	if err != nil {
+		return "", err
+	}
+	return RenderTree(node, opts.ShowSizes), nil
+}
+
+// GetDirectoryTreeNodes returns the directory tree under root as nested
+// nodes, the root named ".". Each directory's entries are sorted by name.
+// With opts.ShowSizes each node has its size.
+func GetDirectoryTreeNodes(root string, opts TreeOptions) (*types.TreeNode, error) {
+	children, size, err := collectTree(root, ".", 1, ignore.New(opts.IgnorePatterns), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &types.TreeNode{Name: ".", IsDir: true, Size: size, Children: children}, nil
+}
+
+// collectTree returns the shown entries of dir, at rel from the root, and
+// their total size. Entries matched by ignored are left out, like the
+// scanner leaves them out. Directories deeper than opts.MaxDepth have no
+// children, though with opts.ShowSizes their files still count toward the
+// totals.
+func collectTree(dir, rel string, depth int, ignored *ignore.Matcher, opts TreeOptions) ([]*types.TreeNode, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var nodes []*types.TreeNode
+	var total int64
+	for _, entry := range entries {
+		entryRel := filepath.Join(rel, entry.Name())
+		if ignored.Match(entryRel) != "" || (!opts.IncludeHidden && IsHidden(entryRel)) {
 			continue
 		}
-
-		// Handle direct matches and path components
-		if strings.Contains(path, pattern) {
-			return true
+		node := &types.TreeNode{Name: entry.Name(), IsDir: entry.IsDir()}
+		listed := opts.MaxDepth <= 0 || depth < opts.MaxDepth
+		switch {
+		case node.IsDir && (listed || opts.ShowSizes):
+			children, size, err := collectTree(filepath.Join(dir, entry.Name()), entryRel, depth+1, ignored, opts)
+			if err != nil {
+				return nil, 0, err
+			}
+			node.Size = size
+			if listed {
+				node.Children = children
+			}
+		case !node.IsDir && opts.ShowSizes:
+			info, err := entry.Info()
+			if err != nil {
+				return nil, 0, err
+			}
+			node.Size = info.Size()
 		}
+		total += node.Size
+		nodes = append(nodes, node)
 	}
-	return false
+	return nodes, total, nil
 }
 
-// GetDirectoryTree returns a string representation of the directory tree
-func GetDirectoryTree(root string, opts TreeOptions) (string, error) {
+// RenderTree draws the tree under root like tree(1): the last entry of each
+// directory is marked └── and │ continues the lines of directories with
+// more entries below. showSizes follows each entry with its size. A nil
+// root renders as "".
+func RenderTree(root *types.TreeNode, showSizes bool) string {
+	if root == nil {
+		return ""
+	}
 	var tree strings.Builder
-	tree.WriteString(".\n")
+	tree.WriteString(root.Name + "\n")
+	writeTree(&tree, root.Children, "", showSizes)
+	return tree.String()
+}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// writeTree writes nodes and their children, each line starting with
+// prefix.
+func writeTree(tree *strings.Builder, nodes []*types.TreeNode, prefix string, showSizes bool) {
+	for i, node := range nodes {
+		connector, indent := "├── ", "│   "
+		if i == len(nodes)-1 {
+			connector, indent = "└── ", "    "
 		}
-		if path == root {
-			return nil
+		fmt.Fprintf(tree, "%s%s%s", prefix, connector, node.Name)
+		if showSizes {
+			fmt.Fprintf(tree, " (%s)", FormatSize(node.Size))
 		}
+		tree.WriteString("\n")
+		writeTree(tree, node.Children, prefix+indent, showSizes)
+	}
+}
 
-		// Use configured ignore patterns
-		if shouldIgnore(path, opts.IgnorePatterns) {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
+// FormatSize formats a size in bytes with binary units, such as 4.2 KB.
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, prefix := float64(n)/unit, 0
+	for size >= unit && prefix < len("MGT") {
+		size /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", size, "KMGT"[prefix])
+}
 
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			return err
-		}
+// GetScopedTree returns a one-level tree of dir's entries, used to show the
+// neighbourhood of selected files next to them in the output. dir is
+// relative to the scanned root, or absolute; then only patterns without a
+// slash can match its entries.
+func GetScopedTree(dir string, opts TreeOptions) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
 
-		depth := strings.Count(relPath, string(os.PathSeparator))
-		indent := strings.Repeat("  ", depth)
-		tree.WriteString(fmt.Sprintf("%s├── %s\n", indent, filepath.Base(path)))
-		return nil
-	})
+	ignored := ignore.New(opts.IgnorePatterns)
+	var tree strings.Builder
+	tree.WriteString(filepath.ToSlash(dir) + "/\n")
+	for _, entry := range entries {
+		if ignored.Match(filepath.Join(dir, entry.Name())) != "" ||
+			(!opts.IncludeHidden && IsHidden(entry.Name())) {
+			continue
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		tree.WriteString(fmt.Sprintf("├── %s\n", name))
+	}
 
-	return tree.String(), err
+	return tree.String(), nil
 }
@@ -0,0 +1,97 @@
+// Package git reads repository metadata directly from the .git directory so
+// pfzf does not depend on a git binary.
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RepoInfo identifies a repository and its checked out branch.
+type RepoInfo struct {
+	// Name is the base name of the repository's top-level directory
+	Name string
+	// Branch is the current branch, or the abbreviated commit when HEAD is
+	// detached
+	Branch string
+}
+
+// Find returns information about the repository containing dir. It reports
+// false when dir is not inside a git repository.
+func Find(dir string) (RepoInfo, bool) {
+	root, gitDir, ok := findRoot(dir)
+	if !ok {
+		return RepoInfo{}, false
+	}
+	branch, ok := readBranch(gitDir)
+	if !ok {
+		return RepoInfo{}, false
+	}
+	return RepoInfo{Name: filepath.Base(root), Branch: branch}, true
+}
+
+// findRoot returns the top-level directory of the working tree containing
+// dir and its git directory.
+func findRoot(dir string) (root, gitDir string, ok bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", false
+	}
+
+	for {
+		if gitDir, ok := gitDirOf(dir); ok {
+			return dir, gitDir, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// gitDirOf returns the git directory for a working tree rooted at dir. .git
+// may be a directory or, for worktrees and submodules, a file pointing at it.
+func gitDirOf(dir string) (string, bool) {
+	path := filepath.Join(dir, ".git")
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	if info.IsDir() {
+		return path, true
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return target, true
+}
+
+// readBranch returns the branch HEAD points at, or the abbreviated commit for
+// a detached HEAD.
+func readBranch(gitDir string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", false
+	}
+
+	head := strings.TrimSpace(string(data))
+	if ref, ok := strings.CutPrefix(head, "ref: "); ok {
+		return strings.TrimPrefix(ref, "refs/heads/"), true
+	}
+	if len(head) > 7 {
+		head = head[:7]
+	}
+	return head, head != ""
+}
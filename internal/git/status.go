@@ -0,0 +1,193 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStatus is how a working tree file differs from the index.
+type FileStatus string
+
+const (
+	// StatusUnmodified means the file matches its index entry.
+	StatusUnmodified FileStatus = "unmodified"
+	// StatusModified means the file's size or modification time differs
+	// from its index entry.
+	StatusModified FileStatus = "modified"
+	// StatusUntracked means the file is not in the index.
+	StatusUntracked FileStatus = "untracked"
+)
+
+// indexEntry is the stat data the index records for a file.
+type indexEntry struct {
+	mtime time.Time
+	size  uint32
+}
+
+// indexCache holds each repository's parsed index until the index changes.
+var indexCache struct {
+	sync.Mutex
+	indexes map[string]cachedIndex
+}
+
+type cachedIndex struct {
+	modTime time.Time
+	entries map[string]indexEntry
+}
+
+// Status reports how the file at path differs from the index of the
+// repository containing it. Like git's own quick check, a file whose size
+// and modification time match its entry counts as unmodified without its
+// content being compared. It reports false outside a repository or when
+// the index can't be read.
+func Status(path string) (FileStatus, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", false
+	}
+	root, gitDir, ok := findRoot(filepath.Dir(abs))
+	if !ok {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", false
+	}
+	entries, err := readIndexCached(filepath.Join(gitDir, "index"))
+	if err != nil {
+		return "", false
+	}
+
+	entry, ok := entries[filepath.ToSlash(rel)]
+	switch {
+	case !ok:
+		return StatusUntracked, true
+	case entry.size != uint32(info.Size()) || !entry.mtime.Equal(info.ModTime()):
+		return StatusModified, true
+	}
+	return StatusUnmodified, true
+}
+
+// readIndexCached returns the entries of the index at path, parsing it
+// again only when it changed.
+func readIndexCached(path string) (map[string]indexEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	indexCache.Lock()
+	defer indexCache.Unlock()
+	if cached, ok := indexCache.indexes[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.entries, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if indexCache.indexes == nil {
+		indexCache.indexes = make(map[string]cachedIndex)
+	}
+	indexCache.indexes[path] = cachedIndex{modTime: info.ModTime(), entries: entries}
+	return entries, nil
+}
+
+// errBadIndex is returned for an index that is truncated or malformed.
+var errBadIndex = errors.New("malformed index")
+
+// parseIndex parses the entries of a version 2, 3 or 4 index file, keyed
+// by their slash-separated path. Extensions after the entries are ignored.
+func parseIndex(data []byte) (map[string]indexEntry, error) {
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, errBadIndex
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+
+	// Each entry is 40 bytes of stat data, the size being the last 4, a
+	// 20-byte object name, 2 bytes of flags and the path
+	const fixedSize = 62
+	entries := make(map[string]indexEntry, count)
+	pos := 12
+	var name []byte
+	for i := uint32(0); i < count; i++ {
+		start := pos
+		if pos+fixedSize > len(data) {
+			return nil, errBadIndex
+		}
+		entry := indexEntry{
+			mtime: time.Unix(int64(binary.BigEndian.Uint32(data[pos+8:])), int64(binary.BigEndian.Uint32(data[pos+12:]))),
+			size:  binary.BigEndian.Uint32(data[pos+36:]),
+		}
+		flags := binary.BigEndian.Uint16(data[pos+60:])
+		pos += fixedSize
+		if version >= 3 && flags&0x4000 != 0 {
+			// Extended flags
+			pos += 2
+		}
+
+		if version == 4 {
+			// The path drops a number of bytes from the end of the previous
+			// one and appends a NUL-terminated suffix
+			strip, n := indexVarint(data[min(pos, len(data)):])
+			if n == 0 || strip > len(name) {
+				return nil, errBadIndex
+			}
+			pos += n
+			end := bytes.IndexByte(data[pos:], 0)
+			if end < 0 {
+				return nil, errBadIndex
+			}
+			name = append(name[:len(name)-strip], data[pos:pos+end]...)
+			pos += end + 1
+		} else {
+			end := bytes.IndexByte(data[min(pos, len(data)):], 0)
+			if end < 0 {
+				return nil, errBadIndex
+			}
+			name = append(name[:0], data[pos:pos+end]...)
+			// Entries are padded with NULs to a multiple of eight bytes
+			pos = start + (pos-start+end+8)&^7
+		}
+		entries[string(name)] = entry
+	}
+	return entries, nil
+}
+
+// indexVarint decodes the offset encoding of index version 4, returning the
+// value and the bytes it took, or zero bytes if data ends first.
+func indexVarint(data []byte) (int, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	c := data[0]
+	value := int(c & 0x7f)
+	n := 1
+	for c&0x80 != 0 {
+		if n >= len(data) {
+			return 0, 0
+		}
+		c = data[n]
+		n++
+		value = (value+1)<<7 | int(c&0x7f)
+	}
+	return value, n
+}
@@ -0,0 +1,122 @@
+// Package ignore matches paths against glob patterns. The scanner and the
+// directory tree both use it, so the file list and the tree written to the
+// output leave out the same files.
+//
+// Patterns are matched against slash-separated paths relative to the scanned
+// root:
+//
+//   - A pattern without a slash matches a file or directory name at any
+//     depth, so "*.exe" matches bin/tool.exe and ".git" matches a/.git but not
+//     git-helper.go.
+//   - A pattern with a slash matches the whole relative path, so "docs/*"
+//     matches the entries of the top-level docs directory. A leading slash
+//     is allowed and changes nothing.
+//   - Segments are matched like path.Match, and a "**" segment matches any
+//     number of directories, including none.
+//   - A trailing slash is ignored: "build/" matches like "build".
+//
+// A path is ignored when it or one of the directories containing it matches.
+package ignore
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Matcher matches relative paths against a list of ignore patterns.
+type Matcher struct {
+	patterns []string
+}
+
+// New returns a Matcher for patterns. Empty patterns are dropped.
+func New(patterns []string) *Matcher {
+	m := &Matcher{}
+	for _, pattern := range patterns {
+		if pattern = normalize(pattern); pattern != "" {
+			m.patterns = append(m.patterns, pattern)
+		}
+	}
+	return m
+}
+
+// Match returns the first pattern matching rel itself, or "" if none does.
+// The directories containing rel aren't checked; it suits walks that skip
+// ignored directories as they go.
+func (m *Matcher) Match(rel string) string {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	for _, pattern := range m.patterns {
+		if MatchGlob(pattern, rel) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Ignored returns the first pattern matching rel or one of the directories
+// containing it, or "" if none does.
+func (m *Matcher) Ignored(rel string) string {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	for {
+		if pattern := m.Match(rel); pattern != "" {
+			return pattern
+		}
+		parent := path.Dir(rel)
+		if parent == "." || parent == "/" || parent == rel {
+			return ""
+		}
+		rel = parent
+	}
+}
+
+// normalize strips the slashes that don't change what pattern matches.
+func normalize(pattern string) string {
+	pattern = strings.TrimSpace(pattern)
+	pattern = strings.TrimSuffix(pattern, "/")
+	return strings.TrimPrefix(pattern, "/")
+}
+
+// MatchGlob reports whether the relative path rel matches pattern. Segments
+// are matched like path.Match, and a "**" segment matches any number of
+// directories, including none. A pattern without a slash matches the file
+// name in any directory. Malformed patterns match nothing; Validate reports
+// them.
+func MatchGlob(pattern, rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// Validate returns path.ErrBadPattern if pattern is malformed.
+func Validate(pattern string) error {
+	for _, segment := range strings.Split(normalize(pattern), "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package ignore
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		rel      string
+		match    string
+		ignored  string
+	}{
+		{"name at top level", []string{".git"}, ".git", ".git", ".git"},
+		{"name nested", []string{"node_modules"}, "web/node_modules", "node_modules", "node_modules"},
+		{"name is not a substring", []string{".git"}, "git-helper.go", "", ""},
+		{"name glob nested", []string{"*.exe"}, "bin/tool.exe", "*.exe", "*.exe"},
+		{"inside an ignored directory", []string{".git"}, ".git/config", "", ".git"},
+		{"inside a nested ignored directory", []string{"vendor"}, "a/vendor/b/c.go", "", "vendor"},
+		{"anchored directory contents", []string{"docs/*"}, "docs/guide.md", "docs/*", "docs/*"},
+		{"anchored directory deeper", []string{"docs/*"}, "docs/api/index.md", "", "docs/*"},
+		{"anchored is not nested", []string{"docs/*"}, "src/docs/guide.md", "", ""},
+		{"leading slash", []string{"/build"}, "build", "build", "build"},
+		{"trailing slash", []string{"build/"}, "src/build/out.o", "", "build"},
+		{"double star", []string{"src/**/*.pb.go"}, "src/a/b/x.pb.go", "src/**/*.pb.go", "src/**/*.pb.go"},
+		{"double star matches no directory", []string{"src/**/*.pb.go"}, "src/x.pb.go", "src/**/*.pb.go", "src/**/*.pb.go"},
+		{"first match wins", []string{"*.go", "main.go"}, "main.go", "*.go", "*.go"},
+		{"empty pattern", []string{""}, "main.go", "", ""},
+		{"no patterns", nil, "main.go", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(tt.patterns)
+			if got := m.Match(tt.rel); got != tt.match {
+				t.Errorf("Match(%q) = %q, want %q", tt.rel, got, tt.match)
+			}
+			if got := m.Ignored(tt.rel); got != tt.ignored {
+				t.Errorf("Ignored(%q) = %q, want %q", tt.rel, got, tt.ignored)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, pattern := range []string{"*.go", "src/**/*.go", "build/", "[abc].txt"} {
+		if err := Validate(pattern); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"[", "src/[a-"} {
+		if err := Validate(pattern); !errors.Is(err, path.ErrBadPattern) {
+			t.Errorf("Validate(%q) = %v, want %v", pattern, err, path.ErrBadPattern)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Package opener opens files with the desktop's default application through
+// the platform's open command: open on macOS, the URL handler on Windows, and
+// xdg-open, wslview or gio elsewhere.
+package opener
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// ErrUnavailable is returned when no open command is installed.
+var ErrUnavailable = errors.New("no open command found (install xdg-open)")
+
+// Open opens path with its default application. It returns once the
+// command has started, since it may run until the application exits.
+func Open(path string) error {
+	args, err := command(runtime.GOOS, exec.LookPath)
+	if err != nil {
+		return err
+	}
+
+	// The command's output would draw over the terminal UI, so it is
+	// discarded along with its input
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("running %s: %w", args[0], err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// command returns the first open command found with lookPath for the
+// operating system goos. The path to open is appended to it.
+func command(goos string, lookPath func(string) (string, error)) ([]string, error) {
+	var candidates [][]string
+	switch goos {
+	case "darwin":
+		candidates = [][]string{{"open"}}
+	case "windows":
+		candidates = [][]string{{"rundll32", "url.dll,FileProtocolHandler"}}
+	default:
+		candidates = [][]string{{"xdg-open"}, {"wslview"}, {"gio", "open"}}
+	}
+
+	for _, args := range candidates {
+		if _, err := lookPath(args[0]); err == nil {
+			return args, nil
+		}
+	}
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,46 @@
+package opener
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		goos      string
+		installed []string
+		want      string
+		wantErr   error
+	}{
+		{name: "macOS", goos: "darwin", installed: []string{"open"}, want: "[open]"},
+		{name: "Windows", goos: "windows", installed: []string{"rundll32"}, want: "[rundll32 url.dll,FileProtocolHandler]"},
+		{name: "xdg-open", goos: "linux", installed: []string{"gio", "xdg-open"}, want: "[xdg-open]"},
+		{name: "WSL", goos: "linux", installed: []string{"wslview"}, want: "[wslview]"},
+		{name: "gio", goos: "freebsd", installed: []string{"gio"}, want: "[gio open]"},
+		{name: "none", goos: "linux", wantErr: ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookPath := func(file string) (string, error) {
+				for _, name := range tt.installed {
+					if name == file {
+						return "/usr/bin/" + file, nil
+					}
+				}
+				return "", exec.ErrNotFound
+			}
+
+			got, err := command(tt.goos, lookPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("command() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && fmt.Sprint(got) != tt.want {
+				t.Errorf("command() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+)
+
+// multilineStringDelims lists the delimiters of string literals that can span
+// lines, where blank lines are part of the value and must be kept.
+var multilineStringDelims = map[string][]string{
+	"python":     {`"""`, `'''`},
+	"go":         {"`"},
+	"javascript": {"`"},
+	"typescript": {"`"},
+}
+
+// stripBlankLines removes every line that is empty or only whitespace,
+// except inside the multi-line string literals of language.
+func stripBlankLines(content []byte, language string) []byte {
+	delims := multilineStringDelims[language]
+	lines := bytes.SplitAfter(content, []byte("\n"))
+
+	var out bytes.Buffer
+	out.Grow(len(content))
+	open := "" // delimiter of the string literal spanning lines, if any
+	for _, line := range lines {
+		if open == "" && len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		out.Write(line)
+		open = openStringAfter(string(line), delims, open)
+	}
+	return out.Bytes()
+}
+
+// openStringAfter returns the delimiter of the literal left open at the end
+// of line, given the one open at its start. Delimiters are paired in order
+// of appearance, which is enough to keep blank lines inside literals.
+func openStringAfter(line string, delims []string, open string) string {
+	for len(line) > 0 {
+		if open != "" {
+			i := strings.Index(line, open)
+			if i < 0 {
+				return open
+			}
+			line, open = line[i+len(open):], ""
+			continue
+		}
+
+		next, at := "", -1
+		for _, d := range delims {
+			if i := strings.Index(line, d); i >= 0 && (at < 0 || i < at) {
+				next, at = d, i
+			}
+		}
+		if at < 0 {
+			return ""
+		}
+		line, open = line[at+len(next):], next
+	}
+	return open
+}
+
+// collapseWhitespace shrinks content without changing what it means: runs
+// of blank lines become one and trailing whitespace is removed. With dedent,
+// the indentation common to every line is removed as well, which keeps
+// relative indentation, and so Python blocks, intact. Lines inside the
+// multi-line string literals of language are left alone.
+func collapseWhitespace(content []byte, language string, dedent bool) []byte {
+	delims := multilineStringDelims[language]
+	lines := bytes.SplitAfter(content, []byte("\n"))
+
+	// literal marks the lines starting inside a literal or ending in one,
+	// whose whitespace may be part of its value
+	literal := make([]bool, len(lines))
+	open := ""
+	for i, line := range lines {
+		after := openStringAfter(string(line), delims, open)
+		literal[i] = open != "" || after != ""
+		open = after
+	}
+
+	var indent []byte
+	if dedent {
+		indent = commonIndent(lines, literal)
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(content))
+	blank := false
+	for i, line := range lines {
+		if literal[i] {
+			out.Write(line)
+			blank = false
+			continue
+		}
+		body := bytes.TrimRight(line, " \t\r\n")
+		if len(body) == 0 {
+			if blank || len(line) == 0 {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		body = bytes.TrimPrefix(body, indent)
+		out.Write(body)
+		out.Write(line[len(bytes.TrimRight(line, "\r\n")):])
+	}
+	return out.Bytes()
+}
+
+// commonIndent returns the leading whitespace shared by every non-blank
+// line outside a literal.
+func commonIndent(lines [][]byte, literal []bool) []byte {
+	var indent []byte
+	first := true
+	for i, line := range lines {
+		if literal[i] || len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		lead := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+		if first {
+			indent, first = lead, false
+			continue
+		}
+		n := 0
+		for n < len(indent) && n < len(lead) && indent[n] == lead[n] {
+			n++
+		}
+		indent = indent[:n]
+	}
+	return indent
+}
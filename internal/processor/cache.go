@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// contentCache keeps recently processed files so a file that is deselected
+// and selected again isn't read and processed again. Entries are keyed by
+// path and only returned while the file's modification time and size are
+// the ones it was processed with. The least recently used files are evicted
+// once the cached content exceeds maxBytes.
+type contentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type cachedContent struct {
+	path      string
+	modTime   time.Time
+	size      int64
+	processed types.ProcessedContent
+}
+
+func newContentCache(maxBytes int64) *contentCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &contentCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the content entry was processed to, if the file hasn't
+// changed since. The cached content is shared, so it must not be modified.
+func (c *contentCache) get(entry types.FileEntry) (types.ProcessedContent, bool) {
+	if c == nil || entry.ModTime.IsZero() {
+		return types.ProcessedContent{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[entry.Path]
+	if !ok {
+		return types.ProcessedContent{}, false
+	}
+	cached := elem.Value.(*cachedContent)
+	if !cached.modTime.Equal(entry.ModTime) || cached.size != entry.Size {
+		c.removeElement(elem)
+		return types.ProcessedContent{}, false
+	}
+	c.order.MoveToFront(elem)
+
+	// The entry is the caller's, apart from the language detected from
+	// the content
+	processed := cached.processed
+	language := processed.Entry.Language
+	processed.Entry = entry
+	processed.Entry.Language = language
+	return processed, true
+}
+
+// put caches the content entry was processed to. Files without a
+// modification time can't be checked for changes and aren't cached.
+func (c *contentCache) put(entry types.FileEntry, processed types.ProcessedContent) {
+	if c == nil || entry.ModTime.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.Path]; ok {
+		c.removeElement(elem)
+	}
+	size := cachedSize(processed)
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[entry.Path] = c.order.PushFront(&cachedContent{
+		path:      entry.Path,
+		modTime:   entry.ModTime,
+		size:      entry.Size,
+		processed: processed,
+	})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// clear drops every cached file, since they were processed with options
+// that have changed.
+func (c *contentCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+func (c *contentCache) removeElement(elem *list.Element) {
+	cached := c.order.Remove(elem).(*cachedContent)
+	delete(c.entries, cached.path)
+	c.bytes -= cachedSize(cached.processed)
+}
+
+// cachedSize approximates the memory held by processed: its content and
+// the content of its chunks.
+func cachedSize(processed types.ProcessedContent) int64 {
+	size := int64(len(processed.Content))
+	for _, chunk := range processed.Chunks {
+		size += int64(len(chunk.Content))
+	}
+	return size
+}
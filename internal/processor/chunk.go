@@ -3,7 +3,7 @@ package processor
 import (
 	"bufio"
 	"bytes"
-	"unicode"
+	"unicode/utf8"
 
 	"github.com/lc/pfzf/pkg/types"
 )
@@ -14,10 +14,18 @@ type ChunkerOptions struct {
 	MaxSize int64
 	// Overlap is the number of bytes to overlap between chunks
 	Overlap int
-	// MaxTokens is the maximum number of tokens per chunk (approximate)
+	// MaxTokens is the maximum number of tokens per chunk as counted by
+	// Tokenizer
 	MaxTokens int
 	// PreserveML determines if markup language tags should be preserved
 	PreserveML bool
+	// Tokenizer counts tokens; nil means HeuristicTokenizer
+	Tokenizer Tokenizer
+	// SemanticBoundaries keeps top-level declarations whole, only splitting
+	// a declaration that does not fit in a chunk on its own
+	SemanticBoundaries bool
+	// Language selects the symbol extractor for SemanticBoundaries
+	Language string
 }
 
 // Chunker handles content chunking operations.
@@ -27,6 +35,9 @@ type Chunker struct {
 
 // NewChunker creates a new chunker with the given options.
 func NewChunker(opts ChunkerOptions) *Chunker {
+	if opts.Tokenizer == nil {
+		opts.Tokenizer = HeuristicTokenizer{}
+	}
 	return &Chunker{opts: opts}
 }
 
@@ -37,6 +48,14 @@ func (c *Chunker) Chunk(content []byte) ([]types.Chunk, error) {
 		return nil, nil
 	}
 
+	if c.opts.SemanticBoundaries {
+		return c.chunkSymbols(content), nil
+	}
+
+	if c.opts.MaxTokens > 0 {
+		return c.chunkLines(content), nil
+	}
+
 	if c.opts.MaxSize > 0 && int64(len(content)) <= c.opts.MaxSize {
 		return []types.Chunk{{
 			Content:    append(bytes.TrimSpace(content), '\n'),
@@ -92,6 +111,150 @@ func (c *Chunker) Chunk(content []byte) ([]types.Chunk, error) {
 	return chunks, nil
 }
 
+// chunkLines splits content at line boundaries, starting a new chunk whenever
+// shouldStartNewChunk reports that the next line would not fit. Each chunk
+// after the first begins with the overlap from the previous one.
+func (c *Chunker) chunkLines(content []byte) []types.Chunk {
+	var (
+		chunks        []types.Chunk
+		current       []byte
+		currentTokens int
+		startLine     = 1
+		line          = 1
+		// fresh reports whether current holds more than the overlap
+		fresh bool
+	)
+
+	emit := func() {
+		endLine := line
+		if bytes.HasSuffix(current, []byte("\n")) {
+			endLine--
+		}
+		chunks = append(chunks, types.Chunk{
+			Content:    append(bytes.Clone(bytes.TrimSpace(current)), '\n'),
+			StartLine:  startLine,
+			EndLine:    endLine,
+			TokenCount: c.countTokens(string(current)),
+		})
+	}
+
+	for _, segment := range bytes.SplitAfter(content, []byte("\n")) {
+		for _, piece := range c.splitToFit(segment) {
+			tokens := c.countTokens(string(piece))
+			if fresh && c.shouldStartNewChunk(len(current), len(piece), currentTokens, tokens) {
+				emit()
+				overlap := c.getOverlapContent(current)
+				current = append([]byte(nil), overlap...)
+				currentTokens = c.countTokens(string(current))
+				startLine = line - bytes.Count(overlap, []byte("\n"))
+				fresh = false
+
+				// Drop the overlap rather than exceed the limits
+				if c.shouldStartNewChunk(len(current), len(piece), currentTokens, tokens) {
+					current, currentTokens, startLine = nil, 0, line
+				}
+			}
+
+			current = append(current, piece...)
+			currentTokens += tokens
+			fresh = true
+			line += bytes.Count(piece, []byte("\n"))
+		}
+	}
+
+	if fresh && len(bytes.TrimSpace(current)) > 0 {
+		emit()
+	}
+	return chunks
+}
+
+// chunkSymbols packs whole top-level declarations into chunks. A declaration
+// too large for a chunk on its own is split with chunkLines. Chunks do not
+// overlap so that each one starts at a declaration.
+func (c *Chunker) chunkSymbols(content []byte) []types.Chunk {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	symbols := ExtractSymbols(content, c.opts.Language)
+
+	// Units cover every line: each runs from its declaration (or the start of
+	// the file) to the line before the next declaration
+	var starts []int
+	for _, symbol := range symbols {
+		if symbol.StartLine > 1 && (len(starts) == 0 || symbol.StartLine > starts[len(starts)-1]) {
+			starts = append(starts, symbol.StartLine)
+		}
+	}
+	starts = append([]int{1}, starts...)
+
+	var (
+		chunks        []types.Chunk
+		current       []byte
+		currentTokens int
+		startLine     int
+		endLine       int
+	)
+
+	emit := func() {
+		if len(bytes.TrimSpace(current)) > 0 {
+			chunks = append(chunks, types.Chunk{
+				Content:    append(bytes.Clone(bytes.TrimSpace(current)), '\n'),
+				StartLine:  startLine,
+				EndLine:    endLine,
+				TokenCount: currentTokens,
+			})
+		}
+		current, currentTokens = nil, 0
+	}
+
+	for i, start := range starts {
+		end := len(lines)
+		if i+1 < len(starts) {
+			end = starts[i+1] - 1
+		}
+		unit := bytes.Join(lines[start-1:end], nil)
+		tokens := c.countTokens(string(unit))
+
+		if c.shouldStartNewChunk(0, len(unit), 0, tokens) {
+			emit()
+			for _, chunk := range c.chunkLines(unit) {
+				chunk.StartLine += start - 1
+				chunk.EndLine += start - 1
+				chunks = append(chunks, chunk)
+			}
+			continue
+		}
+
+		if len(current) > 0 && c.shouldStartNewChunk(len(current), len(unit), currentTokens, tokens) {
+			emit()
+		}
+		if len(current) == 0 {
+			startLine = start
+		}
+		current = append(current, unit...)
+		currentTokens += tokens
+		endLine = end
+	}
+	emit()
+
+	return chunks
+}
+
+// splitToFit splits a line that exceeds MaxSize or MaxTokens on its own into
+// pieces that fit, halving at rune boundaries.
+func (c *Chunker) splitToFit(line []byte) [][]byte {
+	if !c.shouldStartNewChunk(0, len(line), 0, c.countTokens(string(line))) {
+		return [][]byte{line}
+	}
+
+	mid := len(line) / 2
+	for mid > 0 && !utf8.RuneStart(line[mid]) {
+		mid--
+	}
+	if mid == 0 {
+		return [][]byte{line}
+	}
+	return append(c.splitToFit(line[:mid]), c.splitToFit(line[mid:])...)
+}
+
 // chunkSingleLine handles chunking of a single line of content
 func (c *Chunker) chunkSingleLine(content []byte) ([]types.Chunk, error) {
 	chunks := make([]types.Chunk, 0)
@@ -187,10 +350,11 @@ func (c *Chunker) splitMarkup(data []byte, atEOF bool) (advance int, token []byt
 	return 0, nil, nil
 }
 
-// shouldStartNewChunk determines if a new chunk should be started.
-func (c *Chunker) shouldStartNewChunk(currentSize, newTokens, currentTokens int) bool {
+// shouldStartNewChunk determines if adding newSize bytes and newTokens
+// tokens to the current chunk would exceed MaxSize or MaxTokens.
+func (c *Chunker) shouldStartNewChunk(currentSize, newSize, currentTokens, newTokens int) bool {
 	// Always start a new chunk if we exceed MaxSize
-	if c.opts.MaxSize > 0 && int64(currentSize) >= c.opts.MaxSize {
+	if c.opts.MaxSize > 0 && int64(currentSize+newSize) > c.opts.MaxSize {
 		return true
 	}
 
@@ -202,23 +366,9 @@ func (c *Chunker) shouldStartNewChunk(currentSize, newTokens, currentTokens int)
 	return false
 }
 
-// countTokens provides a rough estimate of token count.
+// countTokens counts tokens with the configured tokenizer.
 func (c *Chunker) countTokens(text string) int {
-	var count int
-	inWord := false
-
-	for _, r := range text {
-		if unicode.IsSpace(r) {
-			inWord = false
-		} else {
-			if !inWord {
-				count++
-				inWord = true
-			}
-		}
-	}
-
-	return count
+	return c.opts.Tokenizer.CountTokens(text)
 }
 
 // countLines counts the number of lines in the text.
@@ -0,0 +1,434 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// quoteRule describes a string literal delimiter.
+type quoteRule struct {
+	// delim opens and closes the literal
+	delim string
+	// end closes the literal when it differs from delim
+	end string
+	// escapes reports whether a backslash escapes the next character
+	escapes bool
+	// multiline reports whether the literal may span lines
+	multiline bool
+}
+
+// commentSyntax describes the comment and string literal rules of a language.
+type commentSyntax struct {
+	// lineComments start a comment that runs to the end of the line
+	lineComments []string
+	// notComments are prefixes that look like line comments but aren't,
+	// such as PHP's #[ attributes
+	notComments []string
+	// blockStart and blockEnd delimit a comment that may span lines
+	blockStart string
+	blockEnd   string
+	// quotes lists string delimiters, checked in order
+	quotes []quoteRule
+	// charLiterals treats 'x' and '\n' as character literals rather than strings
+	charLiterals bool
+	// wordComments only starts a line comment at the beginning of a word
+	wordComments bool
+}
+
+var (
+	cSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes:       []quoteRule{{delim: `"`, escapes: true}},
+		charLiterals: true,
+	}
+
+	goSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true},
+			{delim: "`", multiline: true},
+		},
+		charLiterals: true,
+	}
+
+	javaScriptSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+			{delim: "`", escapes: true, multiline: true},
+		},
+	}
+
+	javaSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"""`, escapes: true, multiline: true},
+			{delim: `"`, escapes: true},
+		},
+		charLiterals: true,
+	}
+
+	rustSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true, multiline: true},
+		},
+		charLiterals: true,
+	}
+
+	pythonSyntax = commentSyntax{
+		lineComments: []string{"#"},
+		quotes: []quoteRule{
+			{delim: `"""`, escapes: true, multiline: true},
+			{delim: `'''`, escapes: true, multiline: true},
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+		},
+	}
+
+	// hashSyntax covers Ruby, Perl, R, Elixir and YAML
+	hashSyntax = commentSyntax{
+		lineComments: []string{"#"},
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+		},
+		wordComments: true,
+	}
+
+	phpSyntax = commentSyntax{
+		lineComments: []string{"//", "#"},
+		notComments:  []string{"#["},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true, multiline: true},
+			{delim: `'`, escapes: true, multiline: true},
+		},
+	}
+
+	luaSyntax = commentSyntax{
+		lineComments: []string{"--"},
+		blockStart:   "--[[",
+		blockEnd:     "]]",
+		quotes: []quoteRule{
+			{delim: "[[", end: "]]", multiline: true},
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+		},
+	}
+
+	sqlSyntax = commentSyntax{
+		lineComments: []string{"--"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `'`, multiline: true},
+			{delim: `"`},
+		},
+	}
+
+	cssSyntax = commentSyntax{
+		blockStart: "/*",
+		blockEnd:   "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+		},
+	}
+
+	// scssSyntax also covers Less; // must start a word so url(http://...)
+	// survives
+	scssSyntax = commentSyntax{
+		lineComments: []string{"//"},
+		blockStart:   "/*",
+		blockEnd:     "*/",
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true},
+			{delim: `'`, escapes: true},
+		},
+		wordComments: true,
+	}
+
+	haskellSyntax = commentSyntax{
+		lineComments: []string{"--"},
+		blockStart:   "{-",
+		blockEnd:     "-}",
+		quotes:       []quoteRule{{delim: `"`, escapes: true}},
+		charLiterals: true,
+	}
+
+	ocamlSyntax = commentSyntax{
+		blockStart:   "(*",
+		blockEnd:     "*)",
+		quotes:       []quoteRule{{delim: `"`, escapes: true, multiline: true}},
+		charLiterals: true,
+	}
+
+	erlangSyntax = commentSyntax{
+		lineComments: []string{"%"},
+		quotes:       []quoteRule{{delim: `"`, escapes: true, multiline: true}},
+	}
+
+	// lispSyntax covers Emacs Lisp and Clojure
+	lispSyntax = commentSyntax{
+		lineComments: []string{";"},
+		quotes:       []quoteRule{{delim: `"`, escapes: true, multiline: true}},
+	}
+
+	htmlSyntax = commentSyntax{
+		blockStart: "<!--",
+		blockEnd:   "-->",
+		quotes: []quoteRule{
+			// Conditional comments carry markup and are kept whole
+			{delim: "<!--[if", end: "<![endif]-->", multiline: true},
+			{delim: "<![CDATA[", end: "]]>", multiline: true},
+		},
+	}
+
+	shellSyntax = commentSyntax{
+		lineComments: []string{"#"},
+		quotes: []quoteRule{
+			{delim: `"`, escapes: true, multiline: true},
+			{delim: `'`, multiline: true},
+		},
+		wordComments: true,
+	}
+)
+
+// hashShebang reports whether a leading "#!" line is a shebang, which is
+// only the case for languages with # comments.
+func (c commentSyntax) hashShebang() bool {
+	for _, marker := range c.lineComments {
+		if marker == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// literalState tracks whether the scanner is inside a comment or string
+// literal across line boundaries.
+type literalState struct {
+	syntax  commentSyntax
+	inBlock bool
+	quote   *quoteRule
+}
+
+// stripLine removes comments from a single line. It reports whether any
+// comment text was removed so callers can drop lines that held only comments.
+func (s *literalState) stripLine(line string) (string, bool) {
+	var out strings.Builder
+
+	// Every line that starts inside a block comment, even an empty one,
+	// belongs to the comment
+	removed := s.inBlock
+
+	for i := 0; i < len(line); {
+		if s.inBlock {
+			removed = true
+			end := strings.Index(line[i:], s.syntax.blockEnd)
+			if end < 0 {
+				break
+			}
+			i += end + len(s.syntax.blockEnd)
+			s.inBlock = false
+			continue
+		}
+
+		if s.quote != nil {
+			j := s.scanQuote(line, i)
+			out.WriteString(line[i:j])
+			i = j
+			continue
+		}
+
+		rest := line[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1:
+			out.WriteString(rest[:2])
+			i += 2
+			continue
+		case s.syntax.charLiterals && rest[0] == '\'':
+			if n := charLiteralLen(rest); n > 0 {
+				out.WriteString(rest[:n])
+				i += n
+				continue
+			}
+		}
+
+		// Quotes come before comments so that literals opening with a comment
+		// marker, like HTML conditional comments, are kept. Block comments
+		// come before line comments since some share a prefix, like Lua's
+		// --[[ and --.
+		if q := s.matchQuote(rest); q != nil {
+			s.quote = q
+			out.WriteString(q.delim)
+			i += len(q.delim)
+			continue
+		}
+
+		if s.syntax.blockStart != "" && strings.HasPrefix(rest, s.syntax.blockStart) {
+			s.inBlock = true
+			removed = true
+			i += len(s.syntax.blockStart)
+			continue
+		}
+
+		if s.isLineComment(line, i) {
+			return out.String(), true
+		}
+
+		out.WriteByte(line[i])
+		i++
+	}
+
+	if s.quote != nil && !s.quote.multiline {
+		s.quote = nil
+	}
+	return out.String(), removed
+}
+
+// scanQuote returns the index just past the closing delimiter of the current
+// string literal, or the end of the line if it does not close on this line.
+func (s *literalState) scanQuote(line string, i int) int {
+	end := s.quote.delim
+	if s.quote.end != "" {
+		end = s.quote.end
+	}
+
+	for i < len(line) {
+		if s.quote.escapes && line[i] == '\\' {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(line[i:], end) {
+			i += len(end)
+			s.quote = nil
+			return i
+		}
+		i++
+	}
+	return len(line)
+}
+
+// isLineComment reports whether a line comment starts at line[i].
+func (s *literalState) isLineComment(line string, i int) bool {
+	rest := line[i:]
+	matched := false
+	for _, marker := range s.syntax.lineComments {
+		if strings.HasPrefix(rest, marker) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+
+	for _, prefix := range s.syntax.notComments {
+		if strings.HasPrefix(rest, prefix) {
+			return false
+		}
+	}
+
+	if !s.syntax.wordComments || i == 0 {
+		return true
+	}
+	switch line[i-1] {
+	case ' ', '\t', ';':
+		return true
+	}
+	return false
+}
+
+// matchQuote returns the quote rule opening at the start of rest, if any.
+func (s *literalState) matchQuote(rest string) *quoteRule {
+	for i := range s.syntax.quotes {
+		if strings.HasPrefix(rest, s.syntax.quotes[i].delim) {
+			return &s.syntax.quotes[i]
+		}
+	}
+	return nil
+}
+
+// charLiteralLen returns the length of the character literal at the start of
+// s, or 0 if the quote does not open one (e.g. a Rust lifetime).
+func charLiteralLen(s string) int {
+	if len(s) < 3 {
+		return 0
+	}
+	if s[1] == '\\' {
+		if end := strings.IndexByte(s[2:], '\''); end >= 0 {
+			return end + 3
+		}
+		return 0
+	}
+	_, size := utf8.DecodeRuneInString(s[1:])
+	if 1+size < len(s) && s[1+size] == '\'' {
+		return size + 2
+	}
+	return 0
+}
+
+// stripComments removes comments from content according to syntax while
+// leaving comment markers inside string and character literals untouched.
+// For languages with # comments a leading shebang line is kept verbatim;
+// elsewhere "#!" means something else, such as a Rust inner attribute.
+func stripComments(content []byte, syntax commentSyntax) ([]byte, error) {
+	var result bytes.Buffer
+	if syntax.hashShebang() && bytes.HasPrefix(content, []byte("#!")) {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 {
+			return content, nil
+		}
+		result.Write(content[:end])
+		content = content[end+1:]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	state := &literalState{syntax: syntax}
+	lastLineWasEmpty := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		inString := state.quote != nil
+
+		code, removed := state.stripLine(line)
+		if removed {
+			code = strings.TrimRight(code, " \t")
+		}
+
+		// Lines inside a multi-line string are content and kept verbatim
+		if !inString && strings.TrimSpace(code) == "" {
+			// Drop lines that only held comments, collapse blank runs
+			if !removed && !lastLineWasEmpty {
+				result.WriteString("\n")
+				lastLineWasEmpty = true
+			}
+			continue
+		}
+
+		if result.Len() > 0 {
+			result.WriteString("\n")
+		}
+		result.WriteString(code)
+		lastLineWasEmpty = false
+	}
+
+	// Ensure content does not end with trailing newlines
+	return bytes.TrimRight(result.Bytes(), "\n"), scanner.Err()
+}
@@ -1,21 +1,26 @@
 package processor
 
 import (
-	"bufio"
-	"bytes"
 	"io"
 	"path/filepath"
 	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
 )
 
 // LanguageDetector handles programming language detection and processing.
 type LanguageDetector struct {
+	// filenameMap maps exact base names, such as Makefile, to language names
+	filenameMap map[string]string
 	// extensionMap maps file extensions to language names
 	extensionMap map[string]string
 	// shebangMap maps shebang patterns to language names
 	shebangMap map[string]string
 	// commentMap maps languages to their comment strippers
 	commentMap map[string]CommentStripper
+	// plugins are the registered processors of languages that aren't
+	// built in, asked about files nothing else identifies
+	plugins []types.LanguageProcessor
 }
 
 // CommentStripper defines the interface for language-specific comment stripping.
@@ -26,30 +31,53 @@ type CommentStripper interface {
 // NewLanguageDetector creates a new language detector with predefined mappings.
 func NewLanguageDetector() (*LanguageDetector, error) {
 	ld := &LanguageDetector{
+		filenameMap:  make(map[string]string),
 		extensionMap: make(map[string]string),
 		shebangMap:   make(map[string]string),
 		commentMap:   make(map[string]CommentStripper),
 	}
 
-	// Initialize extension mappings
-	ld.initExtensionMap()
-	// Initialize shebang mappings
+	// Initialize filename and shebang mappings
+	ld.initFilenameMap()
 	ld.initShebangMap()
-	// Initialize comment strippers
-	ld.initCommentStrippers()
+	// Extensions and comment strippers come from the registered languages
+	ld.loadRegistered()
 
 	return ld, nil
 }
 
 // DetectLanguage attempts to identify the programming language of a file.
+// It tries the exact file name, then the extension, then the shebang line,
+// then a vim or emacs modeline near the start or end of the file and
+// finally asks the registered plugins.
 func (ld *LanguageDetector) DetectLanguage(filename string, reader io.Reader) (string, error) {
-	// Try extension-based detection first
+	if lang := ld.filenameMap[filepath.Base(filename)]; lang != "" {
+		return lang, nil
+	}
+
+	// Try extension-based detection next
 	if lang := ld.detectByExtension(filename); lang != "" {
 		return lang, nil
 	}
 
+	// Reset reader if it's a seeker
+	if seeker, ok := reader.(io.Seeker); ok {
+		seeker.Seek(0, io.SeekStart)
+	}
+	head, tail := edgeLines(reader, modelineLines)
+
 	// Try shebang-based detection for scripts
-	if lang := ld.detectByShebang(reader); lang != "" {
+	if len(head) > 0 {
+		if lang := ld.detectByShebang(head[0]); lang != "" {
+			return lang, nil
+		}
+	}
+
+	if lang := ld.detectByModeline(append(head, tail...)); lang != "" {
+		return lang, nil
+	}
+
+	if lang := ld.detectByPlugins(filename, head); lang != "" {
 		return lang, nil
 	}
 
@@ -65,6 +93,15 @@ func (ld *LanguageDetector) GetCommentStripper(language string) (CommentStripper
 	return stripper, nil
 }
 
+// setStripDocstrings toggles docstring removal for languages that support it.
+// It must only be called before the detector is shared, since commentMap is
+// read without locking. A registered python processor is left alone.
+func (ld *LanguageDetector) setStripDocstrings(enabled bool) {
+	if _, ok := ld.commentMap["python"].(*PythonCommentStripper); ok {
+		ld.commentMap["python"] = &PythonCommentStripper{StripDocstrings: enabled}
+	}
+}
+
 func (ld *LanguageDetector) detectByExtension(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
 	if ext == "" {
@@ -73,18 +110,7 @@ func (ld *LanguageDetector) detectByExtension(filename string) string {
 	return ld.extensionMap[ext]
 }
 
-func (ld *LanguageDetector) detectByShebang(reader io.Reader) string {
-	// Reset reader if it's a seeker
-	if seeker, ok := reader.(io.Seeker); ok {
-		seeker.Seek(0, io.SeekStart)
-	}
-
-	scanner := bufio.NewScanner(reader)
-	if !scanner.Scan() {
-		return ""
-	}
-
-	firstLine := scanner.Text()
+func (ld *LanguageDetector) detectByShebang(firstLine string) string {
 	if !strings.HasPrefix(firstLine, "#!") {
 		return ""
 	}
@@ -98,64 +124,90 @@ func (ld *LanguageDetector) detectByShebang(reader io.Reader) string {
 	return ""
 }
 
-func (ld *LanguageDetector) initExtensionMap() {
-	extensions := map[string]string{
-		".go":    "go",
-		".py":    "python",
-		".js":    "javascript",
-		".ts":    "typescript",
-		".jsx":   "javascript",
-		".tsx":   "typescript",
-		".rb":    "ruby",
-		".php":   "php",
-		".java":  "java",
-		".cpp":   "cpp",
-		".cc":    "cpp",
-		".c":     "c",
-		".h":     "c",
-		".hpp":   "cpp",
-		".cs":    "csharp",
-		".rs":    "rust",
-		".swift": "swift",
-		".kt":    "kotlin",
-		".scala": "scala",
-		".r":     "r",
-		".sh":    "shell",
-		".bash":  "shell",
-		".zsh":   "shell",
-		".fish":  "shell",
-		".pl":    "perl",
-		".pm":    "perl",
-		".t":     "perl",
-		".html":  "html",
-		".htm":   "html",
-		".css":   "css",
-		".scss":  "scss",
-		".sass":  "scss",
-		".less":  "less",
-		".xml":   "xml",
-		".json":  "json",
-		".yaml":  "yaml",
-		".yml":   "yaml",
-		".md":    "markdown",
-		".sql":   "sql",
-		".lua":   "lua",
-		".vim":   "vim",
-		".el":    "elisp",
-		".clj":   "clojure",
-		".ex":    "elixir",
-		".exs":   "elixir",
-		".erl":   "erlang",
-		".hs":    "haskell",
-		".ml":    "ocaml",
-		".mli":   "ocaml",
+func (ld *LanguageDetector) initFilenameMap() {
+	filenames := map[string]string{
+		"Dockerfile":     "dockerfile",
+		"Containerfile":  "dockerfile",
+		"Makefile":       "make",
+		"makefile":       "make",
+		"GNUmakefile":    "make",
+		"CMakeLists.txt": "cmake",
+		"Jenkinsfile":    "groovy",
+		"Rakefile":       "ruby",
+		"Gemfile":        "ruby",
+		"Vagrantfile":    "ruby",
+		"BUILD":          "starlark",
+		"BUILD.bazel":    "starlark",
+		"WORKSPACE":      "starlark",
+		".bashrc":        "shell",
+		".bash_profile":  "shell",
+		".zshrc":         "shell",
+		".profile":       "shell",
 	}
 
-	for ext, lang := range extensions {
-		ld.extensionMap[ext] = lang
+	for name, lang := range filenames {
+		ld.filenameMap[name] = lang
 	}
 }
 
+// builtinExtensions maps the extensions of the built-in languages to their
+// names.
+var builtinExtensions = map[string]string{
+	".go":     "go",
+	".py":     "python",
+	".js":     "javascript",
+	".ts":     "typescript",
+	".jsx":    "javascript",
+	".tsx":    "typescript",
+	".rb":     "ruby",
+	".php":    "php",
+	".java":   "java",
+	".cpp":    "cpp",
+	".cc":     "cpp",
+	".c":      "c",
+	".h":      "c",
+	".hpp":    "cpp",
+	".cs":     "csharp",
+	".rs":     "rust",
+	".swift":  "swift",
+	".kt":     "kotlin",
+	".scala":  "scala",
+	".r":      "r",
+	".sh":     "shell",
+	".bash":   "shell",
+	".zsh":    "shell",
+	".fish":   "shell",
+	".pl":     "perl",
+	".pm":     "perl",
+	".t":      "perl",
+	".html":   "html",
+	".htm":    "html",
+	".css":    "css",
+	".scss":   "scss",
+	".sass":   "scss",
+	".less":   "less",
+	".xml":    "xml",
+	".json":   "json",
+	".yaml":   "yaml",
+	".yml":    "yaml",
+	".md":     "markdown",
+	".sql":    "sql",
+	".lua":    "lua",
+	".vim":    "vim",
+	".el":     "elisp",
+	".clj":    "clojure",
+	".ex":     "elixir",
+	".exs":    "elixir",
+	".erl":    "erlang",
+	".hs":     "haskell",
+	".ml":     "ocaml",
+	".mli":    "ocaml",
+	".mk":     "make",
+	".cmake":  "cmake",
+	".groovy": "groovy",
+	".bzl":    "starlark",
+}
+
 func (ld *LanguageDetector) initShebangMap() {
 	shebangs := map[string]string{
 		"python": "python",
@@ -176,115 +228,153 @@ func (ld *LanguageDetector) initShebangMap() {
 	}
 }
 
-func (ld *LanguageDetector) initCommentStrippers() {
-	ld.commentMap = map[string]CommentStripper{
-		"go":         &GoCommentStripper{},
-		"python":     &PythonCommentStripper{},
-		"javascript": &JavaScriptCommentStripper{},
-		"typescript": &JavaScriptCommentStripper{},
-		"java":       &JavaCommentStripper{},
-		"cpp":        &CppCommentStripper{},
-		"c":          &CCommentStripper{},
-		"rust":       &RustCommentStripper{},
-		"shell":      &ShellCommentStripper{},
-	}
+// builtinStrippers maps the built-in languages to their comment strippers;
+// the others use GenericCommentStripper.
+var builtinStrippers = map[string]CommentStripper{
+	"go":         &GoCommentStripper{},
+	"python":     &PythonCommentStripper{},
+	"javascript": &JavaScriptCommentStripper{},
+	"typescript": &JavaScriptCommentStripper{},
+	"java":       &JavaCommentStripper{},
+	"cpp":        &CppCommentStripper{},
+	"c":          &CCommentStripper{},
+	"rust":       &RustCommentStripper{},
+	"shell":      &ShellCommentStripper{},
+	"html":       &HTMLCommentStripper{},
+	"xml":        &HTMLCommentStripper{},
+	"csharp":     &CCommentStripper{},
+	"kotlin":     &JavaCommentStripper{},
+	"scala":      &JavaCommentStripper{},
+	"swift":      &JavaCommentStripper{},
+	"ruby":       &HashCommentStripper{},
+	"perl":       &HashCommentStripper{},
+	"r":          &HashCommentStripper{},
+	"elixir":     &HashCommentStripper{},
+	"yaml":       &HashCommentStripper{},
+	"dockerfile": &HashCommentStripper{},
+	"make":       &HashCommentStripper{},
+	"cmake":      &HashCommentStripper{},
+	"starlark":   &HashCommentStripper{},
+	"groovy":     &JavaCommentStripper{},
+	"php":        &PHPCommentStripper{},
+	"lua":        &LuaCommentStripper{},
+	"sql":        &SQLCommentStripper{},
+	"css":        &CSSCommentStripper{},
+	"scss":       &SCSSCommentStripper{},
+	"less":       &SCSSCommentStripper{},
+	"haskell":    &HaskellCommentStripper{},
+	"ocaml":      &OCamlCommentStripper{},
+	"erlang":     &ErlangCommentStripper{},
+	"elisp":      &LispCommentStripper{},
+	"clojure":    &LispCommentStripper{},
 }
 
-// Generic comment stripper that handles common comment styles
+// GenericCommentStripper handles C-style // and /* */ comments.
 type GenericCommentStripper struct{}
 
+// StripComments implements CommentStripper.
 func (s *GenericCommentStripper) StripComments(content []byte) ([]byte, error) {
-	var result bytes.Buffer
-	scanner := bufio.NewScanner(bytes.NewReader(content))
-
-	var (
-		inMultiLineComment bool
-		lastLineWasEmpty   bool
-	)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		originalIndent := getIndentation(line)
-		trimmedLine := strings.TrimSpace(line)
-
-		// Skip empty lines if the last line was empty
-		if trimmedLine == "" {
-			if !lastLineWasEmpty {
-				result.WriteString("\n")
-				lastLineWasEmpty = true
-			}
-			continue
-		}
-
-		// Handle multi-line comments
-		if inMultiLineComment {
-			if idx := strings.Index(line, "*/"); idx >= 0 {
-				inMultiLineComment = false
-				line = originalIndent + strings.TrimSpace(line[idx+2:])
-				if strings.TrimSpace(line) == "" {
-					continue
-				}
-			} else {
-				continue
-			}
-		}
-
-		// Check for start of multi-line comment
-		if idx := strings.Index(line, "/*"); idx >= 0 {
-			inMultiLineComment = true
-			beforeComment := strings.TrimSpace(line[:idx])
-			if beforeComment == "" {
-				continue
-			}
-			line = originalIndent + beforeComment
-		}
-
-		// Handle single-line comments
-		if idx := strings.Index(line, "//"); idx >= 0 {
-			beforeComment := strings.TrimSpace(line[:idx])
-			if beforeComment == "" {
-				continue
-			}
-			line = originalIndent + beforeComment
-		}
-
-		// Preserve structural empty lines between major blocks
-		if strings.TrimSpace(line) == "" {
-			if !lastLineWasEmpty {
-				result.WriteString("\n")
-				lastLineWasEmpty = true
-			}
-			continue
-		}
-
-		// Write the processed line
-		if result.Len() > 0 {
-			result.WriteString("\n")
-		}
-		result.WriteString(line)
-		lastLineWasEmpty = false
-	}
-
-	// Ensure content ends with a single newline
-	if result.Len() > 0 {
-		return bytes.TrimRight(result.Bytes(), "\n"), scanner.Err()
-	}
-	return result.Bytes(), scanner.Err()
-}
-
-// getIndentation returns the leading whitespace of a line
-func getIndentation(line string) string {
-	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	return stripComments(content, cSyntax)
 }
 
 // Language-specific comment strippers
 type (
 	GoCommentStripper         struct{ GenericCommentStripper }
-	PythonCommentStripper     struct{ GenericCommentStripper }
 	JavaScriptCommentStripper struct{ GenericCommentStripper }
 	JavaCommentStripper       struct{ GenericCommentStripper }
 	CppCommentStripper        struct{ GenericCommentStripper }
 	CCommentStripper          struct{ GenericCommentStripper }
 	RustCommentStripper       struct{ GenericCommentStripper }
 	ShellCommentStripper      struct{ GenericCommentStripper }
+	HTMLCommentStripper       struct{ GenericCommentStripper }
+	HashCommentStripper       struct{ GenericCommentStripper }
+	PHPCommentStripper        struct{ GenericCommentStripper }
+	LuaCommentStripper        struct{ GenericCommentStripper }
+	SQLCommentStripper        struct{ GenericCommentStripper }
+	CSSCommentStripper        struct{ GenericCommentStripper }
+	SCSSCommentStripper       struct{ GenericCommentStripper }
+	HaskellCommentStripper    struct{ GenericCommentStripper }
+	OCamlCommentStripper      struct{ GenericCommentStripper }
+	ErlangCommentStripper     struct{ GenericCommentStripper }
+	LispCommentStripper       struct{ GenericCommentStripper }
 )
+
+// StripComments implements CommentStripper.
+func (s *GoCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, goSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *JavaScriptCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, javaScriptSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *JavaCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, javaSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *RustCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, rustSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *ShellCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, shellSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *HTMLCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, htmlSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *HashCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, hashSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *PHPCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, phpSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *LuaCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, luaSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *SQLCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, sqlSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *CSSCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, cssSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *SCSSCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, scssSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *HaskellCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, haskellSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *OCamlCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, ocamlSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *ErlangCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, erlangSyntax)
+}
+
+// StripComments implements CommentStripper.
+func (s *LispCommentStripper) StripComments(content []byte) ([]byte, error) {
+	return stripComments(content, lispSyntax)
+}
@@ -0,0 +1,23 @@
+package processor
+
+import "bytes"
+
+// normalizeLineEndings converts CRLF and lone CR line endings to LF, so the
+// comment strippers, the chunker and the tokenizer only deal with \n. It
+// reports whether most line endings were CRLF.
+func normalizeLineEndings(content []byte) ([]byte, bool) {
+	if bytes.IndexByte(content, '\r') < 0 {
+		return content, false
+	}
+	crlf := bytes.Count(content, []byte("\r\n"))
+	lf := bytes.Count(content, []byte("\n"))
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	content = bytes.ReplaceAll(content, []byte("\r"), []byte("\n"))
+	return content, crlf > lf-crlf
+}
+
+// restoreCRLF converts the LF line endings of normalized content back to
+// CRLF.
+func restoreCRLF(content []byte) []byte {
+	return bytes.ReplaceAll(content, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// modelineLines is how many lines at the start and at the end of a file are
+// searched for a modeline. Vim checks five by default.
+const modelineLines = 5
+
+var (
+	// vimModeline matches settings such as "vim: set ft=python:" and
+	// "vi: filetype=sh"
+	vimModeline = regexp.MustCompile(`(?:^|\s)(?:vim?|ex):.*?\b(?:ft|filetype|syntax|syn)=([A-Za-z0-9_+-]+)`)
+	// emacsModeline matches the "-*- mode: python -*-" line, or its short
+	// form "-*- python -*-"
+	emacsModeline = regexp.MustCompile(`-\*-\s*(.*?)\s*-\*-`)
+	emacsMode     = regexp.MustCompile(`(?i)(?:^|;)\s*mode:\s*([A-Za-z0-9_+-]+)`)
+)
+
+// modeAliases maps the names editors use for a mode to the detector's
+// language names, where they differ.
+var modeAliases = map[string]string{
+	"sh":               "shell",
+	"bash":             "shell",
+	"zsh":              "shell",
+	"shell-script":     "shell",
+	"py":               "python",
+	"js":               "javascript",
+	"js2":              "javascript",
+	"ts":               "typescript",
+	"rb":               "ruby",
+	"c++":              "cpp",
+	"cperl":            "perl",
+	"makefile":         "make",
+	"makefile-gmake":   "make",
+	"emacs-lisp":       "elisp",
+	"lisp-interaction": "elisp",
+	"yml":              "yaml",
+	"docker":           "dockerfile",
+}
+
+// edgeLines reads the first and last n lines from reader. The two overlap
+// for files shorter than 2n lines.
+func edgeLines(reader io.Reader, n int) (head, tail []string) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(head) < n {
+			head = append(head, line)
+		}
+		tail = append(tail, line)
+		if len(tail) > n {
+			tail = tail[1:]
+		}
+	}
+	return head, tail
+}
+
+// detectByModeline returns the language named by a vim or emacs modeline
+// in lines, if it is one the detector knows.
+func (ld *LanguageDetector) detectByModeline(lines []string) string {
+	for _, line := range lines {
+		var mode string
+		if m := vimModeline.FindStringSubmatch(line); m != nil {
+			mode = m[1]
+		} else if m := emacsModeline.FindStringSubmatch(line); m != nil {
+			if mm := emacsMode.FindStringSubmatch(m[1]); mm != nil {
+				mode = mm[1]
+			} else if !strings.Contains(m[1], ":") {
+				mode = m[1]
+			}
+		}
+		if lang := ld.languageForMode(mode); lang != "" {
+			return lang
+		}
+	}
+	return ""
+}
+
+// languageForMode maps an editor mode name to a known language name, or
+// returns "" if there is none.
+func (ld *LanguageDetector) languageForMode(mode string) string {
+	mode = strings.ToLower(strings.TrimSuffix(mode, "-mode"))
+	if mode == "" {
+		return ""
+	}
+	if alias, ok := modeAliases[mode]; ok {
+		mode = alias
+	}
+	if _, ok := ld.commentMap[mode]; ok {
+		return mode
+	}
+	for _, lang := range ld.extensionMap {
+		if lang == mode {
+			return mode
+		}
+	}
+	return ""
+}
@@ -3,9 +3,13 @@ package processor
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 
+	"github.com/lc/pfzf/internal/fs"
 	"github.com/lc/pfzf/pkg/types"
 )
 
@@ -14,8 +18,13 @@ const DefaultChunkSize = 4096
 
 // Processor implements the types.Processor interface.
 type Processor struct {
-	opts     types.ProcessorOptions
-	language *LanguageDetector
+	opts      types.ProcessorOptions
+	language  *LanguageDetector
+	tokenizer Tokenizer
+	redact    []redactRule
+	logger    *slog.Logger
+	// cache holds recently processed files, or is nil when disabled
+	cache *contentCache
 }
 
 // New creates a new Processor with the given options.
@@ -28,27 +37,111 @@ func New(opts types.ProcessorOptions) (*Processor, error) {
 	if err != nil {
 		return nil, fmt.Errorf("creating language detector: %w", err)
 	}
+	detector.setStripDocstrings(opts.StripDocstrings)
+
+	tokenizer, err := NewTokenizer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("creating tokenizer: %w", err)
+	}
+
+	redact, err := newRedactRules(opts.RedactRules)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
 
 	return &Processor{
-		opts:     opts,
-		language: detector,
+		opts:      opts,
+		language:  detector,
+		tokenizer: tokenizer,
+		redact:    redact,
+		logger:    logger,
+		cache:     newContentCache(opts.CacheSize),
 	}, nil
 }
 
 // Process implements types.Processor.Process.
 func (p *Processor) Process(entry types.FileEntry) (types.ProcessedContent, error) {
+	return p.ProcessContext(context.Background(), entry)
+}
+
+// ProcessContext implements types.Processor.ProcessContext. Cancellation is
+// checked between reading, stripping and chunking.
+func (p *Processor) ProcessContext(ctx context.Context, entry types.FileEntry) (types.ProcessedContent, error) {
+	processed, err := p.process(ctx, entry)
+	if err != nil {
+		p.logger.Error("processing failed", "path", entry.Path, "error", err)
+		return processed, err
+	}
+
+	p.logger.Info("file processed",
+		"path", entry.Path,
+		"language", processed.Entry.Language,
+		"tokens", processed.TokenCount,
+		"saved_tokens", processed.SavedTokens,
+		"chunks", len(processed.Chunks))
+	return processed, nil
+}
+
+// ProcessData is like ProcessContext for content that is not read from a
+// file, such as the output of a command. entry describes the content; its
+// path is only used to detect the language when none is set.
+func (p *Processor) ProcessData(ctx context.Context, entry types.FileEntry, content []byte) (types.ProcessedContent, error) {
+	processed, err := p.processData(ctx, entry, content)
+	if err != nil {
+		p.logger.Error("processing failed", "path", entry.Path, "error", err)
+		return processed, err
+	}
+
+	p.logger.Info("data processed",
+		"path", entry.Path,
+		"language", processed.Entry.Language,
+		"tokens", processed.TokenCount,
+		"saved_tokens", processed.SavedTokens,
+		"chunks", len(processed.Chunks))
+	return processed, nil
+}
+
+func (p *Processor) process(ctx context.Context, entry types.FileEntry) (types.ProcessedContent, error) {
+	if p.Sensitive(entry) {
+		return types.ProcessedContent{}, ErrSensitive
+	}
 	if !p.ShouldProcess(entry) {
 		return types.ProcessedContent{Entry: entry}, nil
 	}
+	if processed, ok := p.cache.get(entry); ok {
+		return processed, nil
+	}
 
 	// Read file content
 	content, err := os.ReadFile(entry.Path)
 	if err != nil {
 		return types.ProcessedContent{}, fmt.Errorf("reading file: %w", err)
 	}
+	processed, err := p.processData(ctx, entry, content)
+	if err != nil {
+		return processed, err
+	}
+	p.cache.put(entry, processed)
+	return processed, nil
+}
+
+func (p *Processor) processData(ctx context.Context, entry types.FileEntry, content []byte) (types.ProcessedContent, error) {
+	if err := ctx.Err(); err != nil {
+		return types.ProcessedContent{}, err
+	}
+
+	// UTF-16 files, which the scanner classifies as text, are written as
+	// UTF-8 like the rest of the output
+	content, _ = fs.DecodeUTF16(content)
 
-	// Detect language if not already set
-	if entry.Language == "" {
+	// Detect language if not already set. The scanner only sees the start
+	// of a file, so an unknown language is detected again from all of it.
+	if entry.Language == "" || entry.Language == "unknown" {
 		lang, err := p.language.DetectLanguage(entry.Path, bytes.NewReader(content))
 		if err != nil {
 			// Don't fail on language detection errors
@@ -58,6 +151,8 @@ func (p *Processor) Process(entry types.FileEntry) (types.ProcessedContent, erro
 		}
 	}
 
+	content, crlf := normalizeLineEndings(content)
+
 	// Process content based on options
 	processed := types.ProcessedContent{
 		Entry:   entry,
@@ -72,9 +167,38 @@ func (p *Processor) Process(entry types.FileEntry) (types.ProcessedContent, erro
 		}
 	}
 
+	if p.opts.CollapseWhitespace {
+		processed.Content = collapseWhitespace(processed.Content, entry.Language, p.opts.Dedent)
+	}
+
+	if p.opts.StripBlankLines {
+		processed.Content = stripBlankLines(processed.Content, entry.Language)
+	}
+
+	if p.opts.RedactSecrets {
+		var n int
+		processed.Content, n = redactSecrets(processed.Content, p.redact)
+		if n > 0 {
+			p.logger.Info("redacted secrets", "path", entry.Path, "count", n)
+		}
+	}
+
+	if crlf && p.opts.PreserveLineEndings {
+		processed.Content = restoreCRLF(processed.Content)
+	}
+
+	processed.TokenCount = p.tokenizer.CountTokens(string(processed.Content))
+	if p.opts.StripComments || p.opts.CollapseWhitespace || p.opts.StripBlankLines {
+		// Measure what the transforms saved
+		processed.SavedTokens = max(0, p.tokenizer.CountTokens(string(content))-processed.TokenCount)
+	}
+	if err := ctx.Err(); err != nil {
+		return types.ProcessedContent{}, err
+	}
+
 	// Create chunks if content exceeds chunk size
 	if int64(len(content)) > p.opts.MaxChunkSize {
-		chunks, err := p.createChunks(processed.Content)
+		chunks, err := p.createChunks(processed.Content, entry.Language)
 		if err != nil {
 			return types.ProcessedContent{}, fmt.Errorf("creating chunks: %w", err)
 		}
@@ -96,6 +220,11 @@ func (p *Processor) ShouldProcess(entry types.FileEntry) bool {
 		return false
 	}
 
+	// Don't include files that commonly hold secrets
+	if p.Sensitive(entry) {
+		return false
+	}
+
 	// TODO: this is very inaccurate comparison lol
 	// Don't process files larger than max tokens (rough estimate)
 	/*if p.opts.MaxTokens > 0 && entry.Size > int64(p.opts.MaxTokens*4) {
@@ -115,19 +244,26 @@ func (p *Processor) stripComments(content []byte, language string) ([]byte, erro
 }
 
 // createChunks splits content into overlapping chunks.
-func (p *Processor) createChunks(content []byte) ([]types.Chunk, error) {
+func (p *Processor) createChunks(content []byte, language string) ([]types.Chunk, error) {
 	chunker := NewChunker(ChunkerOptions{
-		MaxSize:    p.opts.MaxChunkSize,
-		Overlap:    p.opts.ChunkOverlap,
-		MaxTokens:  p.opts.MaxTokens,
-		PreserveML: true, // Preserve markup language tags
+		MaxSize:            p.opts.MaxChunkSize,
+		Overlap:            p.opts.ChunkOverlap,
+		MaxTokens:          p.opts.MaxTokens,
+		PreserveML:         true, // Preserve markup language tags
+		Tokenizer:          p.tokenizer,
+		SemanticBoundaries: p.opts.SemanticChunks,
+		Language:           language,
 	})
 
 	return chunker.Chunk(content)
 }
 
-// Configure updates the processor options.
+// Configure updates the processor options. StripDocstrings, the tokenizer
+// and the redaction rules are fixed when the processor is created because
+// they are shared with in-flight processing. Cached files are processed
+// again with the new options.
 func (p *Processor) Configure(opts types.ProcessorOptions) {
+	p.cache.clear()
 	if opts.MaxChunkSize > 0 {
 		p.opts.MaxChunkSize = opts.MaxChunkSize
 	}
@@ -138,4 +274,11 @@ func (p *Processor) Configure(opts types.ProcessorOptions) {
 		p.opts.MaxTokens = opts.MaxTokens
 	}
 	p.opts.StripComments = opts.StripComments
+	p.opts.SemanticChunks = opts.SemanticChunks
+	p.opts.StripBlankLines = opts.StripBlankLines
+	p.opts.CollapseWhitespace = opts.CollapseWhitespace
+	p.opts.Dedent = opts.Dedent
+	p.opts.RedactSecrets = opts.RedactSecrets
+	p.opts.PreserveLineEndings = opts.PreserveLineEndings
+	p.opts.AllowSensitive = opts.AllowSensitive
 }
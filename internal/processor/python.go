@@ -0,0 +1,108 @@
+package processor
+
+import "strings"
+
+// PythonCommentStripper removes # comments and, optionally, docstrings from
+// Python source.
+type PythonCommentStripper struct {
+	// StripDocstrings removes module, class and function docstrings
+	StripDocstrings bool
+}
+
+// StripComments implements CommentStripper.
+func (s *PythonCommentStripper) StripComments(content []byte) ([]byte, error) {
+	if s.StripDocstrings {
+		content = stripDocstrings(content)
+	}
+	return stripComments(content, pythonSyntax)
+}
+
+// stripDocstrings removes triple-quoted string statements that open a module,
+// class or function body.
+func stripDocstrings(content []byte) []byte {
+	lines := strings.Split(string(content), "\n")
+	out := make([]string, 0, len(lines))
+	state := &literalState{syntax: pythonSyntax}
+
+	// A docstring may only appear as the first statement of a body
+	expectDoc := true
+	inHeader := false
+	depth := 0
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		inString := state.quote != nil
+		trimmed := strings.TrimSpace(line)
+
+		if !inString && expectDoc {
+			if end, ok := docstringEnd(lines, i); ok {
+				i = end
+				expectDoc = false
+				continue
+			}
+		}
+
+		out = append(out, line)
+		code, _ := state.stripLine(line)
+		code = strings.TrimSpace(code)
+		if inString || code == "" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "def ") || strings.HasPrefix(trimmed, "async def ") ||
+			strings.HasPrefix(trimmed, "class ") {
+			inHeader = true
+			depth = 0
+		}
+
+		// Signatures may span lines; wait for the brackets to balance
+		expectDoc = false
+		if inHeader {
+			depth += strings.Count(code, "(") + strings.Count(code, "[") -
+				strings.Count(code, ")") - strings.Count(code, "]")
+			if depth <= 0 {
+				expectDoc = strings.HasSuffix(code, ":")
+				inHeader = false
+			}
+		}
+	}
+
+	return []byte(strings.Join(out, "\n"))
+}
+
+// docstringEnd reports whether lines[start] opens a standalone triple-quoted
+// string and returns the index of the line that closes it.
+func docstringEnd(lines []string, start int) (int, bool) {
+	trimmed := strings.TrimLeft(lines[start], " \t")
+	trimmed = strings.TrimLeft(trimmed, "rRuU")
+
+	var delim string
+	switch {
+	case strings.HasPrefix(trimmed, `"""`):
+		delim = `"""`
+	case strings.HasPrefix(trimmed, `'''`):
+		delim = `'''`
+	default:
+		return 0, false
+	}
+
+	rest := trimmed[len(delim):]
+	for i := start; i < len(lines); i++ {
+		if i > start {
+			rest = lines[i]
+		}
+		idx := strings.Index(rest, delim)
+		if idx < 0 {
+			continue
+		}
+
+		// Only treat it as a docstring if nothing but a comment follows
+		after := strings.TrimSpace(rest[idx+len(delim):])
+		if after != "" && !strings.HasPrefix(after, "#") {
+			return 0, false
+		}
+		return i, true
+	}
+
+	return 0, false
+}
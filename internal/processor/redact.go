@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// redacted replaces each secret found in content.
+const redacted = "[REDACTED]"
+
+// redactRule finds one kind of secret. If its pattern has a capture group,
+// only the first group is replaced, keeping context such as the name of
+// the variable a secret is assigned to; otherwise the whole match is.
+type redactRule struct {
+	name string
+	re   *regexp.Regexp
+	// check, if set, rejects matches that aren't secrets after all
+	check func(secret []byte) bool
+}
+
+// secretNames matches the names of variables and keys that hold secrets.
+const secretNames = `(?:secret|token|passw(?:or)?d|api_?key|access_?key|private_?key|credentials?)`
+
+// defaultRedactRules are the rules RedactSecrets applies before any from
+// the options. They favour missing an odd secret over redacting ordinary
+// code: assignments only count when the value is a literal.
+var defaultRedactRules = []redactRule{
+	{
+		name: "private-key",
+		re:   regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`),
+	},
+	{
+		name: "aws-access-key",
+		re:   regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		name: "github-token",
+		re:   regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	},
+	{
+		name: "jwt",
+		re:   regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`),
+	},
+	{
+		// KEY=value lines of .env files and shell scripts, which have no
+		// spaces around the = unlike most assignments in code
+		name: "env-assignment",
+		re:   regexp.MustCompile(`(?im)^[ \t]*(?:export[ \t]+)?[a-z0-9_]*` + secretNames + `[a-z0-9_]*=["']?([^\s"'#()]{6,})["']?[ \t]*(?:#.*)?$`),
+	},
+	{
+		// String literals assigned to secret names in code and config,
+		// such as apiKey = "..." or "password": "..."
+		name: "assignment",
+		re:   regexp.MustCompile(`(?i)` + secretNames + `[a-z0-9_]*["']?[ \t]*(?::=|=>|[:=])[ \t]*["']([^"'\s]{8,})["']`),
+	},
+	{
+		name:  "high-entropy",
+		re:    regexp.MustCompile(`["']([A-Za-z0-9+/_=-]{24,})["']`),
+		check: looksRandom,
+	},
+}
+
+// newRedactRules returns the default rules followed by the custom rules.
+func newRedactRules(custom []types.RedactRule) ([]redactRule, error) {
+	rules := append([]redactRule(nil), defaultRedactRules...)
+	for _, r := range custom {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction rule %q: %w", r.Name, err)
+		}
+		rules = append(rules, redactRule{name: r.Name, re: re})
+	}
+	return rules, nil
+}
+
+// redactSecrets replaces the secrets rules find in content with
+// [REDACTED] and returns how many were replaced.
+func redactSecrets(content []byte, rules []redactRule) ([]byte, int) {
+	total := 0
+	for _, rule := range rules {
+		var n int
+		content, n = rule.apply(content)
+		total += n
+	}
+	return content, total
+}
+
+func (r redactRule) apply(content []byte) ([]byte, int) {
+	matches := r.re.FindAllSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return content, 0
+	}
+
+	var out bytes.Buffer
+	last, n := 0, 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		if r.check != nil && !r.check(content[start:end]) {
+			continue
+		}
+		out.Write(content[last:start])
+		out.WriteString(redacted)
+		last = end
+		n++
+	}
+	if n == 0 {
+		return content, 0
+	}
+	out.Write(content[last:])
+	return out.Bytes(), n
+}
+
+// looksRandom reports whether s looks like a generated key rather than a
+// word or identifier: it mixes letters and digits, and its characters are
+// spread evenly enough, measured by Shannon entropy.
+func looksRandom(s []byte) bool {
+	var letters, digits bool
+	counts := make(map[byte]int)
+	for _, c := range s {
+		counts[c]++
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letters = true
+		}
+	}
+	if !letters || !digits {
+		return false
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= 4.1
+}
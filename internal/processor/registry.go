@@ -0,0 +1,151 @@
+package processor
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// registry holds the languages LanguageDetectors are created with: names
+// in registration order, their processors and the extensions mapped to
+// them, the latest registration of an extension winning.
+var registry = struct {
+	sync.RWMutex
+	names      []string
+	processors map[string]types.LanguageProcessor
+	extensions map[string]string
+}{
+	processors: make(map[string]types.LanguageProcessor),
+	extensions: make(map[string]string),
+}
+
+func init() {
+	registerBuiltins()
+}
+
+// RegisterLanguage makes a language known to the LanguageDetectors created
+// afterwards, so it is usually called from an init function. Files with one
+// of the extensions are detected as name and use lp to strip comments and
+// extract symbols; lp.DetectLanguage is asked about files nothing else
+// identifies and is given their first lines. Registering a name again,
+// including a built-in one, replaces its processor and adds the extensions
+// to those it already has. It panics if name is empty or lp is nil.
+func RegisterLanguage(name string, lp types.LanguageProcessor, extensions []string) {
+	if name == "" {
+		panic("processor: RegisterLanguage called with an empty name")
+	}
+	if lp == nil {
+		panic("processor: RegisterLanguage called with a nil processor for " + name)
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.processors[name]; !ok {
+		registry.names = append(registry.names, name)
+	}
+	registry.processors[name] = lp
+	for _, ext := range extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		registry.extensions[ext] = name
+	}
+}
+
+// registeredLanguage returns the processor registered for language, or nil.
+func registeredLanguage(language string) types.LanguageProcessor {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.processors[language]
+}
+
+// registerBuiltins registers the built-in languages in name order.
+func registerBuiltins() {
+	extensions := make(map[string][]string)
+	for ext, lang := range builtinExtensions {
+		extensions[lang] = append(extensions[lang], ext)
+	}
+	names := make([]string, 0, len(extensions))
+	for lang := range extensions {
+		names = append(names, lang)
+	}
+	for lang := range builtinStrippers {
+		if _, ok := extensions[lang]; !ok {
+			names = append(names, lang)
+		}
+	}
+	sort.Strings(names)
+
+	for _, lang := range names {
+		stripper, ok := builtinStrippers[lang]
+		if !ok {
+			stripper = &GenericCommentStripper{}
+		}
+		RegisterLanguage(lang, &builtinLanguage{name: lang, stripper: stripper}, extensions[lang])
+	}
+}
+
+// loadRegistered copies the registered extensions and comment strippers
+// into the detector and collects the plugins.
+func (ld *LanguageDetector) loadRegistered() {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	for ext, lang := range registry.extensions {
+		ld.extensionMap[ext] = lang
+	}
+	for _, name := range registry.names {
+		lp := registry.processors[name]
+		if builtin, ok := lp.(*builtinLanguage); ok {
+			ld.commentMap[name] = builtin.stripper
+			continue
+		}
+		ld.commentMap[name] = lp
+		ld.plugins = append(ld.plugins, lp)
+	}
+}
+
+// detectByPlugins asks each plugin in turn about the file whose first lines
+// are head, returning the first language one names.
+func (ld *LanguageDetector) detectByPlugins(filename string, head []string) string {
+	for _, lp := range ld.plugins {
+		lang, err := lp.DetectLanguage(filename, strings.NewReader(strings.Join(head, "\n")))
+		if err == nil && lang != "" && lang != "unknown" {
+			return lang
+		}
+	}
+	return ""
+}
+
+// builtinLanguage is the processor of a built-in language. Its files are
+// detected by the detector's tables rather than by DetectLanguage.
+type builtinLanguage struct {
+	name     string
+	stripper CommentStripper
+}
+
+// DetectLanguage implements types.LanguageProcessor; it never detects
+// anything.
+func (l *builtinLanguage) DetectLanguage(string, io.Reader) (string, error) {
+	return "", nil
+}
+
+// ExtractSymbols implements types.LanguageProcessor. Go source is parsed;
+// other languages are split into unindented blocks.
+func (l *builtinLanguage) ExtractSymbols(content []byte) ([]types.Symbol, error) {
+	if l.name == "go" {
+		if symbols, ok := extractGoSymbols(content); ok {
+			return symbols, nil
+		}
+	}
+	return extractBlockSymbols(content), nil
+}
+
+// StripComments implements types.LanguageProcessor.
+func (l *builtinLanguage) StripComments(content []byte) ([]byte, error) {
+	return l.stripper.StripComments(content)
+}
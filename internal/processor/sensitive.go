@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// ErrSensitive is returned for files that commonly hold secrets, such as
+// .env files and private keys, unless AllowSensitive is set.
+var ErrSensitive = errors.New("the file may hold secrets (set allowSensitive to include it)")
+
+// sensitiveNames are globs matched against file names.
+var sensitiveNames = []string{
+	".env",
+	".env.*",
+	"*.pem",
+	"*.key",
+	"*.p12",
+	"*.pfx",
+	"*.jks",
+	"*.keystore",
+	"*.kdbx",
+	"id_rsa",
+	"id_dsa",
+	"id_ecdsa",
+	"id_ed25519",
+	".netrc",
+	".pgpass",
+	".htpasswd",
+}
+
+// sensitivePaths are the trailing path elements of sensitive files whose
+// names alone are too common to match.
+var sensitivePaths = []string{
+	".aws/credentials",
+	".docker/config.json",
+	".kube/config",
+	".ssh/config",
+}
+
+// exampleEnvSuffixes mark .env files that document the variables rather
+// than set them.
+var exampleEnvSuffixes = []string{".example", ".sample", ".template", ".dist"}
+
+// isSensitive reports whether the file at name is one that commonly holds
+// secrets.
+func isSensitive(name string) bool {
+	slashed := filepath.ToSlash(name)
+	base := path.Base(slashed)
+	if strings.HasPrefix(base, ".env") {
+		for _, suffix := range exampleEnvSuffixes {
+			if strings.HasSuffix(base, suffix) {
+				return false
+			}
+		}
+	}
+
+	for _, pattern := range sensitiveNames {
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	for _, suffix := range sensitivePaths {
+		if slashed == suffix || strings.HasSuffix(slashed, "/"+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sensitive reports whether entry is left out of the context because it
+// commonly holds secrets.
+func (p *Processor) Sensitive(entry types.FileEntry) bool {
+	return !p.opts.AllowSensitive && isSensitive(entry.Path)
+}
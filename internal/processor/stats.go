@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// statsLargest is how many of the largest files Stats lists.
+const statsLargest = 10
+
+// Stats summarizes the files of a selection without their content.
+type Stats struct {
+	Files  int   `json:"files"`
+	Bytes  int64 `json:"bytes"`
+	Tokens int   `json:"tokens"`
+	// Skipped counts the entries ShouldProcess ruled out, such as binary
+	// and empty files
+	Skipped int `json:"skipped"`
+	// Languages breaks the totals down by language, most tokens first
+	Languages []LanguageStats `json:"languages"`
+	// Largest lists the files with the most tokens, most first
+	Largest []FileStats `json:"largest"`
+}
+
+// LanguageStats holds the totals of one language's files.
+type LanguageStats struct {
+	Language string `json:"language"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Tokens   int    `json:"tokens"`
+}
+
+// FileStats describes one file in Stats.
+type FileStats struct {
+	Path     string `json:"path"`
+	Language string `json:"language"`
+	Bytes    int64  `json:"bytes"`
+	Tokens   int    `json:"tokens"`
+}
+
+// Stats processes each entry ShouldProcess accepts, counting its tokens as
+// Process would, and summarizes them.
+func (p *Processor) Stats(entries []types.FileEntry) (Stats, error) {
+	return p.StatsContext(context.Background(), entries)
+}
+
+// StatsContext is like Stats but stops at ctx's cancellation. Files that
+// fail to process are left out and their errors returned together with the
+// summary of the others.
+func (p *Processor) StatsContext(ctx context.Context, entries []types.FileEntry) (Stats, error) {
+	var stats Stats
+	languages := make(map[string]*LanguageStats)
+	var files []FileStats
+	var errs []error
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if !p.ShouldProcess(entry) {
+			stats.Skipped++
+			continue
+		}
+		processed, err := p.ProcessContext(ctx, entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("processing %s: %w", entry.Path, err))
+			continue
+		}
+
+		file := FileStats{
+			Path:     entry.Path,
+			Language: processed.Entry.Language,
+			Bytes:    entry.Size,
+			Tokens:   processed.TokenCount,
+		}
+		files = append(files, file)
+		stats.Files++
+		stats.Bytes += file.Bytes
+		stats.Tokens += file.Tokens
+
+		lang := languages[file.Language]
+		if lang == nil {
+			lang = &LanguageStats{Language: file.Language}
+			languages[file.Language] = lang
+		}
+		lang.Files++
+		lang.Bytes += file.Bytes
+		lang.Tokens += file.Tokens
+	}
+
+	for _, lang := range languages {
+		stats.Languages = append(stats.Languages, *lang)
+	}
+	sort.Slice(stats.Languages, func(i, j int) bool {
+		a, b := stats.Languages[i], stats.Languages[j]
+		if a.Tokens != b.Tokens {
+			return a.Tokens > b.Tokens
+		}
+		return a.Language < b.Language
+	})
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Tokens != files[j].Tokens {
+			return files[i].Tokens > files[j].Tokens
+		}
+		return files[i].Path < files[j].Path
+	})
+	if len(files) > statsLargest {
+		files = files[:statsLargest]
+	}
+	stats.Largest = files
+
+	return stats, errors.Join(errs...)
+}
@@ -0,0 +1,104 @@
+package processor
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// ExtractSymbols returns the top-level declarations in content in source
+// order, as found by the language's registered processor. Go source is
+// parsed; other languages, and processors that fail, fall back to treating
+// each unindented block after a blank line as a declaration.
+func ExtractSymbols(content []byte, language string) []types.Symbol {
+	if lp := registeredLanguage(language); lp != nil {
+		if symbols, err := lp.ExtractSymbols(content); err == nil {
+			return symbols
+		}
+	}
+	return extractBlockSymbols(content)
+}
+
+// EnclosingSymbol returns the symbol whose lines contain the 1-based line.
+func EnclosingSymbol(symbols []types.Symbol, line int) (types.Symbol, bool) {
+	for _, symbol := range symbols {
+		if symbol.StartLine <= line && line <= symbol.EndLine {
+			return symbol, true
+		}
+	}
+	return types.Symbol{}, false
+}
+
+// extractGoSymbols returns Go's top-level declarations, including their doc
+// comments. It reports false if content does not parse.
+func extractGoSymbols(content []byte) ([]types.Symbol, bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", content, parser.ParseComments)
+	if err != nil {
+		return nil, false
+	}
+
+	symbols := make([]types.Symbol, 0, len(file.Decls))
+	for _, decl := range file.Decls {
+		start := decl.Pos()
+		symbol := types.Symbol{EndLine: fset.Position(decl.End()).Line}
+
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			symbol.Name, symbol.Type = d.Name.Name, "func"
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		case *ast.GenDecl:
+			symbol.Name, symbol.Type = d.Tok.String(), d.Tok.String()
+			if len(d.Specs) == 1 {
+				if spec, ok := d.Specs[0].(*ast.TypeSpec); ok {
+					symbol.Name = spec.Name.Name
+				}
+			}
+			if d.Doc != nil {
+				start = d.Doc.Pos()
+			}
+		}
+
+		symbol.StartLine = fset.Position(start).Line
+		symbols = append(symbols, symbol)
+	}
+
+	return symbols, true
+}
+
+// extractBlockSymbols treats every unindented line that follows a blank line
+// as the start of a declaration running until the next one.
+func extractBlockSymbols(content []byte) []types.Symbol {
+	lines := strings.Split(string(content), "\n")
+
+	var symbols []types.Symbol
+	prevBlank := true
+	for i, line := range lines {
+		blank := strings.TrimSpace(line) == ""
+		if prevBlank && !blank && !startsIndented(line) && !strings.ContainsAny(line[:1], ")]}") {
+			if n := len(symbols); n > 0 {
+				symbols[n-1].EndLine = i
+			}
+			symbols = append(symbols, types.Symbol{
+				Name:      strings.TrimSpace(line),
+				Type:      "block",
+				StartLine: i + 1,
+			})
+		}
+		prevBlank = blank
+	}
+	if n := len(symbols); n > 0 {
+		symbols[n-1].EndLine = len(lines)
+	}
+
+	return symbols
+}
+
+func startsIndented(line string) bool {
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
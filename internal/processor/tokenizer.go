@@ -0,0 +1,221 @@
+package processor
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// Tokenizer counts the tokens a language model would see for a text.
+type Tokenizer interface {
+	// CountTokens returns the number of tokens in text.
+	CountTokens(text string) int
+}
+
+// NewTokenizer returns the tokenizer selected by opts. The cl100k tokenizer
+// needs its merge ranks, read from opts.TokenizerVocab in tiktoken format.
+func NewTokenizer(opts types.ProcessorOptions) (Tokenizer, error) {
+	switch opts.Tokenizer {
+	case "", types.TokenizerHeuristic:
+		return HeuristicTokenizer{}, nil
+	case types.TokenizerCL100K:
+		if opts.TokenizerVocab == "" {
+			return nil, fmt.Errorf("tokenizer %s requires a vocabulary file", opts.Tokenizer)
+		}
+		return LoadBPETokenizer(opts.TokenizerVocab)
+	default:
+		return nil, fmt.Errorf("unsupported tokenizer: %s", opts.Tokenizer)
+	}
+}
+
+// HeuristicTokenizer estimates roughly four bytes per token, which is close
+// for English text and source code with BPE vocabularies.
+type HeuristicTokenizer struct{}
+
+// CountTokens implements Tokenizer.
+func (HeuristicTokenizer) CountTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// BPETokenizer counts tokens with byte-pair encoding using cl100k's
+// pre-tokenization rules.
+type BPETokenizer struct {
+	ranks map[string]int
+}
+
+// LoadBPETokenizer reads merge ranks from a tiktoken file such as
+// cl100k_base.tiktoken.
+func LoadBPETokenizer(path string) (*BPETokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening tokenizer vocabulary: %w", err)
+	}
+	defer f.Close()
+
+	return NewBPETokenizer(f)
+}
+
+// NewBPETokenizer reads merge ranks in tiktoken format: one base64 encoded
+// token and its rank per line.
+func NewBPETokenizer(r io.Reader) (*BPETokenizer, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("parsing vocabulary line %d: missing rank", line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("parsing vocabulary line %d: %w", line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("parsing vocabulary line %d: %w", line, err)
+		}
+		ranks[string(decoded)] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading tokenizer vocabulary: %w", err)
+	}
+
+	return &BPETokenizer{ranks: ranks}, nil
+}
+
+// CountTokens implements Tokenizer.
+func (t *BPETokenizer) CountTokens(text string) int {
+	count := 0
+	for len(text) > 0 {
+		n := pretokenLen(text)
+		count += t.countPiece(text[:n])
+		text = text[n:]
+	}
+	return count
+}
+
+// countPiece returns the number of tokens a pre-tokenized piece encodes to,
+// merging the lowest ranked adjacent pair until no pair is in the vocabulary.
+func (t *BPETokenizer) countPiece(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+
+	// bounds[i] is the start of the i'th part; the last entry is len(piece)
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			rank, ok := t.ranks[piece[bounds[i]:bounds[i+2]]]
+			if ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+
+	return len(bounds) - 1
+}
+
+// pretokenLen returns the length of the first piece of text under cl100k's
+// split pattern:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Go's regexp lacks the lookahead, so the alternatives are matched by hand in
+// the same order.
+func pretokenLen(text string) int {
+	r, size := utf8.DecodeRuneInString(text)
+
+	if r == '\'' {
+		lower := strings.ToLower(text[size:min(len(text), size+2)])
+		for _, suffix := range []string{"re", "ve", "ll", "s", "t", "m", "d"} {
+			if strings.HasPrefix(lower, suffix) {
+				return size + len(suffix)
+			}
+		}
+	}
+
+	if unicode.IsLetter(r) {
+		return size + spanLen(text[size:], unicode.IsLetter, -1)
+	}
+	if r != '\r' && r != '\n' && !unicode.IsNumber(r) {
+		if n := spanLen(text[size:], unicode.IsLetter, -1); n > 0 {
+			return size + n
+		}
+	}
+
+	if unicode.IsNumber(r) {
+		return size + spanLen(text[size:], unicode.IsNumber, 2)
+	}
+
+	start := 0
+	if r == ' ' {
+		start = size
+	}
+	if n := spanLen(text[start:], isPunct, -1); n > 0 {
+		end := start + n
+		return end + spanLen(text[end:], isNewline, -1)
+	}
+
+	if !unicode.IsSpace(r) {
+		return size
+	}
+
+	// A whitespace run: up to its last newline, or all but its last rune
+	// when a non-space follows
+	n := spanLen(text, unicode.IsSpace, -1)
+	if i := strings.LastIndexAny(text[:n], "\r\n"); i >= 0 {
+		return i + 1
+	}
+	if n < len(text) {
+		_, last := utf8.DecodeLastRuneInString(text[:n])
+		if n-last > 0 {
+			return n - last
+		}
+	}
+	return n
+}
+
+// spanLen returns the byte length of the longest prefix of s whose runes
+// satisfy fn, stopping after limit runes when limit is non-negative.
+func spanLen(s string, fn func(rune) bool, limit int) int {
+	i := 0
+	for i < len(s) && limit != 0 {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !fn(r) {
+			break
+		}
+		i += size
+		limit--
+	}
+	return i
+}
+
+func isPunct(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isNewline(r rune) bool {
+	return r == '\r' || r == '\n'
+}
@@ -0,0 +1,234 @@
+package scanner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckpointFile is the checkpoint sidecar pfzf keeps in the scanned root
+// when resuming is enabled.
+const CheckpointFile = ".pfzf-checkpoint.json"
+
+// checkpointInterval is how often progress is saved while scanning.
+const checkpointInterval = time.Second
+
+// checkpointState is the saved progress of an interrupted scan.
+type checkpointState struct {
+	// Completed lists directories whose whole subtree was delivered
+	Completed []string `json:"completed"`
+	// Delivered lists files already delivered from directories that
+	// weren't completed
+	Delivered []string `json:"delivered,omitempty"`
+}
+
+// checkpoint tracks which directories of a scan are completed: every file
+// in them was delivered, or skipped, and every subdirectory is completed.
+// Paths are slash-separated and relative to the scan root, which is ".".
+type checkpoint struct {
+	path string
+
+	mu        sync.Mutex
+	completed map[string]bool
+	// delivered holds the delivered files of each directory that isn't
+	// completed yet
+	delivered map[string]map[string]bool
+	// pending counts what a directory still waits on: files being
+	// processed, unfinished subdirectories, and one while it is walked
+	pending   map[string]int
+	lastSaved time.Time
+}
+
+// loadCheckpoint reads the checkpoint at path, starting afresh if there is
+// none.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{
+		path:      path,
+		completed: make(map[string]bool),
+		delivered: make(map[string]map[string]bool),
+		pending:   make(map[string]int),
+		lastSaved: time.Now(),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %w", err)
+	}
+	var state checkpointState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint %s: %w", path, err)
+	}
+	for _, dir := range state.Completed {
+		c.completed[dir] = true
+	}
+	for _, file := range state.Delivered {
+		c.markDelivered(file)
+	}
+	return c, nil
+}
+
+// isCompleted reports whether dir was completed, in this scan or an earlier
+// one.
+func (c *checkpoint) isCompleted(dir string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.completed[dir]
+}
+
+// isDelivered reports whether file was delivered by an earlier scan.
+func (c *checkpoint) isDelivered(file string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delivered[parentDir(file)][file]
+}
+
+// enter records that the walk entered dir.
+func (c *checkpoint) enter(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[dir]++
+	if dir != "." {
+		c.pending[parentDir(dir)]++
+	}
+}
+
+// leave records that the walk is done with dir's entries.
+func (c *checkpoint) leave(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.release(dir)
+}
+
+// add records that file was handed to a worker.
+func (c *checkpoint) add(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[parentDir(file)]++
+}
+
+// done records that file was delivered or skipped by a worker.
+func (c *checkpoint) done(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.markDelivered(file)
+	c.release(parentDir(file))
+}
+
+// markDelivered adds file to the delivered files. c.mu must be held, or c
+// not yet shared.
+func (c *checkpoint) markDelivered(file string) {
+	dir := parentDir(file)
+	if c.delivered[dir] == nil {
+		c.delivered[dir] = make(map[string]bool)
+	}
+	c.delivered[dir][file] = true
+}
+
+// release drops one thing dir waits on, completing it and possibly its
+// ancestors. c.mu must be held.
+func (c *checkpoint) release(dir string) {
+	for {
+		c.pending[dir]--
+		if c.pending[dir] > 0 {
+			return
+		}
+		delete(c.pending, dir)
+		delete(c.delivered, dir)
+		c.completed[dir] = true
+		if dir == "." {
+			return
+		}
+		dir = parentDir(dir)
+	}
+}
+
+// saveIfDue saves the checkpoint if it hasn't been saved recently.
+func (c *checkpoint) saveIfDue() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastSaved) < checkpointInterval {
+		return nil
+	}
+	return c.save()
+}
+
+// finish saves the progress of a stopped scan, or removes the checkpoint
+// once the whole tree was scanned.
+func (c *checkpoint) finish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.completed["."] {
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing checkpoint: %w", err)
+		}
+		return nil
+	}
+	return c.save()
+}
+
+// save writes the checkpoint, leaving out what a completed ancestor already
+// covers. c.mu must be held.
+func (c *checkpoint) save() error {
+	var state checkpointState
+	for dir := range c.completed {
+		if !c.coveredByAncestor(dir) {
+			state.Completed = append(state.Completed, dir)
+		}
+	}
+	for dir, files := range c.delivered {
+		if c.completed[dir] || c.coveredByAncestor(dir) {
+			continue
+		}
+		for file := range files {
+			state.Delivered = append(state.Delivered, file)
+		}
+	}
+	sort.Strings(state.Completed)
+	sort.Strings(state.Delivered)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %w", err)
+	}
+	// Replace the checkpoint atomically so an interruption never leaves a
+	// truncated one behind
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	c.lastSaved = time.Now()
+	return nil
+}
+
+// coveredByAncestor reports whether a directory above path is completed.
+// c.mu must be held.
+func (c *checkpoint) coveredByAncestor(path string) bool {
+	for path != "." {
+		path = parentDir(path)
+		if c.completed[path] {
+			return true
+		}
+	}
+	return false
+}
+
+// parentDir returns the directory containing the slash-separated relative
+// path, "." at the top.
+func parentDir(path string) string {
+	if i := strings.LastIndexByte(path, '/'); i >= 0 {
+		return path[:i]
+	}
+	return "."
+}
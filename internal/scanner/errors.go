@@ -0,0 +1,51 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Operations a ScanError can fail in.
+const (
+	// OpWalk is reading a directory or its entries during the walk
+	OpWalk = "walk"
+	// OpList is checking a path given with WithFiles
+	OpList = "list"
+	// OpStat is reading a file's metadata before it is classified
+	OpStat = "stat"
+	// OpSniff is reading the start of a file to classify it
+	OpSniff = "sniff"
+	// OpCheckpoint is saving or removing the checkpoint
+	OpCheckpoint = "checkpoint"
+)
+
+// ErrIsDirectory is the error of a path given with WithFiles that is a
+// directory.
+var ErrIsDirectory = errors.New("is a directory")
+
+// ScanError is the error sent on the errors channel when the scanner fails
+// on a path. Err is the underlying error, so errors.Is(err, fs.ErrPermission)
+// picks out the files and directories that couldn't be read.
+type ScanError struct {
+	// Path is the path as walked or listed, or the checkpoint's path
+	Path string
+	// Op is what failed: OpWalk, OpList, OpStat, OpSniff or OpCheckpoint
+	Op  string
+	Err error
+}
+
+func (e *ScanError) Error() string {
+	// Errors from the os package name the path already
+	err := e.Err
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Path == e.Path {
+		err = pathErr.Err
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Path, err)
+}
+
+// Unwrap lets errors.Is and errors.As match the underlying error.
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,101 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// languageIgnore is the noise a language's tooling leaves in a tree, such
+// as bytecode and minified bundles, and how to tell the language is used.
+type languageIgnore struct {
+	language string
+	// markers are files at the root that only projects in the language
+	// have, and extensions those of its source files at the root
+	markers    []string
+	extensions []string
+	patterns   []string
+}
+
+// languageIgnores lists the languages with ignore patterns, in the order
+// their patterns are added.
+var languageIgnores = []languageIgnore{
+	{
+		language:   "go",
+		markers:    []string{"go.mod", "go.work"},
+		extensions: []string{".go"},
+		patterns:   []string{"go.sum", "go.work.sum"},
+	},
+	{
+		language:   "javascript",
+		markers:    []string{"package.json", "tsconfig.json"},
+		extensions: []string{".js", ".jsx", ".ts", ".tsx", ".mjs", ".cjs"},
+		patterns: []string{
+			"*.min.js", "*.min.css", "*.map",
+			"package-lock.json", "yarn.lock", "pnpm-lock.yaml",
+			".turbo", ".parcel-cache",
+		},
+	},
+	{
+		language:   "python",
+		markers:    []string{"pyproject.toml", "setup.py", "setup.cfg", "requirements.txt", "Pipfile"},
+		extensions: []string{".py"},
+		patterns: []string{
+			"__pycache__", "*.pyc", "*.pyo", "*.egg-info",
+			".pytest_cache", ".mypy_cache", ".ruff_cache", ".tox", ".venv",
+			"poetry.lock", "Pipfile.lock",
+		},
+	},
+	{
+		language: "rust",
+		markers:  []string{"Cargo.toml"},
+		patterns: []string{"target", "Cargo.lock"},
+	},
+	{
+		language: "java",
+		markers:  []string{"pom.xml", "build.gradle", "build.gradle.kts"},
+		patterns: []string{"*.class", ".gradle"},
+	},
+	{
+		language: "ruby",
+		markers:  []string{"Gemfile"},
+		patterns: []string{"Gemfile.lock", ".bundle"},
+	},
+	{
+		language: "php",
+		markers:  []string{"composer.json"},
+		patterns: []string{"composer.lock"},
+	},
+}
+
+// LanguageIgnorePatterns returns the ignore patterns of the languages used
+// in the tree at root, and those languages. A language is used when the
+// root holds one of its project files, such as go.mod or package.json, or
+// one of its source files. Only the root is read, so this is cheap to call
+// before a scan.
+func LanguageIgnorePatterns(root string) (patterns, languages []string) {
+	dirEntries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, nil
+	}
+	names := make(map[string]bool)
+	extensions := make(map[string]bool)
+	for _, entry := range dirEntries {
+		if entry.IsDir() {
+			continue
+		}
+		names[entry.Name()] = true
+		extensions[strings.ToLower(filepath.Ext(entry.Name()))] = true
+	}
+
+	for _, lang := range languageIgnores {
+		used := slices.ContainsFunc(lang.markers, func(name string) bool { return names[name] }) ||
+			slices.ContainsFunc(lang.extensions, func(ext string) bool { return extensions[ext] })
+		if used {
+			patterns = append(patterns, lang.patterns...)
+			languages = append(languages, lang.language)
+		}
+	}
+	return patterns, languages
+}
@@ -2,8 +2,12 @@ package scanner
 
 import (
 	"fmt"
+	"log/slog"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/lc/pfzf/internal/fs"
 )
 
 // Option represents a scanner configuration option.
@@ -47,6 +51,18 @@ func WithMaxFileSize(size int64) Option {
 	}
 }
 
+// WithMinFileSize sets the minimum file size for scanning. Zero means no
+// minimum.
+func WithMinFileSize(size int64) Option {
+	return func(s *Scanner) error {
+		if size < 0 {
+			return fmt.Errorf("min file size must be non-negative")
+		}
+		s.opts.MinFileSize = size
+		return nil
+	}
+}
+
 // WithMaxFiles sets the maximum number of files to scan.
 func WithMaxFiles(count int) Option {
 	return func(s *Scanner) error {
@@ -88,3 +104,148 @@ func DefaultOptions() []Option {
 		),
 	}
 }
+
+// WithIncludeHidden sets whether dotfiles and dot-directories are scanned.
+func WithIncludeHidden(include bool) Option {
+	return func(s *Scanner) error {
+		s.opts.IncludeHidden = include
+		return nil
+	}
+}
+
+// WithResultBuffer sets how many scanned entries may wait for the consumer,
+// so the scan isn't held up by a consumer that is busy now and then.
+func WithResultBuffer(size int) Option {
+	return func(s *Scanner) error {
+		if size < 0 {
+			return fmt.Errorf("result buffer must be non-negative")
+		}
+		s.opts.ResultBuffer = size
+		return nil
+	}
+}
+
+// WithIncludeGenerated sets whether generated files and Bazel or Buck build
+// files are scanned. They are skipped when false.
+func WithIncludeGenerated(include bool) Option {
+	return func(s *Scanner) error {
+		s.opts.IncludeGenerated = include
+		return nil
+	}
+}
+
+// WithMaxInvalidUTF8 sets how many invalid UTF-8 sequences the start of a
+// file may contain before they count towards classifying it as binary.
+func WithMaxInvalidUTF8(n int) Option {
+	return func(s *Scanner) error {
+		if n < 0 {
+			return fmt.Errorf("max invalid UTF-8 sequences must be non-negative")
+		}
+		s.opts.MaxInvalidUTF8 = n
+		return nil
+	}
+}
+
+// WithBinarySampleSize sets how many bytes of a file's start are judged when
+// classifying it as binary.
+func WithBinarySampleSize(n int) Option {
+	return func(s *Scanner) error {
+		if n <= 0 {
+			return fmt.Errorf("binary sample size must be positive")
+		}
+		s.opts.BinarySampleSize = n
+		return nil
+	}
+}
+
+// WithBinaryThreshold sets the share of non-printable characters, between 0
+// and 1, above which a file is classified as binary.
+func WithBinaryThreshold(t float64) Option {
+	return func(s *Scanner) error {
+		if t <= 0 || t > 1 {
+			return fmt.Errorf("binary threshold must be greater than 0 and at most 1")
+		}
+		s.opts.BinaryThreshold = t
+		return nil
+	}
+}
+
+// WithExcludeContentTypes skips files whose magic bytes identify one of
+// these media types, such as "image/*" or "application/zip", whatever their
+// extension.
+func WithExcludeContentTypes(patterns ...string) Option {
+	return func(s *Scanner) error {
+		for _, pattern := range patterns {
+			if err := fs.ValidateContentType(pattern); err != nil {
+				return fmt.Errorf("invalid content type %q: %w", pattern, err)
+			}
+		}
+		s.opts.ExcludeContentTypes = append(s.opts.ExcludeContentTypes, patterns...)
+		return nil
+	}
+}
+
+// WithCheckpoint records the scan's progress in the checkpoint file at path
+// and, if the file is left from an interrupted scan, resumes it: directories
+// and files delivered before are skipped. The file is removed once a scan
+// completes. Checkpointing hands over each entry directly, ignoring the
+// result buffer.
+func WithCheckpoint(path string) Option {
+	return func(s *Scanner) error {
+		c, err := loadCheckpoint(path)
+		if err != nil {
+			return err
+		}
+		s.checkpoint = c
+		return nil
+	}
+}
+
+// WithLogger sets the logger that receives scan progress, skips and errors.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Scanner) error {
+		if logger == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithTimeout stops scans once they have run for d, keeping the entries
+// found so far. Zero means no limit.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Scanner) error {
+		if d < 0 {
+			return fmt.Errorf("scan timeout must be non-negative")
+		}
+		s.opts.Timeout = d
+		return nil
+	}
+}
+
+// WithFiles scans exactly the files at paths, relative to the working
+// directory, instead of walking the root directory. The walk's rules, such
+// as ignore patterns and size limits, don't apply, though generated files
+// and excluded content types are still skipped. Paths that don't exist are
+// reported as errors. It can't be combined with WithCheckpoint.
+func WithFiles(paths ...string) Option {
+	return func(s *Scanner) error {
+		seen := make(map[string]bool)
+		s.files = []string{}
+		for _, path := range paths {
+			if strings.TrimSpace(path) == "" {
+				continue
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("invalid file path %s: %w", path, err)
+			}
+			if !seen[abs] {
+				seen[abs] = true
+				s.files = append(s.files, abs)
+			}
+		}
+		return nil
+	}
+}
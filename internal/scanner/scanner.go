@@ -2,43 +2,117 @@
 package scanner
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/internal/ignore"
+	"github.com/lc/pfzf/internal/processor"
 	"github.com/lc/pfzf/pkg/types"
 )
 
 const (
-	binaryCheckSize = 512
-	binaryThreshold = 0.3
-	workerCount     = 4
+	// defaultBinarySampleSize is how much of a file's start is judged when
+	// classifying it as binary, and defaultBinaryThreshold the share of
+	// non-printable characters that makes it binary
+	defaultBinarySampleSize = 512
+	defaultBinaryThreshold  = 0.3
+	// headSize is how much of a file is read to look for generated markers,
+	// which may follow a license header
+	headSize    = 4096
+	workerCount = 4
+	// defaultMaxInvalidUTF8 is how many invalid UTF-8 sequences a text file's
+	// start may contain, such as a stray Latin-1 byte in a comment
+	defaultMaxInvalidUTF8 = 8
 )
 
+// binaryExtensions lists extensions that are always binary, so files with
+// them are classified without being opened.
+var binaryExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".bmp": true,
+	".ico": true, ".webp": true, ".tiff": true, ".psd": true,
+	".pdf": true, ".zip": true, ".gz": true, ".tgz": true, ".tar": true,
+	".bz2": true, ".xz": true, ".7z": true, ".rar": true, ".jar": true,
+	".exe": true, ".dll": true, ".so": true, ".dylib": true, ".o": true,
+	".a": true, ".bin": true, ".dat": true, ".class": true, ".pyc": true,
+	".wasm": true, ".woff": true, ".woff2": true, ".ttf": true, ".otf": true,
+	".eot": true, ".mp3": true, ".mp4": true, ".mov": true, ".avi": true,
+	".wav": true, ".flac": true, ".ogg": true, ".db": true, ".sqlite": true,
+}
+
 type Scanner struct {
-	opts    types.ScanOptions
+	opts   types.ScanOptions
+	logger *slog.Logger
+	// ctx ends the scan when it is stopped or times out; stopped is only
+	// done once Stop is called or the context passed to ScanContext ends
 	ctx     context.Context
+	stopped context.Context
 	cancel  context.CancelFunc
 	wg      sync.WaitGroup
 	results chan types.FileEntry
 	errors  chan error
+	// checkpoint records progress for resuming, if enabled
+	checkpoint *checkpoint
+	// scanned is closed once a started scan has finished, checkpoint included
+	scanned chan struct{}
+	// walkHook, if set, is called for each path the walk visits; tests use
+	// it to slow the walk down
+	walkHook func(path string)
+	// ignore matches opts.IgnorePattern; Scan builds it
+	ignore *ignore.Matcher
+	// files, if set, are scanned in place of walking the root
+	files []string
+	// languages detects the language of text files from their names and
+	// the start of their content
+	languages *processor.LanguageDetector
+}
+
+// TimeoutError reports that a scan ran out of time. The entries found
+// before the timeout were delivered.
+type TimeoutError struct {
+	Timeout time.Duration
+	// Files counts the entries delivered
+	Files int64
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("scan timed out after %s with %d files found", e.Timeout, e.Files)
+}
+
+// Unwrap lets errors.Is match context.DeadlineExceeded.
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
 }
 
 func New(opts ...Option) (*Scanner, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Scanner{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
 		ctx:     ctx,
+		stopped: ctx,
 		cancel:  cancel,
 		results: make(chan types.FileEntry),
 		errors:  make(chan error),
 		opts: types.ScanOptions{
-			RootDir:     ".",
-			MaxFileSize: 1 << 20, // 1MB default
+			RootDir:          ".",
+			MaxFileSize:      1 << 20, // 1MB default
+			IncludeHidden:    true,
+			IncludeGenerated: true,
+			MaxInvalidUTF8:   defaultMaxInvalidUTF8,
+			BinarySampleSize: defaultBinarySampleSize,
+			BinaryThreshold:  defaultBinaryThreshold,
 		},
 	}
 
@@ -48,87 +122,273 @@ func New(opts ...Option) (*Scanner, error) {
 			return nil, err
 		}
 	}
+	if s.files != nil && s.checkpoint != nil {
+		return nil, fmt.Errorf("a checkpoint can't be used with a list of files")
+	}
+
+	languages, err := processor.NewLanguageDetector()
+	if err != nil {
+		return nil, fmt.Errorf("creating language detector: %w", err)
+	}
+	s.languages = languages
 
 	return s, nil
 }
 
+// Scan starts scanning with opts, overriding the constructor's options that
+// are set, and returns the channels entries and errors are sent on. Both are
+// closed once the scan is done or stopped. Errors are a *ScanError for each
+// path that couldn't be read, and a *TimeoutError if the scan timed out.
 func (s *Scanner) Scan(opts types.ScanOptions) (<-chan types.FileEntry, <-chan error) {
+	return s.ScanContext(context.Background(), opts)
+}
+
+// ScanContext is like Scan, but cancelling ctx also ends the scan, as Stop
+// does without waiting for it. The entries found until then are delivered
+// and a checkpoint is saved as usual.
+func (s *Scanner) ScanContext(ctx context.Context, opts types.ScanOptions) (<-chan types.FileEntry, <-chan error) {
+	// The scan ends with ctx or on Stop, even if Stop came first
+	stopped, cancel := context.WithCancel(ctx)
+	context.AfterFunc(s.stopped, cancel)
+	s.stopped, s.ctx = stopped, stopped
+
 	if opts.RootDir != "" {
 		s.opts.RootDir = opts.RootDir
 	}
 	if opts.MaxFileSize > 0 {
 		s.opts.MaxFileSize = opts.MaxFileSize
 	}
+	if opts.MinFileSize > 0 {
+		s.opts.MinFileSize = opts.MinFileSize
+	}
 	if len(opts.IgnorePattern) > 0 {
 		s.opts.IgnorePattern = opts.IgnorePattern
 	}
+	if len(opts.ExcludeContentTypes) > 0 {
+		s.opts.ExcludeContentTypes = opts.ExcludeContentTypes
+	}
 	if opts.MaxFiles > 0 {
 		s.opts.MaxFiles = opts.MaxFiles
 	}
+	if opts.MaxInvalidUTF8 > 0 {
+		s.opts.MaxInvalidUTF8 = opts.MaxInvalidUTF8
+	}
+	if opts.BinarySampleSize > 0 {
+		s.opts.BinarySampleSize = opts.BinarySampleSize
+	}
+	if opts.BinaryThreshold > 0 {
+		s.opts.BinaryThreshold = opts.BinaryThreshold
+	}
+	if opts.ResultBuffer > 0 {
+		s.opts.ResultBuffer = opts.ResultBuffer
+	}
+	if opts.Timeout > 0 {
+		s.opts.Timeout = opts.Timeout
+	}
+	// A checkpoint counts files as delivered once sent, so entries must not
+	// wait in a buffer where stopping would lose them
+	if s.opts.ResultBuffer > 0 && s.checkpoint == nil {
+		s.results = make(chan types.FileEntry, s.opts.ResultBuffer)
+	}
+
+	s.ignore = ignore.New(s.opts.IgnorePattern)
 
-	go s.startScan()
+	s.scanned = make(chan struct{})
+	var cancelTimeout context.CancelFunc = func() {}
+	if s.opts.Timeout > 0 {
+		s.ctx, cancelTimeout = context.WithTimeout(s.stopped, s.opts.Timeout)
+	}
+	go func() {
+		defer cancel()
+		defer cancelTimeout()
+		s.startScan()
+	}()
 	return s.results, s.errors
 }
 
+// Stop stops the scan and waits for it to finish, including saving its
+// checkpoint.
 func (s *Scanner) Stop() {
 	s.cancel()
 	s.wg.Wait()
+	if s.scanned != nil {
+		<-s.scanned
+	}
 }
 
 func (s *Scanner) startScan() {
+	defer close(s.scanned)
 	defer close(s.results)
 	defer close(s.errors)
 
 	paths := make(chan string)
+	start := time.Now()
+	var stats scanStats
+	s.logger.Info("scan started", "root", s.opts.RootDir)
 
 	// Start worker pool
 	for i := 0; i < workerCount; i++ {
 		s.wg.Add(1)
-		go s.worker(paths)
+		go s.worker(paths, &stats)
 	}
 
 	// Walk directory tree
+	walked := make(chan struct{})
 	go func() {
+		defer close(walked)
 		defer close(paths)
+
+		if s.files != nil {
+			s.listFiles(paths, &stats)
+			return
+		}
+
+		// open lists the directories being walked, innermost last, so the
+		// checkpoint learns when the walk leaves each of them
+		var open []string
+		leaveUntil := func(rel string) {
+			for len(open) > 0 && !isUnder(rel, open[len(open)-1]) {
+				s.checkpoint.leave(open[len(open)-1])
+				open = open[:len(open)-1]
+			}
+		}
+
 		err := filepath.Walk(s.opts.RootDir, func(path string, info os.FileInfo, err error) error {
+			if s.walkHook != nil {
+				s.walkHook(path)
+			}
+			// Progress made after stopping must not reach the checkpoint
+			if s.ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			rel := s.relSlash(path)
+			if s.checkpoint != nil {
+				leaveUntil(rel)
+			}
+
 			if err != nil {
-				select {
-				case s.errors <- fmt.Errorf("walk error at %s: %w", path, err):
-				case <-s.ctx.Done():
+				// A directory that failed to read is never completed, so a
+				// resumed scan tries it again
+				if s.checkpoint != nil && len(open) > 0 && open[len(open)-1] == rel {
+					open = open[:len(open)-1]
 				}
+				s.reportError(&ScanError{Path: path, Op: OpWalk, Err: err}, &stats)
 				return nil
 			}
 
-			skip, skipDir := s.shouldSkip(path, info)
-			if skip {
+			reason, skipDir := s.shouldSkip(path, info)
+			if reason == "" && s.checkpoint != nil {
+				if info.IsDir() && s.checkpoint.isCompleted(rel) {
+					reason, skipDir = "scanned before resuming", true
+				} else if !info.IsDir() && s.checkpoint.isDelivered(rel) {
+					reason = "scanned before resuming"
+				}
+			}
+			if reason != "" {
+				stats.skipped.Add(1)
+				s.logger.Info("file skipped", "path", path, "reason", reason, "dir", info.IsDir())
 				if info.IsDir() && skipDir {
 					return filepath.SkipDir
 				}
 				return nil
 			}
 
-			if !info.IsDir() {
-				select {
-				case paths <- path:
-				case <-s.ctx.Done():
-					return filepath.SkipDir
+			if info.IsDir() {
+				if s.checkpoint != nil {
+					s.checkpoint.enter(rel)
+					open = append(open, rel)
 				}
+				return nil
 			}
 
+			if s.checkpoint != nil {
+				s.checkpoint.add(rel)
+			}
+			select {
+			case paths <- path:
+			case <-s.ctx.Done():
+				return filepath.SkipAll
+			}
 			return nil
 		})
 		if err != nil {
-			select {
-			case s.errors <- fmt.Errorf("walk error: %w", err):
-			case <-s.ctx.Done():
+			s.reportError(&ScanError{Path: s.opts.RootDir, Op: OpWalk, Err: err}, &stats)
+		}
+		if s.checkpoint != nil && s.ctx.Err() == nil {
+			for i := len(open) - 1; i >= 0; i-- {
+				s.checkpoint.leave(open[i])
 			}
 		}
 	}()
 
 	s.wg.Wait()
+	<-walked
+	if s.checkpoint != nil {
+		if err := s.checkpoint.finish(); err != nil {
+			s.reportError(&ScanError{Path: s.checkpoint.path, Op: OpCheckpoint, Err: err}, &stats)
+		}
+	}
+	if errors.Is(s.ctx.Err(), context.DeadlineExceeded) {
+		err := &TimeoutError{Timeout: s.opts.Timeout, Files: stats.files.Load()}
+		stats.errors.Add(1)
+		s.logger.Error("scan error", "error", err)
+		// The scan's context is done, so only a Stop gives up on sending
+		select {
+		case s.errors <- err:
+		case <-s.stopped.Done():
+		}
+	}
+	s.logger.Info("scan finished",
+		"files", stats.files.Load(),
+		"skipped", stats.skipped.Load(),
+		"errors", stats.errors.Load(),
+		"duration", time.Since(start))
 }
 
-func (s *Scanner) worker(paths <-chan string) {
+// listFiles sends the files given with WithFiles to paths in place of a
+// walk. Listed paths that don't exist or are directories are reported and
+// left out.
+func (s *Scanner) listFiles(paths chan<- string, stats *scanStats) {
+	for _, path := range s.files {
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			err = ErrIsDirectory
+		}
+		if err != nil {
+			if !s.reportError(&ScanError{Path: path, Op: OpList, Err: err}, stats) {
+				return
+			}
+			continue
+		}
+		select {
+		case paths <- path:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// scanStats counts the outcomes of a scan for logging.
+type scanStats struct {
+	files   atomic.Int64
+	skipped atomic.Int64
+	errors  atomic.Int64
+}
+
+// reportError logs err and sends it to the errors channel unless the scan
+// was stopped. It reports whether err was sent.
+func (s *Scanner) reportError(err error, stats *scanStats) bool {
+	stats.errors.Add(1)
+	s.logger.Error("scan error", "error", err)
+	select {
+	case s.errors <- err:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *Scanner) worker(paths <-chan string, stats *scanStats) {
 	defer s.wg.Done()
 
 	for {
@@ -137,15 +397,21 @@ func (s *Scanner) worker(paths <-chan string) {
 			if !ok {
 				return
 			}
-			if entry, err := s.processFile(path); err != nil {
-				select {
-				case s.errors <- fmt.Errorf("processing file %s: %w", path, err):
-				case <-s.ctx.Done():
+			if entry, reason, err := s.processFile(path); err != nil {
+				// Files that failed are left pending in the checkpoint, so a
+				// resumed scan tries them again
+				if !s.reportError(err, stats) {
 					return
 				}
+			} else if reason != "" {
+				stats.skipped.Add(1)
+				s.logger.Info("file skipped", "path", path, "reason", reason, "dir", false)
+				s.checkpointDone(path)
 			} else {
 				select {
 				case s.results <- entry:
+					stats.files.Add(1)
+					s.checkpointDone(path)
 				case <-s.ctx.Done():
 					return
 				}
@@ -156,10 +422,45 @@ func (s *Scanner) worker(paths <-chan string) {
 	}
 }
 
-func (s *Scanner) shouldSkip(path string, info os.FileInfo) (bool, bool) {
+// checkpointDone records in the checkpoint, if any, that path was delivered
+// or skipped, and saves progress now and then.
+func (s *Scanner) checkpointDone(path string) {
+	if s.checkpoint == nil {
+		return
+	}
+	s.checkpoint.done(s.relSlash(path))
+	if err := s.checkpoint.saveIfDue(); err != nil {
+		s.logger.Warn("saving checkpoint failed", "error", err)
+	}
+}
+
+// relSlash returns path relative to the scan root with forward slashes, as
+// the checkpoint records it.
+func (s *Scanner) relSlash(path string) string {
+	rel, err := filepath.Rel(s.opts.RootDir, path)
+	if err != nil {
+		rel = path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// isUnder reports whether the slash-separated relative path is dir or
+// inside it.
+func isUnder(path, dir string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// shouldSkip returns why path should be skipped, or "" to scan it, and
+// whether a skipped directory's contents are skipped too.
+func (s *Scanner) shouldSkip(path string, info os.FileInfo) (string, bool) {
 	// Skip files larger than MaxFileSize
 	if !info.IsDir() && info.Size() > s.opts.MaxFileSize {
-		return true, false
+		return "too large", false
+	}
+
+	// Skip files smaller than MinFileSize
+	if !info.IsDir() && info.Size() < s.opts.MinFileSize {
+		return "too small", false
 	}
 
 	// Get the relative path for pattern matching
@@ -169,75 +470,159 @@ func (s *Scanner) shouldSkip(path string, info os.FileInfo) (bool, bool) {
 		relPath = path
 	}
 
-	// Check patterns against the relative path
-	for _, pattern := range s.opts.IgnorePattern {
-		matched, err := filepath.Match(pattern, relPath)
-		if err == nil && matched {
-			return true, info.IsDir()
-		}
+	if !s.opts.IncludeHidden && fs.IsHidden(relPath) {
+		return "hidden", info.IsDir()
+	}
 
-		// Handle directory wildcard patterns (e.g., "ignored/*")
-		if strings.HasSuffix(pattern, "/*") {
-			dirPattern := strings.TrimSuffix(pattern, "/*")
-			if strings.HasPrefix(relPath, dirPattern+string(filepath.Separator)) {
-				return true, info.IsDir()
-			}
-		}
+	if base := filepath.Base(path); base == CheckpointFile || base == CheckpointFile+".tmp" {
+		return "checkpoint", false
+	}
+
+	if !s.opts.IncludeGenerated && !info.IsDir() && fs.IsBuildFile(path) {
+		return "build file", false
 	}
 
-	return false, false
+	// Directories are skipped whole, so their contents needn't be matched
+	if pattern := s.ignore.Match(relPath); pattern != "" {
+		return "ignored by " + pattern, info.IsDir()
+	}
+
+	return "", false
 }
 
-func (s *Scanner) processFile(path string) (types.FileEntry, error) {
+// processFile builds the entry for path. It returns why the file is skipped
+// instead if its content rules it out, and a *ScanError if it can't be read.
+func (s *Scanner) processFile(path string) (types.FileEntry, string, error) {
 	info, err := os.Stat(path)
 	if err != nil {
-		return types.FileEntry{}, fmt.Errorf("stat error: %w", err)
+		return types.FileEntry{}, "", &ScanError{Path: path, Op: OpStat, Err: err}
 	}
 
-	isBinary, err := s.isBinaryFile(path)
+	sniffed, err := s.sniffFile(path)
 	if err != nil {
-		return types.FileEntry{}, fmt.Errorf("binary check error: %w", err)
+		return types.FileEntry{}, "", &ScanError{Path: path, Op: OpSniff, Err: err}
+	}
+	if sniffed.isGenerated && !s.opts.IncludeGenerated {
+		return types.FileEntry{}, "generated", nil
+	}
+	for _, pattern := range s.opts.ExcludeContentTypes {
+		if sniffed.contentType != "" && fs.MatchContentType(pattern, sniffed.contentType) {
+			return types.FileEntry{}, "content type " + sniffed.contentType, nil
+		}
 	}
 
 	// Get relative path
 	relPath, err := filepath.Rel(s.opts.RootDir, path)
 	if err != nil {
-		return types.FileEntry{}, fmt.Errorf("relative path error: %w", err)
+		return types.FileEntry{}, "", &ScanError{Path: path, Op: OpStat, Err: err}
 	}
 
 	return types.FileEntry{
-		Path:     relPath,
-		Size:     info.Size(),
-		ModTime:  info.ModTime(),
-		IsBinary: isBinary,
-	}, nil
+		Path:        relPath,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		IsBinary:    sniffed.isBinary,
+		IsGenerated: sniffed.isGenerated,
+		IsBuildFile: fs.IsBuildFile(path),
+		Language:    sniffed.language,
+	}, "", nil
+}
+
+// sniff is what the start of a file reveals about it.
+type sniff struct {
+	isBinary bool
+	// isGenerated is only detected in text files
+	isGenerated bool
+	// contentType is the media type detected from the magic bytes. It is
+	// only detected when content types are excluded.
+	contentType string
+	// language is only detected in text files
+	language string
 }
 
-func (s *Scanner) isBinaryFile(path string) (bool, error) {
+// sniffFile reads the start of path to report whether it is binary and, if
+// not, whether it was generated by a tool and its language. The language
+// comes from the name when it can; only files without a known name or
+// extension look for a shebang or modeline in the start already read.
+func (s *Scanner) sniffFile(path string) (sniff, error) {
+	detectType := len(s.opts.ExcludeContentTypes) > 0
+
+	// Known binary extensions skip the open and content sniffing entirely,
+	// unless the content type is needed
+	if binaryExtensions[strings.ToLower(filepath.Ext(path))] && !detectType {
+		return sniff{isBinary: true}, nil
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
-		return false, err
+		return sniff{}, err
 	}
 	defer f.Close()
 
-	buf := make([]byte, binaryCheckSize)
-	n, err := f.Read(buf)
-	if err != nil && err != io.EOF {
-		return false, err
+	head := make([]byte, max(headSize, s.opts.BinarySampleSize))
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return sniff{}, err
+	}
+	head = head[:n]
+
+	var result sniff
+	if detectType {
+		result.contentType = fs.DetectContentType(head)
 	}
-	buf = buf[:n]
+	// UTF-16 text is judged, and its language detected, as UTF-8
+	head, _ = fs.DecodeUTF16(head)
+	if binaryExtensions[strings.ToLower(filepath.Ext(path))] || s.isBinaryHead(head) {
+		result.isBinary = true
+	} else {
+		result.isGenerated = fs.IsGenerated(head)
+		result.language, _ = s.languages.DetectLanguage(path, bytes.NewReader(head))
+	}
+	return result, nil
+}
 
+// isBinaryHead reports whether the first BinarySampleSize bytes of a file
+// look binary, judged by whether the share of non-printable characters
+// exceeds BinaryThreshold. A UTF-8 byte order mark is skipped, and
+// multibyte characters count once like any other. Up to MaxInvalidUTF8
+// invalid UTF-8 sequences are ignored, so text with a few stray bytes stays
+// text; beyond that, each counts as non-printable.
+func (s *Scanner) isBinaryHead(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	buf := head[:min(len(head), s.opts.BinarySampleSize)]
+	// Don't count a character cut off by the end of the check as invalid
+	if len(head) > len(buf) {
+		for i := len(buf) - 1; i >= max(0, len(buf)-utf8.UTFMax+1); i-- {
+			if utf8.RuneStart(buf[i]) {
+				if !utf8.FullRune(buf[i:]) {
+					buf = buf[:i]
+				}
+				break
+			}
+		}
+	}
 	if len(buf) == 0 {
-		return false, nil
+		return false
 	}
 
-	nonPrintable := 0
-	for _, b := range buf {
-		if b == 0 || (!unicode.IsGraphic(rune(b)) && !unicode.IsSpace(rune(b))) {
+	chars, nonPrintable, invalid := 0, 0, 0
+	for len(buf) > 0 {
+		r, size := utf8.DecodeRune(buf)
+		buf = buf[size:]
+		chars++
+		switch {
+		case r == utf8.RuneError && size == 1:
+			invalid++
+		// Format characters, such as the zero-width joiners in emoji
+		// sequences, are text
+		case r == 0 || (!unicode.IsGraphic(r) && !unicode.IsSpace(r) && !unicode.Is(unicode.Cf, r)):
 			nonPrintable++
 		}
 	}
+	if invalid > s.opts.MaxInvalidUTF8 {
+		nonPrintable += invalid
+	}
 
-	ratio := float64(nonPrintable) / float64(len(buf))
-	return ratio > binaryThreshold, nil
+	ratio := float64(nonPrintable) / float64(chars)
+	return ratio > s.opts.BinaryThreshold
 }
@@ -1,11 +1,25 @@
 package scanner
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf16"
 
+	"github.com/lc/pfzf/internal/fs"
 	"github.com/lc/pfzf/pkg/types"
 )
 
@@ -183,3 +197,918 @@ func TestScannerStop(t *testing.T) {
 		t.Fatal("Scanner did not stop in time")
 	}
 }
+
+func TestScanContext(t *testing.T) {
+	dir := t.TempDir()
+	const total = 50
+	for i := 0; i < total; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d.txt", i)), []byte("text"), 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	s, err := New(WithRootDir(dir))
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	// Each path takes 10ms, so the whole walk would take half a second
+	s.walkHook = func(string) { time.Sleep(10 * time.Millisecond) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, errs := s.ScanContext(ctx, types.ScanOptions{})
+	var found int
+	start := time.Now()
+	for results != nil || errs != nil {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			// Cancelling the caller's context ends the scan
+			if found++; found == 1 {
+				cancel()
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			t.Errorf("ScanContext() error = %v", err)
+		}
+	}
+
+	if found == 0 || found >= total {
+		t.Errorf("found %d files, want the scan cut short after the first", found)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("scan took %s after cancelling, want it to end promptly", elapsed)
+	}
+	// Stopping a cancelled scan returns at once
+	s.Stop()
+}
+
+func TestSniffFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	license := strings.Repeat("// Licensed under the Apache License.\n", 60)
+
+	tests := []struct {
+		name          string
+		content       []byte
+		want          bool
+		wantGenerated bool
+	}{
+		// Classified by extension even though the content is text
+		{name: "logo.PNG", content: []byte("not really an image"), want: true},
+		// Unknown extensions fall back to content sniffing
+		{name: "blob.custom", content: []byte{0x00, 0x01, 0x02, 0x03}, want: true},
+		{name: "notes.custom", content: []byte("plain text"), want: false},
+		{name: "main.go", content: []byte("package main\n"), want: false},
+		// Generated markers
+		{name: "api.pb.go", content: []byte("// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage api\n"), wantGenerated: true},
+		{name: "crlf.go", content: []byte("// Code generated by stringer. DO NOT EDIT.\r\npackage kind\r\n"), wantGenerated: true},
+		{name: "schema.ts", content: []byte("/**\n * " + "@" + "generated SignedSource<<abc>>\n */\nexport {}\n"), wantGenerated: true},
+		{name: "after_license.go", content: []byte(license + "// Code generated by mockgen. DO NOT EDIT.\npackage mocks\n"), wantGenerated: true},
+		// Only a whole marker line counts
+		{name: "mention.go", content: []byte("package gen\n\n// Writes \"// Code generated ... DO NOT EDIT.\" lines\n"), wantGenerated: false},
+		{name: "binary.custom", content: append(bytes.Repeat([]byte{0x00, 0x01}, 8), "@"+"generated"...), want: true},
+		// Mostly valid UTF-8 with a couple of stray Latin-1 bytes is text
+		{name: "latin1.c", content: []byte("/* Caf\xe9 r\xe9sum\xe9 */\nint main(void) { return 0; }\n"), want: false},
+		{name: "cjk.txt", content: []byte(strings.Repeat("日本語のテキスト\n", 40)), want: false},
+		// Invalid sequences past the limit count as non-printable
+		{name: "mostly_latin1.custom", content: bytes.Repeat([]byte{'a', 0xe9}, 40), want: true},
+		// Byte order marks and emoji are text
+		{name: "utf16le.txt", content: utf16Text(false, strings.Repeat("Hello, wörld\r\n", 30)), want: false},
+		{name: "utf16be.custom", content: utf16Text(true, strings.Repeat("Hello, wörld\n", 30)), want: false},
+		{name: "bom.custom", content: []byte("\xef\xbb\xbfplain text\n"), want: false},
+		{name: "emoji.md", content: []byte(strings.Repeat("👩‍💻 ships 🚀✨ 👍🏽\n", 30)), want: false},
+	}
+
+	s, err := New()
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, tt.name)
+			if err := os.WriteFile(path, tt.content, 0o644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			got, err := s.sniffFile(path)
+			if err != nil {
+				t.Fatalf("sniffFile() error = %v", err)
+			}
+			if got.isBinary != tt.want {
+				t.Errorf("sniffFile() binary = %v, want %v", got.isBinary, tt.want)
+			}
+			if got.isGenerated != tt.wantGenerated {
+				t.Errorf("sniffFile() generated = %v, want %v", got.isGenerated, tt.wantGenerated)
+			}
+		})
+	}
+
+	// Files with a binary extension are never opened
+	got, err := s.sniffFile(filepath.Join(tmpDir, "missing.jpg"))
+	if err != nil || !got.isBinary {
+		t.Errorf("sniffFile() on missing .jpg = %+v, %v; want binary, nil", got, err)
+	}
+}
+
+// utf16Text encodes s as UTF-16 with a byte order mark.
+func utf16Text(bigEndian bool, s string) []byte {
+	var order binary.AppendByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	out := order.AppendUint16(nil, 0xfeff)
+	for _, unit := range utf16.Encode([]rune(s)) {
+		out = order.AppendUint16(out, unit)
+	}
+	return out
+}
+
+func TestBinaryThreshold(t *testing.T) {
+	// A quarter of the characters are control characters
+	path := filepath.Join(t.TempDir(), "data.custom")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("abc\x01"), 200), 0o644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	for _, tt := range []struct {
+		threshold float64
+		want      bool
+	}{
+		{threshold: 0.3, want: false},
+		{threshold: 0.2, want: true},
+	} {
+		s, err := New(WithBinaryThreshold(tt.threshold), WithBinarySampleSize(64))
+		if err != nil {
+			t.Fatalf("Failed to create scanner: %v", err)
+		}
+		got, err := s.sniffFile(path)
+		if err != nil {
+			t.Fatalf("sniffFile() error = %v", err)
+		}
+		if got.isBinary != tt.want {
+			t.Errorf("sniffFile() with threshold %v binary = %v, want %v", tt.threshold, got.isBinary, tt.want)
+		}
+	}
+
+	if _, err := New(WithBinaryThreshold(1.5)); err == nil {
+		t.Error("New() should reject a threshold above 1")
+	}
+}
+
+func TestLanguageIgnorePatterns(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"go.mod", "tool.py", "README.md"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	// Project files are only looked for at the root
+	if err := os.MkdirAll(filepath.Join(root, "web"), 0o755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "web", "package.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	patterns, languages := LanguageIgnorePatterns(root)
+	if fmt.Sprint(languages) != "[go python]" {
+		t.Errorf("languages = %v, want [go python]", languages)
+	}
+	for _, want := range []string{"go.sum", "__pycache__", "*.pyc"} {
+		if !slices.Contains(patterns, want) {
+			t.Errorf("patterns = %v, want %s among them", patterns, want)
+		}
+	}
+	if slices.Contains(patterns, "*.min.js") {
+		t.Errorf("patterns = %v, want no JavaScript patterns", patterns)
+	}
+
+	if patterns, _ := LanguageIgnorePatterns(filepath.Join(root, "web")); !slices.Contains(patterns, "*.min.js") {
+		t.Errorf("patterns under web = %v, want the JavaScript patterns", patterns)
+	}
+}
+
+func BenchmarkScanAssetTree(b *testing.B) {
+	tmpDir := b.TempDir()
+	for i := 0; i < 200; i++ {
+		ext := ".png"
+		if i%4 == 0 {
+			ext = ".go"
+		}
+		path := filepath.Join(tmpDir, fmt.Sprintf("file%03d%s", i, ext))
+		if err := os.WriteFile(path, []byte("package main\n"), 0o644); err != nil {
+			b.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := New()
+		if err != nil {
+			b.Fatalf("Failed to create scanner: %v", err)
+		}
+
+		results, errs := s.Scan(types.ScanOptions{RootDir: tmpDir})
+		go func() {
+			for range errs {
+			}
+		}()
+		for range results {
+		}
+	}
+}
+
+func TestScanAndTreeAgreeOnHiddenFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, path := range []string{"main.go", ".env", ".config/settings.json", "src/.hidden", "src/lib.go"} {
+		fullPath := filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte("x"), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	for _, includeHidden := range []bool{true, false} {
+		t.Run(fmt.Sprintf("includeHidden=%v", includeHidden), func(t *testing.T) {
+			s, err := New(WithRootDir(tmpDir), WithIncludeHidden(includeHidden))
+			if err != nil {
+				t.Fatalf("Failed to create scanner: %v", err)
+			}
+
+			scanned := make(map[string]bool)
+			files, errs := s.Scan(types.ScanOptions{})
+			for files != nil || errs != nil {
+				select {
+				case entry, ok := <-files:
+					if !ok {
+						files = nil
+						continue
+					}
+					scanned[filepath.Base(entry.Path)] = true
+				case err, ok := <-errs:
+					if !ok {
+						errs = nil
+						continue
+					}
+					t.Errorf("Scan() error = %v", err)
+				}
+			}
+
+			tree, err := fs.GetDirectoryTree(tmpDir, fs.TreeOptions{IncludeHidden: includeHidden})
+			if err != nil {
+				t.Fatalf("GetDirectoryTree() error = %v", err)
+			}
+
+			for _, name := range []string{"main.go", ".env", "settings.json", ".hidden", "lib.go"} {
+				inTree := strings.Contains(tree, "── "+name+"\n")
+				if scanned[name] != inTree {
+					t.Errorf("%s: scanned = %v, in tree = %v\n%s", name, scanned[name], inTree, tree)
+				}
+			}
+			if scanned[".env"] != includeHidden {
+				t.Errorf(".env scanned = %v, want %v", scanned[".env"], includeHidden)
+			}
+		})
+	}
+}
+
+func TestScanAndTreeAgreeOnIgnorePatterns(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := []string{
+		"main.go",
+		"git-helper.go",
+		"bin/tool.exe",
+		"node_modules/pkg/index.js",
+		"web/node_modules/lib.js",
+		"web/app.js",
+		"docs/guide.md",
+		"docs/api/index.md",
+		"src/docs/notes.md",
+		"src/gen/a/b.pb.go",
+		"src/gen/c.go",
+	}
+	for _, path := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte("x"), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	patterns := []string{".git", "*.exe", "node_modules", "docs/*", "src/**/*.pb.go"}
+
+	s, err := New(WithRootDir(tmpDir), WithIgnorePattern(patterns...))
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	var scanned []string
+	results, errs := s.Scan(types.ScanOptions{})
+	for results != nil || errs != nil {
+		select {
+		case entry, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			scanned = append(scanned, filepath.ToSlash(entry.Path))
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			t.Errorf("Scan() error = %v", err)
+		}
+	}
+	sort.Strings(scanned)
+
+	tree, err := fs.GetDirectoryTree(tmpDir, fs.TreeOptions{IgnorePatterns: patterns})
+	if err != nil {
+		t.Fatalf("GetDirectoryTree() error = %v", err)
+	}
+	// Rebuild the file paths from the tree's indentation
+	var inTree, dirs []string
+	for _, line := range strings.Split(strings.TrimSuffix(tree, "\n"), "\n")[1:] {
+		i := strings.Index(line, "── ")
+		depth := len([]rune(line[:i]))/4 + 1
+		name := line[i+len("── "):]
+		dirs = append(dirs[:depth-1], name)
+		if strings.Contains(name, ".") {
+			inTree = append(inTree, strings.Join(dirs, "/"))
+		}
+	}
+	sort.Strings(inTree)
+
+	want := []string{"git-helper.go", "main.go", "src/docs/notes.md", "src/gen/c.go", "web/app.js"}
+	if !reflect.DeepEqual(scanned, want) {
+		t.Errorf("scanned = %v, want %v", scanned, want)
+	}
+	if !reflect.DeepEqual(inTree, scanned) {
+		t.Errorf("tree files = %v, scanned = %v\n%s", inTree, scanned, tree)
+	}
+}
+
+func TestScanLogsJSON(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, path := range []string{"main.go", "lib.go", "build.log"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, path), []byte("x"), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	var logs bytes.Buffer
+	s, err := New(
+		WithRootDir(tmpDir),
+		WithIgnorePattern("*.log"),
+		WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+
+	files, errs := s.Scan(types.ScanOptions{})
+	for files != nil || errs != nil {
+		select {
+		case _, ok := <-files:
+			if !ok {
+				files = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		for _, key := range []string{"time", "level", "msg"} {
+			if _, ok := record[key]; !ok {
+				t.Errorf("log line %q has no %s", line, key)
+			}
+		}
+		records = append(records, record)
+	}
+
+	if len(records) < 3 {
+		t.Fatalf("got %d log records, want at least 3:\n%s", len(records), logs.String())
+	}
+	if msg := records[0]["msg"]; msg != "scan started" {
+		t.Errorf("first record msg = %v, want scan started", msg)
+	}
+
+	last := records[len(records)-1]
+	if last["msg"] != "scan finished" {
+		t.Fatalf("last record msg = %v, want scan finished", last["msg"])
+	}
+	if last["files"] != 2.0 || last["skipped"] != 1.0 || last["errors"] != 0.0 {
+		t.Errorf("scan finished = %v, want 2 files, 1 skipped, 0 errors", last)
+	}
+
+	skipped := false
+	for _, record := range records {
+		if record["msg"] == "file skipped" && record["path"] == filepath.Join(tmpDir, "build.log") {
+			skipped = true
+		}
+	}
+	if !skipped {
+		t.Errorf("no file skipped record for build.log:\n%s", logs.String())
+	}
+}
+
+func TestScanSkipsFilesBelowMinSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]int{"empty.json": 0, "stub.go": 9, "exact.go": 10, "main.go": 200}
+	for name, size := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), bytes.Repeat([]byte("x"), size), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	s, err := New(WithRootDir(tmpDir), WithMinFileSize(10))
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+
+	var scanned []string
+	entries, errs := s.Scan(types.ScanOptions{})
+	for entries != nil || errs != nil {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				entries = nil
+				continue
+			}
+			scanned = append(scanned, entry.Path)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			t.Errorf("Scan() error = %v", err)
+		}
+	}
+
+	sort.Strings(scanned)
+	if want := []string{"exact.go", "main.go"}; !reflect.DeepEqual(scanned, want) {
+		t.Errorf("scanned = %v, want %v", scanned, want)
+	}
+
+	if _, err := New(WithMinFileSize(-1)); err == nil {
+		t.Error("New() with a negative min file size should fail")
+	}
+}
+
+func TestScanGeneratedAndBuildFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.go":           "package main\n",
+		"api/api.pb.go":     "// Code generated by protoc-gen-go. DO NOT EDIT.\npackage api\n",
+		"web/schema.ts":     "// " + "@" + "generated\nexport {}\n",
+		"api/BUILD.bazel":   "go_library(name = \"api\")\n",
+		"web/BUCK":          "js_library(name = \"web\")\n",
+		"docs/BUILD.md":     "# Building\n",
+		"BUILD/notes.txt":   "a directory named BUILD is not a build file\n",
+		"tools/generate.go": "package tools\n\n// Run writes files marked as generated.\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	scan := func(t *testing.T, include bool) map[string]types.FileEntry {
+		t.Helper()
+		s, err := New(WithRootDir(tmpDir), WithIncludeGenerated(include))
+		if err != nil {
+			t.Fatalf("Failed to create scanner: %v", err)
+		}
+		scanned := make(map[string]types.FileEntry)
+		entries, errs := s.Scan(types.ScanOptions{})
+		for entries != nil || errs != nil {
+			select {
+			case entry, ok := <-entries:
+				if !ok {
+					entries = nil
+					continue
+				}
+				scanned[filepath.ToSlash(entry.Path)] = entry
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				t.Errorf("Scan() error = %v", err)
+			}
+		}
+		return scanned
+	}
+
+	t.Run("excluded", func(t *testing.T) {
+		var got []string
+		for path := range scan(t, false) {
+			got = append(got, path)
+		}
+		sort.Strings(got)
+		want := []string{"BUILD/notes.txt", "docs/BUILD.md", "main.go", "tools/generate.go"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("scanned = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("labeled", func(t *testing.T) {
+		scanned := scan(t, true)
+		if len(scanned) != len(files) {
+			t.Errorf("scanned %d files, want %d", len(scanned), len(files))
+		}
+		for path, entry := range scanned {
+			wantGenerated := path == "api/api.pb.go" || path == "web/schema.ts"
+			wantBuild := path == "api/BUILD.bazel" || path == "web/BUCK"
+			if entry.IsGenerated != wantGenerated || entry.IsBuildFile != wantBuild {
+				t.Errorf("%s: IsGenerated = %v, IsBuildFile = %v; want %v, %v",
+					path, entry.IsGenerated, entry.IsBuildFile, wantGenerated, wantBuild)
+			}
+		}
+	})
+}
+
+// BenchmarkScanSlowConsumer scans for a consumer that stalls now and then, like
+// a UI redrawing, with and without a result buffer.
+func BenchmarkScanSlowConsumer(b *testing.B) {
+	tmpDir := b.TempDir()
+	for i := 0; i < 400; i++ {
+		path := filepath.Join(tmpDir, fmt.Sprintf("dir%d", i%8), fmt.Sprintf("file%03d.go", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			b.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("package main\n"), 0o644); err != nil {
+			b.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	for _, buffer := range []int{0, 256} {
+		b.Run(fmt.Sprintf("buffer=%d", buffer), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s, err := New()
+				if err != nil {
+					b.Fatalf("Failed to create scanner: %v", err)
+				}
+
+				results, errs := s.Scan(types.ScanOptions{RootDir: tmpDir, ResultBuffer: buffer})
+				go func() {
+					for range errs {
+					}
+				}()
+				n := 0
+				for range results {
+					// A redraw every 100 entries takes about as long as the
+					// filesystem needs to produce them
+					if n++; n%100 == 0 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScanExcludesContentTypes(t *testing.T) {
+	tmpDir := t.TempDir()
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+	files := map[string][]byte{
+		"main.go":          []byte("package main\n"),
+		"notes.txt":        []byte("plain notes\n"),
+		"photo.txt":        png,
+		"assets/logo.png":  png,
+		"backup/site.data": append([]byte("PK\x03\x04"), bytes.Repeat([]byte{1}, 64)...),
+	}
+	for name, data := range files {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	scan := func(t *testing.T, opts ...Option) []string {
+		t.Helper()
+		s, err := New(append([]Option{WithRootDir(tmpDir)}, opts...)...)
+		if err != nil {
+			t.Fatalf("Failed to create scanner: %v", err)
+		}
+		var got []string
+		entries, errs := s.Scan(types.ScanOptions{})
+		for entries != nil || errs != nil {
+			select {
+			case entry, ok := <-entries:
+				if !ok {
+					entries = nil
+					continue
+				}
+				got = append(got, filepath.ToSlash(entry.Path))
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				t.Errorf("Scan() error = %v", err)
+			}
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	if got := scan(t); len(got) != len(files) {
+		t.Errorf("scanned %v, want every file without exclusions", got)
+	}
+
+	// The image is excluded by its content even with a .txt extension
+	got := scan(t, WithExcludeContentTypes("image/*", "Application/Zip"))
+	want := []string{"main.go", "notes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned = %v, want %v", got, want)
+	}
+
+	if _, err := New(WithExcludeContentTypes("image")); err == nil {
+		t.Error("New() with a content type missing its subtype should fail")
+	}
+}
+
+func TestScanResumesFromCheckpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	want := make(map[string]bool)
+	for d := 0; d < 8; d++ {
+		for f := 0; f < 12; f++ {
+			name := fmt.Sprintf("dir%d/sub%d/file%02d.txt", d, f%3, f)
+			if f%4 == 0 {
+				name = fmt.Sprintf("dir%d/file%02d.txt", d, f)
+			}
+			path := filepath.Join(tmpDir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+			want[name] = true
+		}
+	}
+	checkpointPath := filepath.Join(tmpDir, CheckpointFile)
+
+	// scan delivers up to limit entries, or all with a negative limit, then
+	// stops the scanner and waits for it to finish
+	seen := make(map[string]int)
+	scan := func(limit int) int {
+		s, err := New(WithRootDir(tmpDir), WithCheckpoint(checkpointPath))
+		if err != nil {
+			t.Fatalf("Failed to create scanner: %v", err)
+		}
+		entries, errs := s.Scan(types.ScanOptions{ResultBuffer: 64})
+		n := 0
+		for entry := range entries {
+			seen[filepath.ToSlash(entry.Path)]++
+			n++
+			if n == limit {
+				s.Stop()
+				break
+			}
+		}
+		for range entries {
+			t.Error("entry delivered after Stop()")
+		}
+		for err := range errs {
+			t.Errorf("Scan() error = %v", err)
+		}
+		return n
+	}
+
+	scan(37)
+	if _, err := os.Stat(checkpointPath); err != nil {
+		t.Fatalf("no checkpoint after an interrupted scan: %v", err)
+	}
+
+	if n := scan(-1); n != len(want)-37 {
+		t.Errorf("resumed scan delivered %d files, want the remaining %d", n, len(want)-37)
+	}
+	for name := range want {
+		if seen[name] != 1 {
+			t.Errorf("%s delivered %d times, want once", name, seen[name])
+		}
+	}
+	if len(seen) != len(want) {
+		t.Errorf("delivered %d distinct files, want %d", len(seen), len(want))
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after a completed scan: %v", err)
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	dir := t.TempDir()
+	const total = 50
+	for i := 0; i < total; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d.txt", i)), []byte("text"), 0o644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	s, err := New(WithRootDir(dir), WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	// Each path takes 10ms, so the whole walk would take half a second
+	s.walkHook = func(string) { time.Sleep(10 * time.Millisecond) }
+
+	start := time.Now()
+	results, errs := s.Scan(types.ScanOptions{})
+	var found int
+	var timeoutErr *TimeoutError
+	for results != nil || errs != nil {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			found++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			if !errors.As(err, &timeoutErr) {
+				t.Errorf("scan error = %v, want a *TimeoutError", err)
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	if timeoutErr == nil {
+		t.Fatal("scan finished without a timeout error")
+	}
+	if !errors.Is(timeoutErr, context.DeadlineExceeded) {
+		t.Errorf("errors.Is(%v, context.DeadlineExceeded) = false", timeoutErr)
+	}
+	if found == 0 || found >= total {
+		t.Errorf("found %d files, want some but not all of %d", found, total)
+	}
+	if timeoutErr.Files != int64(found) {
+		t.Errorf("TimeoutError.Files = %d, want %d", timeoutErr.Files, found)
+	}
+	if elapsed > 300*time.Millisecond {
+		t.Errorf("scan took %v, want it to stop at the 100ms timeout", elapsed)
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, path := range []string{"a.go", "b.go", "ignored/c.go", "dir/d.go"} {
+		fullPath := filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte("package x\n"), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	// Listed paths are relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	s, err := New(
+		WithRootDir(tmpDir),
+		WithIgnorePattern("ignored"),
+		WithFiles("a.go", "ignored/c.go", "missing.go", "dir", "a.go", ""),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+
+	var got []string
+	var errs []*ScanError
+	files, scanErrs := s.Scan(types.ScanOptions{})
+	for files != nil || scanErrs != nil {
+		select {
+		case entry, ok := <-files:
+			if !ok {
+				files = nil
+				continue
+			}
+			got = append(got, filepath.ToSlash(entry.Path))
+		case err, ok := <-scanErrs:
+			if !ok {
+				scanErrs = nil
+				continue
+			}
+			var scanErr *ScanError
+			if !errors.As(err, &scanErr) {
+				t.Fatalf("Scan() error = %v, want a *ScanError", err)
+			}
+			errs = append(errs, scanErr)
+		}
+	}
+	sort.Strings(got)
+
+	// Ignore patterns don't apply to listed files, and duplicates are
+	// scanned once
+	if want := []string{"a.go", "ignored/c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() files = %v, want %v", got, want)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Scan() errors = %v, want one for missing.go and one for dir", errs)
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+	if errs[0].Op != OpList || filepath.Base(errs[0].Path) != "dir" || !errors.Is(errs[0], ErrIsDirectory) {
+		t.Errorf("Scan() error = %#v, want dir listed as a directory", errs[0])
+	}
+	if errs[1].Op != OpList || filepath.Base(errs[1].Path) != "missing.go" || !errors.Is(errs[1], iofs.ErrNotExist) {
+		t.Errorf("Scan() error = %#v, want missing.go listed as not existing", errs[1])
+	}
+	// The path isn't repeated for errors from the os package
+	if msg := errs[1].Error(); !strings.HasPrefix(msg, "list "+errs[1].Path+": ") || strings.Count(msg, errs[1].Path) != 1 {
+		t.Errorf("Error() = %q, want the operation and path once", msg)
+	}
+
+	if _, err := New(WithFiles("a.go"), WithCheckpoint(filepath.Join(tmpDir, CheckpointFile))); err == nil {
+		t.Error("New() with files and a checkpoint should fail")
+	}
+}
+
+func TestScanDetectsLanguage(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"main.go":      "package main\n",
+		"Makefile":     "all:\n",
+		"bin/deploy":   "#!/usr/bin/env python3\nprint('hi')\n",
+		"notes":        "just some notes\n",
+		"logo.png":     "\x89PNG\r\n\x1a\n",
+		"data/blob":    "\x00\x01\x02\x03",
+		"lib/app.rb":   "puts 1\n",
+		"conf/app.cfg": "# -*- mode: yaml -*-\nkey: value\n",
+	}
+	for path, content := range files {
+		fullPath := filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	s, err := New(WithRootDir(tmpDir))
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+
+	got := make(map[string]string)
+	entries, errs := s.Scan(types.ScanOptions{})
+	go func() {
+		for range errs {
+		}
+	}()
+	for entry := range entries {
+		got[filepath.ToSlash(entry.Path)] = entry.Language
+	}
+
+	// Binary files are left without a language
+	want := map[string]string{
+		"main.go":      "go",
+		"Makefile":     "make",
+		"bin/deploy":   "python",
+		"notes":        "unknown",
+		"logo.png":     "",
+		"data/blob":    "",
+		"lib/app.rb":   "ruby",
+		"conf/app.cfg": "yaml",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("languages = %v, want %v", got, want)
+	}
+}
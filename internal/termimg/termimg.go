@@ -0,0 +1,237 @@
+// Package termimg encodes images for terminals that display graphics
+// inline, using the kitty graphics protocol or sixel.
+package termimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	_ "image/gif"  // register GIF decoding
+	_ "image/jpeg" // register JPEG decoding
+	"image/png"
+	"path/filepath"
+	"strings"
+)
+
+// Protocol is a terminal graphics protocol.
+type Protocol string
+
+const (
+	// ProtocolNone means the terminal can't display images.
+	ProtocolNone Protocol = "none"
+	// ProtocolKitty is the kitty graphics protocol, also spoken by WezTerm
+	// and Ghostty.
+	ProtocolKitty Protocol = "kitty"
+	// ProtocolSixel is DEC sixel graphics.
+	ProtocolSixel Protocol = "sixel"
+)
+
+const (
+	// cellWidth and cellHeight approximate a terminal cell in pixels, to
+	// size thumbnails for an area of cells
+	cellWidth  = 10
+	cellHeight = 20
+
+	// kittyChunkSize is the most base64 data the kitty protocol accepts
+	// in one escape sequence
+	kittyChunkSize = 4096
+)
+
+// KittyDelete removes every image placed with the kitty protocol.
+const KittyDelete = "\x1b_Ga=d,q=2\x1b\\"
+
+// Detect guesses the graphics protocol of the terminal from its environment,
+// read with getenv. Inside tmux or screen, which don't pass graphics through,
+// it returns ProtocolNone.
+func Detect(getenv func(string) string) Protocol {
+	term := getenv("TERM")
+	if getenv("TMUX") != "" || strings.HasPrefix(term, "screen") || strings.HasPrefix(term, "tmux") {
+		return ProtocolNone
+	}
+
+	switch {
+	case term == "xterm-kitty" || getenv("KITTY_WINDOW_ID") != "":
+		return ProtocolKitty
+	case getenv("TERM_PROGRAM") == "WezTerm" || getenv("TERM_PROGRAM") == "ghostty":
+		return ProtocolKitty
+	case strings.Contains(term, "sixel") || term == "foot" || term == "foot-extra" || term == "mlterm":
+		return ProtocolSixel
+	}
+	return ProtocolNone
+}
+
+// Resolve returns the protocol for the imagePreview setting: "auto" or ""
+// detects it, "kitty" and "sixel" force one, and "off" disables images.
+func Resolve(setting string, getenv func(string) string) Protocol {
+	switch strings.ToLower(setting) {
+	case "", "auto":
+		return Detect(getenv)
+	case string(ProtocolKitty):
+		return ProtocolKitty
+	case string(ProtocolSixel):
+		return ProtocolSixel
+	}
+	return ProtocolNone
+}
+
+// IsImage reports whether path has the extension of a format termimg can
+// decode.
+func IsImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// Encode scales img down to fit an area of cols by rows cells and encodes
+// it with protocol p.
+func Encode(p Protocol, img image.Image, cols, rows int) ([]byte, error) {
+	thumb := Thumbnail(img, cols*cellWidth, rows*cellHeight)
+	switch p {
+	case ProtocolKitty:
+		size := thumb.Bounds().Size()
+		return Kitty(thumb, ceilDiv(size.X, cellWidth), ceilDiv(size.Y, cellHeight))
+	case ProtocolSixel:
+		return Sixel(thumb), nil
+	}
+	return nil, fmt.Errorf("terminal graphics protocol %q can't display images", p)
+}
+
+// Thumbnail scales img down, keeping its aspect ratio, to fit in maxWidth
+// by maxHeight pixels. Images that already fit are returned as they are.
+func Thumbnail(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxWidth && h <= maxHeight || w == 0 || h == 0 {
+		return img
+	}
+
+	scale := min(float64(maxWidth)/float64(w), float64(maxHeight)/float64(h))
+	tw, th := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			thumb.Set(x, y, img.At(bounds.Min.X+x*w/tw, bounds.Min.Y+y*h/th))
+		}
+	}
+	return thumb
+}
+
+// Kitty encodes img with the kitty graphics protocol, displayed over cols
+// by rows cells at the cursor. The image is sent as PNG in chunks, and the
+// terminal is asked not to reply.
+func Kitty(img image.Image, cols, rows int) ([]byte, error) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return nil, fmt.Errorf("encoding PNG: %w", err)
+	}
+	payload := base64.StdEncoding.EncodeToString(encoded.Bytes())
+
+	var out bytes.Buffer
+	for first := true; first || payload != ""; first = false {
+		chunk := payload[:min(len(payload), kittyChunkSize)]
+		payload = payload[len(chunk):]
+		more := 0
+		if payload != "" {
+			more = 1
+		}
+		if first {
+			fmt.Fprintf(&out, "\x1b_Ga=T,f=100,q=2,c=%d,r=%d,m=%d;%s\x1b\\", cols, rows, more, chunk)
+		} else {
+			fmt.Fprintf(&out, "\x1b_Gm=%d;%s\x1b\\", more, chunk)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// Sixel encodes img as sixel graphics, displayed at the cursor. Colors are
+// reduced to the 216 web-safe colors with dithering.
+func Sixel(img image.Image) []byte {
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette.WebSafe)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, bounds.Min)
+	w, h := paletted.Rect.Dx(), paletted.Rect.Dy()
+
+	var out bytes.Buffer
+	// Pixels left unset keep the background, and the raster attributes give
+	// a 1:1 aspect ratio and the image size
+	fmt.Fprintf(&out, "\x1bP0;1;0q\"1;1;%d;%d", w, h)
+
+	used := make([]bool, len(palette.WebSafe))
+	for _, i := range paletted.Pix {
+		used[i] = true
+	}
+	for i, c := range palette.WebSafe {
+		if used[i] {
+			r, g, b := percent(c)
+			fmt.Fprintf(&out, "#%d;2;%d;%d;%d", i, r, g, b)
+		}
+	}
+
+	// Each band is six pixel rows; every color in it is drawn in turn,
+	// returning to the band's start with "$"
+	row := make([]byte, w)
+	for y0 := 0; y0 < h; y0 += 6 {
+		for i := range palette.WebSafe {
+			if !used[i] {
+				continue
+			}
+			end := 0
+			for x := 0; x < w; x++ {
+				var bits byte
+				for dy := 0; dy < 6 && y0+dy < h; dy++ {
+					if paletted.ColorIndexAt(x, y0+dy) == uint8(i) {
+						bits |= 1 << dy
+					}
+				}
+				row[x] = '?' + bits
+				if bits != 0 {
+					end = x + 1
+				}
+			}
+			if end == 0 {
+				continue
+			}
+			// Trailing empty sixels need not be sent
+			fmt.Fprintf(&out, "#%d", i)
+			writeSixelRun(&out, row[:end])
+			out.WriteByte('$')
+		}
+		out.WriteByte('-')
+	}
+	out.WriteString("\x1b\\")
+	return out.Bytes()
+}
+
+// writeSixelRun writes a row of sixel characters, compressing repeats with
+// sixel's "!count" run length encoding.
+func writeSixelRun(out *bytes.Buffer, row []byte) {
+	for i := 0; i < len(row); {
+		j := i
+		for j < len(row) && row[j] == row[i] {
+			j++
+		}
+		if n := j - i; n > 3 {
+			fmt.Fprintf(out, "!%d%c", n, row[i])
+		} else {
+			out.Write(row[i:j])
+		}
+		i = j
+	}
+}
+
+// percent returns c's red, green and blue as percentages, as sixel color
+// definitions expect.
+func percent(c color.Color) (r, g, b int) {
+	r32, g32, b32, _ := c.RGBA()
+	return int(r32 * 100 / 0xffff), int(g32 * 100 / 0xffff), int(b32 * 100 / 0xffff)
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
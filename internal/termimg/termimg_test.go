@@ -0,0 +1,148 @@
+package termimg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testPNG decodes a PNG with a red left half and a blue right half, as a
+// previewed file would be. With noise, every pixel gets a pseudo-random
+// color instead, so the image doesn't compress.
+func testPNG(t *testing.T, w, h int, noise bool) image.Image {
+	t.Helper()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	seed := uint32(1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 0xff, A: 0xff}
+			if x >= w/2 {
+				c = color.RGBA{B: 0xff, A: 0xff}
+			}
+			if noise {
+				seed = seed*1664525 + 1013904223
+				c = color.RGBA{R: uint8(seed >> 24), G: uint8(seed >> 16), B: uint8(seed >> 8), A: 0xff}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Failed to decode PNG: %v", err)
+	}
+	return img
+}
+
+func TestKitty(t *testing.T) {
+	img := testPNG(t, 8, 4, false)
+	out, err := Encode(ProtocolKitty, img, 40, 10)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	// An 8x4 image fits in a single cell
+	want := "\x1b_Ga=T,f=100,q=2,c=1,r=1,m=0;"
+	if !bytes.HasPrefix(out, []byte(want)) || !bytes.HasSuffix(out, []byte("\x1b\\")) {
+		t.Fatalf("Encode() = %q, want a single %q sequence", out, want)
+	}
+	payload := strings.TrimSuffix(strings.TrimPrefix(string(out), want), "\x1b\\")
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("payload is not base64: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("payload is not a PNG: %v", err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Errorf("payload bounds = %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+
+	// Large images are scaled down and sent in chunks
+	out, err = Encode(ProtocolKitty, testPNG(t, 900, 600, true), 30, 10)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	sequences := regexp.MustCompile(`\x1b_G([^;]*);([^\x1b]*)\x1b\\`).FindAllStringSubmatch(string(out), -1)
+	if len(sequences) < 2 {
+		t.Fatalf("got %d sequences, want the image in chunks", len(sequences))
+	}
+	// 900x600 scaled into 300x200 pixels spans 30x10 cells
+	if !strings.Contains(sequences[0][1], "c=30,r=10,m=1") || sequences[len(sequences)-1][1] != "m=0" {
+		t.Errorf("sequences = %q ... %q, want c=30,r=10 continued until m=0", sequences[0][1], sequences[len(sequences)-1][1])
+	}
+	var payloads strings.Builder
+	for _, seq := range sequences {
+		if len(seq[2]) > kittyChunkSize {
+			t.Errorf("chunk of %d bytes, want at most %d", len(seq[2]), kittyChunkSize)
+		}
+		payloads.WriteString(seq[2])
+	}
+	data, err = base64.StdEncoding.DecodeString(payloads.String())
+	if err != nil {
+		t.Fatalf("payload is not base64: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width != 300 || cfg.Height != 200 {
+		t.Errorf("thumbnail = %dx%d, %v; want 300x200", cfg.Width, cfg.Height, err)
+	}
+}
+
+func TestSixel(t *testing.T) {
+	out, err := Encode(ProtocolSixel, testPNG(t, 8, 7, false), 40, 10)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	s := string(out)
+
+	if !strings.HasPrefix(s, "\x1bP0;1;0q\"1;1;8;7") || !strings.HasSuffix(s, "\x1b\\") {
+		t.Fatalf("Encode() = %q, want a sixel sequence with an 8x7 raster", s)
+	}
+	// Web-safe red is 180 and blue 5; both are defined and drawn
+	for _, want := range []string{"#180;2;100;0;0", "#5;2;0;0;100"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Encode() = %q, want color %s", s, want)
+		}
+	}
+	// The first band covers rows 0-5 (all bits, '~'), the second row 6
+	// ('@'), four pixels each
+	for _, want := range []string{"#180!4~$", "#5!4?!4~$", "#180!4@$", "#5!4?!4@$"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Encode() = %q, want %q", s, want)
+		}
+	}
+	if n := strings.Count(s, "-"); n != 2 {
+		t.Errorf("got %d bands, want 2", n)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		setting string
+		env     map[string]string
+		want    Protocol
+	}{
+		{"auto", map[string]string{"TERM": "xterm-kitty"}, ProtocolKitty},
+		{"", map[string]string{"TERM_PROGRAM": "WezTerm", "TERM": "xterm-256color"}, ProtocolKitty},
+		{"auto", map[string]string{"TERM": "foot"}, ProtocolSixel},
+		{"auto", map[string]string{"TERM": "xterm-kitty", "TMUX": "/tmp/tmux-0/default"}, ProtocolNone},
+		{"auto", map[string]string{"TERM": "xterm-256color"}, ProtocolNone},
+		{"sixel", nil, ProtocolSixel},
+		{"off", map[string]string{"TERM": "xterm-kitty"}, ProtocolNone},
+	}
+	for _, tt := range tests {
+		getenv := func(name string) string { return tt.env[name] }
+		if got := Resolve(tt.setting, getenv); got != tt.want {
+			t.Errorf("Resolve(%q, %v) = %s, want %s", tt.setting, tt.env, got, tt.want)
+		}
+	}
+}
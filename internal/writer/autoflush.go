@@ -0,0 +1,58 @@
+package writer
+
+import "time"
+
+// startAutoFlush starts writing changed content to the output every
+// interval until stopAutoFlush is called.
+func (w *FileWriter) startAutoFlush(interval time.Duration) {
+	stop := make(chan struct{})
+	w.stopFlush = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.mu.Lock()
+				// A tick racing with stopAutoFlush must not write again
+				if w.stopFlush != nil {
+					w.flushChanges()
+				}
+				w.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// stopAutoFlush stops the timer started by startAutoFlush, if any. The
+// caller must hold w.mu.
+func (w *FileWriter) stopAutoFlush() {
+	if w.stopFlush != nil {
+		close(w.stopFlush)
+		w.stopFlush = nil
+	}
+}
+
+// changed counts a change to the buffer and writes the output once
+// AutoFlushChanges changes have been made since it was last written. The
+// caller must hold w.mu.
+func (w *FileWriter) changed() {
+	w.changes++
+	if n := w.opts.AutoFlushChanges; n > 0 && w.changes >= n {
+		w.flushChanges()
+	}
+}
+
+// flushChanges writes the output if the buffer changed since it was last
+// written. Errors are logged rather than returned, since the final Flush
+// reports them. The caller must hold w.mu.
+func (w *FileWriter) flushChanges() {
+	if !w.dirty || w.discarded || w.opts.Stream {
+		return
+	}
+	if err := w.writeOutput(); err != nil {
+		w.opts.Logger.Warn("auto flush failed", "path", w.opts.OutputPath, "error", err)
+	}
+}
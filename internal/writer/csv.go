@@ -0,0 +1,38 @@
+package writer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// csvHeader names the columns of the csv format.
+var csvHeader = []string{"path", "language", "size", "tokens", "chunks"}
+
+// renderCSV writes a header row and a row per buffered file ordered by
+// path. The format is a file inventory, so content and the directory
+// context are left out. An unchunked file counts as one chunk.
+func (w *FileWriter) renderCSV(out io.Writer) error {
+	cw := csv.NewWriter(out)
+	cw.Write(csvHeader)
+	for _, content := range w.sortedContents() {
+		chunks := len(content.Chunks)
+		if chunks == 0 {
+			chunks = 1
+		}
+		cw.Write([]string{
+			content.Entry.Path,
+			content.Entry.Language,
+			strconv.FormatInt(content.Entry.Size, 10),
+			strconv.Itoa(FileTokens(content)),
+			strconv.Itoa(chunks),
+		})
+	}
+	// Write errors are sticky, so checking once after flushing is enough
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("writing CSV: %w", err)
+	}
+	return nil
+}
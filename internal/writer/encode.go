@@ -0,0 +1,35 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// encodeContent returns content encoded as configured by EncodeContent.
+func (w *FileWriter) encodeContent(content []byte) string {
+	switch w.opts.EncodeContent {
+	case types.ContentEncodingBase64:
+		return base64.StdEncoding.EncodeToString(content)
+	case types.ContentEncodingGzipBase64:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		// Writing to a bytes.Buffer can't fail
+		zw.Write(content)
+		zw.Close()
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return string(content)
+}
+
+// xmlContent returns the <content> element for content: CDATA, or the
+// encoded content with its encoding as an attribute.
+func (w *FileWriter) xmlContent(content []byte) string {
+	if w.opts.EncodeContent == "" {
+		return fmt.Sprintf("<content><![CDATA[\n%s\n]]></content>", cdata(content))
+	}
+	return fmt.Sprintf("<content encoding=%q>%s</content>", w.opts.EncodeContent, w.encodeContent(content))
+}
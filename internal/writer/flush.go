@@ -0,0 +1,183 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lc/pfzf/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// canRenderIncrementally reports whether writeOutput should use
+// renderIncremental. Query results are ranked across all files and templates
+// see the whole document at once, so both are always rendered in one go.
+func (w *FileWriter) canRenderIncrementally() bool {
+	return w.opts.FlushConcurrency > 0 && w.opts.Query == "" &&
+		w.opts.Format != types.OutputFormatTemplate && w.opts.Format != types.OutputFormatCSV && len(w.buffer) > 0
+}
+
+// renderIncremental writes the same document as render, but formats up to
+// FlushConcurrency files at once, each into its own buffer, and writes them
+// to out in order as they become ready. A formatted file is held only until
+// it has been written, and no new file is formatted while FlushConcurrency
+// are waiting, so a slow out holds formatting back instead of letting
+// buffers pile up. The caller must hold w.mu.
+func (w *FileWriter) renderIncremental(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(out)
+	if w.opts.Format == types.OutputFormatJSON {
+		err = w.writeJSONOpening(bw)
+	} else {
+		err = w.writeHeader(bw)
+		if err == nil && w.hasContext {
+			err = w.writeDirectoryContext(bw)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = formatInOrder(bw, len(contents), w.opts.FlushConcurrency, func(buf *bytes.Buffer, i int) error {
+		return w.writeFile(buf, i, contents[i], trees[contents[i].Entry.Path])
+	})
+	if err != nil {
+		return err
+	}
+
+	if w.opts.Format == types.OutputFormatJSON {
+		err = w.writeJSONClosing(bw, len(contents), w.outputTokens())
+	} else {
+		err = w.writeFooter(bw, w.outputTokens())
+	}
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	return nil
+}
+
+// writeFile writes the file at index i of the document to out, as render
+// would have written it.
+func (w *FileWriter) writeFile(out io.Writer, i int, content types.ProcessedContent, tree string) error {
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		return w.writeXMLFile(out, content, tree)
+	case types.OutputFormatJSON:
+		return w.writeJSONFile(out, i, content, tree)
+	case types.OutputFormatJSONL:
+		return w.writeJSONLFile(out, content, tree)
+	case types.OutputFormatYAML:
+		// Each file is its own document, separated as one encoder would
+		if i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return fmt.Errorf("writing YAML separator: %w", err)
+			}
+		}
+		if err := yaml.NewEncoder(out).Encode(w.outputFile(content, tree)); err != nil {
+			return fmt.Errorf("encoding YAML content: %w", err)
+		}
+		return nil
+	case types.OutputFormatText:
+		return w.writeTextFile(out, content, tree)
+	case types.OutputFormatMarkdown:
+		return w.writeMarkdownFile(out, content, tree)
+	default:
+		return fmt.Errorf("unsupported format: %s", w.opts.Format)
+	}
+}
+
+// formatJob asks a formatInOrder worker to format item i into buf and send
+// the result to done.
+type formatJob struct {
+	i    int
+	buf  *bytes.Buffer
+	done chan<- formatted
+}
+
+// formatted is the result of a formatJob.
+type formatted struct {
+	buf *bytes.Buffer
+	err error
+}
+
+// formatInOrder calls format for items 0 to n-1 on up to limit workers and
+// copies each buffer to out in item order. Exactly limit buffers are shared
+// between the items, and one is only reused once its item has been written,
+// so at most limit formatted items are held at any time. The first error
+// stops new items from starting and is returned once the running ones have
+// finished.
+func formatInOrder(out io.Writer, n, limit int, format func(buf *bytes.Buffer, i int) error) error {
+	limit = min(limit, n)
+	free := make(chan *bytes.Buffer, limit)
+	for i := 0; i < limit; i++ {
+		free <- new(bytes.Buffer)
+	}
+	jobs := make(chan formatJob, limit)
+	results := make(chan chan formatted, limit)
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.done <- formatted{buf: job.buf, err: format(job.buf, job.i)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			// Checked first so a free buffer can't win over a stop
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var buf *bytes.Buffer
+			select {
+			case buf = <-free:
+			case <-stop:
+				return
+			}
+
+			done := make(chan formatted, 1)
+			results <- done
+			jobs <- formatJob{i: i, buf: buf, done: done}
+		}
+	}()
+
+	var err error
+	for done := range results {
+		r := <-done
+		if err == nil {
+			err = r.err
+			if err == nil {
+				if _, werr := r.buf.WriteTo(out); werr != nil {
+					err = fmt.Errorf("writing output: %w", werr)
+				}
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		r.buf.Reset()
+		free <- r.buf
+	}
+
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,113 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// JSON Lines output has no enclosing document: every record is one compact
+// JSON object on its own line, told apart by its "type" field.
+const (
+	jsonlTypeContext = "directory_context"
+	jsonlTypeFile    = "file"
+	jsonlTypeChunk   = "chunk"
+	jsonlTypeSummary = "summary"
+)
+
+type jsonlContext struct {
+	Type string `json:"type"`
+	jsonDirectoryContext
+}
+
+type jsonlFile struct {
+	Type string `json:"type"`
+	outputFile
+}
+
+// jsonlChunk is an emitted chunk of a file, or a ranked chunk with its score
+// when a query is set.
+type jsonlChunk struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	fileChunk
+	Score *float64 `json:"score,omitempty"`
+}
+
+type jsonlSummary struct {
+	Type        string `json:"type"`
+	TotalTokens int    `json:"total_tokens"`
+}
+
+// writeJSONLRecord writes v to out as one line.
+func writeJSONLRecord(out io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding JSON line: %w", err)
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing JSON line: %w", err)
+	}
+	return nil
+}
+
+func (w *FileWriter) writeJSONLContext(out io.Writer) error {
+	return writeJSONLRecord(out, jsonlContext{
+		Type:                 jsonlTypeContext,
+		jsonDirectoryContext: jsonDirectoryContext{Repo: w.repoInfo(), CWD: w.cwd, Tree: w.tree},
+	})
+}
+
+func (w *FileWriter) flushJSONL(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+
+	for _, content := range contents {
+		if err := w.writeJSONLFile(out, content, trees[content.Entry.Path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeJSONLFile writes content as one file record, or one chunk record per
+// chunk with EmitChunks so each can be embedded separately.
+func (w *FileWriter) writeJSONLFile(out io.Writer, content types.ProcessedContent, tree string) error {
+	file := w.outputFile(content, tree)
+	if !w.opts.EmitChunks {
+		return writeJSONLRecord(out, jsonlFile{Type: jsonlTypeFile, outputFile: file})
+	}
+
+	for _, chunk := range file.Chunks {
+		if err := writeJSONLRecord(out, jsonlChunk{Type: jsonlTypeChunk, Path: file.Path, fileChunk: chunk}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *FileWriter) writeJSONLChunks(out io.Writer, chunks []scoredChunk) error {
+	for _, c := range chunks {
+		score := c.score
+		if err := writeJSONLRecord(out, jsonlChunk{
+			Type: jsonlTypeChunk,
+			Path: c.path,
+			fileChunk: fileChunk{
+				StartLine:  c.chunk.StartLine,
+				EndLine:    c.chunk.EndLine,
+				TokenCount: c.chunk.TokenCount,
+				Content:    string(bytes.TrimRight(c.chunk.Content, "\n")),
+			},
+			Score: &score,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// markdownInfoStrings maps detected languages to the fence info strings
+// markdown renderers highlight. Languages not listed use their own name.
+var markdownInfoStrings = map[string]string{
+	"typescript": "ts",
+	"javascript": "js",
+	"shell":      "sh",
+	"csharp":     "cs",
+	"markdown":   "md",
+	"unknown":    "",
+}
+
+// markdownInfoString returns the fence info string for language.
+func markdownInfoString(language string) string {
+	if info, ok := markdownInfoStrings[language]; ok {
+		return info
+	}
+	return language
+}
+
+// writeMarkdownFence writes body as a fenced code block. The fence is longer
+// than any backtick run in body so the block cannot end early.
+func writeMarkdownFence(out io.Writer, info string, body []byte) error {
+	longest, run := 0, 0
+	for _, b := range body {
+		if b == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+
+	if _, err := fmt.Fprintf(out, "%s%s\n%s\n%s\n\n", fence, info, bytes.TrimRight(body, "\n"), fence); err != nil {
+		return fmt.Errorf("writing markdown code block: %w", err)
+	}
+	return nil
+}
+
+// writeMarkdownContext writes the directory context section.
+func (w *FileWriter) writeMarkdownContext(out io.Writer, cwd, tree string) error {
+	repo := ""
+	if w.repo != nil {
+		repo = fmt.Sprintf(" (repository `%s`, branch `%s`)", w.repo.Name, w.repo.Branch)
+	}
+	if _, err := fmt.Fprintf(out, "# Directory context\n\nWorking directory: `%s`%s\n\n", cwd, repo); err != nil {
+		return fmt.Errorf("writing markdown directory context: %w", err)
+	}
+	return writeMarkdownFence(out, "text", []byte(tree))
+}
+
+// writeMarkdownFile writes one file as a heading and a fenced code block,
+// preceded by its scoped tree if not empty.
+func (w *FileWriter) writeMarkdownFile(out io.Writer, content types.ProcessedContent, tree string) error {
+	if _, err := fmt.Fprintf(out, "## %s\n\n", w.fileLabel(content)); err != nil {
+		return fmt.Errorf("writing markdown content: %w", err)
+	}
+	if tree != "" {
+		if err := writeMarkdownFence(out, "text", []byte(tree)); err != nil {
+			return err
+		}
+	}
+	info := markdownInfoString(content.Entry.Language)
+	if !w.opts.EmitChunks {
+		return writeMarkdownFence(out, info, content.Content)
+	}
+
+	for _, chunk := range fileChunks(content) {
+		if _, err := fmt.Fprintf(out, "### Lines %d-%d (%d tokens)\n\n", chunk.StartLine, chunk.EndLine, chunk.TokenCount); err != nil {
+			return fmt.Errorf("writing markdown chunk: %w", err)
+		}
+		if err := writeMarkdownFence(out, info, chunk.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *FileWriter) flushMarkdown(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+
+	for _, content := range contents {
+		if err := w.writeMarkdownFile(out, content, trees[content.Entry.Path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *FileWriter) writeMarkdownChunks(out io.Writer, chunks []scoredChunk) error {
+	for _, c := range chunks {
+		if _, err := fmt.Fprintf(out, "## %s:%d-%d (score %.4f)\n\n", c.path, c.chunk.StartLine, c.chunk.EndLine, c.score); err != nil {
+			return fmt.Errorf("writing markdown chunk: %w", err)
+		}
+		if err := writeMarkdownFence(out, markdownInfoString(c.language), c.chunk.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
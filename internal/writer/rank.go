@@ -0,0 +1,99 @@
+package writer
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// scoredChunk is a chunk of a buffered file with its relevance to the query.
+type scoredChunk struct {
+	path     string
+	language string
+	chunk    types.Chunk
+	score    float64
+}
+
+// rankChunks scores every chunk of contents against query by the cosine
+// similarity of their TF-IDF vectors and returns them best first. Ties are
+// ordered by path and line. Only the first topK are returned when topK is
+// positive.
+func rankChunks(contents []types.ProcessedContent, query string, topK int) []scoredChunk {
+	var chunks []scoredChunk
+	for _, content := range contents {
+		for _, chunk := range fileChunks(content) {
+			chunks = append(chunks, scoredChunk{path: content.Entry.Path, language: content.Entry.Language, chunk: chunk})
+		}
+	}
+
+	terms := make([]map[string]int, len(chunks))
+	docFreq := make(map[string]int)
+	for i, c := range chunks {
+		terms[i] = termFrequencies(string(c.chunk.Content))
+		for term := range terms[i] {
+			docFreq[term]++
+		}
+	}
+
+	idf := func(term string) float64 {
+		return math.Log(float64(len(chunks)+1)/float64(docFreq[term]+1)) + 1
+	}
+	queryVec := weigh(termFrequencies(query), idf)
+	for i := range chunks {
+		chunks[i].score = cosine(queryVec, weigh(terms[i], idf))
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		if chunks[i].score != chunks[j].score {
+			return chunks[i].score > chunks[j].score
+		}
+		if chunks[i].path != chunks[j].path {
+			return chunks[i].path < chunks[j].path
+		}
+		return chunks[i].chunk.StartLine < chunks[j].chunk.StartLine
+	})
+	if topK > 0 && len(chunks) > topK {
+		chunks = chunks[:topK]
+	}
+	return chunks
+}
+
+// termFrequencies counts the lowercased alphanumeric words in text.
+func termFrequencies(text string) map[string]int {
+	freq := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		freq[word]++
+	}
+	return freq
+}
+
+// weigh turns term frequencies into a TF-IDF vector.
+func weigh(freq map[string]int, idf func(string) float64) map[string]float64 {
+	vec := make(map[string]float64, len(freq))
+	for term, n := range freq {
+		vec[term] = float64(n) * idf(term)
+	}
+	return vec
+}
+
+// cosine returns the cosine similarity of two sparse vectors.
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for term, x := range a {
+		dot += x * b[term]
+		normA += x * x
+	}
+	for _, y := range b {
+		normB += y * y
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,230 @@
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// SplitWriter routes each file to a FileWriter of its own for the top-level
+// directory containing it, so a monorepo's parts can be handed out
+// separately. The output for a directory is named after the configured
+// path with the directory inserted before the extension, such as
+// out.api.xml; files directly in the root go to the configured path itself.
+// Each output's directory context is scoped to its directory.
+type SplitWriter struct {
+	opts types.WriterOptions
+
+	mu sync.Mutex
+	// writers holds the output of each top-level directory, "." for the
+	// root, created when its first file is written
+	writers map[string]*FileWriter
+	// cwd and tree hold the directory context once it has been written
+	cwd        string
+	tree       *types.TreeNode
+	hasContext bool
+}
+
+// NewSplit creates a SplitWriter. Like New, it fails early for invalid
+// options or an unwritable output directory.
+func NewSplit(opts types.WriterOptions) (*SplitWriter, error) {
+	// Validate the options once rather than at the first write
+	if _, err := checkOptions(opts); err != nil {
+		return nil, err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("getting the current directory: %w", err)
+	}
+	return &SplitWriter{
+		opts:    opts,
+		writers: make(map[string]*FileWriter),
+		cwd:     cwd,
+	}, nil
+}
+
+// SplitOutputPath returns the output path for the top-level directory dir:
+// path with the directory's name inserted before the extension, or path
+// itself for the root.
+func SplitOutputPath(path, dir string) string {
+	if dir == "." {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + dir + ext
+}
+
+// topDir returns the top-level directory containing path, relative to the
+// directory context's working directory, or "." for files directly in it
+// or outside of it. Virtual files, such as command output, aren't in any
+// directory and go to the root too.
+func (s *SplitWriter) topDir(path string) string {
+	if strings.HasPrefix(path, "$ ") {
+		return "."
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "."
+	}
+	if _, err := os.Lstat(abs); err != nil {
+		return "."
+	}
+	rel, err := filepath.Rel(s.cwd, abs)
+	if err != nil {
+		return "."
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "."
+	}
+	if i := strings.IndexByte(rel, '/'); i >= 0 {
+		return rel[:i]
+	}
+	return "."
+}
+
+// writer returns the output of dir, creating it with its scoped directory
+// context if needed. s.mu must be held.
+func (s *SplitWriter) writer(dir string) (*FileWriter, error) {
+	if w, ok := s.writers[dir]; ok {
+		return w, nil
+	}
+
+	opts := s.opts
+	opts.OutputPath = SplitOutputPath(s.opts.OutputPath, dir)
+	w, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	if s.hasContext {
+		cwd, tree := s.cwd, s.tree
+		if dir != "." {
+			cwd = filepath.Join(s.cwd, dir)
+			tree, err = fs.GetDirectoryTreeNodes(cwd, fs.TreeOptions{
+				IgnorePatterns: s.opts.TreeIgnorePatterns,
+				IncludeHidden:  s.opts.TreeIncludeHidden,
+				MaxDepth:       s.opts.TreeMaxDepth,
+				ShowSizes:      s.opts.TreeShowSizes,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("generating the tree of %s: %w", dir, err)
+			}
+		}
+		if err := w.WriteDirectoryContext(cwd, tree); err != nil {
+			return nil, err
+		}
+	}
+	s.writers[dir] = w
+	return w, nil
+}
+
+// Write buffers content in the output of its top-level directory.
+func (s *SplitWriter) Write(content types.ProcessedContent) error {
+	if content.Entry.Path == "" {
+		return fmt.Errorf("content path cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, err := s.writer(s.topDir(content.Entry.Path))
+	if err != nil {
+		return err
+	}
+	return w.Write(content)
+}
+
+// WriteDirectoryContext records the directory context. Outputs created
+// afterwards get it scoped to their directory.
+func (s *SplitWriter) WriteDirectoryContext(cwd string, tree *types.TreeNode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.writers) > 0 {
+		return fmt.Errorf("directory context must be written before content when splitting output")
+	}
+	s.cwd, s.tree, s.hasContext = cwd, tree, true
+	return nil
+}
+
+// Remove removes the file at path from its directory's output.
+func (s *SplitWriter) Remove(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := s.writers[s.topDir(path)]; ok {
+		w.Remove(path)
+	}
+}
+
+// Flush writes every output.
+func (s *SplitWriter) Flush() error {
+	return s.each(func(_ string, w *FileWriter) error { return w.Flush() })
+}
+
+// Preview renders every output into dst, each under a line naming its
+// file.
+func (s *SplitWriter) Preview(dst io.Writer) error {
+	return s.each(func(dir string, w *FileWriter) error {
+		if _, err := fmt.Fprintf(dst, "==> %s <==\n", w.opts.OutputPath); err != nil {
+			return err
+		}
+		return w.Preview(dst)
+	})
+}
+
+// Close closes every output, returning their errors joined.
+func (s *SplitWriter) Close() error {
+	var errs []error
+	s.each(func(_ string, w *FileWriter) error {
+		errs = append(errs, w.Close())
+		return nil
+	})
+	return errors.Join(errs...)
+}
+
+// Discard discards every output, returning their errors joined.
+func (s *SplitWriter) Discard() error {
+	var errs []error
+	s.each(func(_ string, w *FileWriter) error {
+		errs = append(errs, w.Discard())
+		return nil
+	})
+	return errors.Join(errs...)
+}
+
+// Outputs returns the paths of the outputs files were written to, in the
+// order of their directories.
+func (s *SplitWriter) Outputs() []string {
+	var paths []string
+	s.each(func(_ string, w *FileWriter) error {
+		paths = append(paths, w.opts.OutputPath)
+		return nil
+	})
+	return paths
+}
+
+// each calls f for the output of each directory in order, stopping at the
+// first error.
+func (s *SplitWriter) each(f func(dir string, w *FileWriter) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dirs := make([]string, 0, len(s.writers))
+	for dir := range s.writers {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := f(dir, s.writers[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package writer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// errStreamPreview is returned by Preview in streaming mode, where content
+// is not kept after it has been written.
+var errStreamPreview = errors.New("output preview is not available when streaming")
+
+// startStream creates the output file and writes everything that precedes
+// the first file: the header and the directory context. The caller must hold
+// w.mu.
+func (w *FileWriter) startStream() error {
+	f, err := os.Create(w.opts.OutputPath)
+	if err != nil {
+		return fmt.Errorf("creating output file: %w", err)
+	}
+	w.stream = f
+	w.written = true
+
+	if w.opts.Format == types.OutputFormatJSON {
+		return w.writeJSONOpening(f)
+	}
+
+	if err := w.writeHeader(f); err != nil {
+		return err
+	}
+	if w.hasContext {
+		return w.writeDirectoryContext(f)
+	}
+	return nil
+}
+
+// writeJSONOpening writes the document object up to the opening of its files
+// array, so the files can be written one at a time with writeJSONFile.
+func (w *FileWriter) writeJSONOpening(out io.Writer) error {
+	var b strings.Builder
+	b.WriteString("{")
+	if w.hasContext {
+		ctx, err := w.marshalJSON(jsonDirectoryContext{Repo: w.repoInfo(), CWD: w.cwd, Tree: w.tree}, "  ")
+		if err != nil {
+			return err
+		}
+		b.WriteString(w.jsonSpace("\n  ") + `"directory_context":` + w.jsonSpace(" ") + ctx + ",")
+	}
+	b.WriteString(w.jsonSpace("\n  ") + `"files":` + w.jsonSpace(" ") + "[")
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("writing JSON header: %w", err)
+	}
+	return nil
+}
+
+// streamFile appends content to the output file. The caller must hold w.mu.
+func (w *FileWriter) streamFile(content types.ProcessedContent) error {
+	if w.stream == nil {
+		if err := w.startStream(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		err = w.writeXMLFile(w.stream, content, "")
+	case types.OutputFormatJSON:
+		err = w.writeJSONFile(w.stream, w.streamed, content, "")
+	case types.OutputFormatJSONL:
+		err = w.writeJSONLFile(w.stream, content, "")
+	case types.OutputFormatYAML:
+		err = w.streamYAMLFile(content)
+	case types.OutputFormatText:
+		err = w.writeTextFile(w.stream, content, "")
+	case types.OutputFormatMarkdown:
+		err = w.writeMarkdownFile(w.stream, content, "")
+	default:
+		err = fmt.Errorf("unsupported format: %s", w.opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.streamed++
+	w.streamedTokens += FileTokens(content)
+	return nil
+}
+
+// writeJSONFile writes the element at index i of the files array, preceded by
+// a comma unless it is the first.
+func (w *FileWriter) writeJSONFile(out io.Writer, i int, content types.ProcessedContent, tree string) error {
+	file, err := w.marshalJSON(w.outputFile(content, tree), "    ")
+	if err != nil {
+		return err
+	}
+
+	sep := ""
+	if i > 0 {
+		sep = ","
+	}
+	if _, err := io.WriteString(out, sep+w.jsonSpace("\n    ")+file); err != nil {
+		return fmt.Errorf("writing JSON content: %w", err)
+	}
+	return nil
+}
+
+// streamYAMLFile appends content as its own document. The header starts the
+// first document, so a separator is needed once anything precedes it.
+func (w *FileWriter) streamYAMLFile(content types.ProcessedContent) error {
+	if w.hasContext || w.streamed > 0 {
+		if _, err := io.WriteString(w.stream, "---\n"); err != nil {
+			return fmt.Errorf("writing YAML separator: %w", err)
+		}
+	}
+
+	encoder := yaml.NewEncoder(w.stream)
+	if err := encoder.Encode(w.outputFile(content, "")); err != nil {
+		return fmt.Errorf("encoding YAML content: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("encoding YAML content: %w", err)
+	}
+	return nil
+}
+
+// closeStream writes the document closing and closes the output file. The
+// caller must hold w.mu.
+func (w *FileWriter) closeStream() error {
+	if w.stream == nil {
+		// Like buffered mode, a context alone still produces a document,
+		// but only once
+		if w.written || !w.hasContext {
+			return nil
+		}
+		if err := w.startStream(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if w.opts.Format == types.OutputFormatJSON {
+		err = w.writeJSONClosing(w.stream, w.streamed, w.streamedTokens)
+	} else {
+		err = w.writeFooter(w.stream, w.streamedTokens)
+	}
+
+	if cerr := w.stream.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("closing file: %w", cerr)
+	}
+	w.stream = nil
+	if err != nil {
+		return err
+	}
+
+	w.opts.Logger.Info("output written", "path", w.opts.OutputPath,
+		"format", w.opts.Format, "files", w.streamed, "stream", true)
+	return nil
+}
+
+// writeJSONClosing closes the files array after files elements and then the
+// document object, adding the total token count when it is included.
+func (w *FileWriter) writeJSONClosing(out io.Writer, files, totalTokens int) error {
+	closing := "]"
+	if w.opts.PrettyPrint && files > 0 {
+		closing = "\n  ]"
+	}
+	if w.opts.IncludeTokenCounts {
+		closing += fmt.Sprintf(",%s\"total_tokens\":%s%d", w.jsonSpace("\n  "), w.jsonSpace(" "), totalTokens)
+	}
+	closing += w.jsonSpace("\n") + "}\n"
+	if _, err := io.WriteString(out, closing); err != nil {
+		return fmt.Errorf("writing closing tags: %w", err)
+	}
+	return nil
+}
+
+// marshalJSON encodes v, indented to continue at prefix when pretty printing.
+func (w *FileWriter) marshalJSON(v any, prefix string) (string, error) {
+	var data []byte
+	var err error
+	if w.opts.PrettyPrint {
+		data, err = json.MarshalIndent(v, prefix, "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return "", fmt.Errorf("encoding JSON output: %w", err)
+	}
+	return string(data), nil
+}
+
+// jsonSpace returns s when pretty printing and nothing otherwise.
+func (w *FileWriter) jsonSpace(s string) string {
+	if w.opts.PrettyPrint {
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/lc/pfzf/internal/git"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// TemplateData is the value a user template is executed with.
+type TemplateData struct {
+	// CWD and Tree are the directory context; both are empty if none was
+	// written
+	CWD  string
+	Tree string
+	// Repo is the git repository containing CWD, or nil
+	Repo *git.RepoInfo
+	// Files are the selected files ordered by path
+	Files []types.ProcessedContent
+	// TotalTokens is the sum of the files' token counts
+	TotalTokens int
+}
+
+// templateFuncs are available to user templates in addition to the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// string converts file content, which is a byte slice, to text
+	"string": func(b []byte) string { return string(b) },
+	// cdata prepares content for an XML CDATA section
+	"cdata": func(b []byte) string { return string(cdata(b)) },
+	// xml escapes text for XML element content and attributes
+	"xml": xmlText,
+}
+
+// parseTemplate reads and parses the template at path.
+func parseTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, fmt.Errorf("template format requires a template path")
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate executes the user template once over the whole buffer.
+func (w *FileWriter) renderTemplate(out io.Writer) error {
+	data := TemplateData{
+		CWD:   w.cwd,
+		Tree:  w.treeText,
+		Repo:  w.repo,
+		Files: w.sortedContents(),
+	}
+	for _, content := range data.Files {
+		data.TotalTokens += FileTokens(content)
+	}
+
+	if err := w.tmpl.Execute(out, data); err != nil {
+		return fmt.Errorf("executing template: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// writeTextSection writes a "==== label ====" separator followed by body.
+// PrettyPrint surrounds the separator with blank lines.
+func (w *FileWriter) writeTextSection(out io.Writer, label string, body []byte) error {
+	body = bytes.TrimRight(body, "\n")
+
+	format := "==== %s ====\n%s\n"
+	if w.opts.PrettyPrint {
+		format = "==== %s ====\n\n%s\n\n"
+	}
+	if _, err := fmt.Fprintf(out, format, label, body); err != nil {
+		return fmt.Errorf("writing text section: %w", err)
+	}
+	return nil
+}
+
+// writeTextContext writes the directory tree section.
+func (w *FileWriter) writeTextContext(out io.Writer, cwd, tree string) error {
+	label := "directory: " + cwd
+	if w.repo != nil {
+		label += fmt.Sprintf(" (repo %s, branch %s)", w.repo.Name, w.repo.Branch)
+	}
+	return w.writeTextSection(out, label, []byte(tree))
+}
+
+func (w *FileWriter) flushText(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+
+	for _, content := range contents {
+		if err := w.writeTextFile(out, content, trees[content.Entry.Path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTextFile writes content as one section, or one per chunk with
+// EmitChunks, preceded by its scoped tree if not empty.
+func (w *FileWriter) writeTextFile(out io.Writer, content types.ProcessedContent, tree string) error {
+	if tree != "" {
+		dir := strings.TrimSuffix(strings.SplitN(tree, "\n", 2)[0], "/")
+		if err := w.writeTextSection(out, "tree: "+dir, []byte(tree)); err != nil {
+			return err
+		}
+	}
+
+	if !w.opts.EmitChunks {
+		return w.writeTextSection(out, w.fileLabel(content), content.Content)
+	}
+
+	for _, chunk := range fileChunks(content) {
+		label := fmt.Sprintf("%s:%d-%d (%d tokens)", content.Entry.Path, chunk.StartLine, chunk.EndLine, chunk.TokenCount)
+		if err := w.writeTextSection(out, label, chunk.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *FileWriter) writeTextChunks(out io.Writer, chunks []scoredChunk) error {
+	for _, c := range chunks {
+		label := fmt.Sprintf("%s:%d-%d (score %.4f)", c.path, c.chunk.StartLine, c.chunk.EndLine, c.score)
+		if err := w.writeTextSection(out, label, c.chunk.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileLabel returns the separator label for content: its path, followed by
+// its token count when token counts are included.
+func (w *FileWriter) fileLabel(content types.ProcessedContent) string {
+	if n := w.tokenCount(content); n != nil {
+		return fmt.Sprintf("%s (%d tokens)", content.Entry.Path, *n)
+	}
+	return content.Entry.Path
+}
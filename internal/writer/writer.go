@@ -2,78 +2,178 @@
 package writer
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	iofs "io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"text/template"
+	"time"
 
+	"github.com/lc/pfzf/internal/fs"
+	"github.com/lc/pfzf/internal/git"
 	"github.com/lc/pfzf/pkg/types"
 	"gopkg.in/yaml.v3"
 )
 
 // FileWriter manages writing processed content to a file in various formats.
+// Content is buffered and the whole document is rendered each time it is
+// written, so the output is always well formed.
 type FileWriter struct {
-	opts      types.WriterOptions
-	file      io.WriteCloser
-	mu        sync.Mutex
-	initOnce  sync.Once
-	initError error
-	buffer    map[string]types.ProcessedContent
+	opts types.WriterOptions
+	// tmpl renders the template format
+	tmpl   *template.Template
+	mu     sync.Mutex
+	buffer map[string]types.ProcessedContent
+	// tokens tracks buffered tokens per language
+	tokens map[string]int
+	// cwd and tree hold the directory context once it has been written;
+	// treeText is the tree as drawn for the text-based formats
+	cwd        string
+	tree       *types.TreeNode
+	treeText   string
+	hasContext bool
+	// repo describes the git repository containing cwd, if any
+	repo *git.RepoInfo
+	// written reports whether the output file exists; dirty whether the
+	// buffer changed since it was last written
+	written bool
+	dirty   bool
+	// discarded is set by Discard, after which nothing is written
+	discarded bool
+	// changes counts the buffer changes since the output was last written,
+	// and stopFlush stops the auto flush timer while it runs
+	changes   int
+	stopFlush chan struct{}
+	// stream is the open output file in streaming mode, streamed the number
+	// of files appended to it and streamedTokens their tokens
+	stream         *os.File
+	streamed       int
+	streamedTokens int
+	// streamedKeys holds the canonical paths of the streamed files
+	streamedKeys map[string]bool
+}
+
+// BudgetError reports that content would exceed its language's token budget.
+type BudgetError struct {
+	Language string
+	Budget   int
+	Used     int
+	Tokens   int
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s token budget exceeded: %d used + %d requested > %d",
+		e.Language, e.Used, e.Tokens, e.Budget)
 }
 
 // New creates a new FileWriter without immediately creating the output file.
+// It fails if the output directory is not writable so the problem surfaces
+// before any work is done rather than at flush time.
 func New(opts types.WriterOptions) (*FileWriter, error) {
-	if opts.OutputPath == "" {
-		return nil, fmt.Errorf("output path cannot be empty")
+	tmpl, err := checkOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.EncodeContent == types.ContentEncodingNone {
+		opts.EncodeContent = ""
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
 
-	return &FileWriter{
-		opts:   opts,
-		buffer: make(map[string]types.ProcessedContent),
-	}, nil
+	w := &FileWriter{
+		opts:         opts,
+		tmpl:         tmpl,
+		buffer:       make(map[string]types.ProcessedContent),
+		tokens:       make(map[string]int),
+		streamedKeys: make(map[string]bool),
+	}
+	// Streamed content is on disk as soon as it is written
+	if opts.AutoFlushInterval > 0 && !opts.Stream {
+		w.startAutoFlush(opts.AutoFlushInterval)
+	}
+	return w, nil
 }
 
-// initialize creates the output file and writes initial format headers.
-func (w *FileWriter) initialize() error {
-	var err error
-	w.initOnce.Do(func() {
-		var f *os.File
-		f, err = os.Create(w.opts.OutputPath)
-		if err != nil {
-			err = fmt.Errorf("creating output file: %w", err)
-			return
+// checkOptions reports options no writer can be created with, such as an
+// unsupported format or an unwritable output directory. The template of the
+// template format is parsed to check it and returned.
+func checkOptions(opts types.WriterOptions) (*template.Template, error) {
+	if opts.OutputPath == "" {
+		return nil, fmt.Errorf("output path cannot be empty")
+	}
+	switch opts.Format {
+	case types.OutputFormatXML, types.OutputFormatJSON, types.OutputFormatJSONL, types.OutputFormatYAML,
+		types.OutputFormatText, types.OutputFormatMarkdown, types.OutputFormatTemplate, types.OutputFormatCSV:
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", opts.Format)
+	}
+	if opts.Format == types.OutputFormatCSV && (opts.Stream || opts.Query != "") {
+		return nil, fmt.Errorf("the csv format does not support streaming or queries")
+	}
+
+	var tmpl *template.Template
+	if opts.Format == types.OutputFormatTemplate {
+		if opts.Stream {
+			return nil, fmt.Errorf("streaming does not support templates")
 		}
-		w.file = f
-
-		// Write format-specific headers
-		switch w.opts.Format {
-		case types.OutputFormatXML:
-			_, err = io.WriteString(f, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<files>\n")
-		case types.OutputFormatJSON:
-			_, err = io.WriteString(f, "{\n")
-		case types.OutputFormatYAML:
-			_, err = io.WriteString(f, "---\n")
-		default:
-			err = fmt.Errorf("unsupported format: %s", w.opts.Format)
+		var err error
+		if tmpl, err = parseTemplate(opts.TemplatePath); err != nil {
+			return nil, err
 		}
-
-		if err != nil {
-			f.Close()
-			err = fmt.Errorf("writing format header: %w", err)
-			return
+	}
+	if opts.Stream && (opts.Query != "" || opts.ScopedTrees) {
+		return nil, fmt.Errorf("streaming does not support queries or scoped trees")
+	}
+	switch opts.EncodeContent {
+	case "", types.ContentEncodingNone:
+	case types.ContentEncodingBase64, types.ContentEncodingGzipBase64:
+		switch {
+		case opts.Format != types.OutputFormatXML && opts.Format != types.OutputFormatJSON &&
+			opts.Format != types.OutputFormatJSONL && opts.Format != types.OutputFormatYAML:
+			return nil, fmt.Errorf("content encoding %s is only supported by the xml, json, jsonl and yaml formats", opts.EncodeContent)
+		case opts.Query != "":
+			return nil, fmt.Errorf("content encoding does not support queries")
 		}
-	})
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", opts.EncodeContent)
+	}
+	if err := checkWritable(filepath.Dir(opts.OutputPath)); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
 
+// checkWritable verifies that files can be created in dir by creating and
+// removing a temporary file.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".pfzf-write-check-*")
 	if err != nil {
-		w.initError = err
-		return err
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
 	}
-
-	return w.initError
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return fmt.Errorf("removing write check file: %w", err)
+	}
+	return nil
 }
 
-// Write buffers content instead of writing immediately.
+// Write buffers content instead of writing immediately. Content that would
+// push its language over the configured token budget is rejected with a
+// *BudgetError. A file written again under another path, such as through a
+// symlink, replaces the earlier write and is listed under the new path.
 func (w *FileWriter) Write(content types.ProcessedContent) error {
 	if content.Entry.Path == "" {
 		return fmt.Errorf("content path cannot be empty")
@@ -82,162 +182,748 @@ func (w *FileWriter) Write(content types.ProcessedContent) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.buffer[content.Entry.Path] = content
+	key := canonicalPath(content.Entry.Path)
+	if w.opts.Stream && w.streamedKeys[key] {
+		w.opts.Logger.Info("duplicate file skipped", "path", content.Entry.Path, "file", key)
+		return nil
+	}
+
+	lang := content.Entry.Language
+	used := w.tokens[lang]
+	if prev, ok := w.buffer[key]; ok && prev.Entry.Language == lang {
+		used -= prev.TokenCount
+	}
+
+	if budget, ok := w.opts.LanguageTokenBudgets[lang]; ok && used+content.TokenCount > budget {
+		w.opts.Logger.Warn("file rejected", "path", content.Entry.Path, "language", lang,
+			"tokens", content.TokenCount, "budget", budget, "used", used)
+		return &BudgetError{
+			Language: lang,
+			Budget:   budget,
+			Used:     used,
+			Tokens:   content.TokenCount,
+		}
+	}
+
+	if w.opts.Stream {
+		if err := w.streamFile(content); err != nil {
+			return err
+		}
+		w.streamedKeys[key] = true
+		w.tokens[lang] += content.TokenCount
+		return nil
+	}
+
+	w.remove(key)
+	w.buffer[key] = content
+	w.tokens[lang] += content.TokenCount
+	w.dirty = true
+	w.changed()
 	return nil
 }
 
-// Remove removes content from the buffer.
+// Remove removes content from the buffer. Streamed content has already been
+// written, so Remove does nothing in streaming mode.
 func (w *FileWriter) Remove(path string) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	delete(w.buffer, path)
+	key := canonicalPath(path)
+	if _, ok := w.buffer[key]; ok {
+		w.remove(key)
+		w.changed()
+	}
 }
 
-// Flush writes all buffered content to file.
+// remove drops the file with the canonical path key from the buffer and its
+// language's token total. The caller must hold w.mu.
+func (w *FileWriter) remove(key string) {
+	if prev, ok := w.buffer[key]; ok {
+		w.tokens[prev.Entry.Language] -= prev.TokenCount
+		delete(w.buffer, key)
+		w.dirty = true
+	}
+}
+
+// canonicalPath returns the absolute, symlink-free path of path, which
+// identifies a file however it was reached. Paths that cannot be resolved,
+// such as files that no longer exist, are only made absolute.
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// Flush writes the buffered content to the output file, replacing anything
+// written earlier. The file is not created until there is content to write.
 func (w *FileWriter) Flush() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// Streamed content is already in the file
+	if w.opts.Stream || w.discarded {
+		return nil
+	}
+
 	// Don't create file if nothing to write
-	if len(w.buffer) == 0 {
+	if len(w.buffer) == 0 && !w.written {
 		return nil
 	}
 
-	if err := w.initialize(); err != nil {
-		return fmt.Errorf("initializing writer: %w", err)
+	return w.writeOutput()
+}
+
+// Preview renders the output that would be produced for the current buffer
+// into dst without touching the output file.
+func (w *FileWriter) Preview(dst io.Writer) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opts.Stream {
+		return errStreamPreview
+	}
+
+	// Mirror Flush and Close: no output file exists until something is written
+	if !w.hasContext && len(w.buffer) == 0 {
+		return nil
+	}
+
+	return w.render(dst)
+}
+
+// writeOutput renders the document to a temporary file next to the output
+// and renames it over the output, so the output is never left half written.
+func (w *FileWriter) writeOutput() error {
+	dir, base := filepath.Split(w.opts.OutputPath)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating output file: %w", err)
+	}
+	tmp := f.Name()
+
+	size, err := w.renderTo(f)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("closing file: %w", cerr)
+	}
+	if err == nil {
+		if err = os.Rename(tmp, w.opts.OutputPath); err != nil {
+			err = fmt.Errorf("replacing output file: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	w.opts.Logger.Info("output written", "path", w.opts.OutputPath,
+		"format", w.opts.Format, "files", len(w.buffer), "bytes", size)
+	w.written, w.dirty, w.changes = true, false, 0
+	return nil
+}
+
+// renderTo renders the document to f, returning its size.
+func (w *FileWriter) renderTo(f *os.File) (int64, error) {
+	// CreateTemp makes the file private; the output is an ordinary file
+	if err := f.Chmod(0o644); err != nil {
+		return 0, fmt.Errorf("setting output file mode: %w", err)
+	}
+	render := w.render
+	if w.canRenderIncrementally() {
+		render = w.renderIncremental
+	}
+	if err := render(f); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat output file: %w", err)
 	}
+	return info.Size(), nil
+}
 
-	// Write buffered content based on format
+// render writes the complete document for the current state to out.
+func (w *FileWriter) render(out io.Writer) error {
 	switch w.opts.Format {
-	case types.OutputFormatXML:
-		return w.flushXML()
 	case types.OutputFormatJSON:
-		return w.flushJSON()
+		return w.renderJSON(out)
+	case types.OutputFormatTemplate:
+		return w.renderTemplate(out)
+	case types.OutputFormatCSV:
+		return w.renderCSV(out)
+	}
+
+	if err := w.writeHeader(out); err != nil {
+		return err
+	}
+	if w.hasContext {
+		if err := w.writeDirectoryContext(out); err != nil {
+			return err
+		}
+	}
+	if len(w.buffer) > 0 {
+		if err := w.writeFiles(out); err != nil {
+			return err
+		}
+	}
+	return w.writeFooter(out, w.outputTokens())
+}
+
+// writeHeader writes the format-specific document opening to out.
+func (w *FileWriter) writeHeader(out io.Writer) error {
+	var err error
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		_, err = io.WriteString(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<files>\n")
 	case types.OutputFormatYAML:
-		return w.flushYAML()
+		_, err = io.WriteString(out, "---\n")
+	case types.OutputFormatJSONL, types.OutputFormatText, types.OutputFormatMarkdown:
+		// JSON Lines, plain text and markdown have no header, only records
+		// or sections
 	default:
 		return fmt.Errorf("unsupported format: %s", w.opts.Format)
 	}
+
+	if err != nil {
+		return fmt.Errorf("writing format header: %w", err)
+	}
+	return nil
 }
 
-func (w *FileWriter) flushXML() error {
-	for _, content := range w.buffer {
-		if _, err := fmt.Fprintf(w.file,
-			"<file>\n  <path>%s</path>\n  <content><![CDATA[\n%s\n]]></content>\n</file>\n",
-			content.Entry.Path,
-			content.Content); err != nil {
-			return fmt.Errorf("writing XML content: %w", err)
+// writeFooter writes the format-specific document closing to out, with the
+// total token count when it is included.
+func (w *FileWriter) writeFooter(out io.Writer, totalTokens int) error {
+	if w.opts.IncludeTokenCounts {
+		if err := w.writeTotalTokens(out, totalTokens); err != nil {
+			return err
 		}
 	}
+
+	var err error
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		_, err = io.WriteString(out, "</files>")
+	}
+
+	if err != nil {
+		return fmt.Errorf("writing closing tags: %w", err)
+	}
 	return nil
 }
 
-func (w *FileWriter) flushJSON() error {
-	encoder := json.NewEncoder(w.file)
-	if w.opts.PrettyPrint {
-		encoder.SetIndent("", "  ")
+// writeTotalTokens writes the total token count for the end of the document.
+func (w *FileWriter) writeTotalTokens(out io.Writer, total int) error {
+	var err error
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		_, err = fmt.Fprintf(out, "<total-tokens>%d</total-tokens>\n", total)
+	case types.OutputFormatJSONL:
+		return writeJSONLRecord(out, jsonlSummary{Type: jsonlTypeSummary, TotalTokens: total})
+	case types.OutputFormatYAML:
+		_, err = fmt.Fprintf(out, "---\ntotal_tokens: %d\n", total)
+	case types.OutputFormatText:
+		return w.writeTextSection(out, "total tokens", []byte(strconv.Itoa(total)))
+	case types.OutputFormatMarkdown:
+		_, err = fmt.Fprintf(out, "**Total tokens:** %d\n", total)
+	}
+	if err != nil {
+		return fmt.Errorf("writing total tokens: %w", err)
+	}
+	return nil
+}
+
+// FileTokens returns the tokens content contributes to the output: the sum
+// of its chunks, or the count for the whole content when unchunked.
+func FileTokens(content types.ProcessedContent) int {
+	if len(content.Chunks) == 0 {
+		return content.TokenCount
+	}
+	total := 0
+	for _, chunk := range content.Chunks {
+		total += chunk.TokenCount
+	}
+	return total
+}
+
+// tokenCount returns content's token count for the output, or nil when
+// token counts are not included.
+func (w *FileWriter) tokenCount(content types.ProcessedContent) *int {
+	if !w.opts.IncludeTokenCounts {
+		return nil
 	}
+	n := FileTokens(content)
+	return &n
+}
 
-	// Write files array opening
-	if _, err := io.WriteString(w.file, "\"files\": [\n"); err != nil {
-		return fmt.Errorf("writing JSON array opening: %w", err)
+// outputTokens returns the tokens in the buffered output: the ranked chunks
+// with a query, otherwise every file.
+func (w *FileWriter) outputTokens() int {
+	total := 0
+	if w.opts.Query != "" {
+		for _, c := range rankChunks(w.sortedContents(), w.opts.Query, w.opts.QueryTopK) {
+			total += c.chunk.TokenCount
+		}
+		return total
 	}
+	for _, content := range w.buffer {
+		total += FileTokens(content)
+	}
+	return total
+}
 
-	first := true
+// sortedContents returns the buffered content ordered by path so every
+// rendering of the buffer lists files in the same order. With scoped trees
+// enabled files are grouped by directory so each tree sits next to all of
+// its files.
+func (w *FileWriter) sortedContents() []types.ProcessedContent {
+	contents := make([]types.ProcessedContent, 0, len(w.buffer))
 	for _, content := range w.buffer {
-		if !first {
-			if _, err := io.WriteString(w.file, ",\n"); err != nil {
-				return fmt.Errorf("writing JSON separator: %w", err)
+		contents = append(contents, content)
+	}
+
+	sort.Slice(contents, func(i, j int) bool {
+		pi, pj := contents[i].Entry.Path, contents[j].Entry.Path
+		if w.opts.ScopedTrees {
+			if di, dj := filepath.Dir(pi), filepath.Dir(pj); di != dj {
+				return di < dj
 			}
 		}
-		first = false
-
-		if err := encoder.Encode(struct {
-			Path    string `json:"path"`
-			Content string `json:"content"`
-		}{
-			Path:    content.Entry.Path,
-			Content: string(content.Content),
-		}); err != nil {
-			return fmt.Errorf("encoding JSON content: %w", err)
+		return pi < pj
+	})
+	return contents
+}
+
+// scopedTrees returns the scoped tree for each directory with buffered files,
+// keyed by the path of the first file listed in that directory. It returns
+// nil when scoped trees are disabled.
+func (w *FileWriter) scopedTrees(contents []types.ProcessedContent) (map[string]string, error) {
+	if !w.opts.ScopedTrees {
+		return nil, nil
+	}
+
+	trees := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, content := range contents {
+		dir := filepath.Dir(content.Entry.Path)
+		if seen[dir] {
+			continue
 		}
+		seen[dir] = true
+
+		tree, err := fs.GetScopedTree(dir, fs.TreeOptions{
+			IgnorePatterns: w.opts.TreeIgnorePatterns,
+			IncludeHidden:  w.opts.TreeIncludeHidden,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("generating scoped tree for %s: %w", dir, err)
+		}
+		trees[content.Entry.Path] = tree
 	}
+	return trees, nil
+}
 
-	return nil
+// writeFiles writes all buffered content to out based on format.
+func (w *FileWriter) writeFiles(out io.Writer) error {
+	if w.opts.Query != "" {
+		return w.writeChunks(out)
+	}
+
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		return w.flushXML(out)
+	case types.OutputFormatJSONL:
+		return w.flushJSONL(out)
+	case types.OutputFormatYAML:
+		return w.flushYAML(out)
+	case types.OutputFormatText:
+		return w.flushText(out)
+	case types.OutputFormatMarkdown:
+		return w.flushMarkdown(out)
+	default:
+		return fmt.Errorf("unsupported format: %s", w.opts.Format)
+	}
 }
 
-func (w *FileWriter) flushYAML() error {
-	encoder := yaml.NewEncoder(w.file)
-	for _, content := range w.buffer {
-		if err := encoder.Encode(struct {
-			Path    string `yaml:"path"`
-			Content string `yaml:"content"`
-		}{
-			Path:    content.Entry.Path,
-			Content: string(content.Content),
-		}); err != nil {
-			return fmt.Errorf("encoding YAML content: %w", err)
+// writeChunks writes the chunks of all buffered files as one stream ordered
+// by relevance to the query.
+func (w *FileWriter) writeChunks(out io.Writer) error {
+	chunks := rankChunks(w.sortedContents(), w.opts.Query, w.opts.QueryTopK)
+
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		for _, c := range chunks {
+			if _, err := fmt.Fprintf(out,
+				"<chunk>\n  <path>%s</path>\n  <lines>%d-%d</lines>\n  <score>%.4f</score>\n  <content><![CDATA[\n%s\n]]></content>\n</chunk>\n",
+				xmlText(c.path), c.chunk.StartLine, c.chunk.EndLine, c.score,
+				cdata(bytes.TrimRight(c.chunk.Content, "\n"))); err != nil {
+				return fmt.Errorf("writing XML chunk: %w", err)
+			}
+		}
+	case types.OutputFormatYAML:
+		encoder := yaml.NewEncoder(out)
+		for _, c := range chunks {
+			if err := encoder.Encode(yamlChunk{
+				Path:       c.path,
+				StartLine:  c.chunk.StartLine,
+				EndLine:    c.chunk.EndLine,
+				Score:      c.score,
+				TokenCount: c.chunk.TokenCount,
+				Content:    string(bytes.TrimRight(c.chunk.Content, "\n")),
+			}); err != nil {
+				return fmt.Errorf("encoding YAML chunk: %w", err)
+			}
 		}
+	case types.OutputFormatJSONL:
+		return w.writeJSONLChunks(out, chunks)
+	case types.OutputFormatText:
+		return w.writeTextChunks(out, chunks)
+	case types.OutputFormatMarkdown:
+		return w.writeMarkdownChunks(out, chunks)
+	default:
+		return fmt.Errorf("unsupported format: %s", w.opts.Format)
 	}
 	return nil
 }
 
-// WriteDirectoryContext writes the directory context information.
-func (w *FileWriter) WriteDirectoryContext(cwd, tree string) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+type yamlChunk struct {
+	Path       string  `yaml:"path"`
+	StartLine  int     `yaml:"start_line"`
+	EndLine    int     `yaml:"end_line"`
+	Score      float64 `yaml:"score"`
+	TokenCount int     `yaml:"token_count"`
+	Content    string  `yaml:"content"`
+}
+
+// xmlText escapes s for use as XML element text.
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// cdata prepares content for a CDATA section. A "]]>" would end the section
+// early, so it is split across two sections.
+func cdata(content []byte) []byte {
+	return bytes.ReplaceAll(content, []byte("]]>"), []byte("]]]]><![CDATA[>"))
+}
 
-	if err := w.initialize(); err != nil {
-		return fmt.Errorf("initializing writer: %w", err)
+func (w *FileWriter) flushXML(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
 	}
 
-	switch w.opts.Format {
-	case types.OutputFormatXML:
-		_, err := fmt.Fprintf(w.file,
-			"<directory-context>\n  <cwd>%s</cwd>\n  <tree><![CDATA[\n%s\n]]></tree>\n</directory-context>\n",
-			cwd, tree)
-		if err != nil {
-			return fmt.Errorf("writing XML directory context: %w", err)
+	for _, content := range contents {
+		if err := w.writeXMLFile(out, content, trees[content.Entry.Path]); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-	case types.OutputFormatJSON:
-		if _, err := io.WriteString(w.file, "\"directory_context\": {\n"); err != nil {
-			return fmt.Errorf("writing JSON context opening: %w", err)
+// writeXMLFile writes one <file> element, with its scoped tree if not empty.
+func (w *FileWriter) writeXMLFile(out io.Writer, content types.ProcessedContent, tree string) error {
+	if _, err := fmt.Fprintf(out, "<file>\n  <path>%s</path>\n", xmlText(content.Entry.Path)); err != nil {
+		return fmt.Errorf("writing XML content: %w", err)
+	}
+	if m := w.metadata(content); m != nil {
+		var labels string
+		if m.Generated {
+			labels += ` generated="true"`
+		}
+		if m.BuildFile {
+			labels += ` build-file="true"`
+		}
+		if _, err := fmt.Fprintf(out, "  <metadata size=\"%d\" mod-time=\"%s\" language=\"%s\" chunked=\"%t\"%s/>\n",
+			m.Size, m.ModTime.Format(time.RFC3339), xmlText(m.Language), m.Chunked, labels); err != nil {
+			return fmt.Errorf("writing XML metadata: %w", err)
 		}
+	}
+	if n := w.tokenCount(content); n != nil {
+		if _, err := fmt.Fprintf(out, "  <tokens>%d</tokens>\n", *n); err != nil {
+			return fmt.Errorf("writing XML token count: %w", err)
+		}
+	}
+	if tree != "" {
+		if _, err := fmt.Fprintf(out, "  <scoped-tree><![CDATA[\n%s\n]]></scoped-tree>\n", cdata([]byte(tree))); err != nil {
+			return fmt.Errorf("writing XML scoped tree: %w", err)
+		}
+	}
+	if !w.opts.EmitChunks {
+		if _, err := fmt.Fprintf(out, "  %s\n</file>\n", w.xmlContent(content.Content)); err != nil {
+			return fmt.Errorf("writing XML content: %w", err)
+		}
+		return nil
+	}
 
-		encoder := json.NewEncoder(w.file)
-		if w.opts.PrettyPrint {
-			encoder.SetIndent("  ", "  ")
+	for _, chunk := range fileChunks(content) {
+		if _, err := fmt.Fprintf(out,
+			"  <chunk>\n    <start-line>%d</start-line>\n    <end-line>%d</end-line>\n    <token-count>%d</token-count>\n    %s\n  </chunk>\n",
+			chunk.StartLine, chunk.EndLine, chunk.TokenCount,
+			w.xmlContent(bytes.TrimRight(chunk.Content, "\n"))); err != nil {
+			return fmt.Errorf("writing XML chunk: %w", err)
 		}
+	}
+	if _, err := io.WriteString(out, "</file>\n"); err != nil {
+		return fmt.Errorf("writing XML content: %w", err)
+	}
+	return nil
+}
 
-		if err := encoder.Encode(struct {
-			CWD  string `json:"cwd"`
-			Tree string `json:"tree"`
-		}{
-			CWD:  cwd,
-			Tree: tree,
-		}); err != nil {
-			return fmt.Errorf("encoding JSON directory context: %w", err)
+// jsonDocument is the root of the JSON output.
+type jsonDocument struct {
+	DirectoryContext *jsonDirectoryContext `json:"directory_context,omitempty"`
+	Files            []outputFile          `json:"files,omitempty"`
+	Chunks           []jsonChunk           `json:"chunks,omitempty"`
+	TotalTokens      *int                  `json:"total_tokens,omitempty"`
+}
+
+type jsonDirectoryContext struct {
+	Repo *repoInfo       `json:"repo,omitempty"`
+	CWD  string          `json:"cwd"`
+	Tree *types.TreeNode `json:"tree"`
+}
+
+// outputFile is a file in JSON and YAML output. With EmitChunks its content
+// is split into Chunks instead.
+type outputFile struct {
+	Path       string        `json:"path" yaml:"path"`
+	Metadata   *fileMetadata `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	Tokens     *int          `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+	ScopedTree string        `json:"scoped_tree,omitempty" yaml:"scoped_tree,omitempty"`
+	Encoding   string        `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	Content    string        `json:"content,omitempty" yaml:"content,omitempty"`
+	Chunks     []fileChunk   `json:"chunks,omitempty" yaml:"chunks,omitempty"`
+}
+
+type fileChunk struct {
+	StartLine  int    `json:"start_line" yaml:"start_line"`
+	EndLine    int    `json:"end_line" yaml:"end_line"`
+	TokenCount int    `json:"token_count" yaml:"token_count"`
+	Encoding   string `json:"encoding,omitempty" yaml:"encoding,omitempty"`
+	Content    string `json:"content" yaml:"content"`
+}
+
+// outputFile returns the JSON and YAML form of content.
+func (w *FileWriter) outputFile(content types.ProcessedContent, tree string) outputFile {
+	file := outputFile{
+		Path:       content.Entry.Path,
+		Metadata:   w.metadata(content),
+		Tokens:     w.tokenCount(content),
+		ScopedTree: tree,
+	}
+	if !w.opts.EmitChunks {
+		file.Content = w.encodeContent(content.Content)
+		file.Encoding = string(w.opts.EncodeContent)
+		return file
+	}
+
+	for _, chunk := range fileChunks(content) {
+		file.Chunks = append(file.Chunks, fileChunk{
+			StartLine:  chunk.StartLine,
+			EndLine:    chunk.EndLine,
+			TokenCount: chunk.TokenCount,
+			Encoding:   string(w.opts.EncodeContent),
+			Content:    w.encodeContent(bytes.TrimRight(chunk.Content, "\n")),
+		})
+	}
+	return file
+}
+
+// fileChunks returns content's chunks, or a single chunk covering all of it
+// when it was not chunked.
+func fileChunks(content types.ProcessedContent) []types.Chunk {
+	if len(content.Chunks) > 0 {
+		return content.Chunks
+	}
+
+	lines := bytes.Count(content.Content, []byte("\n"))
+	if len(content.Content) > 0 && !bytes.HasSuffix(content.Content, []byte("\n")) {
+		lines++
+	}
+	return []types.Chunk{{
+		Content:    content.Content,
+		StartLine:  1,
+		EndLine:    max(lines, 1),
+		TokenCount: content.TokenCount,
+	}}
+}
+
+// fileMetadata describes a file in the output when metadata is included.
+type fileMetadata struct {
+	Size     int64     `json:"size" yaml:"size"`
+	ModTime  time.Time `json:"mod_time" yaml:"mod_time"`
+	Language string    `json:"language,omitempty" yaml:"language,omitempty"`
+	Chunked  bool      `json:"chunked" yaml:"chunked"`
+	// Generated and BuildFile label files most readers want to tell apart
+	Generated bool `json:"generated,omitempty" yaml:"generated,omitempty"`
+	BuildFile bool `json:"build_file,omitempty" yaml:"build_file,omitempty"`
+}
+
+// metadata returns content's metadata, or nil when it is not included.
+func (w *FileWriter) metadata(content types.ProcessedContent) *fileMetadata {
+	if !w.opts.IncludeMetadata {
+		return nil
+	}
+	return &fileMetadata{
+		Size:      content.Entry.Size,
+		ModTime:   content.Entry.ModTime,
+		Language:  content.Entry.Language,
+		Chunked:   len(content.Chunks) > 0,
+		Generated: content.Entry.IsGenerated,
+		BuildFile: content.Entry.IsBuildFile,
+	}
+}
+
+type jsonChunk struct {
+	Path       string  `json:"path"`
+	StartLine  int     `json:"start_line"`
+	EndLine    int     `json:"end_line"`
+	Score      float64 `json:"score"`
+	TokenCount int     `json:"token_count"`
+	Content    string  `json:"content"`
+}
+
+// renderJSON marshals the whole document at once; streaming the pieces
+// separately made it too easy to produce invalid JSON.
+func (w *FileWriter) renderJSON(out io.Writer) error {
+	doc := jsonDocument{}
+	if w.hasContext {
+		doc.DirectoryContext = &jsonDirectoryContext{Repo: w.repoInfo(), CWD: w.cwd, Tree: w.tree}
+	}
+
+	contents := w.sortedContents()
+	if w.opts.Query != "" {
+		for _, c := range rankChunks(contents, w.opts.Query, w.opts.QueryTopK) {
+			doc.Chunks = append(doc.Chunks, jsonChunk{
+				Path:       c.path,
+				StartLine:  c.chunk.StartLine,
+				EndLine:    c.chunk.EndLine,
+				Score:      c.score,
+				TokenCount: c.chunk.TokenCount,
+				Content:    string(bytes.TrimRight(c.chunk.Content, "\n")),
+			})
+		}
+		if w.opts.IncludeTokenCounts {
+			total := w.outputTokens()
+			doc.TotalTokens = &total
+		}
+		return w.encodeJSON(out, doc)
+	}
+
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+	for _, content := range contents {
+		doc.Files = append(doc.Files, w.outputFile(content, trees[content.Entry.Path]))
+	}
+	if w.opts.IncludeTokenCounts {
+		total := w.outputTokens()
+		doc.TotalTokens = &total
+	}
+
+	return w.encodeJSON(out, doc)
+}
+
+func (w *FileWriter) encodeJSON(out io.Writer, doc jsonDocument) error {
+	encoder := json.NewEncoder(out)
+	if w.opts.PrettyPrint {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("encoding JSON output: %w", err)
+	}
+	return nil
+}
+
+func (w *FileWriter) flushYAML(out io.Writer) error {
+	contents := w.sortedContents()
+	trees, err := w.scopedTrees(contents)
+	if err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(out)
+	for _, content := range contents {
+		if err := encoder.Encode(w.outputFile(content, trees[content.Entry.Path])); err != nil {
+			return fmt.Errorf("encoding YAML content: %w", err)
+		}
+	}
+	return nil
+}
+
+// WriteDirectoryContext records the directory context information, which is
+// written at the top of the document.
+func (w *FileWriter) WriteDirectoryContext(cwd string, tree *types.TreeNode) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stream != nil {
+		return fmt.Errorf("directory context must be written before content when streaming")
+	}
+
+	w.cwd, w.tree, w.hasContext = cwd, tree, true
+	w.treeText = fs.RenderTree(tree, w.opts.TreeShowSizes)
+	w.repo = nil
+	if w.opts.IncludeRepoInfo {
+		if info, ok := git.Find(cwd); ok {
+			w.repo = &info
 		}
+	}
+	w.dirty = true
+	return nil
+}
 
-		if _, err := io.WriteString(w.file, "},\n"); err != nil {
-			return fmt.Errorf("writing JSON context closing: %w", err)
+// writeDirectoryContext writes the directory context to out based on format.
+// The structured formats nest the tree's nodes; the others draw it.
+func (w *FileWriter) writeDirectoryContext(out io.Writer) error {
+	cwd, tree := w.cwd, w.treeText
+	switch w.opts.Format {
+	case types.OutputFormatXML:
+		var repo string
+		if w.repo != nil {
+			repo = fmt.Sprintf("  <repo name=\"%s\" branch=\"%s\"/>\n", xmlText(w.repo.Name), xmlText(w.repo.Branch))
+		}
+		_, err := fmt.Fprintf(out,
+			"<directory-context>\n%s  <cwd>%s</cwd>\n  <tree><![CDATA[\n%s\n]]></tree>\n</directory-context>\n",
+			repo, xmlText(cwd), cdata([]byte(tree)))
+		if err != nil {
+			return fmt.Errorf("writing XML directory context: %w", err)
 		}
 
 	case types.OutputFormatYAML:
-		encoder := yaml.NewEncoder(w.file)
+		encoder := yaml.NewEncoder(out)
 		if err := encoder.Encode(map[string]interface{}{
 			"directory_context": struct {
-				CWD  string `yaml:"cwd"`
-				Tree string `yaml:"tree"`
+				Repo *repoInfo       `yaml:"repo,omitempty"`
+				CWD  string          `yaml:"cwd"`
+				Tree *types.TreeNode `yaml:"tree"`
 			}{
+				Repo: w.repoInfo(),
 				CWD:  cwd,
-				Tree: tree,
+				Tree: w.tree,
 			},
 		}); err != nil {
 			return fmt.Errorf("encoding YAML directory context: %w", err)
 		}
 
+	case types.OutputFormatJSONL:
+		return w.writeJSONLContext(out)
+
+	case types.OutputFormatText:
+		return w.writeTextContext(out, cwd, tree)
+
+	case types.OutputFormatMarkdown:
+		return w.writeMarkdownContext(out, cwd, tree)
+
 	default:
 		return fmt.Errorf("unsupported format: %s", w.opts.Format)
 	}
@@ -245,31 +931,60 @@ func (w *FileWriter) WriteDirectoryContext(cwd, tree string) error {
 	return nil
 }
 
-// Close properly closes the file if it was created.
-func (w *FileWriter) Close() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// repoInfo is the serialized form of the git repository in the context.
+type repoInfo struct {
+	Name   string `json:"name" yaml:"name"`
+	Branch string `json:"branch" yaml:"branch"`
+}
 
-	if w.file == nil {
+func (w *FileWriter) repoInfo() *repoInfo {
+	if w.repo == nil {
 		return nil
 	}
+	return &repoInfo{Name: w.repo.Name, Branch: w.repo.Branch}
+}
+
+// Discard drops the buffer and removes the output file if one was created,
+// such as a partial streamed output. Flush and Close write nothing after it.
+func (w *FileWriter) Discard() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopAutoFlush()
 
 	var err error
-	switch w.opts.Format {
-	case types.OutputFormatXML:
-		_, err = io.WriteString(w.file, "</files>")
-	case types.OutputFormatJSON:
-		_, err = io.WriteString(w.file, "\n]}")
+	if w.stream != nil {
+		err = w.stream.Close()
+		w.stream = nil
+	}
+	if w.written {
+		if rerr := os.Remove(w.opts.OutputPath); rerr != nil && !errors.Is(rerr, iofs.ErrNotExist) && err == nil {
+			err = fmt.Errorf("removing output file: %w", rerr)
+		}
 	}
 
-	if err != nil {
-		w.file.Close()
-		return fmt.Errorf("writing closing tags: %w", err)
+	clear(w.buffer)
+	clear(w.tokens)
+	w.written, w.dirty, w.discarded = false, false, true
+	return err
+}
+
+// Close writes any content that has not been flushed yet. Like Flush, it
+// creates no file when there is nothing to write.
+func (w *FileWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopAutoFlush()
+
+	if w.discarded {
+		return nil
+	}
+	if w.opts.Stream {
+		return w.closeStream()
 	}
 
-	if err := w.file.Close(); err != nil {
-		return fmt.Errorf("closing file: %w", err)
+	if !w.dirty || (!w.written && !w.hasContext && len(w.buffer) == 0) {
+		return nil
 	}
 
-	return nil
+	return w.writeOutput()
 }
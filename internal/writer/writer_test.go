@@ -2,22 +2,47 @@
 package writer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/lc/pfzf/pkg/types"
+	"gopkg.in/yaml.v3"
 )
 
 func TestWriter(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
 	testCases := []struct {
-		name   string
-		format types.OutputFormat
+		name     string
+		format   types.OutputFormat
+		metadata bool
+		// want appears in the output only with metadata included
+		want []string
 	}{
-		{"XML", types.OutputFormatXML},
-		{"JSON", types.OutputFormatJSON},
-		{"YAML", types.OutputFormatYAML},
+		{"XML", types.OutputFormatXML, false,
+			[]string{`size="100"`, `mod-time="2024-05-06T07:08:09Z"`, `language="go"`, `chunked="true"`}},
+		{"JSON", types.OutputFormatJSON, false,
+			[]string{`"size": 100`, `"mod_time": "2024-05-06T07:08:09Z"`, `"language": "go"`, `"chunked": true`}},
+		{"YAML", types.OutputFormatYAML, false,
+			[]string{"size: 100", "mod_time: 2024-05-06T07:08:09Z", "language: go", "chunked: true"}},
+	}
+	for _, tc := range testCases {
+		tc.name += "/metadata"
+		tc.metadata = true
+		testCases = append(testCases, tc)
 	}
 
 	for _, tc := range testCases {
@@ -26,9 +51,10 @@ func TestWriter(t *testing.T) {
 			tmpFile := filepath.Join(t.TempDir(), "test_output")
 
 			opts := types.WriterOptions{
-				OutputPath:  tmpFile,
-				Format:      tc.format,
-				PrettyPrint: true,
+				OutputPath:      tmpFile,
+				Format:          tc.format,
+				PrettyPrint:     true,
+				IncludeMetadata: tc.metadata,
 			}
 
 			writer, err := New(opts)
@@ -39,12 +65,14 @@ func TestWriter(t *testing.T) {
 			// Test writing content
 			content := types.ProcessedContent{
 				Entry: types.FileEntry{
-					Path:     "test.txt",
+					Path:     "test.go",
 					Size:     100,
-					ModTime:  time.Now(),
+					ModTime:  modTime,
 					IsBinary: false,
+					Language: "go",
 				},
 				Content: []byte("test content"),
+				Chunks:  []types.Chunk{{Content: []byte("test content")}},
 			}
 
 			if err := writer.Write(content); err != nil {
@@ -68,6 +96,1856 @@ func TestWriter(t *testing.T) {
 			if len(data) == 0 {
 				t.Error("Output file is empty")
 			}
+
+			for _, want := range tc.want {
+				if got := strings.Contains(string(data), want); got != tc.metadata {
+					t.Errorf("output contains %s = %v, want %v:\n%s", want, got, tc.metadata, data)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterLanguageTokenBudget(t *testing.T) {
+	writer, err := New(types.WriterOptions{
+		OutputPath:           filepath.Join(t.TempDir(), "test_output"),
+		Format:               types.OutputFormatXML,
+		LanguageTokenBudgets: map[string]int{"yaml": 10},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	content := func(path, lang string, tokens int) types.ProcessedContent {
+		return types.ProcessedContent{
+			Entry:      types.FileEntry{Path: path, Language: lang},
+			Content:    []byte("test content"),
+			TokenCount: tokens,
+		}
+	}
+
+	if err := writer.Write(content("a.yaml", "yaml", 6)); err != nil {
+		t.Fatalf("Write() under budget error = %v", err)
+	}
+	if err := writer.Write(content("b.yaml", "yaml", 4)); err != nil {
+		t.Fatalf("Write() at budget error = %v", err)
+	}
+
+	err = writer.Write(content("c.yaml", "yaml", 1))
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("Write() over budget error = %v, want *BudgetError", err)
+	}
+	if budgetErr.Language != "yaml" {
+		t.Errorf("BudgetError.Language = %q, want %q", budgetErr.Language, "yaml")
+	}
+
+	// Other languages are unaffected
+	if err := writer.Write(content("main.go", "go", 100)); err != nil {
+		t.Errorf("Write() unbudgeted language error = %v", err)
+	}
+
+	// Rewriting a file replaces its previous share
+	if err := writer.Write(content("b.yaml", "yaml", 4)); err != nil {
+		t.Errorf("Write() rewrite error = %v", err)
+	}
+
+	// Removing a file frees its share of the budget
+	writer.Remove("a.yaml")
+	if err := writer.Write(content("c.yaml", "yaml", 6)); err != nil {
+		t.Errorf("Write() after remove error = %v", err)
+	}
+}
+
+func TestWriterPreviewMatchesOutput(t *testing.T) {
+	formats := []types.OutputFormat{
+		types.OutputFormatXML,
+		types.OutputFormatJSON,
+		types.OutputFormatYAML,
+	}
+
+	tests := []struct {
+		name    string
+		context bool
+		paths   []string
+	}{
+		{
+			name:    "several files",
+			context: true,
+			paths:   []string{"d.go", "e.go", "a.go", "b.go", "c.go"},
+		},
+		{
+			name:    "context only",
+			context: true,
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, format := range formats {
+		for _, tt := range tests {
+			t.Run(string(format)+"/"+tt.name, func(t *testing.T) {
+				tmpFile := filepath.Join(t.TempDir(), "test_output")
+				writer, err := New(types.WriterOptions{
+					OutputPath:  tmpFile,
+					Format:      format,
+					PrettyPrint: true,
+				})
+				if err != nil {
+					t.Fatalf("Failed to create writer: %v", err)
+				}
+
+				if tt.context {
+					if err := writer.WriteDirectoryContext("/project", fileTree("main.go")); err != nil {
+						t.Fatalf("Failed to write directory context: %v", err)
+					}
+				}
+				for _, path := range tt.paths {
+					if err := writer.Write(types.ProcessedContent{
+						Entry:   types.FileEntry{Path: path},
+						Content: []byte("package " + path),
+					}); err != nil {
+						t.Fatalf("Failed to write content: %v", err)
+					}
+				}
+
+				var preview bytes.Buffer
+				if err := writer.Preview(&preview); err != nil {
+					t.Fatalf("Preview() error = %v", err)
+				}
+
+				if err := writer.Flush(); err != nil {
+					t.Fatalf("Flush() error = %v", err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+
+				data, err := os.ReadFile(tmpFile)
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatalf("Failed to read output file: %v", err)
+				}
+
+				if preview.String() != string(data) {
+					t.Errorf("Preview does not match output.\nPreview:\n%s\nOutput:\n%s", preview.String(), data)
+				}
+			})
+		}
+	}
+}
+
+func TestWriterScopedTrees(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a/x.go":     "package a",
+		"a/y.go":     "package a",
+		"a/z.txt":    "not selected",
+		"a/c/d.go":   "package c",
+		"b/w.go":     "package b",
+		"b/skip.log": "ignored",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tmpFile := filepath.Join(t.TempDir(), "test_output")
+	writer, err := New(types.WriterOptions{
+		OutputPath:         tmpFile,
+		Format:             types.OutputFormatXML,
+		ScopedTrees:        true,
+		TreeIgnorePatterns: []string{"*.log"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	// a/c/d.go sorts between a/x.go and a/y.go by path; grouping must keep
+	// a's files together under a's tree
+	selected := []string{"a/x.go", "a/c/d.go", "a/y.go", "b/w.go"}
+	for _, name := range selected {
+		if err := writer.Write(types.ProcessedContent{
+			Entry:   types.FileEntry{Path: filepath.Join(root, name)},
+			Content: []byte(files[name]),
+		}); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writer.Preview(&out); err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+
+	// Each file block is either preceded by its directory's scoped tree or
+	// follows a file from the same directory
+	blocks := strings.Split(out.String(), "<file>\n")[1:]
+	if len(blocks) != len(selected) {
+		t.Fatalf("got %d file blocks, want %d", len(blocks), len(selected))
+	}
+
+	wantTrees := map[string][]string{
+		"a":   {"├── c/", "├── x.go", "├── y.go", "├── z.txt"},
+		"a/c": {"├── d.go"},
+		"b":   {"├── w.go"},
+	}
+	prevDir := ""
+	for _, block := range blocks {
+		path := block[strings.Index(block, "<path>")+len("<path>") : strings.Index(block, "</path>")]
+		rel, _ := filepath.Rel(root, path)
+		dir := filepath.ToSlash(filepath.Dir(rel))
+
+		hasTree := strings.Contains(block, "<scoped-tree>")
+		if dir == prevDir {
+			if hasTree {
+				t.Errorf("%s: repeated scoped tree within %s", rel, dir)
+			}
+			continue
+		}
+		if !hasTree {
+			t.Errorf("%s: first file in %s has no adjacent scoped tree", rel, dir)
+			continue
+		}
+		lines := wantTrees[dir]
+		delete(wantTrees, dir)
+
+		tree := block[strings.Index(block, "<scoped-tree>"):strings.Index(block, "</scoped-tree>")]
+		for _, line := range lines {
+			if !strings.Contains(tree, line) {
+				t.Errorf("scoped tree for %s missing %q:\n%s", dir, line, tree)
+			}
+		}
+		if strings.Contains(tree, "skip.log") {
+			t.Errorf("scoped tree for %s lists an ignored file:\n%s", dir, tree)
+		}
+		prevDir = dir
+	}
+
+	for dir := range wantTrees {
+		t.Errorf("no scoped tree emitted for %s", dir)
+	}
+}
+
+func TestNewRejectsUnwritableDirectory(t *testing.T) {
+	t.Run("missing directory", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "missing", "out.xml")
+		if _, err := New(types.WriterOptions{OutputPath: path, Format: types.OutputFormatXML}); err == nil {
+			t.Error("New() error = nil, want error for a missing directory")
+		}
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root ignores directory permissions")
+		}
+
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0o555); err != nil {
+			t.Fatalf("Failed to make directory read-only: %v", err)
+		}
+		t.Cleanup(func() { os.Chmod(dir, 0o755) })
+
+		if _, err := New(types.WriterOptions{
+			OutputPath: filepath.Join(dir, "out.xml"),
+			Format:     types.OutputFormatXML,
+		}); err == nil {
+			t.Error("New() error = nil, want error for a read-only directory")
+		}
+	})
+
+	t.Run("writable directory leaves no files", func(t *testing.T) {
+		dir := t.TempDir()
+		if _, err := New(types.WriterOptions{
+			OutputPath: filepath.Join(dir, "out.xml"),
+			Format:     types.OutputFormatXML,
+		}); err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("New() left %d files in the output directory", len(entries))
+		}
+	})
+}
+
+// fileTree returns a directory tree listing the files names.
+func fileTree(names ...string) *types.TreeNode {
+	root := &types.TreeNode{Name: ".", IsDir: true}
+	for _, name := range names {
+		root.Children = append(root.Children, &types.TreeNode{Name: name})
+	}
+	return root
+}
+
+func TestWriterJSONIsValid(t *testing.T) {
+	type output struct {
+		DirectoryContext *struct {
+			CWD  string          `json:"cwd"`
+			Tree *types.TreeNode `json:"tree"`
+		} `json:"directory_context"`
+		Files []struct {
+			Path    string `json:"path"`
+			Content string `json:"content"`
+		} `json:"files"`
+	}
+
+	tests := []struct {
+		name    string
+		pretty  bool
+		context bool
+		files   map[string]string
+	}{
+		{
+			name:    "context and files",
+			pretty:  true,
+			context: true,
+			files: map[string]string{
+				"main.go":   "package main\n\nfunc main() {\n\tprintln(\"}, ]\")\n}\n",
+				"notes.txt": "tabs\tquotes \" backslashes \\ and ünïcode",
+			},
+		},
+		{
+			name:    "compact",
+			context: true,
+			files:   map[string]string{"a.txt": "a", "b.txt": "b"},
+		},
+		{
+			name:   "files only",
+			pretty: true,
+			files:  map[string]string{"a.txt": "a"},
+		},
+		{
+			name:    "context only",
+			pretty:  true,
+			context: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "test_output.json")
+			writer, err := New(types.WriterOptions{
+				OutputPath:  tmpFile,
+				Format:      types.OutputFormatJSON,
+				PrettyPrint: tt.pretty,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+
+			if tt.context {
+				if err := writer.WriteDirectoryContext("/project", fileTree("main.go")); err != nil {
+					t.Fatalf("Failed to write directory context: %v", err)
+				}
+			}
+			for path, content := range tt.files {
+				if err := writer.Write(types.ProcessedContent{
+					Entry:   types.FileEntry{Path: path},
+					Content: []byte(content),
+				}); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			data, err := os.ReadFile(tmpFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+
+			var got output
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("output is not valid JSON: %v\n%s", err, data)
+			}
+
+			if tt.context {
+				if got.DirectoryContext == nil || got.DirectoryContext.CWD != "/project" {
+					t.Errorf("directory_context = %+v, want cwd /project", got.DirectoryContext)
+				}
+				if ctx := got.DirectoryContext; ctx != nil && !reflect.DeepEqual(ctx.Tree, fileTree("main.go")) {
+					t.Errorf("tree = %+v, want the nested nodes of main.go", ctx.Tree)
+				}
+			} else if got.DirectoryContext != nil {
+				t.Errorf("directory_context = %+v, want none", got.DirectoryContext)
+			}
+
+			if len(got.Files) != len(tt.files) {
+				t.Fatalf("got %d files, want %d", len(got.Files), len(tt.files))
+			}
+			for _, file := range got.Files {
+				if file.Content != tt.files[file.Path] {
+					t.Errorf("%s content = %q, want %q", file.Path, file.Content, tt.files[file.Path])
+				}
+			}
+		})
+	}
+}
+
+func TestWriterQueryOrdersChunksByRelevance(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{
+			Entry: types.FileEntry{Path: "db.go"},
+			Chunks: []types.Chunk{
+				{Content: []byte("func openDatabase() { connect to the database pool }\n"), StartLine: 1, EndLine: 3},
+				{Content: []byte("func closeDatabase() { release the pool }\n"), StartLine: 4, EndLine: 6},
+			},
+		},
+		{
+			Entry:   types.FileEntry{Path: "http.go"},
+			Content: []byte("func serve() { listen for http requests }"),
+		},
+		{
+			Entry: types.FileEntry{Path: "query.go"},
+			Chunks: []types.Chunk{
+				{Content: []byte("func queryDatabase() { run the database query over the database connection }\n"), StartLine: 1, EndLine: 2},
+			},
+		},
+	}
+
+	want := []string{"query.go:1", "db.go:1", "db.go:4", "http.go:1"}
+
+	tmpFile := filepath.Join(t.TempDir(), "test_output.json")
+	writer, err := New(types.WriterOptions{
+		OutputPath: tmpFile,
+		Format:     types.OutputFormatJSON,
+		Query:      "database connection",
+		QueryTopK:  3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, content := range contents {
+		if err := writer.Write(content); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	var got struct {
+		Chunks []struct {
+			Path      string  `json:"path"`
+			StartLine int     `json:"start_line"`
+			Score     float64 `json:"score"`
+		} `json:"chunks"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, data)
+	}
+
+	// Top-K keeps the three most relevant chunks
+	if len(got.Chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(got.Chunks))
+	}
+	for i, chunk := range got.Chunks {
+		if id := fmt.Sprintf("%s:%d", chunk.Path, chunk.StartLine); id != want[i] {
+			t.Errorf("chunk %d = %s, want %s", i, id, want[i])
+		}
+		if i > 0 && chunk.Score > got.Chunks[i-1].Score {
+			t.Errorf("chunk %d score %.4f above previous %.4f", i, chunk.Score, got.Chunks[i-1].Score)
+		}
+	}
+	if got.Chunks[2].Score != 0 {
+		t.Errorf("chunk without query terms scored %.4f, want 0", got.Chunks[2].Score)
+	}
+}
+
+func TestWriterXMLEscaping(t *testing.T) {
+	const (
+		path    = "a&b<c>.txt"
+		content = "if a < b && c > d {\n\tx := data[y[0]]>\n}\n// ]]> ends CDATA"
+		cwd     = "/home/me & you"
+	)
+	tree := fileTree("a&b<c>.txt", "odd]]>name")
+	want := ".\n├── a&b<c>.txt\n└── odd]]>name"
+
+	tmpFile := filepath.Join(t.TempDir(), "test_output.xml")
+	writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatXML})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.WriteDirectoryContext(cwd, tree); err != nil {
+		t.Fatalf("Failed to write directory context: %v", err)
+	}
+	if err := writer.Write(types.ProcessedContent{
+		Entry:   types.FileEntry{Path: path},
+		Content: []byte(content),
+	}); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+
+	var got struct {
+		Context struct {
+			CWD  string `xml:"cwd"`
+			Tree string `xml:"tree"`
+		} `xml:"directory-context"`
+		Files []struct {
+			Path    string `xml:"path"`
+			Content string `xml:"content"`
+		} `xml:"file"`
+	}
+	if err := xml.Unmarshal(data, &got); err != nil {
+		t.Fatalf("output is not valid XML: %v\n%s", err, data)
+	}
+
+	if got.Context.CWD != cwd {
+		t.Errorf("cwd = %q, want %q", got.Context.CWD, cwd)
+	}
+	if strings.TrimSpace(got.Context.Tree) != want {
+		t.Errorf("tree = %q, want %q", got.Context.Tree, want)
+	}
+	if len(got.Files) != 1 {
+		t.Fatalf("got %d files, want 1", len(got.Files))
+	}
+	if got.Files[0].Path != path {
+		t.Errorf("path = %q, want %q", got.Files[0].Path, path)
+	}
+	if c := strings.TrimPrefix(strings.TrimSuffix(got.Files[0].Content, "\n"), "\n"); c != content {
+		t.Errorf("content = %q, want %q", c, content)
+	}
+}
+
+func TestWriterOutputOrderIsStable(t *testing.T) {
+	paths := []string{"src/z.go", "a.go", "src/b.go", "m/n.go", "b.go", "src/a/c.go"}
+
+	for _, format := range []types.OutputFormat{
+		types.OutputFormatXML,
+		types.OutputFormatJSON,
+		types.OutputFormatYAML,
+	} {
+		t.Run(string(format), func(t *testing.T) {
+			var first string
+			for run := 0; run < 10; run++ {
+				tmpFile := filepath.Join(t.TempDir(), "test_output")
+				writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: format, PrettyPrint: true})
+				if err != nil {
+					t.Fatalf("Failed to create writer: %v", err)
+				}
+
+				// Insert in a different order each run
+				for i := range paths {
+					path := paths[(i+run)%len(paths)]
+					if err := writer.Write(types.ProcessedContent{
+						Entry:   types.FileEntry{Path: path},
+						Content: []byte("// " + path),
+					}); err != nil {
+						t.Fatalf("Failed to write content: %v", err)
+					}
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+
+				data, err := os.ReadFile(tmpFile)
+				if err != nil {
+					t.Fatalf("Failed to read output file: %v", err)
+				}
+
+				if run == 0 {
+					first = string(data)
+					continue
+				}
+				if string(data) != first {
+					t.Fatalf("run %d output differs from run 0.\nGot:\n%s\nWant:\n%s", run, data, first)
+				}
+			}
+
+			// Files are listed by path
+			last := -1
+			for _, path := range []string{"a.go", "b.go", "m/n.go", "src/a/c.go", "src/b.go", "src/z.go"} {
+				idx := strings.Index(first, "// "+path)
+				if idx < last {
+					t.Errorf("%s is out of order", path)
+				}
+				last = idx
+			}
+		})
+	}
+}
+
+func TestWriterRepoInfo(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := filepath.Join(t.TempDir(), "my-repo")
+	sub := filepath.Join(repo, "pkg", "sub")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gitBin, "init", "-q", "-b", "feature/x", repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	outside := t.TempDir()
+
+	tests := []struct {
+		name    string
+		cwd     string
+		include bool
+		want    string
+	}{
+		{name: "repo root", cwd: repo, include: true, want: `<repo name="my-repo" branch="feature/x"/>`},
+		{name: "subdirectory", cwd: sub, include: true, want: `<repo name="my-repo" branch="feature/x"/>`},
+		{name: "disabled", cwd: repo},
+		{name: "outside a repo", cwd: outside, include: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer, err := New(types.WriterOptions{
+				OutputPath:      filepath.Join(t.TempDir(), "test_output.xml"),
+				Format:          types.OutputFormatXML,
+				IncludeRepoInfo: tt.include,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := writer.WriteDirectoryContext(tt.cwd, fileTree()); err != nil {
+				t.Fatalf("WriteDirectoryContext() error = %v", err)
+			}
+
+			var out bytes.Buffer
+			if err := writer.Preview(&out); err != nil {
+				t.Fatalf("Preview() error = %v", err)
+			}
+
+			if tt.want == "" {
+				if strings.Contains(out.String(), "<repo") {
+					t.Errorf("unexpected repo element:\n%s", out.String())
+				}
+				return
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("output missing %s:\n%s", tt.want, out.String())
+			}
+			if err := xml.Unmarshal(out.Bytes(), new(struct{})); err != nil {
+				t.Errorf("output is not valid XML: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriterText(t *testing.T) {
+	tests := []struct {
+		name   string
+		pretty bool
+		want   string
+	}{
+		{
+			name: "compact",
+			want: "==== directory: /work ====\n.\n└── a.go\n" +
+				"==== a.go ====\npackage a\n" +
+				"==== b/c.go ====\npackage c\n",
+		},
+		{
+			name:   "pretty",
+			pretty: true,
+			want: "==== directory: /work ====\n\n.\n└── a.go\n\n" +
+				"==== a.go ====\n\npackage a\n\n" +
+				"==== b/c.go ====\n\npackage c\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "out.txt")
+			writer, err := New(types.WriterOptions{
+				OutputPath:  tmpFile,
+				Format:      types.OutputFormatText,
+				PrettyPrint: tt.pretty,
+			})
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := writer.WriteDirectoryContext("/work", fileTree("a.go")); err != nil {
+				t.Fatalf("Failed to write directory context: %v", err)
+			}
+			for _, path := range []string{"b/c.go", "a.go"} {
+				pkg := strings.TrimSuffix(filepath.Base(path), ".go")
+				if err := writer.Write(types.ProcessedContent{
+					Entry:   types.FileEntry{Path: path},
+					Content: []byte("package " + pkg + "\n"),
+				}); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			data, err := os.ReadFile(tmpFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("output = %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriterStream(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "a.go", Language: "go"}, Content: []byte("package a\n"), TokenCount: 3},
+		{Entry: types.FileEntry{Path: "b/<c>.go", Language: "go"}, Content: []byte("package c // ]]>\n"), TokenCount: 5},
+	}
+
+	write := func(t *testing.T, opts types.WriterOptions) string {
+		t.Helper()
+		writer, err := New(opts)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if err := writer.WriteDirectoryContext("/work", fileTree("a.go")); err != nil {
+			t.Fatalf("Failed to write directory context: %v", err)
+		}
+		for _, content := range contents {
+			if err := writer.Write(content); err != nil {
+				t.Fatalf("Failed to write content: %v", err)
+			}
+		}
+		// Closing twice must not truncate streamed output
+		for i := 0; i < 2; i++ {
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+		}
+		data, err := os.ReadFile(opts.OutputPath)
+		if err != nil {
+			t.Fatalf("Failed to read output file: %v", err)
+		}
+		return string(data)
+	}
+
+	for _, format := range []types.OutputFormat{types.OutputFormatXML, types.OutputFormatJSON, types.OutputFormatJSONL, types.OutputFormatText} {
+		for _, pretty := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/pretty=%v", format, pretty), func(t *testing.T) {
+				dir := t.TempDir()
+				opts := types.WriterOptions{Format: format, PrettyPrint: pretty, IncludeTokenCounts: pretty}
+
+				opts.OutputPath = filepath.Join(dir, "buffered")
+				want := write(t, opts)
+				opts.OutputPath, opts.Stream = filepath.Join(dir, "streamed"), true
+				got := write(t, opts)
+
+				if got != want {
+					t.Errorf("streamed output differs from buffered:\ngot:\n%s\nwant:\n%s", got, want)
+				}
+			})
+		}
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		out := write(t, types.WriterOptions{
+			OutputPath: filepath.Join(t.TempDir(), "out.yaml"),
+			Format:     types.OutputFormatYAML,
+			Stream:     true,
+		})
+
+		decoder := yaml.NewDecoder(strings.NewReader(out))
+		var docs []map[string]interface{}
+		for {
+			var doc map[string]interface{}
+			if err := decoder.Decode(&doc); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				t.Fatalf("Decode() error = %v\n%s", err, out)
+			}
+			docs = append(docs, doc)
+		}
+		if len(docs) != 3 || docs[0]["directory_context"] == nil || docs[2]["path"] != "b/<c>.go" {
+			t.Errorf("documents = %v, want the context then both files", docs)
+		}
+	})
+}
+
+func TestWriterStreamIgnoresRemove(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "out.txt")
+	writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatText, Stream: true})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.Write(types.ProcessedContent{
+		Entry:   types.FileEntry{Path: "a.go"},
+		Content: []byte("package a\n"),
+	}); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	writer.Remove("a.go")
+
+	if err := writer.WriteDirectoryContext("/work", fileTree()); err == nil {
+		t.Error("WriteDirectoryContext() after streaming content should fail")
+	}
+	if err := writer.Preview(io.Discard); err == nil {
+		t.Error("Preview() should fail when streaming")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if want := "==== a.go ====\npackage a\n"; string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+}
+
+func TestWriterDiscard(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "out.txt")
+			writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatText, Stream: stream})
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := writer.Write(types.ProcessedContent{
+				Entry:   types.FileEntry{Path: "a.go"},
+				Content: []byte("package a\n"),
+			}); err != nil {
+				t.Fatalf("Failed to write content: %v", err)
+			}
+
+			if err := writer.Discard(); err != nil {
+				t.Fatalf("Discard() error = %v", err)
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+				t.Errorf("output file exists after Discard(), stat error = %v", err)
+			}
+		})
+	}
+}
+
+func TestWriterAutoFlush(t *testing.T) {
+	content := func(path string) types.ProcessedContent {
+		return types.ProcessedContent{Entry: types.FileEntry{Path: path}, Content: []byte("package " + path[:1] + "\n")}
+	}
+	readOutput := func(t *testing.T, path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read output file: %v", err)
+		}
+		return string(data)
+	}
+
+	t.Run("changes", func(t *testing.T) {
+		dir := t.TempDir()
+		tmpFile := filepath.Join(dir, "out.txt")
+		writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatText, AutoFlushChanges: 2})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		defer writer.Close()
+
+		writer.Write(content("a.go"))
+		if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+			t.Fatalf("output written after one change, stat error = %v", err)
+		}
+		writer.Write(content("b.go"))
+		if got := readOutput(t, tmpFile); !strings.Contains(got, "a.go") || !strings.Contains(got, "b.go") {
+			t.Errorf("output after two changes = %q, want both files", got)
+		}
+
+		// Removing is a change too, reflected by the next write
+		writer.Remove("a.go")
+		writer.Write(content("c.go"))
+		if got := readOutput(t, tmpFile); strings.Contains(got, "a.go") || !strings.Contains(got, "c.go") {
+			t.Errorf("output after removing a.go = %q, want b.go and c.go", got)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Failed to read output directory: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("output directory holds %d files, want no temporary files left", len(entries))
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		tmpFile := filepath.Join(t.TempDir(), "out.txt")
+		writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatText, AutoFlushInterval: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		writer.Write(content("a.go"))
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, err := os.Stat(tmpFile); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("output not written by the auto flush timer")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := readOutput(t, tmpFile); !strings.Contains(got, "a.go") {
+			t.Errorf("output = %q, want a.go", got)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	})
+}
+
+func TestMarkdownInfoString(t *testing.T) {
+	tests := map[string]string{
+		"typescript": "ts",
+		"javascript": "js",
+		"shell":      "sh",
+		"yaml":       "yaml",
+		"csharp":     "cs",
+		"go":         "go",
+		"python":     "python",
+		"unknown":    "",
+		"":           "",
+	}
+	for language, want := range tests {
+		if got := markdownInfoString(language); got != want {
+			t.Errorf("markdownInfoString(%q) = %q, want %q", language, got, want)
+		}
+	}
+}
+
+func TestWriterCSV(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "out.csv")
+	writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatCSV, FlushConcurrency: 2})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.WriteDirectoryContext("/work", fileTree("a.go")); err != nil {
+		t.Fatalf("Failed to write directory context: %v", err)
+	}
+	for _, content := range []types.ProcessedContent{
+		{
+			Entry:      types.FileEntry{Path: "b/c,d.go", Language: "go", Size: 2048},
+			Content:    []byte("package c\n"),
+			Chunks:     []types.Chunk{{TokenCount: 300}, {TokenCount: 200}},
+			TokenCount: 480,
+		},
+		{
+			Entry:      types.FileEntry{Path: "a.go", Language: "go", Size: 10},
+			Content:    []byte("package a\n"),
+			TokenCount: 4,
+		},
+	} {
+		if err := writer.Write(content); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	want := "path,language,size,tokens,chunks\n" +
+		"a.go,go,10,4,1\n" +
+		"\"b/c,d.go\",go,2048,500,2\n"
+	if string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+
+	if _, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatCSV, Stream: true}); err == nil {
+		t.Error("New() should reject streaming CSV")
+	}
+}
+
+func TestWriterMarkdown(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "out.md")
+	writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: types.OutputFormatMarkdown})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.WriteDirectoryContext("/work", fileTree("app.ts")); err != nil {
+		t.Fatalf("Failed to write directory context: %v", err)
+	}
+	for _, content := range []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "app.ts", Language: "typescript"}, Content: []byte("let x = 1\n")},
+		{Entry: types.FileEntry{Path: "README.md", Language: "markdown"}, Content: []byte("```sh\nmake\n```\n")},
+	} {
+		if err := writer.Write(content); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	want := "# Directory context\n\nWorking directory: `/work`\n\n```text\n.\n└── app.ts\n```\n\n" +
+		"## README.md\n\n````md\n```sh\nmake\n```\n````\n\n" +
+		"## app.ts\n\n```ts\nlet x = 1\n```\n\n"
+	if string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+}
+
+func TestWriterDeduplicatesPathsToSameFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "src", "main.go")
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(target, []byte("package main\n"), 0o644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("src", link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	writer, err := New(types.WriterOptions{
+		OutputPath:           filepath.Join(dir, "out.txt"),
+		Format:               types.OutputFormatText,
+		LanguageTokenBudgets: map[string]int{"go": 5},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	viaLink := filepath.Join(link, "main.go")
+	for _, path := range []string{target, viaLink} {
+		// The second write replaces the first instead of counting twice
+		// against the budget
+		if err := writer.Write(types.ProcessedContent{
+			Entry:      types.FileEntry{Path: path, Language: "go"},
+			Content:    []byte("package main\n"),
+			TokenCount: 4,
+		}); err != nil {
+			t.Fatalf("Write(%s) error = %v", path, err)
+		}
+	}
+
+	if len(writer.buffer) != 1 {
+		t.Fatalf("buffered %d entries, want 1", len(writer.buffer))
+	}
+	if got := writer.sortedContents()[0].Entry.Path; got != viaLink {
+		t.Errorf("buffered path = %s, want the latest user-facing path %s", got, viaLink)
+	}
+
+	writer.Remove(target)
+	if len(writer.buffer) != 0 {
+		t.Errorf("Remove() through the other path left %d entries", len(writer.buffer))
+	}
+}
+
+func TestWriterTokenCounts(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "a.go"}, Content: []byte("package a\n"), TokenCount: 3},
+		{
+			Entry:      types.FileEntry{Path: "b.go"},
+			Content:    []byte("package b\n"),
+			TokenCount: 4,
+			Chunks:     []types.Chunk{{TokenCount: 2}, {TokenCount: 5}},
+		},
+	}
+
+	tests := []struct {
+		format types.OutputFormat
+		want   []string
+	}{
+		{types.OutputFormatXML, []string{"<tokens>3</tokens>", "<tokens>7</tokens>", "<total-tokens>10</total-tokens>\n</files>"}},
+		{types.OutputFormatJSON, []string{`"tokens":3`, `"tokens":7`, `"total_tokens":10}`}},
+		{types.OutputFormatYAML, []string{"tokens: 3", "tokens: 7", "---\ntotal_tokens: 10\n"}},
+		{types.OutputFormatText, []string{"==== a.go (3 tokens) ====", "==== b.go (7 tokens) ====", "==== total tokens ====\n10\n"}},
+		{types.OutputFormatMarkdown, []string{"## a.go (3 tokens)", "## b.go (7 tokens)", "**Total tokens:** 10\n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			for _, include := range []bool{true, false} {
+				tmpFile := filepath.Join(t.TempDir(), "out")
+				writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: tt.format, IncludeTokenCounts: include})
+				if err != nil {
+					t.Fatalf("Failed to create writer: %v", err)
+				}
+				for _, content := range contents {
+					if err := writer.Write(content); err != nil {
+						t.Fatalf("Failed to write content: %v", err)
+					}
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+
+				data, err := os.ReadFile(tmpFile)
+				if err != nil {
+					t.Fatalf("Failed to read output file: %v", err)
+				}
+				for _, want := range tt.want {
+					if got := strings.Contains(string(data), want); got != include {
+						t.Errorf("IncludeTokenCounts=%v: output contains %q = %v:\n%s", include, want, got, data)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWriterTemplate(t *testing.T) {
+	dir := t.TempDir()
+	tmplPath := filepath.Join(dir, "context.tmpl")
+	tmpl := `{{.CWD}}
+{{range $i, $f := .Files}}<document index="{{$i}}" source="{{xml $f.Entry.Path}}">{{string $f.Content}}</document>
+{{end}}total {{.TotalTokens}}`
+	if err := os.WriteFile(tmplPath, []byte(tmpl), 0o644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	outPath := filepath.Join(dir, "out.txt")
+	writer, err := New(types.WriterOptions{
+		OutputPath:   outPath,
+		Format:       types.OutputFormatTemplate,
+		TemplatePath: tmplPath,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.WriteDirectoryContext("/work", fileTree()); err != nil {
+		t.Fatalf("Failed to write directory context: %v", err)
+	}
+	for _, content := range []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "b&c.go"}, Content: []byte("package c"), TokenCount: 2},
+		{Entry: types.FileEntry{Path: "a.go"}, Content: []byte("package a"), TokenCount: 3},
+	} {
+		if err := writer.Write(content); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	want := `/work
+<document index="0" source="a.go">package a</document>
+<document index="1" source="b&amp;c.go">package c</document>
+total 5`
+	if string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+}
+
+func TestNewRejectsInvalidTemplate(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.tmpl")
+	if err := os.WriteFile(broken, []byte("{{range .Files}}"), 0o644); err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	for name, path := range map[string]string{
+		"missing path": "",
+		"missing file": filepath.Join(dir, "nope.tmpl"),
+		"parse error":  broken,
+	} {
+		_, err := New(types.WriterOptions{
+			OutputPath:   filepath.Join(dir, "out.txt"),
+			Format:       types.OutputFormatTemplate,
+			TemplatePath: path,
 		})
+		if err == nil {
+			t.Errorf("%s: New() error = nil, want an error", name)
+		}
+	}
+}
+
+func TestWriterEmitChunks(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{
+			Entry:   types.FileEntry{Path: "big.go"},
+			Content: []byte("package big\n\nfunc A() {}\n\nfunc B() {}\n"),
+			Chunks: []types.Chunk{
+				{Content: []byte("package big\n\nfunc A() {}\n"), StartLine: 1, EndLine: 3, TokenCount: 6},
+				{Content: []byte("\nfunc B() {}\n"), StartLine: 4, EndLine: 5, TokenCount: 3},
+			},
+		},
+		{Entry: types.FileEntry{Path: "small.go"}, Content: []byte("package small\n"), TokenCount: 4},
+	}
+	want := map[string][]fileChunk{
+		"big.go": {
+			{StartLine: 1, EndLine: 3, TokenCount: 6, Content: "package big\n\nfunc A() {}"},
+			{StartLine: 4, EndLine: 5, TokenCount: 3, Content: "\nfunc B() {}"},
+		},
+		"small.go": {
+			{StartLine: 1, EndLine: 1, TokenCount: 4, Content: "package small"},
+		},
+	}
+
+	render := func(t *testing.T, format types.OutputFormat) []byte {
+		t.Helper()
+		tmpFile := filepath.Join(t.TempDir(), "out")
+		writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: format, EmitChunks: true})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, content := range contents {
+			if err := writer.Write(content); err != nil {
+				t.Fatalf("Failed to write content: %v", err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		data, err := os.ReadFile(tmpFile)
+		if err != nil {
+			t.Fatalf("Failed to read output file: %v", err)
+		}
+		return data
+	}
+
+	check := func(t *testing.T, files []outputFile) {
+		t.Helper()
+		if len(files) != len(want) {
+			t.Fatalf("got %d files, want %d", len(files), len(want))
+		}
+		for _, file := range files {
+			if file.Content != "" {
+				t.Errorf("%s: content = %q, want it split into chunks", file.Path, file.Content)
+			}
+			if fmt.Sprint(file.Chunks) != fmt.Sprint(want[file.Path]) {
+				t.Errorf("%s: chunks = %+v, want %+v", file.Path, file.Chunks, want[file.Path])
+			}
+		}
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var doc struct {
+			Files []outputFile `json:"files"`
+		}
+		if err := json.Unmarshal(render(t, types.OutputFormatJSON), &doc); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		check(t, doc.Files)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		decoder := yaml.NewDecoder(bytes.NewReader(render(t, types.OutputFormatYAML)))
+		var files []outputFile
+		for {
+			var file outputFile
+			if err := decoder.Decode(&file); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				t.Fatalf("Decode() error = %v", err)
+			}
+			files = append(files, file)
+		}
+		check(t, files)
+	})
+
+	t.Run("xml", func(t *testing.T) {
+		var doc struct {
+			Files []struct {
+				Path    string `xml:"path"`
+				Content string `xml:"content"`
+				Chunks  []struct {
+					StartLine  int    `xml:"start-line"`
+					EndLine    int    `xml:"end-line"`
+					TokenCount int    `xml:"token-count"`
+					Content    string `xml:"content"`
+				} `xml:"chunk"`
+			} `xml:"file"`
+		}
+		if err := xml.Unmarshal(render(t, types.OutputFormatXML), &doc); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+
+		var files []outputFile
+		for _, f := range doc.Files {
+			file := outputFile{Path: f.Path, Content: f.Content}
+			for _, c := range f.Chunks {
+				file.Chunks = append(file.Chunks, fileChunk{
+					StartLine:  c.StartLine,
+					EndLine:    c.EndLine,
+					TokenCount: c.TokenCount,
+					Content:    strings.TrimPrefix(strings.TrimSuffix(c.Content, "\n"), "\n"),
+				})
+			}
+			files = append(files, file)
+		}
+		check(t, files)
+	})
+}
+
+// flushTestContents returns n files spread over a few directories of root,
+// every third of them chunked.
+func flushTestContents(t testing.TB, root string, n int) []types.ProcessedContent {
+	t.Helper()
+	var contents []types.ProcessedContent
+	for i := 0; i < n; i++ {
+		path := filepath.Join(root, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%03d.go", i))
+		data := []byte(fmt.Sprintf("package dir%d\n\n// File %d ]]> ```\nfunc F%d() {}\n", i%4, i, i))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+
+		content := types.ProcessedContent{
+			Entry:      types.FileEntry{Path: path, Language: "go", Size: int64(len(data))},
+			Content:    data,
+			TokenCount: len(data) / 4,
+		}
+		if i%3 == 0 {
+			content.Chunks = []types.Chunk{
+				{Content: data[:14], StartLine: 1, EndLine: 2, TokenCount: 3},
+				{Content: data[14:], StartLine: 3, EndLine: 4, TokenCount: len(data)/4 - 3},
+			}
+		}
+		contents = append(contents, content)
+	}
+	return contents
+}
+
+func TestWriterIncrementalFlushMatchesBatch(t *testing.T) {
+	root := t.TempDir()
+	contents := flushTestContents(t, root, 40)
+
+	write := func(t *testing.T, opts types.WriterOptions) string {
+		t.Helper()
+		writer, err := New(opts)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if err := writer.WriteDirectoryContext(root, fileTree("dir0")); err != nil {
+			t.Fatalf("Failed to write directory context: %v", err)
+		}
+		for _, content := range contents {
+			if err := writer.Write(content); err != nil {
+				t.Fatalf("Failed to write content: %v", err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+		data, err := os.ReadFile(opts.OutputPath)
+		if err != nil {
+			t.Fatalf("Failed to read output file: %v", err)
+		}
+		return string(data)
+	}
+
+	formats := []types.OutputFormat{
+		types.OutputFormatXML, types.OutputFormatJSON, types.OutputFormatJSONL, types.OutputFormatYAML,
+		types.OutputFormatText, types.OutputFormatMarkdown,
+	}
+	for _, format := range formats {
+		for _, extras := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/extras=%v", format, extras), func(t *testing.T) {
+				dir := t.TempDir()
+				opts := types.WriterOptions{
+					Format:             format,
+					PrettyPrint:        extras,
+					ScopedTrees:        extras,
+					EmitChunks:         extras,
+					IncludeMetadata:    extras,
+					IncludeTokenCounts: extras,
+				}
+
+				opts.OutputPath = filepath.Join(dir, "batch")
+				want := write(t, opts)
+				for _, concurrency := range []int{1, 3, 64} {
+					opts.OutputPath, opts.FlushConcurrency = filepath.Join(dir, fmt.Sprint(concurrency)), concurrency
+					if got := write(t, opts); got != want {
+						t.Errorf("FlushConcurrency=%d output differs from batch:\ngot:\n%s\nwant:\n%s", concurrency, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFormatInOrder(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		var out bytes.Buffer
+		err := formatInOrder(&out, 20, 4, func(buf *bytes.Buffer, i int) error {
+			// Later items finish first
+			time.Sleep(time.Duration(20-i) * 100 * time.Microsecond)
+			fmt.Fprintf(buf, "%d,", i)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("formatInOrder() error = %v", err)
+		}
+		if want := "0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,"; out.String() != want {
+			t.Errorf("formatInOrder() wrote %q, want %q", out.String(), want)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var out bytes.Buffer
+		errBoom := errors.New("boom")
+		err := formatInOrder(&out, 100, 2, func(buf *bytes.Buffer, i int) error {
+			if i == 3 {
+				return errBoom
+			}
+			fmt.Fprintf(buf, "%d,", i)
+			return nil
+		})
+		if !errors.Is(err, errBoom) {
+			t.Fatalf("formatInOrder() error = %v, want %v", err, errBoom)
+		}
+		if want := "0,1,2,"; out.String() != want {
+			t.Errorf("formatInOrder() wrote %q, want %q", out.String(), want)
+		}
+	})
+}
+
+func BenchmarkWriterFlush(b *testing.B) {
+	contents := flushTestContents(b, b.TempDir(), 2000)
+	for _, concurrency := range []int{0, 1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			writer, err := New(types.WriterOptions{
+				OutputPath:       filepath.Join(b.TempDir(), "out.json"),
+				Format:           types.OutputFormatJSON,
+				PrettyPrint:      true,
+				FlushConcurrency: concurrency,
+			})
+			if err != nil {
+				b.Fatalf("Failed to create writer: %v", err)
+			}
+			for _, content := range contents {
+				if err := writer.Write(content); err != nil {
+					b.Fatalf("Failed to write content: %v", err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := writer.Flush(); err != nil {
+					b.Fatalf("Flush() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterJSONL(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "b.go"}, Content: []byte("package b\n\nfunc B() {}\n"), TokenCount: 6},
+		{Entry: types.FileEntry{Path: "a.go"}, Content: []byte("package a\n"), TokenCount: 3},
+	}
+
+	testCases := []struct {
+		name string
+		opts types.WriterOptions
+		want []string
+	}{
+		{
+			name: "files",
+			want: []string{
+				`{"type":"directory_context","cwd":"/work","tree":{"name":".","is_dir":true,"children":[{"name":"a.go","is_dir":false}]}}`,
+				`{"type":"file","path":"a.go","content":"package a\n"}`,
+				`{"type":"file","path":"b.go","content":"package b\n\nfunc B() {}\n"}`,
+			},
+		},
+		{
+			name: "chunks and token counts",
+			opts: types.WriterOptions{EmitChunks: true, IncludeTokenCounts: true, PrettyPrint: true},
+			want: []string{
+				`{"type":"directory_context","cwd":"/work","tree":{"name":".","is_dir":true,"children":[{"name":"a.go","is_dir":false}]}}`,
+				`{"type":"chunk","path":"a.go","start_line":1,"end_line":1,"token_count":3,"content":"package a"}`,
+				`{"type":"chunk","path":"b.go","start_line":1,"end_line":3,"token_count":6,"content":"package b\n\nfunc B() {}"}`,
+				`{"type":"summary","total_tokens":9}`,
+			},
+		},
+		{
+			name: "query",
+			opts: types.WriterOptions{Query: "func", QueryTopK: 1},
+			want: []string{
+				`{"type":"directory_context","cwd":"/work","tree":{"name":".","is_dir":true,"children":[{"name":"a.go","is_dir":false}]}}`,
+				`{"type":"chunk","path":"b.go","start_line":1,"end_line":3,"token_count":6,"content":"package b\n\nfunc B() {}","score":`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.OutputPath = filepath.Join(t.TempDir(), "out.jsonl")
+			opts.Format = types.OutputFormatJSONL
+			writer, err := New(opts)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := writer.WriteDirectoryContext("/work", fileTree("a.go")); err != nil {
+				t.Fatalf("Failed to write directory context: %v", err)
+			}
+			for _, content := range contents {
+				if err := writer.Write(content); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			data, err := os.ReadFile(opts.OutputPath)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(lines) != len(tc.want) {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(tc.want), data)
+			}
+			for i, line := range lines {
+				if !json.Valid([]byte(line)) {
+					t.Errorf("line %d is not valid JSON: %s", i+1, line)
+				}
+				if !strings.HasPrefix(line, tc.want[i]) {
+					t.Errorf("line %d = %s, want %s", i+1, line, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriterMetadataLabels(t *testing.T) {
+	contents := []types.ProcessedContent{
+		{Entry: types.FileEntry{Path: "api.pb.go", IsGenerated: true}, Content: []byte("package api\n")},
+		{Entry: types.FileEntry{Path: "BUILD.bazel", IsBuildFile: true}, Content: []byte("go_library()\n")},
+		{Entry: types.FileEntry{Path: "main.go"}, Content: []byte("package main\n")},
+	}
+
+	for format, want := range map[types.OutputFormat][]string{
+		types.OutputFormatXML: {
+			`chunked="false" build-file="true"/>`,
+			`chunked="false" generated="true"/>`,
+			`chunked="false"/>`,
+		},
+		types.OutputFormatJSON: {
+			`"chunked":false,"build_file":true}`,
+			`"chunked":false,"generated":true}`,
+			`"chunked":false}`,
+		},
+	} {
+		t.Run(string(format), func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "out")
+			writer, err := New(types.WriterOptions{OutputPath: tmpFile, Format: format, IncludeMetadata: true})
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			for _, content := range contents {
+				if err := writer.Write(content); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			data, err := os.ReadFile(tmpFile)
+			if err != nil {
+				t.Fatalf("Failed to read output file: %v", err)
+			}
+
+			// Files are written in path order
+			rest := string(data)
+			for _, s := range want {
+				i := strings.Index(rest, s)
+				if i < 0 {
+					t.Fatalf("output is missing %s in order:\n%s", s, data)
+				}
+				rest = rest[i+len(s):]
+			}
+		})
+	}
+}
+
+func TestWriterEncodeContent(t *testing.T) {
+	original := "package main\n\n// Quotes \" and ]]> and <tags> & tabs\t survive\nfunc main() {}\n"
+
+	decode := func(t *testing.T, encoding, content string) string {
+		t.Helper()
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			t.Fatalf("content is not base64: %v", err)
+		}
+		if encoding == string(types.ContentEncodingGzipBase64) {
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("content is not gzipped: %v", err)
+			}
+			if data, err = io.ReadAll(zr); err != nil {
+				t.Fatalf("Failed to gunzip content: %v", err)
+			}
+		}
+		return string(data)
+	}
+
+	for _, encoding := range []types.ContentEncoding{types.ContentEncodingBase64, types.ContentEncodingGzipBase64} {
+		for _, format := range []types.OutputFormat{types.OutputFormatJSON, types.OutputFormatXML} {
+			t.Run(fmt.Sprintf("%s %s", encoding, format), func(t *testing.T) {
+				outputPath := filepath.Join(t.TempDir(), "out")
+				writer, err := New(types.WriterOptions{OutputPath: outputPath, Format: format, EncodeContent: encoding})
+				if err != nil {
+					t.Fatalf("Failed to create writer: %v", err)
+				}
+				if err := writer.Write(types.ProcessedContent{
+					Entry:   types.FileEntry{Path: "main.go"},
+					Content: []byte(original),
+				}); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Close() error = %v", err)
+				}
+				data, err := os.ReadFile(outputPath)
+				if err != nil {
+					t.Fatalf("Failed to read output file: %v", err)
+				}
+
+				var gotEncoding, content string
+				if format == types.OutputFormatJSON {
+					var doc struct {
+						Files []struct {
+							Encoding string `json:"encoding"`
+							Content  string `json:"content"`
+						} `json:"files"`
+					}
+					if err := json.Unmarshal(data, &doc); err != nil || len(doc.Files) != 1 {
+						t.Fatalf("Failed to parse output: %v\n%s", err, data)
+					}
+					gotEncoding, content = doc.Files[0].Encoding, doc.Files[0].Content
+				} else {
+					var doc struct {
+						File struct {
+							Content struct {
+								Encoding string `xml:"encoding,attr"`
+								Text     string `xml:",chardata"`
+							} `xml:"content"`
+						} `xml:"file"`
+					}
+					if err := xml.Unmarshal(data, &doc); err != nil {
+						t.Fatalf("Failed to parse output: %v\n%s", err, data)
+					}
+					gotEncoding, content = doc.File.Content.Encoding, doc.File.Content.Text
+				}
+
+				if gotEncoding != string(encoding) {
+					t.Errorf("encoding = %q, want %q", gotEncoding, encoding)
+				}
+				if got := decode(t, gotEncoding, content); got != original {
+					t.Errorf("decoded content = %q, want %q", got, original)
+				}
+			})
+		}
+	}
+
+	// Formats meant to be read as they are reject encoding
+	if _, err := New(types.WriterOptions{
+		OutputPath:    filepath.Join(t.TempDir(), "out.md"),
+		Format:        types.OutputFormatMarkdown,
+		EncodeContent: types.ContentEncodingBase64,
+	}); err == nil {
+		t.Error("New() with markdown and base64 succeeded, want an error")
+	}
+}
+
+func TestSplitWriter(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"api/main.go":           "package main",
+		"api/handlers/users.go": "package handlers",
+		"web/index.ts":          "export {}",
+		"README.md":             "# repo",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "out.xml")
+	writer, err := NewSplit(types.WriterOptions{
+		OutputPath: outputPath,
+		Format:     types.OutputFormatXML,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := writer.WriteDirectoryContext(root, fileTree("whole.txt")); err != nil {
+		t.Fatalf("WriteDirectoryContext() error = %v", err)
+	}
+	for name, data := range files {
+		if err := writer.Write(types.ProcessedContent{
+			Entry:   types.FileEntry{Path: filepath.Join(root, name)},
+			Content: []byte(data),
+		}); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	tests := []struct {
+		output  string
+		cwd     string
+		files   []string
+		missing []string
+	}{
+		{"out.xml", root, []string{"README.md"}, []string{"main.go", "index.ts"}},
+		{"out.api.xml", filepath.Join(root, "api"), []string{"api/main.go", "api/handlers/users.go"}, []string{"README.md", "index.ts"}},
+		{"out.web.xml", filepath.Join(root, "web"), []string{"web/index.ts"}, []string{"README.md", "main.go"}},
+	}
+	var want []string
+	for _, tt := range tests {
+		path := filepath.Join(outDir, tt.output)
+		want = append(want, path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", tt.output, err)
+		}
+		out := string(data)
+		if !strings.Contains(out, "<cwd>"+tt.cwd+"</cwd>") {
+			t.Errorf("%s: want the directory context scoped to %s:\n%s", tt.output, tt.cwd, out)
+		}
+		for _, name := range tt.files {
+			if !strings.Contains(out, "<path>"+filepath.Join(root, name)+"</path>") {
+				t.Errorf("%s: missing %s", tt.output, name)
+			}
+		}
+		for _, name := range tt.missing {
+			if strings.Contains(out, name) {
+				t.Errorf("%s: unexpectedly contains %s", tt.output, name)
+			}
+		}
+	}
+	// Scoped trees only list their own directory
+	if data, _ := os.ReadFile(filepath.Join(outDir, "out.api.xml")); !strings.Contains(string(data), "users.go") || strings.Contains(string(data), "whole.txt") {
+		t.Errorf("out.api.xml: want the tree of api:\n%s", data)
+	}
+	// Outputs lists the root's output first, as "." sorts before names
+	if got := writer.Outputs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Outputs() = %v, want %v", got, want)
+	}
+}
+
+func TestNewSplitStartsNoAutoFlush(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for range 10 {
+		if _, err := NewSplit(types.WriterOptions{
+			OutputPath:        filepath.Join(t.TempDir(), "out.xml"),
+			Format:            types.OutputFormatXML,
+			AutoFlushInterval: time.Hour,
+		}); err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+	}
+	// Each output starts its own auto-flush once it is written to
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("NewSplit left %d goroutines running", after-before)
+	}
+}
+
+func TestSplitWriterVirtualFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "api"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "api", "main.go"), []byte("package main"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relative paths are resolved against the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "out.xml")
+	writer, err := NewSplit(types.WriterOptions{
+		OutputPath: outputPath,
+		Format:     types.OutputFormatXML,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, path := range []string{"api/main.go", "$ go doc ./...", "docs/generated.txt"} {
+		if err := writer.Write(types.ProcessedContent{
+			Entry:   types.FileEntry{Path: path},
+			Content: []byte("content of " + path),
+		}); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := []string{outputPath, filepath.Join(outDir, "out.api.xml")}
+	if got := writer.Outputs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Outputs() = %v, want %v", got, want)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	for _, path := range []string{"$ go doc ./...", "docs/generated.txt"} {
+		if !strings.Contains(string(data), "<path>"+path+"</path>") {
+			t.Errorf("out.xml: missing virtual file %s:\n%s", path, data)
+		}
 	}
 }
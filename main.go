@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	iofs "io/fs"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/lc/pfzf/internal/fs"
 
 	"github.com/lc/pfzf/internal/app"
+	"github.com/lc/pfzf/internal/command"
 	"github.com/lc/pfzf/internal/config"
+	"github.com/lc/pfzf/internal/ignore"
 	"github.com/lc/pfzf/internal/processor"
 	"github.com/lc/pfzf/internal/scanner"
 	"github.com/lc/pfzf/internal/writer"
@@ -18,18 +28,77 @@ import (
 )
 
 var (
-	configPath = flag.String("config", "", "path to config file (default: $XDG_CONFIG_HOME/pfzf/config.json)")
-	outputPath = flag.String("output", "", "path to output file (default: pfzf_*.xml)")
-	format     = flag.String("format", "xml", "output format: xml, json, yaml (default: xml)")
+	configPath   = flag.String("config", "", "path to config file (default: $XDG_CONFIG_HOME/pfzf/config.json)")
+	outputPath   = flag.String("output", "", "path to output file (default: pfzf_*.xml)")
+	format       = flag.String("format", "xml", "output format: xml, json, jsonl, yaml, text, markdown, csv, template (default: xml)")
+	query        = flag.String("query", "", "output the chunks of all selected files ordered by relevance to this query")
+	topK         = flag.Int("top-k", 0, "with -query, only output the K most relevant chunks (default: all)")
+	logJSON      = flag.String("log-json", "", "write structured logs as JSON lines to this file")
+	templatePath = flag.String("template", "", "render the output with this text/template file (implies -format template)")
+	resume       = flag.Bool("resume", false, "resume an interrupted scan from its checkpoint, skipping files it already listed")
+	split        = flag.Bool("split", false, "write one output file per top-level directory, such as out.api.xml")
+	noRestore    = flag.Bool("no-restore", false, "don't save the selection on quit or offer to restore the last one")
+	batch        = flag.Bool("batch", false, "write every scanned file, or those matching -include, without the UI")
+	list         = flag.Bool("list", false, "print the files -batch would write with their sizes and tokens, and exit without writing")
+	stats        = flag.String("stats", "", "print the totals, languages and largest files -batch would write as a table or json, and exit without writing")
+	filesFrom    = flag.String("files", "", "scan only the paths listed one per line in this file, or read from stdin with -")
+	showVersion  = flag.Bool("version", false, "print the version, commit and build date, and exit")
+	commands     listFlag
+	includes     listFlag
 )
 
+func init() {
+	flag.Var(&commands, "command", "include the output of this shell command as a virtual file (repeatable)")
+	flag.Var(&includes, "include", "with -batch, -list or -stats, only include files matching this glob, such as 'src/**/*.go' (repeatable)")
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func validateFlags() error {
 	if *format != "" {
 		switch strings.ToLower(*format) {
-		case "xml", "json", "yaml":
+		case "xml", "json", "jsonl", "yaml", "text", "markdown", "csv":
 			// Valid format
+		case "template":
+			if *templatePath == "" {
+				return fmt.Errorf("format template requires -template")
+			}
 		default:
-			return fmt.Errorf("invalid format: %s (must be xml, json, or yaml)", *format)
+			return fmt.Errorf("invalid format: %s (must be xml, json, jsonl, yaml, text, markdown, csv, or template)", *format)
+		}
+	}
+	if *topK < 0 {
+		return fmt.Errorf("invalid top-k: %d (must be non-negative)", *topK)
+	}
+	if *filesFrom != "" && *resume {
+		return fmt.Errorf("-files and -resume can't be combined")
+	}
+	if *batch && *list {
+		return fmt.Errorf("-batch and -list can't be combined")
+	}
+	switch *stats {
+	case "":
+	case "table", "json":
+		if *batch || *list {
+			return fmt.Errorf("-stats can't be combined with -batch or -list")
+		}
+	default:
+		return fmt.Errorf("invalid stats format: %s (must be table or json)", *stats)
+	}
+	if len(includes) > 0 && !*batch && !*list && *stats == "" {
+		return fmt.Errorf("-include requires -batch, -list or -stats")
+	}
+	for _, glob := range includes {
+		if err := ignore.Validate(glob); err != nil {
+			return fmt.Errorf("invalid include glob %q: %w", glob, err)
 		}
 	}
 	return nil
@@ -38,6 +107,11 @@ func validateFlags() error {
 func main() {
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
 	if err := validateFlags(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		flag.Usage()
@@ -45,37 +119,108 @@ func main() {
 	}
 
 	// Load configuration
-	cfg, err := loadConfig(*configPath)
+	cfg, cfgPath, err := loadConfig(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Override config with command line flags if provided
+	// Environment variables override the file, and flags override both
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		fmt.Fprintf(os.Stderr, "Error in environment: %v\n", err)
+		os.Exit(1)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
 	if *outputPath != "" {
 		cfg.Writer.OutputPath = *outputPath
 	}
-	if *format != "" {
+	// -format has a default, so only an explicit one overrides the config
+	if set["format"] {
 		cfg.Writer.Format = types.OutputFormat(strings.ToLower(*format))
 	}
+	if *split {
+		cfg.Writer.SplitByTopDir = true
+	}
+	if *templatePath != "" {
+		cfg.Writer.Format = types.OutputFormatTemplate
+		cfg.Writer.TemplatePath = *templatePath
+	}
+	for _, cmd := range commands {
+		cfg.Commands = append(cfg.Commands, config.CommandConfig{Command: cmd})
+	}
+	// Check the settings again now that the environment and flags are merged in
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger, closeLog, err := newLogger(*logJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening log file: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeLog()
+
+	// The noise of the languages used here is ignored everywhere the
+	// patterns are, in the file list and in the directory tree alike
+	if cfg.Scanner.LanguageIgnores {
+		patterns, languages := scanner.LanguageIgnorePatterns(".")
+		cfg.Scanner.IgnorePatterns = append(cfg.Scanner.IgnorePatterns, patterns...)
+		logger.Info("ignoring language noise", "languages", languages, "patterns", patterns)
+	}
 
 	// Initialize scanner
-	s, err := scanner.New(
+	scanOpts := []scanner.Option{
 		scanner.WithRootDir("."),
+		scanner.WithLogger(logger),
 		scanner.WithMaxFileSize(cfg.Scanner.MaxFileSize),
+		scanner.WithMinFileSize(cfg.Scanner.MinFileSize),
 		scanner.WithIgnorePattern(cfg.Scanner.IgnorePatterns...),
 		scanner.WithMaxFiles(cfg.Scanner.MaxFiles),
-	)
+		scanner.WithIncludeHidden(cfg.Scanner.IncludeHidden),
+		scanner.WithIncludeGenerated(cfg.Scanner.IncludeGenerated),
+		scanner.WithMaxInvalidUTF8(cfg.Scanner.MaxInvalidUTF8),
+		scanner.WithBinarySampleSize(cfg.Scanner.BinarySampleSize),
+		scanner.WithBinaryThreshold(cfg.Scanner.BinaryThreshold),
+		scanner.WithExcludeContentTypes(cfg.Scanner.ExcludeContentTypes...),
+		scanner.WithTimeout(cfg.Scanner.ScanTimeout()),
+	}
+	if *resume {
+		scanOpts = append(scanOpts, scanner.WithCheckpoint(scanner.CheckpointFile))
+	}
+	if *filesFrom != "" {
+		paths, err := readFileList(*filesFrom)
+		if err != nil {
+			log.Fatalf("failed to read the file list: %v", err)
+		}
+		scanOpts = append(scanOpts, scanner.WithFiles(paths...))
+	}
+	s, err := scanner.New(scanOpts...)
 	if err != nil {
 		log.Fatalf("failed to create scanner: %v", err)
 	}
 
 	// Initialize processor with converted options
 	procOpts := types.ProcessorOptions{
-		MaxChunkSize:  cfg.Processor.MaxChunkSize,
-		ChunkOverlap:  cfg.Processor.ChunkOverlap,
-		MaxTokens:     cfg.Processor.MaxTokens,
-		StripComments: cfg.Processor.StripComments,
+		MaxChunkSize:        cfg.Processor.MaxChunkSize,
+		ChunkOverlap:        cfg.Processor.ChunkOverlap,
+		MaxTokens:           cfg.Processor.MaxTokens,
+		StripComments:       cfg.Processor.StripComments,
+		StripDocstrings:     cfg.Processor.StripDocstrings,
+		Tokenizer:           cfg.Processor.Tokenizer,
+		TokenizerVocab:      cfg.Processor.TokenizerVocab,
+		SemanticChunks:      cfg.Processor.SemanticChunks,
+		StripBlankLines:     cfg.Processor.StripBlankLines,
+		CollapseWhitespace:  cfg.Processor.CollapseWhitespace,
+		Dedent:              cfg.Processor.Dedent,
+		RedactSecrets:       cfg.Processor.RedactSecrets,
+		RedactRules:         cfg.Processor.RedactRules,
+		PreserveLineEndings: cfg.Processor.PreserveLineEndings,
+		CacheSize:           cfg.Processor.CacheSize,
+		AllowSensitive:      cfg.Processor.AllowSensitive,
+		Logger:              logger,
 	}
 
 	proc, err := processor.New(procOpts)
@@ -83,26 +228,72 @@ func main() {
 		log.Fatalf("failed to create processor: %v", err)
 	}
 
+	if *list {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := runList(ctx, s, proc, os.Stdout, os.Stderr, includes, logger); err != nil {
+			log.Fatalf("listing files: %v", err)
+		}
+		return
+	}
+	if *stats != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := runStats(ctx, s, proc, os.Stdout, *stats == "json", includes, logger); err != nil {
+			log.Fatalf("summarizing files: %v", err)
+		}
+		return
+	}
+
 	// Initialize writer with converted options
 	writerOpts := types.WriterOptions{
-		OutputPath:  cfg.Writer.OutputPath,
-		Format:      cfg.Writer.Format,
-		PrettyPrint: cfg.Writer.PrettyPrint,
+		OutputPath:           cfg.Writer.OutputPath,
+		Format:               cfg.Writer.Format,
+		PrettyPrint:          cfg.Writer.PrettyPrint,
+		LanguageTokenBudgets: cfg.Writer.LanguageTokenBudgets,
+		ScopedTrees:          cfg.Writer.ScopedTrees,
+		TreeIgnorePatterns:   cfg.Scanner.IgnorePatterns,
+		TreeIncludeHidden:    cfg.Scanner.IncludeHidden,
+		TreeMaxDepth:         cfg.Writer.TreeMaxDepth,
+		TreeShowSizes:        cfg.Writer.TreeShowSizes,
+		Query:                *query,
+		QueryTopK:            *topK,
+		IncludeRepoInfo:      cfg.Writer.IncludeRepoInfo,
+		TemplatePath:         cfg.Writer.TemplatePath,
+		EmitChunks:           cfg.Writer.EmitChunks,
+		IncludeMetadata:      cfg.Writer.IncludeMetadata,
+		IncludeTokenCounts:   cfg.Writer.IncludeTokenCounts,
+		Stream:               cfg.Writer.Stream,
+		FlushConcurrency:     cfg.Writer.FlushConcurrency,
+		AutoFlushInterval:    cfg.Writer.AutoFlushEvery(),
+		AutoFlushChanges:     cfg.Writer.AutoFlushChanges,
+		EncodeContent:        cfg.Writer.EncodeContent,
+		Logger:               logger,
 	}
 
-	w, err := writer.New(writerOpts)
+	var w types.Writer
+	if cfg.Writer.SplitByTopDir {
+		w, err = writer.NewSplit(writerOpts)
+	} else {
+		w, err = writer.New(writerOpts)
+	}
 	if err != nil {
 		log.Fatalf("failed to create writer: %v", err)
 	}
 	defer w.Close()
 
-	// Write directory context before starting UI
+	// Write directory context before any files
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("failed to get the current directory: %v", err)
 	}
 
-	tree, err := fs.GetDirectoryTree(".", fs.TreeOptions{IgnorePatterns: cfg.Scanner.IgnorePatterns})
+	tree, err := fs.GetDirectoryTreeNodes(".", fs.TreeOptions{
+		IgnorePatterns: cfg.Scanner.IgnorePatterns,
+		IncludeHidden:  cfg.Scanner.IncludeHidden,
+		MaxDepth:       cfg.Writer.TreeMaxDepth,
+		ShowSizes:      cfg.Writer.TreeShowSizes,
+	})
 	if err != nil {
 		log.Fatalf("failed to generate directory tree: %v", err)
 	}
@@ -111,30 +302,156 @@ func main() {
 		log.Fatalf("failed to write directory context: %v\n", err)
 	}
 
+	if err := writeCommands(cfg.Commands, proc, w, logger); err != nil {
+		log.Fatalf("failed to include command output: %v", err)
+	}
+
+	if *batch {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		n, err := runBatch(ctx, s, proc, w, includes, logger)
+		if flushErr := w.Flush(); flushErr != nil {
+			log.Fatalf("failed to write output: %v", flushErr)
+		}
+		if err != nil {
+			// Close writes what was processed before exiting with an error
+			w.Close()
+			log.Fatalf("batch failed after writing %d files: %v", n, err)
+		}
+		printOutputs(w, cfg.Writer.OutputPath)
+		return
+	}
+
 	// Create and run application
+	var sessionPath string
+	if cfg.UI.RestoreSelection && !*noRestore {
+		if sessionPath, err = app.SessionFile(cwd); err != nil {
+			logger.Warn("not saving the selection", "error", err)
+		}
+	}
+
 	app := app.New(cfg, s, proc, w)
+	if sessionPath != "" {
+		app.EnableSession(sessionPath)
+	}
+	app.SetConfigPath(cfgPath)
 	if err := app.Run(); err != nil {
 		log.Fatalf("failed to run: %v\n", err)
 	}
+	if app.Discarded() {
+		fmt.Println("output discarded")
+		return
+	}
 
-	fmt.Printf("context written to %s\n", cfg.Writer.OutputPath)
+	printOutputs(w, cfg.Writer.OutputPath)
 }
 
-// loadConfig loads the configuration from the specified path or uses defaults
-func loadConfig(path string) (*config.Config, error) {
+// printOutputs reports the files w wrote to, outputPath unless the output
+// was split.
+func printOutputs(w types.Writer, outputPath string) {
+	if split, ok := w.(*writer.SplitWriter); ok {
+		fmt.Printf("context written to %s\n", strings.Join(split.Outputs(), ", "))
+		return
+	}
+	fmt.Printf("context written to %s\n", outputPath)
+}
+
+// loadConfig loads the configuration from the specified path, or from the
+// nearest project-local config when path is empty, or uses defaults. It
+// also returns the path of the config file, or "" when none was found.
+func loadConfig(path string) (*config.Config, string, error) {
 	if path == "" {
-		// Use default config if no config file exists
-		return config.DefaultConfig(), nil
+		discovered, err := config.Discover(".")
+		if errors.Is(err, iofs.ErrNotExist) {
+			// Use default config if no config file exists
+			return config.DefaultConfig(), "", nil
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("finding project config: %w", err)
+		}
+		path = discovered
 	}
 
 	cfg, err := config.LoadConfig(path)
 	if err != nil {
 		// If config file doesn't exist, use defaults
 		if os.IsNotExist(err) {
-			return config.DefaultConfig(), nil
+			return config.DefaultConfig(), path, nil
+		}
+		return nil, "", fmt.Errorf("loading config from %s: %w", path, err)
+	}
+
+	return cfg, path, nil
+}
+
+// readFileList reads the paths listed one per line in the file at path, or
+// in stdin when path is "-", as output by git diff --name-only, fd or rg -l.
+// Blank lines and comments, lines starting with #, are skipped.
+func readFileList(path string) ([]string, error) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("loading config from %s: %w", path, err)
+		defer f.Close()
+		r = f
 	}
 
-	return cfg, nil
+	var paths []string
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		if line := strings.TrimSpace(lines.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	return paths, lines.Err()
+}
+
+// writeCommands runs each command and writes its output to w as a virtual
+// file. A failing command doesn't stop pfzf: the failure is logged and shows
+// in the file.
+func writeCommands(cmds []config.CommandConfig, proc *processor.Processor, w types.Writer, logger *slog.Logger) error {
+	for _, c := range cmds {
+		spec := command.Spec{Path: c.Path, Command: c.Command}
+		if spec.Path == "" {
+			spec.Path = "$ " + c.Command
+		}
+		if c.Timeout != "" {
+			d, err := time.ParseDuration(c.Timeout)
+			if err != nil {
+				return fmt.Errorf("invalid timeout for %q: %w", c.Command, err)
+			}
+			spec.Timeout = d
+		}
+
+		out, err := command.Run(context.Background(), spec)
+		if err != nil {
+			logger.Warn("command failed", "command", c.Command, "error", err)
+		}
+
+		entry := types.FileEntry{Path: spec.Path, Size: int64(len(out)), ModTime: time.Now(), Language: "text"}
+		processed, err := proc.ProcessData(context.Background(), entry, out)
+		if err != nil {
+			return fmt.Errorf("processing output of %q: %w", c.Command, err)
+		}
+		if err := w.Write(processed); err != nil {
+			return fmt.Errorf("writing output of %q: %w", c.Command, err)
+		}
+	}
+	return nil
+}
+
+// newLogger returns a logger writing JSON lines to path, or one that discards
+// everything when path is empty. The returned func closes the log file.
+func newLogger(path string) (*slog.Logger, func(), error) {
+	if path == "" {
+		return slog.New(slog.NewTextHandler(io.Discard, nil)), func() {}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return slog.New(slog.NewJSONHandler(f, nil)), func() { f.Close() }, nil
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lc/pfzf/internal/processor"
+	"github.com/lc/pfzf/internal/scanner"
+	"github.com/lc/pfzf/internal/writer"
+	"github.com/lc/pfzf/pkg/types"
+)
+
+// writeTree creates files, keyed by their slash-separated path, in a new
+// temporary directory and makes it the working directory for the rest of
+// the test, as pfzf scans the directory it runs in.
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get the working directory: %v", err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return root
+}
+
+func newTestScanner(t *testing.T, opts ...scanner.Option) *scanner.Scanner {
+	t.Helper()
+	s, err := scanner.New(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create scanner: %v", err)
+	}
+	return s
+}
+
+func newTestProcessor(t *testing.T) *processor.Processor {
+	t.Helper()
+	proc, err := processor.New(types.ProcessorOptions{MaxChunkSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to create processor: %v", err)
+	}
+	return proc
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestRunBatch(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"main.go":       "package main\n\nfunc main() {}\n",
+		"lib/util.go":   "package lib\n",
+		"docs/guide.md": "# Guide\n",
+		"logo.png":      "\x89PNG\r\n\x1a\n\x00\x00\x00\x00",
+		".env":          "TOKEN=secret\n",
+	})
+
+	outputPath := filepath.Join(t.TempDir(), "out.xml")
+	w, err := writer.New(types.WriterOptions{OutputPath: outputPath, Format: types.OutputFormatXML})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	s := newTestScanner(t, scanner.WithRootDir(root), scanner.WithIncludeHidden(true))
+	n, err := runBatch(context.Background(), s, newTestProcessor(t), w, nil, discardLogger)
+	if err != nil {
+		t.Fatalf("runBatch() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("runBatch() wrote %d files, want 3", n)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	out := string(data)
+	for _, name := range []string{"main.go", "lib/util.go", "docs/guide.md"} {
+		if !strings.Contains(out, filepath.FromSlash(name)+"</path>") {
+			t.Errorf("output is missing %s:\n%s", name, out)
+		}
+	}
+	// Binary files are ruled out by the processor, and files that may hold
+	// secrets are skipped
+	for _, name := range []string{"logo.png", ".env"} {
+		if strings.Contains(out, name) {
+			t.Errorf("output contains %s:\n%s", name, out)
+		}
+	}
+}
+
+func TestRunList(t *testing.T) {
+	writeTree(t, map[string]string{
+		"main.go":              "package main\n",
+		"lib/util.go":          "package lib\n\nfunc Util() {}\n",
+		"lib/util_test.go":     "package lib\n",
+		"vendor/dep/dep.go":    "package dep\n",
+		"docs/guide.md":        "# Guide\n",
+		"testdata/fixture.bin": "\x00\x01\x02\x03",
+	})
+
+	s := newTestScanner(t, scanner.WithIgnorePattern("vendor/**", "**/*_test.go"))
+	var out, summary strings.Builder
+	if err := runList(context.Background(), s, newTestProcessor(t), &out, &summary, []string{"**/*.go"}, discardLogger); err != nil {
+		t.Fatalf("runList() error = %v", err)
+	}
+
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			t.Fatalf("line %q has %d fields, want path, size and tokens", line, len(fields))
+		}
+		paths = append(paths, filepath.ToSlash(fields[0]))
+	}
+	sort.Strings(paths)
+	if want := []string{"lib/util.go", "main.go"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("listed %v, want %v", paths, want)
+	}
+	if !strings.Contains(out.String(), "main.go\t13\t") {
+		t.Errorf("output = %q, want main.go listed with its 13 bytes", out.String())
+	}
+	if got := summary.String(); !strings.HasPrefix(got, "2 files, ") {
+		t.Errorf("summary = %q, want 2 files", got)
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	writeTree(t, map[string]string{
+		"main.go":     "package main\n",
+		"lib/util.go": "package lib\n",
+		"changed.txt": "main.go\n\n# files changed on this branch\n  lib/util.go  \n   \nmissing.go\n",
+	})
+
+	paths, err := readFileList("changed.txt")
+	if err != nil {
+		t.Fatalf("readFileList() error = %v", err)
+	}
+	if want := []string{"main.go", "lib/util.go", "missing.go"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("readFileList() = %q, want %q", paths, want)
+	}
+
+	if _, err := readFileList("no-such-list.txt"); !os.IsNotExist(err) {
+		t.Errorf("readFileList() of a missing list error = %v, want it not to exist", err)
+	}
+
+	// Listed files that don't exist are skipped with a warning
+	s := newTestScanner(t, scanner.WithRootDir("."), scanner.WithFiles(paths...))
+	var out, summary strings.Builder
+	if err := runList(context.Background(), s, newTestProcessor(t), &out, &summary, nil, discardLogger); err != nil {
+		t.Fatalf("runList() error = %v", err)
+	}
+	if got := summary.String(); !strings.HasPrefix(got, "2 files, ") {
+		t.Errorf("summary = %q, want the 2 files that exist", got)
+	}
+	if strings.Contains(out.String(), "missing.go") {
+		t.Errorf("output = %q, want missing.go skipped", out.String())
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	files := map[string]string{
+		"main.go":       "package main\n",
+		"lib/util.go":   "package lib\n\nfunc Util() {}\n",
+		"docs/guide.md": "# Guide\n\nRead the code.\n",
+		"empty.txt":     "",
+	}
+	writeTree(t, files)
+
+	var out strings.Builder
+	if err := runStats(context.Background(), newTestScanner(t), newTestProcessor(t), &out, true, nil, discardLogger); err != nil {
+		t.Fatalf("runStats() error = %v", err)
+	}
+	var stats processor.Stats
+	if err := json.Unmarshal([]byte(out.String()), &stats); err != nil {
+		t.Fatalf("Failed to decode the stats: %v\n%s", err, out.String())
+	}
+
+	var bytes int64
+	for _, data := range files {
+		bytes += int64(len(data))
+	}
+	if stats.Files != 3 || stats.Bytes != bytes || stats.Skipped != 1 {
+		t.Errorf("stats = %d files, %d bytes, %d skipped, want 3 files, %d bytes, 1 skipped", stats.Files, stats.Bytes, stats.Skipped, bytes)
+	}
+	if stats.Tokens <= 0 {
+		t.Errorf("stats.Tokens = %d, want a positive count", stats.Tokens)
+	}
+
+	languages := make(map[string]processor.LanguageStats)
+	tokens := 0
+	for _, lang := range stats.Languages {
+		languages[lang.Language] = lang
+		tokens += lang.Tokens
+	}
+	if got := languages["go"]; got.Files != 2 || got.Bytes != 41 {
+		t.Errorf("go stats = %+v, want 2 files, 41 bytes", got)
+	}
+	if got := languages["markdown"]; got.Files != 1 {
+		t.Errorf("markdown stats = %+v, want 1 file", got)
+	}
+	if tokens != stats.Tokens {
+		t.Errorf("languages add up to %d tokens, want %d", tokens, stats.Tokens)
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+
+	platform := fmt.Sprintf("%s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	tests := []struct {
+		name                  string
+		version, commit, date string
+		want                  string
+	}{
+		{
+			name:    "release build",
+			version: "v1.2.3",
+			commit:  "0123456789abcdef0123456789abcdef01234567",
+			date:    "2026-01-02T03:04:05Z",
+			want:    "pfzf v1.2.3 (commit 0123456789ab, built 2026-01-02T03:04:05Z, " + platform + ")",
+		},
+		{
+			name: "unset",
+			want: "pfzf (devel) (commit unknown, built unknown, " + platform + ")",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, commit, date = tt.version, tt.commit, tt.date
+			if got := versionString(); got != tt.want {
+				t.Errorf("versionString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@
 package types
 
 import (
+	"context"
 	"io"
+	"log/slog"
 	"time"
 )
 
@@ -13,14 +15,22 @@ type FileEntry struct {
 	ModTime    time.Time
 	IsSelected bool
 	IsBinary   bool
-	Language   string
+	// IsGenerated marks files a tool generated, such as protobuf stubs
+	IsGenerated bool
+	// IsBuildFile marks Bazel and Buck build files
+	IsBuildFile bool
+	Language    string
 }
 
 // ProcessedContent represents processed file content ready for output.
 type ProcessedContent struct {
-	Entry   FileEntry
-	Content []byte
-	Chunks  []Chunk
+	Entry      FileEntry
+	Content    []byte
+	Chunks     []Chunk
+	TokenCount int
+	// SavedTokens is how many tokens stripping comments and whitespace
+	// removed from the content
+	SavedTokens int
 }
 
 // Chunk represents a segment of file content.
@@ -46,7 +56,35 @@ type ScanOptions struct {
 	RootDir       string
 	IgnorePattern []string
 	MaxFileSize   int64
-	MaxFiles      int
+	// MinFileSize skips files smaller than it; zero means no minimum
+	MinFileSize int64
+	MaxFiles    int
+	// IncludeHidden scans dotfiles and dot-directories. Scanners take it from
+	// their constructor options; Scan does not override it.
+	IncludeHidden bool
+	// IncludeGenerated scans generated files and build files instead of
+	// skipping them. Like IncludeHidden, it comes from the constructor.
+	IncludeGenerated bool
+	// ExcludeContentTypes skips files whose content, judged by its magic
+	// bytes, has one of these media types, such as "image/*" or
+	// "application/zip"
+	ExcludeContentTypes []string
+	// MaxInvalidUTF8 is how many invalid UTF-8 sequences the start of a file
+	// may contain and still be classified as text
+	MaxInvalidUTF8 int
+	// BinarySampleSize is how many bytes of a file's start are judged when
+	// classifying it as binary; zero keeps the scanner's default
+	BinarySampleSize int
+	// BinaryThreshold is the share of non-printable characters in that
+	// sample, between 0 and 1, above which a file is binary; zero keeps the
+	// scanner's default
+	BinaryThreshold float64
+	// ResultBuffer lets the scan run this many entries ahead of a slow
+	// consumer; zero hands each entry over directly
+	ResultBuffer int
+	// Timeout stops the scan once it has run this long, keeping the entries
+	// already found; zero means no limit
+	Timeout time.Duration
 }
 
 // Processor defines the interface for content processing operations.
@@ -54,16 +92,80 @@ type Processor interface {
 	// Process processes a file entry and returns the processed content.
 	Process(entry FileEntry) (ProcessedContent, error)
 
+	// ProcessContext is like Process but stops early once ctx is cancelled.
+	ProcessContext(ctx context.Context, entry FileEntry) (ProcessedContent, error)
+
 	// ShouldProcess determines if a file should be processed based on its metadata.
 	ShouldProcess(entry FileEntry) bool
 }
 
 // ProcessorOptions configures the processing behavior.
 type ProcessorOptions struct {
-	MaxChunkSize  int64
-	ChunkOverlap  int
-	MaxTokens     int
-	StripComments bool
+	MaxChunkSize    int64
+	ChunkOverlap    int
+	MaxTokens       int
+	StripComments   bool
+	StripDocstrings bool
+	// Tokenizer selects how tokens are counted; empty means heuristic
+	Tokenizer TokenizerType
+	// TokenizerVocab is the tiktoken vocabulary file for BPE tokenizers
+	TokenizerVocab string
+	// SemanticChunks breaks chunks at top-level declarations
+	SemanticChunks bool
+	// StripBlankLines removes blank lines after the other transforms,
+	// except inside multi-line string literals
+	StripBlankLines bool
+	// CollapseWhitespace collapses runs of blank lines to one and removes
+	// trailing whitespace, except inside multi-line string literals
+	CollapseWhitespace bool
+	// Dedent removes the indentation common to every line along with
+	// CollapseWhitespace
+	Dedent bool
+	// RedactSecrets replaces secrets such as API keys and private keys
+	// with [REDACTED] before the content reaches the writer
+	RedactSecrets bool
+	// RedactRules are applied by RedactSecrets after the built-in rules
+	RedactRules []RedactRule
+	// PreserveLineEndings writes files that mostly use CRLF line endings
+	// with CRLF endings; otherwise every line ending is written as LF
+	PreserveLineEndings bool
+	// CacheSize is how many bytes of processed content are kept so files
+	// that haven't changed aren't processed again; 0 disables the cache
+	CacheSize int64
+	// AllowSensitive includes files that commonly hold secrets, such as
+	// .env files and private keys, which are refused otherwise
+	AllowSensitive bool
+	// Logger receives processing results and errors; nil discards them
+	Logger *slog.Logger
+}
+
+// TokenizerType represents the supported token counting methods.
+type TokenizerType string
+
+const (
+	// TokenizerHeuristic estimates tokens from the byte length.
+	TokenizerHeuristic TokenizerType = "heuristic"
+	// TokenizerCL100K counts tokens with OpenAI's cl100k_base encoding.
+	TokenizerCL100K TokenizerType = "cl100k"
+)
+
+// RedactRule is a custom rule for finding secrets to redact. If Pattern
+// has a capture group, only the text it captures is redacted; otherwise
+// the whole match is.
+type RedactRule struct {
+	Name    string `json:"name" yaml:"name"`
+	Pattern string `json:"pattern" yaml:"pattern"`
+}
+
+// TreeNode is an entry of a directory tree: a file, or a directory and the
+// entries listed in it.
+type TreeNode struct {
+	Name  string `json:"name" yaml:"name"`
+	IsDir bool   `json:"is_dir" yaml:"is_dir"`
+	// Size is a file's size, or the total size of the files below a
+	// directory; it is only set when the tree shows sizes
+	Size     int64       `json:"size,omitempty" yaml:"size,omitempty"`
+	Children []*TreeNode `json:"children,omitempty" yaml:"children,omitempty"`
 }
 
 // Writer defines the interface for output writing operations.
@@ -72,15 +174,23 @@ type Writer interface {
 	Write(content ProcessedContent) error
 
 	// WriteDirectoryContext writes the directory context information.
-	WriteDirectoryContext(cwd string, tree string) error
+	WriteDirectoryContext(cwd string, tree *TreeNode) error
 
 	// Flush flushes any buffered data to the output.
 	Flush() error
 
+	// Preview renders the output for the buffered data into dst without
+	// writing it to the output destination.
+	Preview(dst io.Writer) error
+
 	// Remove removes the file at the specified path.
 	Remove(path string)
 	// Close finalizes the output and closes any open resources.
 	Close() error
+
+	// Discard drops the buffered data and removes any output written so
+	// far, leaving nothing for Flush or Close to write.
+	Discard() error
 }
 
 // WriterOptions configures the output writing behavior.
@@ -88,6 +198,61 @@ type WriterOptions struct {
 	OutputPath  string
 	Format      OutputFormat
 	PrettyPrint bool
+	// LanguageTokenBudgets caps the tokens written per language
+	LanguageTokenBudgets map[string]int
+	// ScopedTrees adds a one-level tree of each directory with selected
+	// files next to the first of those files
+	ScopedTrees bool
+	// TreeIgnorePatterns hides entries from scoped trees
+	TreeIgnorePatterns []string
+	// TreeIncludeHidden lists dotfiles in scoped trees
+	TreeIncludeHidden bool
+	// TreeMaxDepth limits the levels of the directory trees the writer
+	// generates itself, such as those of split outputs; zero means no limit
+	TreeMaxDepth int
+	// TreeShowSizes annotates the entries of those trees with their sizes
+	TreeShowSizes bool
+	// Query replaces the per-file output with the chunks of all files
+	// ordered by relevance to it
+	Query string
+	// QueryTopK limits the ranked chunks; zero keeps all of them
+	QueryTopK int
+	// IncludeRepoInfo adds the git repository name and branch to the
+	// directory context
+	IncludeRepoInfo bool
+	// EmitChunks writes each chunk of a file as its own record with its line
+	// range and token count; unchunked files get a single chunk
+	EmitChunks bool
+	// TemplatePath is the text/template file rendered by the template format
+	TemplatePath string
+	// IncludeMetadata adds each file's size, modification time, language
+	// and whether it was chunked to XML, JSON and YAML output
+	IncludeMetadata bool
+	// IncludeTokenCounts adds each file's token count and the total of the
+	// whole output
+	IncludeTokenCounts bool
+	// Stream appends each file to the output as it is written instead of
+	// buffering everything until Flush. Removing content is ignored once it
+	// has been streamed, and the directory context must come first.
+	Stream bool
+	// FlushConcurrency formats up to this many files at once when the
+	// buffer is written and writes each as soon as it is ready, bounding
+	// the memory held for formatting; zero renders the whole document in
+	// one go
+	FlushConcurrency int
+	// AutoFlushInterval writes the buffer to the output this often while
+	// it has changes, so a crash leaves the selection so far on disk; zero
+	// only writes it on Flush and Close. It is ignored when streaming.
+	AutoFlushInterval time.Duration
+	// AutoFlushChanges writes the buffer once this many files have been
+	// written or removed since it was last written; zero disables it
+	AutoFlushChanges int
+	// EncodeContent encodes each file's content, and each chunk's, for
+	// transport; the output names the encoding next to the content. Empty
+	// means ContentEncodingNone.
+	EncodeContent ContentEncoding
+	// Logger receives written outputs and rejected files; nil discards them
+	Logger *slog.Logger
 }
 
 // OutputFormat represents the supported output formats.
@@ -100,6 +265,30 @@ const (
 	OutputFormatJSON OutputFormat = "json"
 	// OutputFormatYAML represents YAML output format.
 	OutputFormatYAML OutputFormat = "yaml"
+	// OutputFormatJSONL represents JSON Lines output, one record per line.
+	OutputFormatJSONL OutputFormat = "jsonl"
+	// OutputFormatText represents plain concatenated text output format.
+	OutputFormatText OutputFormat = "text"
+	// OutputFormatMarkdown represents markdown with a fenced code block per file.
+	OutputFormatMarkdown OutputFormat = "markdown"
+	// OutputFormatTemplate represents output rendered by a user's text/template.
+	OutputFormatTemplate OutputFormat = "template"
+	// OutputFormatCSV represents a file inventory, one row per file without
+	// its content.
+	OutputFormatCSV OutputFormat = "csv"
+)
+
+// ContentEncoding represents how file content is encoded in the output.
+type ContentEncoding string
+
+const (
+	// ContentEncodingNone writes content as it is.
+	ContentEncodingNone ContentEncoding = "none"
+	// ContentEncodingBase64 writes content as standard base64.
+	ContentEncodingBase64 ContentEncoding = "base64"
+	// ContentEncodingGzipBase64 gzips content and writes it as standard
+	// base64.
+	ContentEncodingGzipBase64 ContentEncoding = "gzip-base64"
 )
 
 // LanguageProcessor defines the interface for language-specific processing.
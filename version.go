@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set when building releases with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Whatever is left unset is read from the module and VCS information the Go
+// toolchain embeds in the binary.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the running build for -version.
+func versionString() string {
+	v, c, d := version, commit, date
+	modified := false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true" && commit == ""
+			}
+		}
+	}
+
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	} else if len(c) > 12 {
+		c = c[:12]
+	}
+	if modified {
+		c += "-dirty"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("pfzf %s (commit %s, built %s, %s %s/%s)", v, c, d, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}